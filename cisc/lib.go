@@ -130,7 +130,12 @@ func (cfg *ciscConfig) saveConfig(c *cli.Context) error {
 }
 
 // convenience function to send and vote a proposition and update.
+// The nodes refuse a threshold above the number of devices, so a threshold
+// given at creation is lowered as long as not enough devices joined.
 func (cfg *ciscConfig) proposeSendVoteUpdate(id *identity.Identity, p *identity.Data) {
+	if len(p.Weights) == 0 && p.Threshold > len(p.Device) {
+		p.Threshold = len(p.Device)
+	}
 	log.ErrFatal(id.ProposeSend(p))
 	log.ErrFatal(id.ProposeVote(true))
 	log.ErrFatal(id.DataUpdate())
@@ -0,0 +1,181 @@
+package identity
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash"
+	"strings"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+)
+
+// ReadRule restricts reading the values whose keys start with Prefix to
+// the Readers and the devices. If several rules match a key, the rules with
+// the longest prefix decide. Keys without a rule can be read by everybody
+// allowed to read the identity. Like Readers, the rules are part of the
+// data and only protect the requests to the identity service.
+type ReadRule struct {
+	Prefix  string
+	Readers []kyber.Point
+}
+
+// keyRules returns the rules restricting the key, nil if the key is not
+// restricted.
+func (d *Data) keyRules(key string) []*ReadRule {
+	var rules []*ReadRule
+	longest := -1
+	for _, r := range d.ReadRules {
+		if r == nil || !strings.HasPrefix(key, r.Prefix) || len(r.Prefix) < longest {
+			continue
+		}
+		if len(r.Prefix) > longest {
+			rules = nil
+			longest = len(r.Prefix)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// CanReadKey returns true if the reader, which may be nil for anonymous
+// requests, can read the value of key. Devices can read all values.
+func (d *Data) CanReadKey(key string, reader kyber.Point) bool {
+	rules := d.keyRules(key)
+	if len(rules) == 0 || d.isDevice(reader) {
+		return true
+	}
+	if reader == nil {
+		return false
+	}
+	for _, r := range rules {
+		for _, pub := range r.Readers {
+			if pointsEqual(pub, reader) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isDevice returns true if pub is the key of one of the devices.
+func (d *Data) isDevice(pub kyber.Point) bool {
+	if pub == nil {
+		return false
+	}
+	for _, dev := range d.Device {
+		if dev != nil && pointsEqual(dev.Point, pub) {
+			return true
+		}
+	}
+	return false
+}
+
+// readableBy returns d without the values the reader can't read under the
+// rules of d or of latest, which may be nil. The rules of latest protect
+// the values of older or proposed data, and its devices can read all of
+// them, as they vote on the proposals. If all values can be read, d itself
+// is returned, else a copy that shares everything but the storage.
+func (d *Data) readableBy(reader kyber.Point, latest *Data) *Data {
+	if latest != nil && latest.isDevice(reader) {
+		return d
+	}
+	restricts := func(r *Data) bool {
+		return r != nil && len(r.ReadRules) > 0 && !r.isDevice(reader)
+	}
+	if d == nil || (!restricts(d) && !restricts(latest)) {
+		return d
+	}
+	c := *d
+	c.Storage = make(map[string]string)
+	for k, v := range d.Storage {
+		if d.CanReadKey(k, reader) && (latest == nil || latest.CanReadKey(k, reader)) {
+			c.Storage[k] = v
+		}
+	}
+	return &c
+}
+
+// writeReadRules adds the rules to the hash.
+func (d *Data) writeReadRules(h hash.Hash) error {
+	if err := writeString(h, "read-rules"); err != nil {
+		return err
+	}
+	for _, r := range d.ReadRules {
+		if r == nil {
+			return errors.New("missing read-rule")
+		}
+		if err := writeString(h, r.Prefix); err != nil {
+			return err
+		}
+		err := binary.Write(h, binary.LittleEndian, int32(len(r.Readers)))
+		if err != nil {
+			return err
+		}
+		for _, pub := range r.Readers {
+			if pub == nil {
+				return errors.New("read-rule with a missing reader")
+			}
+			if _, err := pub.MarshalTo(h); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readRulesEqual returns true if both data have the same rules in the same
+// order.
+func (d *Data) readRulesEqual(other *Data) bool {
+	if len(d.ReadRules) != len(other.ReadRules) {
+		return false
+	}
+	for i, r := range d.ReadRules {
+		o := other.ReadRules[i]
+		if r == nil || o == nil {
+			if r != o {
+				return false
+			}
+			continue
+		}
+		if r.Prefix != o.Prefix || len(r.Readers) != len(o.Readers) {
+			return false
+		}
+		for j, pub := range r.Readers {
+			if !pointsEqual(pub, o.Readers[j]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// authorizeRead checks the read-request for d and returns the reader that
+// signed it, or nil for anonymous requests. Requests for data with readers
+// must be signed by a reader, requests for data with read-rules may be
+// signed to read restricted values.
+func (s *Service) authorizeRead(id ID, d *Data, auth *ReadAuth) (kyber.Point, error) {
+	if d == nil || (len(d.Readers) == 0 && len(d.ReadRules) == 0) {
+		return nil, nil
+	}
+	if auth == nil || auth.Reader == nil {
+		if len(d.Readers) > 0 {
+			return nil, ErrorReadNotAuthorized
+		}
+		return nil, nil
+	}
+	if len(d.Readers) > 0 && !d.IsReader(auth.Reader) {
+		return nil, ErrorReadNotAuthorized
+	}
+	s.readMutex.Lock()
+	expiry, ok := s.readNonces[string(auth.Nonce)]
+	delete(s.readNonces, string(auth.Nonce))
+	s.readMutex.Unlock()
+	if !ok || s.now().After(expiry) {
+		return nil, errors.New("unknown or expired read-challenge")
+	}
+	if schnorr.Verify(s.Suite(), auth.Reader, readMessage(id, auth.Nonce), auth.Signature) != nil {
+		return nil, ErrorReadNotAuthorized
+	}
+	return auth.Reader, nil
+}
@@ -1,11 +1,14 @@
 package identity
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"io/ioutil"
+	"time"
 
 	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/sign/anon"
 	"github.com/dedis/kyber/sign/schnorr"
@@ -35,13 +38,79 @@ func init() {
 		&DataUpdate{},
 		&DataUpdateReply{},
 		&ProposeSend{},
+		&ProposeSendReply{},
+		&ProposeReceipt{},
+		&ProposeReplace{},
+		&ProposeReplaceReply{},
+		&ProposeRemoveDevice{},
+		&ProposeRemoveDeviceReply{},
+		&ProposeRosterChange{},
+		&ProposeRosterChangeReply{},
 		&ProposeUpdate{},
 		&ProposeUpdateReply{},
 		&ProposeVote{},
 		&ProposeVoteReply{},
+		&Heartbeat{},
+		&HeartbeatReply{},
+		&ListIdentities{},
+		&ListIdentitiesReply{},
+		&GetRPCLog{},
+		&GetRPCLogReply{},
+		&SuspendIdentity{},
+		&SuspendIdentityReply{},
+		&ResumeIdentity{},
+		&ResumeIdentityReply{},
+		&ReadChallenge{},
+		&ReadChallengeReply{},
+		&ReadAuth{},
+		&ForwardBlock{},
+		&ForwardBlockReply{},
+		&GetDataAtTime{},
+		&GetDataAtTimeReply{},
+		&GetDataHistory{},
+		&GetDataHistoryReply{},
+		&GetLatest{},
+		&GetLatestReply{},
+		&AuthenticatedRequest{},
+		&IdempotentRequest{},
+		&PropagationSupport{},
+		&PropagationSupportReply{},
+		&GetIdentityState{},
+		&IdentityState{},
+		&VerifyConsistency{},
+		&VerifyConsistencyReply{},
+		&DumpState{},
+		&DumpStateReply{},
+		&Search{},
+		&SearchReply{},
+		&PendingVotes{},
+		&PendingVotesReply{},
+		&CancelProposal{},
+		&CancelProposalReply{},
+		&LastSeen{},
+		&LastSeenReply{},
+		&GetTimestamp{},
+		&GetTimestampReply{},
+		&ListSessions{},
+		&ListSessionsReply{},
+		&RevokeSession{},
+		&RevokeSessionReply{},
+		&CompactIdentity{},
+		&CompactIdentityReply{},
+		&RevokeVote{},
+		&RevokeVoteReply{},
+		&DeleteIdentity{},
+		&DeleteIdentityReply{},
+		&ProposeDataBatch{},
+		&ProposeDataBatchReply{},
+		&ProposeStatus{},
+		&ProposeStatusReply{},
 		// Internal messages
 		&PropagateIdentity{},
+		&HandoffIdentity{},
+		&PropagateVotes{},
 		&UpdateSkipBlock{},
+		&EncryptedPropagation{},
 	} {
 		network.RegisterMessage(s)
 	}
@@ -73,8 +142,27 @@ type Identity struct {
 	// Proposed is the new data that has not been validated by a
 	// threshold of devices.
 	Proposed *Data
+	// ProposedBy is the device that made the proposal, as returned by
+	// ProposeUpdate.
+	ProposedBy string
+	// ProposedHash is the hash of Proposed computed by the node, as
+	// returned by ProposeUpdate. If it is set, ProposeVote signs it instead
+	// of hashing Proposed itself.
+	ProposedHash []byte
 	// DeviceName must be unique in the identity-skipchain.
 	DeviceName string
+	// AuthenticateRequests signs every request with the key of the
+	// device, for nodes that only accept authenticated clients.
+	AuthenticateRequests bool
+	// TimedVotes makes ProposeVote send votes with the current time, for
+	// nodes with a maximum vote age.
+	TimedVotes bool
+	// Retries is how often a failed request is resent with the same
+	// idempotency key, see IdempotentRequest.
+	Retries int
+	// PropagateTimeout is used by the nodes for the propagations of an
+	// identity created by CreateIdentity, 0 for their default.
+	PropagateTimeout time.Duration
 }
 
 // NewIdentity starts a new identity that can contain multiple managers with
@@ -163,7 +251,7 @@ func (i *Identity) AttachToIdentity(ID ID) error {
 		return errors.New("Adding with an existing account-name")
 	}
 	confPropose := i.Data.Copy()
-	confPropose.Device[i.DeviceName] = &Device{i.Public}
+	confPropose.Device[i.DeviceName] = &Device{Point: i.Public}
 	err = i.ProposeSend(confPropose)
 	if err != nil {
 		return err
@@ -189,9 +277,10 @@ func (i *Identity) popAuth(au *Authenticate, atts []kyber.Point, priv kyber.Scal
 	}
 	sigtag := anon.Sign(as, au.Nonce, anon.Set(atts), au.Ctx, index, priv)
 	cr := &CreateIdentity{
-		Data:  i.Data,
-		Sig:   sigtag,
-		Nonce: au.Nonce,
+		Data:             i.Data,
+		Sig:              sigtag,
+		Nonce:            au.Nonce,
+		PropagateTimeout: int64(i.PropagateTimeout),
 	}
 	return cr, nil
 }
@@ -202,10 +291,11 @@ func (i *Identity) publicAuth(nonce []byte, priv kyber.Scalar) (*CreateIdentity,
 		return nil, err
 	}
 	cr := &CreateIdentity{
-		Data:    i.Data,
-		Sig:     []byte{},
-		SchnSig: &sig,
-		Nonce:   nonce,
+		Data:             i.Data,
+		Sig:              []byte{},
+		SchnSig:          &sig,
+		Nonce:            nonce,
+		PropagateTimeout: int64(i.PropagateTimeout),
 	}
 	return cr, nil
 }
@@ -217,11 +307,16 @@ func (i *Identity) CreateIdentity(t AuthType, atts []kyber.Point, priv kyber.Sca
 	// request for authentication
 	si := i.Data.Roster.List[0]
 	au := &Authenticate{[]byte{}, []byte{}}
-	cerr := i.Client.SendProtobuf(si, au, au)
+	cerr := i.send(si, au, au)
 	if cerr != nil {
 		return cerr
 	}
 
+	// The nodes check the time of the genesis-block like for every
+	// other block.
+	if i.Data.Timestamp == 0 {
+		i.Data.Timestamp = time.Now().UnixNano()
+	}
 	var cr *CreateIdentity
 	var err error
 
@@ -238,7 +333,7 @@ func (i *Identity) CreateIdentity(t AuthType, atts []kyber.Point, priv kyber.Sca
 	}
 	cr.Type = t
 	air := &CreateIdentityReply{}
-	err = i.Client.SendProtobuf(si, cr, air)
+	err = i.send(si, cr, air)
 	if err != nil {
 		return err
 	}
@@ -246,28 +341,421 @@ func (i *Identity) CreateIdentity(t AuthType, atts []kyber.Point, priv kyber.Sca
 	return nil
 }
 
+// ErrorGenesisMismatch is returned by VerifyGenesis if the genesis-block
+// has not been created by the request.
+var ErrorGenesisMismatch = errors.New("genesis-block doesn't match the request")
+
+// VerifyGenesis checks that genesis is the genesis-block the service
+// creates for ci, including the roster of the skipchain and the verifiers,
+// and that its hash, the ID of the identity, is correct. The ID can't be
+// computed before the identity exists, as the skipchain-service adds a
+// random back-link to every genesis-block, which is taken from genesis.
+func VerifyGenesis(ci *CreateIdentity, genesis *skipchain.SkipBlock) error {
+	if ci == nil || ci.Data == nil || ci.Data.Roster == nil {
+		return errors.New("need data with a roster")
+	}
+	if genesis == nil || genesis.Index != 0 || len(genesis.BackLinkIDs) != 1 {
+		return errors.New("not a genesis-block")
+	}
+	id, err := ci.genesisHash(genesis.BackLinkIDs[0])
+	if err != nil {
+		return err
+	}
+	if !id.Equal(genesis.Hash) || !id.Equal(genesis.CalculateHash()) {
+		return ErrorGenesisMismatch
+	}
+	return nil
+}
+
+// genesisHash returns the hash of the genesis-block created by ci with the
+// given back-link. Without back-link, the hash only depends on ci, which
+// is used to recognize retried requests.
+func (ci *CreateIdentity) genesisHash(backLink skipchain.SkipBlockID) (skipchain.SkipBlockID, error) {
+	d, err := network.Marshal(ci.Data)
+	if err != nil {
+		return nil, err
+	}
+	sb := ci.genesisBlock()
+	sb.Data = d
+	sb.Height = sb.MaximumHeight
+	if len(backLink) > 0 {
+		sb.BackLinkIDs = []skipchain.SkipBlockID{backLink}
+	}
+	return sb.CalculateHash(), nil
+}
+
+// GetDataAtTime returns the data that was the latest at time t, together
+// with the block holding it.
+func (i *Identity) GetDataAtTime(t time.Time) (*Data, *skipchain.SkipBlock, error) {
+	reply := &GetDataAtTimeReply{}
+	err := i.sendRead(func(auth *ReadAuth) interface{} {
+		return &GetDataAtTime{ID: i.ID, Time: t.UnixNano(), Auth: auth}
+	}, reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply.Data, reply.Block, nil
+}
+
+// GetDataHistory returns the data of the latest maxDepth blocks of the
+// identity, oldest first. With maxDepth 0, the node chooses how many blocks
+// it returns.
+func (i *Identity) GetDataHistory(maxDepth int) ([]*HistoryEntry, error) {
+	reply := &GetDataHistoryReply{}
+	err := i.sendRead(func(auth *ReadAuth) interface{} {
+		return &GetDataHistory{ID: i.ID, MaxDepth: maxDepth, Auth: auth}
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.History, nil
+}
+
+// GetLatest returns the latest data of the identity, checked by the node
+// against its skipchain, with the index and the hash of the block holding
+// it.
+func (i *Identity) GetLatest() (*GetLatestReply, error) {
+	reply := &GetLatestReply{}
+	err := i.sendRead(func(auth *ReadAuth) interface{} {
+		return &GetLatest{ID: i.ID, Auth: auth}
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// VerifyConsistency asks the first node of the roster to compare its state
+// of the identity with the other nodes. It returns the nodes that differ.
+func (i *Identity) VerifyConsistency() ([]*StateMismatch, error) {
+	reply := &VerifyConsistencyReply{}
+	err := i.sendRead(func(auth *ReadAuth) interface{} {
+		return &VerifyConsistency{ID: i.ID, Auth: auth}
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Mismatches, nil
+}
+
+// DumpState returns the complete state of the identity on the first node of
+// the roster. The node must have enabled the debug-requests.
+func (i *Identity) DumpState() (*IDBlock, error) {
+	reply := &DumpStateReply{}
+	err := i.send(i.Data.Roster.List[0], &DumpState{ID: i.ID}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.IDBlock, nil
+}
+
 // ProposeSend sends the new proposition of this identity
 // ProposeVote
+// If the device is part of the data, the proposal is signed by the device.
 func (i *Identity) ProposeSend(d *Data) error {
+	return i.ProposeSendDelayed(d, 0)
+}
+
+// ProposeSendDelayed sends the new proposition like ProposeSend, but once
+// enough devices voted, the nodes wait for delay before committing it. Until
+// then, every device can cancel it with CancelProposal.
+func (i *Identity) ProposeSendDelayed(d *Data, delay time.Duration) error {
 	log.Lvl3("Sending proposal", d)
-	err := i.Client.SendProtobuf(i.Data.Roster.List[0],
-		&ProposeSend{i.ID, d}, nil)
+	p, err := i.signProposal(d, false)
+	if err != nil {
+		return err
+	}
+	p.Delay = int64(delay)
+	err = i.send(i.Data.Roster.List[0], p, nil)
+	i.Proposed = d
+	i.ProposedHash = nil
+	return err
+}
+
+// ProposeSendTTL sends the new proposition like ProposeSend, but the nodes
+// remove it if it didn't get enough votes after ttl. They use their own
+// maximum age of proposals if it is shorter.
+func (i *Identity) ProposeSendTTL(d *Data, ttl time.Duration) error {
+	p, err := i.signProposal(d, false)
+	if err != nil {
+		return err
+	}
+	p.TTL = int64(ttl)
+	err = i.send(i.Data.Roster.List[0], p, nil)
 	i.Proposed = d
+	i.ProposedHash = nil
 	return err
 }
 
+// ProposeSendForced sends the new proposition like ProposeSend, replacing
+// the open proposal and its votes.
+func (i *Identity) ProposeSendForced(d *Data) error {
+	p, err := i.signProposal(d, false)
+	if err != nil {
+		return err
+	}
+	if p.Proposer == "" {
+		return errors.New("only a device of the identity can force a proposal")
+	}
+	p.Force = true
+	err = i.send(i.Data.Roster.List[0], p, nil)
+	i.Proposed = d
+	i.ProposedHash = nil
+	return err
+}
+
+// ProposeSendReceipt sends the new proposition like ProposeSend and returns
+// a receipt signed by the roster, which can be checked with
+// ProposeReceipt.Verify.
+func (i *Identity) ProposeSendReceipt(d *Data) (*ProposeReceipt, error) {
+	p, err := i.signProposal(d, true)
+	if err != nil {
+		return nil, err
+	}
+	reply := &ProposeSendReply{}
+	err = i.send(i.Data.Roster.List[0], p, reply)
+	if err != nil {
+		return nil, err
+	}
+	i.Proposed = d
+	i.ProposedHash = nil
+	return reply.Receipt, nil
+}
+
+// ProposeReplace proposes to replace all devices of the identity and the
+// threshold in one step. The current devices still need to vote on it.
+func (i *Identity) ProposeReplace(devices map[string]*Device, threshold int) error {
+	reply := &ProposeReplaceReply{}
+	err := i.send(i.Data.Roster.List[0], &ProposeReplace{
+		ID:        i.ID,
+		Devices:   devices,
+		Threshold: threshold,
+	}, reply)
+	if err != nil {
+		return err
+	}
+	i.Proposed = reply.Propose
+	i.ProposedHash = nil
+	return nil
+}
+
+// ProposeDataBatch proposes to add or change the keys of upserts and to
+// remove the keys of deletes in one proposal.
+func (i *Identity) ProposeDataBatch(upserts map[string]string, deletes []string) error {
+	reply := &ProposeDataBatchReply{}
+	err := i.send(i.Data.Roster.List[0], &ProposeDataBatch{
+		ID:      i.ID,
+		Upserts: upserts,
+		Deletes: deletes,
+	}, reply)
+	if err != nil {
+		return err
+	}
+	i.Proposed = reply.Propose
+	i.ProposedHash = nil
+	return nil
+}
+
+// ProposeRemoveDevice proposes to remove the device with the given name.
+// The current devices, including the removed one, still need to vote on it.
+func (i *Identity) ProposeRemoveDevice(name string) error {
+	reply := &ProposeRemoveDeviceReply{}
+	err := i.send(i.Data.Roster.List[0], &ProposeRemoveDevice{
+		ID:     i.ID,
+		Device: name,
+	}, reply)
+	if err != nil {
+		return err
+	}
+	i.Proposed = reply.Propose
+	i.ProposedHash = nil
+	return nil
+}
+
+// ProposeRosterChange proposes to move the identity to a new roster. The
+// devices have to vote on it like on any other proposal. Once the data is
+// updated, the requests go to the new roster.
+func (i *Identity) ProposeRosterChange(roster *onet.Roster) error {
+	reply := &ProposeRosterChangeReply{}
+	err := i.send(i.Data.Roster.List[0], &ProposeRosterChange{
+		ID:     i.ID,
+		Roster: roster,
+	}, reply)
+	if err != nil {
+		return err
+	}
+	i.Proposed = reply.Propose
+	i.ProposedHash = nil
+	return nil
+}
+
+// SendHeartbeat tells the nodes that this device is online, which is used
+// if the nodes run with a dynamic threshold.
+func (i *Identity) SendHeartbeat() error {
+	h := &Heartbeat{
+		ID:     i.ID,
+		Device: i.DeviceName,
+		Time:   time.Now().UnixNano(),
+	}
+	sig, err := schnorr.Sign(i.Client.Suite(), i.Private, h.message())
+	if err != nil {
+		return err
+	}
+	h.Signature = sig
+	return i.send(i.Data.Roster.List[0], h, nil)
+}
+
+// SignSuspend returns the signature of this device to suspend or resume the
+// identity at time t, which must be the same for all devices.
+func (i *Identity) SignSuspend(suspend bool, t int64) ([]byte, error) {
+	return schnorr.Sign(i.Client.Suite(), i.Private, SuspendMessage(i.ID, suspend, t))
+}
+
+// Suspend asks the nodes to refuse all proposals and votes until the
+// identity is resumed. The signatures are collected from a threshold of
+// devices with SignSuspend and mapped by device-name.
+func (i *Identity) Suspend(t int64, sigs map[string][]byte) error {
+	return i.send(i.Data.Roster.List[0], &SuspendIdentity{
+		ID: i.ID, Time: t, Signatures: sigs}, nil)
+}
+
+// Resume asks the nodes to accept proposals and votes again.
+func (i *Identity) Resume(t int64, sigs map[string][]byte) error {
+	return i.send(i.Data.Roster.List[0], &ResumeIdentity{
+		ID: i.ID, Time: t, Signatures: sigs}, nil)
+}
+
+// ListSessions returns the sessions of the devices on the first node of the
+// roster.
+func (i *Identity) ListSessions() ([]*Session, error) {
+	reply := &ListSessionsReply{}
+	err := i.sendRead(func(auth *ReadAuth) interface{} {
+		return &ListSessions{ID: i.ID, Auth: auth}
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Sessions, nil
+}
+
+// SignRevokeSession returns the signature of this device to revoke the
+// session of the device with the key pub at time t, which must be the same
+// for all devices.
+func (i *Identity) SignRevokeSession(pub kyber.Point, t int64) ([]byte, error) {
+	msg, err := RevokeSessionMessage(i.ID, pub, t)
+	if err != nil {
+		return nil, err
+	}
+	return schnorr.Sign(i.Client.Suite(), i.Private, msg)
+}
+
+// RevokeSession asks the nodes to refuse the credentials of the device with
+// the key pub. The signatures are collected from a threshold of devices
+// with SignRevokeSession and mapped by device-name.
+func (i *Identity) RevokeSession(pub kyber.Point, t int64, sigs map[string][]byte) error {
+	return i.send(i.Data.Roster.List[0], &RevokeSession{
+		ID: i.ID, Public: pub, Time: t, Signatures: sigs}, nil)
+}
+
+// SignCompact returns the signature of this device to compact the skipchain
+// ending at the block tip at time t, which must be the same for all devices.
+// The latest block is returned by GetLatest.
+func (i *Identity) SignCompact(tip skipchain.SkipBlockID, t int64) ([]byte, error) {
+	return schnorr.Sign(i.Client.Suite(), i.Private, CompactMessage(i.ID, tip, t))
+}
+
+// Compact asks the first node of the roster, which has to be the leader of
+// the skipchain-roster, to compact the skipchain of the identity. The
+// signatures are collected from a threshold of devices with SignCompact and
+// mapped by device-name. It returns the genesis-block of the new skipchain.
+func (i *Identity) Compact(t int64, sigs map[string][]byte) (*skipchain.SkipBlock, error) {
+	reply := &CompactIdentityReply{}
+	err := i.send(i.Data.Roster.List[0], &CompactIdentity{
+		ID: i.ID, Time: t, Signatures: sigs}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Checkpoint, nil
+}
+
+// SignDelete returns the signature of this device to delete the identity at
+// time t, which must be the same for all devices.
+func (i *Identity) SignDelete(t int64) ([]byte, error) {
+	return schnorr.Sign(i.Client.Suite(), i.Private, DeleteMessage(i.ID, t))
+}
+
+// Delete asks the nodes to forget the identity. The signatures are
+// collected from a threshold of devices with SignDelete and mapped by
+// device-name.
+func (i *Identity) Delete(t int64, sigs map[string][]byte) error {
+	return i.send(i.Data.Roster.List[0], &DeleteIdentity{
+		ID: i.ID, Time: t, Signatures: sigs}, nil)
+}
+
+// RevokeVote asks the nodes to remove the vote of this device from the
+// current proposal, which must not have been committed yet.
+func (i *Identity) RevokeVote() error {
+	if i.Proposed == nil {
+		return errors.New("no proposal to revoke the vote of")
+	}
+	hash, err := i.Proposed.Hash(i.Client.Suite().(kyber.HashFactory))
+	if err != nil {
+		return err
+	}
+	sig, err := schnorr.Sign(i.Client.Suite(), i.Private, RevokeVoteMessage(i.ID, hash))
+	if err != nil {
+		return err
+	}
+	return i.send(i.Data.Roster.List[0], &RevokeVote{
+		ID:        i.ID,
+		Hash:      hash,
+		Signer:    i.DeviceName,
+		Signature: sig,
+	}, nil)
+}
+
+// CancelProposal asks the nodes to drop the current delayed proposal before
+// it is committed.
+func (i *Identity) CancelProposal() error {
+	if i.Proposed == nil {
+		return errors.New("no proposal to cancel")
+	}
+	hash, err := i.Proposed.Hash(i.Client.Suite().(kyber.HashFactory))
+	if err != nil {
+		return err
+	}
+	sig, err := schnorr.Sign(i.Client.Suite(), i.Private, CancelMessage(i.ID, hash))
+	if err != nil {
+		return err
+	}
+	err = i.send(i.Data.Roster.List[0], &CancelProposal{
+		ID:        i.ID,
+		Hash:      hash,
+		Signer:    i.DeviceName,
+		Signature: sig,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	i.Proposed = nil
+	i.ProposedHash = nil
+	return nil
+}
+
 // ProposeUpdate verifies if there is a new data waiting that
 // needs approval from clients
 func (i *Identity) ProposeUpdate() error {
 	log.Lvl3("Updating proposal")
 	cnc := &ProposeUpdateReply{}
-	err := i.Client.SendProtobuf(i.Data.Roster.List[0], &ProposeUpdate{
-		ID: i.ID,
+	err := i.sendRead(func(auth *ReadAuth) interface{} {
+		return &ProposeUpdate{ID: i.ID, Auth: auth}
 	}, cnc)
 	if err != nil {
 		return err
 	}
 	i.Proposed = cnc.Propose
+	i.ProposedBy = cnc.ProposedBy
+	i.ProposedHash = cnc.Hash
 	return nil
 }
 
@@ -281,24 +769,35 @@ func (i *Identity) ProposeVote(accept bool) error {
 	if !accept {
 		return nil
 	}
-	hash, err := i.Proposed.Hash(i.Client.Suite().(kyber.HashFactory))
-	if err != nil {
-		return err
+	var vote *ProposeVote
+	var err error
+	hash := i.ProposedHash
+	if hash == nil {
+		hash, err = i.Proposed.Hash(cothority.Suite)
+		if err != nil {
+			return err
+		}
 	}
-	if i.Private == nil {
-		return errors.New("no private key is provided")
+	if i.TimedVotes {
+		vote, err = PrepareTimedVote(i.ID, i.DeviceName, hash, i.Private, time.Now())
+	} else {
+		vote, err = PrepareVoteHash(i.ID, i.DeviceName, hash, i.Private)
 	}
-	sig, err := schnorr.Sign(i.Client.Suite(), i.Private, hash)
 	if err != nil {
 		return err
 	}
 	log.Lvl3("Signed with public-key:", cothority.Suite.Point().Mul(i.Private, nil).String())
+	return i.SendVote(vote)
+}
+
+// SendVote sends a vote prepared for the current proposal, e.g. with
+// PrepareGroupVote, and updates the data if the proposal is committed.
+func (i *Identity) SendVote(vote *ProposeVote) error {
+	if i.Proposed == nil {
+		return errors.New("No proposed data")
+	}
 	pvr := &ProposeVoteReply{}
-	err = i.Client.SendProtobuf(i.Data.Roster.List[0], &ProposeVote{
-		ID:        i.ID,
-		Signer:    i.DeviceName,
-		Signature: sig,
-	}, pvr)
+	err := i.send(i.Data.Roster.List[0], vote, pvr)
 	if err != nil {
 		return err
 	}
@@ -306,12 +805,49 @@ func (i *Identity) ProposeVote(accept bool) error {
 		log.Lvl2("Threshold reached and signed")
 		i.Data = i.Proposed
 		i.Proposed = nil
+		i.ProposedHash = nil
 	} else {
 		log.Lvl2("Threshold not reached")
 	}
 	return nil
 }
 
+// PrepareVote returns the vote of the device signer, with the private key
+// device, accepting proposed. It signs the same hash the nodes verify, so
+// that it can be sent as it is.
+func PrepareVote(id ID, signer string, proposed *Data, device kyber.Scalar) (*ProposeVote, error) {
+	if proposed == nil {
+		return nil, errors.New("No proposed data")
+	}
+	if device == nil {
+		return nil, errors.New("no private key is provided")
+	}
+	hash, err := proposed.Hash(cothority.Suite)
+	if err != nil {
+		return nil, err
+	}
+	return PrepareVoteHash(id, signer, hash, device)
+}
+
+// PrepareVoteHash returns the vote of the device signer on the proposal
+// with the given hash, as returned by the nodes in ProposeUpdateReply.
+func PrepareVoteHash(id ID, signer string, hash []byte, device kyber.Scalar) (*ProposeVote, error) {
+	if device == nil {
+		return nil, errors.New("no private key is provided")
+	}
+	sig, err := schnorr.Sign(cothority.Suite, device, hash)
+	if err != nil {
+		return nil, err
+	}
+	return &ProposeVote{ID: id, Signer: signer, Signature: sig}, nil
+}
+
+// PrepareReject returns the vote of the device signer rejecting the
+// proposal, which has no signature.
+func PrepareReject(id ID, signer string) *ProposeVote {
+	return &ProposeVote{ID: id, Signer: signer}
+}
+
 // DataUpdate asks if there is any new data available that has already
 // been approved by others and updates the local data
 func (i *Identity) DataUpdate() error {
@@ -320,12 +856,219 @@ func (i *Identity) DataUpdate() error {
 		return errors.New("Didn't find any list in the cothority")
 	}
 	cur := &DataUpdateReply{}
-	err := i.Client.SendProtobuf(i.Data.Roster.List[0],
-		&DataUpdate{ID: i.ID}, cur)
+	err := i.sendRead(func(auth *ReadAuth) interface{} {
+		return &DataUpdate{ID: i.ID, Auth: auth}
+	}, cur)
 	if err != nil {
 		return err
 	}
+	// The unauthenticated request only returns the values that everybody
+	// can read, but a device needs all of them.
+	if !i.readRestricted() && len(cur.Data.ReadRules) > 0 && i.Private != nil {
+		auth, err := i.readAuth()
+		if err != nil {
+			return err
+		}
+		err = i.send(i.Data.Roster.List[0], &DataUpdate{ID: i.ID, Auth: auth}, cur)
+		if err != nil {
+			return err
+		}
+	}
 	// TODO - verify new data
 	i.Data = cur.Data
 	return nil
 }
+
+// LastSeen returns the last time in unix-nanoseconds every device voted or
+// sent a heartbeat, as seen by the first node of the roster.
+func (i *Identity) LastSeen() (map[string]int64, error) {
+	reply := &LastSeenReply{}
+	err := i.sendRead(func(auth *ReadAuth) interface{} {
+		return &LastSeen{ID: i.ID, Auth: auth}
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Devices, nil
+}
+
+// GetTimestamp returns the hash of the block with the given index and the
+// token of the timestamp authority over it. The token can be checked with
+// VerifyTimestamp.
+func (i *Identity) GetTimestamp(index int) (skipchain.SkipBlockID, []byte, error) {
+	reply := &GetTimestampReply{}
+	err := i.sendRead(func(auth *ReadAuth) interface{} {
+		return &GetTimestamp{ID: i.ID, Index: index, Auth: auth}
+	}, reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply.Hash, reply.Token, nil
+}
+
+// GetValuesByPrefix asks the cothority for all values of the latest data
+// whose keys start with prefix. The local data is not changed.
+func (i *Identity) GetValuesByPrefix(prefix string) (map[string]string, error) {
+	if i.Data.Roster == nil || len(i.Data.Roster.List) == 0 {
+		return nil, errors.New("Didn't find any list in the cothority")
+	}
+	reply := &GetValuesByPrefixReply{}
+	err := i.sendRead(func(auth *ReadAuth) interface{} {
+		return &GetValuesByPrefix{ID: i.ID, Prefix: prefix, Auth: auth}
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Values == nil {
+		reply.Values = make(map[string]string)
+	}
+	return reply.Values, nil
+}
+
+// ListIdentities returns a summary of all identities stored on the first
+// node of the roster.
+func (i *Identity) ListIdentities() ([]*IdentitySummary, error) {
+	reply := &ListIdentitiesReply{}
+	err := i.send(i.Data.Roster.List[0], &ListIdentities{}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Identities, nil
+}
+
+// ListIdentitiesWithDevice returns a summary of the identities stored on the
+// first node of the roster that have a device with the given name.
+func (i *Identity) ListIdentitiesWithDevice(name string) ([]*IdentitySummary, error) {
+	reply := &ListIdentitiesReply{}
+	err := i.send(i.Data.Roster.List[0], &ListIdentities{Device: name}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Identities, nil
+}
+
+// Search returns the keys of the identities on the first node of the
+// roster whose key or value is equal to query. The node must have enabled
+// its search-index.
+func (i *Identity) Search(query string) ([]*SearchMatch, error) {
+	reply := &SearchReply{}
+	err := i.send(i.Data.Roster.List[0], &Search{Query: query}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Matches, nil
+}
+
+// PendingVotes returns the open proposals of all identities on the first
+// node of the roster that this device can still vote on, at most max of
+// them. More is true if there are more proposals.
+func (i *Identity) PendingVotes(max int) (proposals []*PendingProposal, more bool, err error) {
+	reply := &PendingVotesReply{}
+	err = i.send(i.Data.Roster.List[0], &PendingVotes{Device: i.Public, Max: max}, reply)
+	if err != nil {
+		return nil, false, err
+	}
+	return reply.Proposals, reply.More, nil
+}
+
+// ProposeStatus returns the votes on the open proposal of the identity, as
+// seen by the first node of the roster.
+func (i *Identity) ProposeStatus() (*ProposeStatusReply, error) {
+	reply := &ProposeStatusReply{}
+	err := i.sendRead(func(auth *ReadAuth) interface{} {
+		return &ProposeStatus{ID: i.ID, Auth: auth}
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetRPCLog returns the log of the requests changing the state of the
+// first node of the roster, after verifying that the entries are linked
+// correctly.
+func (i *Identity) GetRPCLog(start, count int) ([]*RPCLogEntry, error) {
+	reply := &GetRPCLogReply{}
+	err := i.send(i.Data.Roster.List[0],
+		&GetRPCLog{Start: start, Count: count}, reply)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Entries) > 0 {
+		if err := VerifyRPCLog(reply.Entries, reply.Entries[0].Prev); err != nil {
+			return nil, err
+		}
+	}
+	return reply.Entries, nil
+}
+
+// RPCLogHead returns the index and the hash of the latest entry of the
+// RPC-log of the first node of the roster. They can be used later with
+// RPCLogSince to make sure the node didn't rewrite the log.
+func (i *Identity) RPCLogHead() (int, []byte, error) {
+	reply := &GetRPCLogReply{}
+	err := i.send(i.Data.Roster.List[0], &GetRPCLog{Start: -1}, reply)
+	if err != nil {
+		return 0, nil, err
+	}
+	return reply.Length - 1, reply.Head, nil
+}
+
+// RPCLogSince returns all entries after the entry with the given index and
+// hash, as returned by RPCLogHead, and verifies that they extend it.
+func (i *Identity) RPCLogSince(index int, head []byte) ([]*RPCLogEntry, error) {
+	reply := &GetRPCLogReply{}
+	err := i.send(i.Data.Roster.List[0],
+		&GetRPCLog{Start: index + 1}, reply)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Entries) == 0 && !bytes.Equal(reply.Head, head) {
+		return nil, errors.New("head of the RPC-log changed")
+	}
+	if err := VerifyRPCLog(reply.Entries, head); err != nil {
+		return nil, err
+	}
+	return reply.Entries, nil
+}
+
+// readAuth asks the node for a read-challenge and signs it with the key of
+// the device.
+func (i *Identity) readAuth() (*ReadAuth, error) {
+	reply := &ReadChallengeReply{}
+	err := i.send(i.Data.Roster.List[0],
+		&ReadChallenge{ID: i.ID}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return NewReadAuth(i.ID, reply.Nonce, i.Private)
+}
+
+// readRestricted returns true if the read-requests have to be signed, for
+// readers or read-rules of the data.
+func (i *Identity) readRestricted() bool {
+	return len(i.Data.Readers) > 0 || len(i.Data.ReadRules) > 0
+}
+
+// sendRead sends the read-request returned by req. If the identity has
+// readers or read-rules, the request is authenticated. If an unauthenticated request
+// fails, it is tried once more with authentication, as the readers might
+// have been added since the last update.
+func (i *Identity) sendRead(req func(auth *ReadAuth) interface{}, reply interface{}) error {
+	var auth *ReadAuth
+	if i.readRestricted() {
+		var err error
+		if auth, err = i.readAuth(); err != nil {
+			return err
+		}
+	}
+	err := i.send(i.Data.Roster.List[0], req(auth), reply)
+	if err == nil || auth != nil {
+		return err
+	}
+	auth, errAuth := i.readAuth()
+	if errAuth != nil {
+		return err
+	}
+	return i.send(i.Data.Roster.List[0], req(auth), reply)
+}
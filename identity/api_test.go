@@ -10,6 +10,7 @@ import (
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/ftcosi/protocol"
 	"github.com/dedis/cothority/pop/service"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/sign/anon"
 	"github.com/dedis/kyber/sign/schnorr"
@@ -153,7 +154,7 @@ func TestIdentity_DataNewCheck(t *testing.T) {
 
 	data2 := c1.Data.Copy()
 	kp2 := key.NewKeyPair(tSuite)
-	data2.Device["two"] = &Device{kp2.Public}
+	data2.Device["two"] = &Device{Point: kp2.Public}
 	data2.Storage["two"] = "public2"
 	log.ErrFatal(c1.ProposeSend(data2))
 
@@ -169,6 +170,26 @@ func TestIdentity_DataNewCheck(t *testing.T) {
 	assert.Equal(t, "public2", pub2)
 }
 
+func TestIdentity_ProposeSendReceipt(t *testing.T) {
+	l, services, roster := newTestNodes(3)
+	defer l.CloseAll()
+
+	c1 := createIdentity(l, services, roster, "one")
+	data2 := c1.Data.Copy()
+	data2.Storage["two"] = "public2"
+	receipt, err := c1.ProposeSendReceipt(data2)
+	require.Nil(t, err)
+	require.NotNil(t, receipt)
+	require.Equal(t, c1.ID, receipt.ID)
+	require.Nil(t, receipt.Verify(roster, data2))
+
+	require.NotNil(t, receipt.Verify(roster, c1.Data))
+	_, other, _ := l.GenTree(3, true)
+	require.NotNil(t, receipt.Verify(other, data2))
+	receipt.Timestamp++
+	require.NotNil(t, receipt.Verify(roster, data2))
+}
+
 func TestIdentity_AttachToIdentity(t *testing.T) {
 	l := onet.NewTCPTest(tSuite)
 	hosts, roster, _ := l.GenTree(5, true)
@@ -180,7 +201,7 @@ func TestIdentity_AttachToIdentity(t *testing.T) {
 
 	c1 := createIdentity(l, services, roster, "one")
 
-	c2 := NewTestIdentity(roster, 50, "two", l, nil)
+	c2 := NewTestIdentity(roster, 1, "two", l, nil)
 	log.ErrFatal(c2.AttachToIdentity(c1.ID))
 	for _, s := range services {
 		is := s.(*Service)
@@ -200,7 +221,7 @@ func TestIdentity_DataUpdate(t *testing.T) {
 
 	c1 := createIdentity(l, services, roster, "one")
 
-	c2 := NewTestIdentity(roster, 50, "two", l, nil)
+	c2 := NewTestIdentity(roster, 1, "two", l, nil)
 	c2.ID = c1.ID
 	log.ErrFatal(c2.DataUpdate())
 
@@ -211,6 +232,106 @@ func TestIdentity_DataUpdate(t *testing.T) {
 	}
 }
 
+func TestIdentity_GetValuesByPrefix(t *testing.T) {
+	l, services, roster := newTestNodes(3)
+	defer l.CloseAll()
+
+	c1 := createIdentity(l, services, roster, "one")
+	data := c1.Data.Copy()
+	data.Storage["acl/one"] = "1"
+	data.Storage["acl/two"] = "2"
+	data.Storage["web"] = "3"
+	log.ErrFatal(c1.ProposeSend(data))
+	log.ErrFatal(proposeUpVote(c1))
+
+	values, err := c1.GetValuesByPrefix("acl/")
+	log.ErrFatal(err)
+	assert.Equal(t, map[string]string{"acl/one": "1", "acl/two": "2"}, values)
+	values, err = c1.GetValuesByPrefix("none")
+	log.ErrFatal(err)
+	assert.Equal(t, 0, len(values))
+}
+
+func TestIdentity_ProposeRemoveDevice(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 2)
+	defer l.CloseAll()
+	c := td.Devices[0]
+
+	err := c.ProposeRemoveDevice("unknown")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrorAccountMissing.Error())
+
+	require.Nil(t, c.ProposeRemoveDevice("dev2"))
+	require.Nil(t, c.Proposed.Device["dev2"])
+	sb, err := td.vote(0, 1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Nil(t, c.DataUpdate())
+	require.Equal(t, 2, len(c.Data.Device))
+	require.Equal(t, 2, c.Data.Threshold)
+
+	// Two devices are needed for the threshold.
+	require.NotNil(t, c.ProposeRemoveDevice("dev1"))
+}
+
+func TestIdentity_ProposeDataBatch(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	c := td.Devices[0]
+	data := c.Data.Copy()
+	data.Storage["old"] = "value"
+	data.Storage["keep"] = "value"
+	require.Nil(t, td.propose(data))
+	_, err := td.vote(0, 1)
+	require.Nil(t, err)
+
+	require.NotNil(t, c.ProposeDataBatch(map[string]string{"old": "new"}, []string{"old"}))
+	require.Nil(t, c.ProposeDataBatch(map[string]string{"one": "1", "two": "2"},
+		[]string{"old", "missing"}))
+	sb, err := td.vote(0, 1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Nil(t, c.DataUpdate())
+	require.Equal(t, map[string]string{"keep": "value", "one": "1", "two": "2"},
+		c.Data.Storage)
+
+	// Too large values or data are refused.
+	td.service.SetDataLimits(10, 0)
+	err = c.ProposeDataBatch(map[string]string{"key": "a long value"}, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrorDataTooLarge.Error())
+	td.service.SetDataLimits(0, 100)
+	err = c.ProposeDataBatch(map[string]string{"key": string(make([]byte, 100))}, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrorDataTooLarge.Error())
+}
+
+func TestIdentity_ProposeReplace(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	kp1, kp2 := key.NewKeyPair(tSuite), key.NewKeyPair(tSuite)
+	c := td.Devices[0]
+
+	// Invalid sets of devices are refused.
+	require.NotNil(t, c.ProposeReplace(map[string]*Device{
+		"new1": {Point: kp1.Public}, "new2": {Point: kp2.Public}}, 3))
+	require.NotNil(t, c.ProposeReplace(map[string]*Device{
+		"new1": {Point: kp1.Public}, "new2": {Point: kp1.Public}}, 1))
+
+	devices := map[string]*Device{"new1": {Point: kp1.Public}, "new2": {Point: kp2.Public}}
+	require.Nil(t, c.ProposeReplace(devices, 1))
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	sb, err = td.vote(1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Nil(t, c.DataUpdate())
+	require.Equal(t, 1, c.Data.Threshold)
+	require.Equal(t, 2, len(c.Data.Device))
+	require.True(t, kp1.Public.Equal(c.Data.Device["new1"].Point))
+}
+
 func TestIdentity_Authenticate(t *testing.T) {
 	l := onet.NewTCPTest(tSuite)
 	hosts, _, _ := l.GenTree(1, true)
@@ -232,6 +353,33 @@ func TestIdentity_CreateIdentity(t *testing.T) {
 	assert.NotNil(t, c.Data)
 }
 
+func TestVerifyGenesis(t *testing.T) {
+	l, services, roster := newTestNodes(3)
+	defer l.CloseAll()
+	c := createIdentity(l, services, roster, "one")
+
+	genesis := services[0].(*Service).getIdentityStorage(c.ID).LatestSkipblock
+	require.Equal(t, 0, genesis.Index)
+	require.True(t, genesis.Hash.Equal(skipchain.SkipBlockID(c.ID)))
+	require.Nil(t, VerifyGenesis(&CreateIdentity{Data: c.Data}, genesis))
+	require.NotNil(t, VerifyGenesis(&CreateIdentity{Data: c.Data}, nil))
+
+	// Another skipchain-roster and other verifiers are part of the ID.
+	kp := key.NewKeyPair(tSuite)
+	ci := &CreateIdentity{
+		Data:            NewData(roster, 1, kp.Public, "two"),
+		Verifiers:       []skipchain.VerifierID{VerifyIdentity, skipchain.VerifyBase},
+		SkipchainRoster: onet.NewRoster(roster.List[1:]),
+	}
+	air, err := services[0].(*Service).CreateIdentityInternal(ci, "", "")
+	require.Nil(t, err)
+	require.Nil(t, VerifyGenesis(ci, air.Genesis))
+	ci.Verifiers = nil
+	require.Equal(t, ErrorGenesisMismatch, VerifyGenesis(ci, air.Genesis))
+	require.Equal(t, ErrorGenesisMismatch,
+		VerifyGenesis(&CreateIdentity{Data: c.Data}, air.Genesis))
+}
+
 func TestIdentity_DataNewPropose(t *testing.T) {
 	l := onet.NewTCPTest(tSuite)
 	hosts, roster, _ := l.GenTree(2, true)
@@ -242,7 +390,7 @@ func TestIdentity_DataNewPropose(t *testing.T) {
 
 	data2 := c1.Data.Copy()
 	kp2 := key.NewKeyPair(tSuite)
-	data2.Device["two"] = &Device{kp2.Public}
+	data2.Device["two"] = &Device{Point: kp2.Public}
 	log.ErrFatal(c1.ProposeSend(data2))
 
 	for _, s := range services {
@@ -272,7 +420,7 @@ func TestIdentity_ProposeVote(t *testing.T) {
 	c1 := createIdentity(l, services, roster, "one1")
 	data2 := c1.Data.Copy()
 	kp2 := key.NewKeyPair(tSuite)
-	data2.Device["two2"] = &Device{kp2.Public}
+	data2.Device["two2"] = &Device{Point: kp2.Public}
 	data2.Storage["two2"] = "public2"
 	log.ErrFatal(c1.ProposeSend(data2))
 	log.ErrFatal(c1.ProposeUpdate())
@@ -283,11 +431,63 @@ func TestIdentity_ProposeVote(t *testing.T) {
 	}
 }
 
+func TestPrepareVote(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+
+	sid := td.service.getIdentityStorage(td.ID())
+	sid.Lock()
+	proposed := sid.Proposed
+	owner := sid.Latest.Device["dev1"]
+	sid.Unlock()
+	vote, err := PrepareVote(td.ID(), "dev1", proposed, td.Devices[1].Private)
+	require.Nil(t, err)
+	require.Nil(t, td.service.verifyVote(proposed, owner, vote.Signature))
+	wrong, err := PrepareVote(td.ID(), "dev1", proposed, td.Devices[0].Private)
+	require.Nil(t, err)
+	require.NotNil(t, td.service.verifyVote(proposed, owner, wrong.Signature))
+	_, err = PrepareVote(td.ID(), "dev1", nil, td.Devices[1].Private)
+	require.NotNil(t, err)
+
+	_, err = td.service.ProposeVote(vote)
+	require.Nil(t, err)
+	votes, err := td.votes()
+	require.Nil(t, err)
+	require.NotNil(t, votes["dev1"])
+	require.Nil(t, PrepareReject(td.ID(), "dev0").Signature)
+}
+
+func TestProposeUpdate_Hash(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+
+	dev := td.Devices[1]
+	require.Nil(t, dev.ProposeUpdate())
+	sid := td.service.getIdentityStorage(td.ID())
+	sid.Lock()
+	hash, err := sid.Proposed.Hash(tSuite)
+	sid.Unlock()
+	require.Nil(t, err)
+	require.Equal(t, hash, dev.ProposedHash)
+
+	// The vote on the returned hash is accepted by the node.
+	require.Nil(t, dev.ProposeVote(true))
+	votes, err := td.votes()
+	require.Nil(t, err)
+	require.NotNil(t, votes["dev1"])
+}
+
 func TestIdentity_SaveToStream(t *testing.T) {
 	l := onet.NewTCPTest(tSuite)
 	_, roster, _ := l.GenTree(5, true)
 	defer l.CloseAll()
-	id := NewIdentity(roster, 50, "one1", nil)
+	id := NewIdentity(roster, 1, "one1", nil)
 	tmpfile, err := ioutil.TempFile("", "example")
 	log.ErrFatal(err)
 	defer os.Remove(tmpfile.Name())
@@ -377,7 +577,7 @@ func TestVerificationFunction(t *testing.T) {
 	log.Lvl1("hack data in conode")
 	data2 := c1.Data.Copy()
 	kp2 := key.NewKeyPair(tSuite)
-	data2.Device["two2"] = &Device{kp2.Public}
+	data2.Device["two2"] = &Device{Point: kp2.Public}
 	data2.Storage["two2"] = "public2"
 	hash, err := data2.Hash(tSuite)
 	log.ErrFatal(err)
@@ -440,7 +640,7 @@ func createIdentity(l *onet.LocalTest, services []onet.Service, roster *onet.Ros
 		s.Storage.Auth.sets = append(s.Storage.Auth.sets, set)
 	}
 
-	c := NewTestIdentity(roster, 50, name, l, kp1)
+	c := NewTestIdentity(roster, 1, name, l, kp1)
 	log.Lvl2("popauth", PoPAuth)
 	log.Lvl2("set", set)
 	log.ErrFatal(c.CreateIdentity(PoPAuth, set, kp1.Private))
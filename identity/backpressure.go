@@ -0,0 +1,67 @@
+package identity
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrorBusy is returned if too many propagations of an identity are
+// running. The request can be sent again later.
+var ErrorBusy = errors.New("too many requests for this identity, retry later")
+
+const (
+	// defaultPropagationLimit is how many propagations of proposals and
+	// votes run at the same time for one identity.
+	defaultPropagationLimit = 16
+	// defaultPropagationWait is how long a request waits for one of the
+	// running propagations to finish.
+	defaultPropagationWait = time.Second
+)
+
+// SetPropagationLimit sets how many propagations of proposals and votes
+// can run at the same time for one identity. Further requests wait up to
+// wait for a running propagation to finish and fail with ErrorBusy
+// afterwards. A limit of 0 removes the limit.
+func (s *Service) SetPropagationLimit(limit int, wait time.Duration) {
+	s.inflightMutex.Lock()
+	defer s.inflightMutex.Unlock()
+	s.propagationLimit = limit
+	s.propagationWait = wait
+	s.inflight = make(map[string]chan struct{})
+}
+
+// acquirePropagation waits for the identity to have less than the limit of
+// propagations running. The returned function must be called once the
+// propagation is done.
+func (s *Service) acquirePropagation(id ID) (func(), error) {
+	s.inflightMutex.Lock()
+	limit, wait := s.propagationLimit, s.propagationWait
+	if limit <= 0 {
+		s.inflightMutex.Unlock()
+		return func() {}, nil
+	}
+	slots := s.inflight[string(id)]
+	if slots == nil {
+		slots = make(chan struct{}, limit)
+		s.inflight[string(id)] = slots
+	}
+	s.inflightMutex.Unlock()
+
+	release := func() { <-slots }
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if wait <= 0 {
+		return nil, ErrorBusy
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, ErrorBusy
+	}
+}
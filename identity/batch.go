@@ -0,0 +1,78 @@
+package identity
+
+import (
+	"time"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+)
+
+// voteBatch collects the votes on one identity during the coalescing
+// window. All callers wait for done and get the same reply.
+type voteBatch struct {
+	votes  []*ProposeVote
+	roster *onet.Roster
+	done   chan struct{}
+	reply  *ProposeVoteReply
+	err    error
+}
+
+// SetVoteCoalescing sets the window during which the votes on an identity
+// are collected and propagated together. Every vote is still verified by
+// all nodes. A window of 0 propagates every vote on its own.
+func (s *Service) SetVoteCoalescing(window time.Duration) {
+	s.batchMutex.Lock()
+	defer s.batchMutex.Unlock()
+	s.voteWindow = window
+}
+
+// coalescingWindow returns the current coalescing window.
+func (s *Service) coalescingWindow() time.Duration {
+	s.batchMutex.Lock()
+	defer s.batchMutex.Unlock()
+	return s.voteWindow
+}
+
+// batchVote adds the vote to the batch of the identity, starting a new
+// batch if none is open, and waits until the batch has been propagated.
+func (s *Service) batchVote(v *ProposeVote, sid *IDBlock, roster *onet.Roster,
+	window time.Duration) (*ProposeVoteReply, error) {
+	s.batchMutex.Lock()
+	if s.voteBatches == nil {
+		s.voteBatches = make(map[string]*voteBatch)
+	}
+	batch := s.voteBatches[string(v.ID)]
+	if batch == nil {
+		batch = &voteBatch{roster: roster, done: make(chan struct{})}
+		s.voteBatches[string(v.ID)] = batch
+		time.AfterFunc(window, func() { s.flushVotes(v.ID, sid) })
+	}
+	batch.votes = append(batch.votes, v)
+	s.batchMutex.Unlock()
+	<-batch.done
+	return batch.reply, batch.err
+}
+
+// flushVotes propagates all votes of the open batch of the identity in one
+// round and checks whether the proposal can be committed.
+func (s *Service) flushVotes(id ID, sid *IDBlock) {
+	s.batchMutex.Lock()
+	batch := s.voteBatches[string(id)]
+	delete(s.voteBatches, string(id))
+	s.batchMutex.Unlock()
+	defer close(batch.done)
+
+	release, err := s.acquirePropagation(id)
+	if err != nil {
+		batch.err = err
+		return
+	}
+	defer release()
+	log.Lvl3(s.ServerIdentity(), "propagating", len(batch.votes), "votes")
+	_, batch.err = s.propagate(propagateKindData, batch.roster,
+		&PropagateVotes{ID: id, Votes: batch.votes}, sid.propagateTimeout())
+	if batch.err != nil {
+		return
+	}
+	batch.reply, batch.err = s.commitProposal(id, sid)
+}
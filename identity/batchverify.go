@@ -0,0 +1,211 @@
+package identity
+
+import (
+	"crypto/sha512"
+	"errors"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/random"
+	"github.com/dedis/onet/log"
+)
+
+// BatchVoteVerifier can be implemented by a VoteVerifier to check all votes
+// on a proposal at once. It is only used if batch verification has been
+// enabled with SetBatchVerification.
+type BatchVoteVerifier interface {
+	// VerifyVotes returns nil if all credentials are valid votes of the
+	// devices with the same index. If it returns an error, the votes are
+	// checked one by one with VerifyVote to find the invalid ones.
+	VerifyVotes(proposed *Data, devices []*Device, credentials [][]byte) error
+}
+
+// VerifyVotes implements BatchVoteVerifier. For a signature (R, s) of the
+// device A with the challenge h, it checks with random factors z
+//   (sum z*s) * B == sum z*R + sum z*h*A
+// which holds for valid signatures and fails with overwhelming probability
+// if one of them is invalid. The sums are split between the CPUs.
+func (sv *SchnorrVerifier) VerifyVotes(proposed *Data, devices []*Device, credentials [][]byte) error {
+	if len(devices) != len(credentials) {
+		return errors.New("not as many devices as credentials")
+	}
+	hash, err := proposed.Hash(sv.Suite.(kyber.HashFactory))
+	if err != nil {
+		return err
+	}
+	workers := runtime.NumCPU()
+	if workers > len(credentials) {
+		workers = len(credentials)
+	}
+	type sum struct {
+		s   kyber.Scalar
+		p   kyber.Point
+		err error
+	}
+	sums := make([]sum, workers)
+	var wg sync.WaitGroup
+	for w := range sums {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			sums[w].s, sums[w].p = sv.Suite.Scalar().Zero(), sv.Suite.Point().Null()
+			for i := w; i < len(credentials); i += workers {
+				if err := sv.addVote(sums[w].s, sums[w].p, hash, devices[i],
+					credentials[i]); err != nil {
+					sums[w].err = err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	s, p := sv.Suite.Scalar().Zero(), sv.Suite.Point().Null()
+	for _, sm := range sums {
+		if sm.err != nil {
+			return sm.err
+		}
+		s.Add(s, sm.s)
+		p.Add(p, sm.p)
+	}
+	if !sv.Suite.Point().Mul(s, nil).Equal(p) {
+		return errors.New("batch verification failed")
+	}
+	return nil
+}
+
+// addVote adds z*s to s and z*R + z*h*A to p, for a random z. The
+// collective signatures of groups are verified on their own.
+func (sv *SchnorrVerifier) addVote(s kyber.Scalar, p kyber.Point, msg []byte,
+	device *Device, sig []byte) error {
+	pointLen, scalarLen := sv.Suite.PointLen(), sv.Suite.ScalarLen()
+	if device != nil && device.Scheme != SchemeSchnorr {
+		return sv.VerifyMessage(device, msg, sig)
+	}
+	if device == nil || device.Point == nil {
+		return errors.New("missing device")
+	}
+	if device.Group != nil {
+		return device.Group.verify(sv.Suite, device.Point, msg, sig)
+	}
+	if len(sig) != pointLen+scalarLen {
+		return errors.New("signature has the wrong length")
+	}
+	r := sv.Suite.Point()
+	if err := r.UnmarshalBinary(sig[:pointLen]); err != nil {
+		return err
+	}
+	sigS := sv.Suite.Scalar()
+	if err := sigS.UnmarshalBinary(sig[pointLen:]); err != nil {
+		return err
+	}
+	h, err := schnorrChallenge(sv.Suite, device.Point, r, msg)
+	if err != nil {
+		return err
+	}
+	z := sv.Suite.Scalar().Pick(random.New())
+	s.Add(s, sv.Suite.Scalar().Mul(z, sigS))
+	p.Add(p, sv.Suite.Point().Mul(z, r))
+	p.Add(p, sv.Suite.Point().Mul(sv.Suite.Scalar().Mul(z, h), device.Point))
+	return nil
+}
+
+// schnorrChallenge returns the challenge of a schnorr-signature, computed
+// the same way as in kyber/sign/schnorr.
+func schnorrChallenge(g kyber.Group, public, r kyber.Point, msg []byte) (kyber.Scalar, error) {
+	h := sha512.New()
+	if _, err := r.MarshalTo(h); err != nil {
+		return nil, err
+	}
+	if _, err := public.MarshalTo(h); err != nil {
+		return nil, err
+	}
+	h.Write(msg)
+	return g.Scalar().SetBytes(h.Sum(nil)), nil
+}
+
+// SetBatchVerification enables or disables batch verification of the votes.
+// With batch verification a new vote is not verified when it arrives, but
+// all votes are verified together once there are enough of them to commit
+// the proposal. Invalid votes are removed at that time. A vote replacing
+// another vote of the same device is still verified on its own, so that an
+// invalid vote can't replace a valid one. Like the other settings, it has to
+// be done on all nodes of the identity.
+func (s *Service) SetBatchVerification(enabled bool) {
+	s.verifierMutex.Lock()
+	defer s.verifierMutex.Unlock()
+	s.batchVerify = enabled
+}
+
+// batchVerification returns true if batch verification is enabled.
+func (s *Service) batchVerification() bool {
+	s.verifierMutex.Lock()
+	defer s.verifierMutex.Unlock()
+	return s.batchVerify
+}
+
+// deferVote returns true if the vote of the signer on proposed is only
+// verified once the proposal is committed.
+func (s *Service) deferVote(proposed *Data, signer string) bool {
+	return s.batchVerification() && proposed.Votes[signer] == nil
+}
+
+// validVotes checks the votes of the devices on proposed and returns the
+// names of the valid and of the invalid ones, sorted. Votes of devices that
+// are not in devices are invalid. With batch verification, verifiers
+// implementing BatchVoteVerifier first check all votes at once.
+func (s *Service) validVotes(proposed *Data, devices map[string]*Device,
+	votes map[string][]byte) (valid, invalid []string) {
+	if maxAge := s.maxVoteAge(); maxAge > 0 {
+		return s.validTimedVotes(proposed, devices, votes, maxAge, s.now())
+	}
+	s.verifierMutex.Lock()
+	verifiers := s.verifiers
+	batch := s.batchVerify
+	s.verifierMutex.Unlock()
+
+	var names []string
+	for name := range votes {
+		if devices[name] == nil {
+			invalid = append(invalid, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ok := make(map[string]bool)
+	for _, name := range names {
+		ok[name] = true
+	}
+	for _, v := range verifiers {
+		if bv, isBatch := v.(BatchVoteVerifier); batch && isBatch {
+			var devs []*Device
+			var creds [][]byte
+			for _, name := range names {
+				if ok[name] {
+					devs = append(devs, devices[name])
+					creds = append(creds, votes[name])
+				}
+			}
+			if len(devs) == 0 || bv.VerifyVotes(proposed, devs, creds) == nil {
+				continue
+			}
+			log.Lvl2("Batch verification failed, verifying the votes one by one")
+		}
+		for _, name := range names {
+			if ok[name] && v.VerifyVote(proposed, devices[name], votes[name]) != nil {
+				ok[name] = false
+			}
+		}
+	}
+	for _, name := range names {
+		if ok[name] {
+			valid = append(valid, name)
+		} else {
+			invalid = append(invalid, name)
+		}
+	}
+	sort.Strings(invalid)
+	return
+}
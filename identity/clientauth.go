@@ -0,0 +1,238 @@
+package identity
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// ErrorNotAuthenticated is returned if the node only accepts authenticated
+// requests and the request has no valid credential.
+var ErrorNotAuthenticated = errors.New("request is not authenticated")
+
+// credentialTag prefixes the message signed for a credential, so that the
+// signature can't be used for another message of the device.
+const credentialTag = "identity-client"
+
+// credentialWindow is how old or how far in the future a credential may be.
+const credentialWindow = time.Minute
+
+// ClientCredential proves that a request has been sent by the owner of
+// Public.
+type ClientCredential struct {
+	Public kyber.Point
+	// Time in unix-nanoseconds when the credential has been created.
+	Time int64
+	// Signature on CredentialMessage.
+	Signature []byte
+}
+
+// AuthenticatedRequest wraps a request to the service together with the
+// credential of the client. Path is the name of the request, like it is
+// used by onet.
+type AuthenticatedRequest struct {
+	Path       string
+	Request    []byte
+	Credential *ClientCredential
+}
+
+// ClientAuthenticator decides whether a request to the service is handled.
+type ClientAuthenticator interface {
+	// AuthenticateClient returns nil if the request may be handled.
+	AuthenticateClient(path string, request []byte, cred *ClientCredential) error
+}
+
+// CredentialMessage returns the bytes signed for a credential of the request.
+func CredentialMessage(path string, request []byte, t int64) []byte {
+	var tb [8]byte
+	binary.LittleEndian.PutUint64(tb[:], uint64(t))
+	hash := sha256.Sum256(request)
+	msg := []byte(credentialTag)
+	msg = append(msg, []byte(path)...)
+	msg = append(msg, tb[:]...)
+	return append(msg, hash[:]...)
+}
+
+// DeviceAuthenticator accepts requests signed by a device of one of the
+// identities stored on the node, or by one of Keys, which is needed to
+// create a new identity or attach a new device.
+type DeviceAuthenticator struct {
+	Service *Service
+	Keys    []kyber.Point
+}
+
+// AuthenticateClient implements ClientAuthenticator.
+func (da *DeviceAuthenticator) AuthenticateClient(path string, request []byte,
+	cred *ClientCredential) error {
+	if cred == nil || cred.Public == nil {
+		return ErrorNotAuthenticated
+	}
+	age := da.Service.now().Sub(time.Unix(0, cred.Time))
+	if age > credentialWindow || age < -credentialWindow {
+		return errors.New("credential is outside of the time-window")
+	}
+	if !da.knows(cred.Public) {
+		return ErrorNotAuthenticated
+	}
+	return schnorr.Verify(da.Service.Suite(), cred.Public,
+		CredentialMessage(path, request, cred.Time), cred.Signature)
+}
+
+// knows returns true if pub is one of the keys or a device of an identity.
+func (da *DeviceAuthenticator) knows(pub kyber.Point) bool {
+	for _, k := range da.Keys {
+		if k.Equal(pub) {
+			return true
+		}
+	}
+	s := da.Service
+	s.storageMutex.Lock()
+	sids := make([]*IDBlock, 0, len(s.Storage.Identities))
+	for _, sid := range s.Storage.Identities {
+		sids = append(sids, sid)
+	}
+	s.storageMutex.Unlock()
+	for _, sid := range sids {
+		sid.Lock()
+		known := false
+		for _, dev := range sid.Latest.Device {
+			if dev != nil && dev.Point != nil && dev.Point.Equal(pub) {
+				known = true
+				break
+			}
+		}
+		sid.Unlock()
+		if known {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAuth holds the authenticator of the service.
+type clientAuth struct {
+	sync.Mutex
+	auth ClientAuthenticator
+}
+
+// SetClientAuthenticator makes the node only handle the requests of clients
+// the authenticator accepts. The clients have to set
+// Identity.AuthenticateRequests. The requests sent by the other nodes,
+// like ForwardBlock, are not authenticated. A nil authenticator accepts all
+// requests again.
+func (s *Service) SetClientAuthenticator(auth ClientAuthenticator) {
+	s.clientAuth.Lock()
+	defer s.clientAuth.Unlock()
+	s.clientAuth.auth = auth
+}
+
+// ProcessClientRequest checks the credential of the request, if the node
+// authenticates the clients, before it is handled.
+func (s *Service) ProcessClientRequest(path string, buf []byte) ([]byte, error) {
+	s.clientAuth.Lock()
+	auth := s.clientAuth.auth
+	s.clientAuth.Unlock()
+	if path == requestPath(&AuthenticatedRequest{}) {
+		ar := &AuthenticatedRequest{}
+		err := protobuf.DecodeWithConstructors(buf, ar,
+			network.DefaultConstructors(s.Suite()))
+		if err != nil {
+			return nil, err
+		}
+		if auth != nil {
+			if err := auth.AuthenticateClient(ar.Path, ar.Request, ar.Credential); err != nil {
+				log.Lvl2(s.ServerIdentity(), "refusing request", ar.Path, err)
+				return nil, err
+			}
+			if ar.Credential != nil && ar.Credential.Public != nil {
+				if err := s.startSession(ar.Credential.Public); err != nil {
+					log.Lvl2(s.ServerIdentity(), "refusing request", ar.Path, err)
+					return nil, err
+				}
+			}
+		}
+		return s.processIdempotent(ar.Path, ar.Request)
+	}
+	if auth != nil && !nodeRequests[path] {
+		return nil, ErrorNotAuthenticated
+	}
+	return s.processIdempotent(path, buf)
+}
+
+// nodeRequests are sent by the other nodes and are handled without the
+// authentication of a device. GetIdentityState is signed by the node
+// instead.
+var nodeRequests = map[string]bool{
+	requestPath(&ForwardBlock{}):       true,
+	requestPath(&GetIdentityState{}):   true,
+	requestPath(&PropagationSupport{}): true,
+}
+
+// requestPath returns the name under which onet sends msg.
+func requestPath(msg interface{}) string {
+	return reflect.Indirect(reflect.ValueOf(msg)).Type().Name()
+}
+
+// send sends msg to dst. If Retries is set, msg is wrapped in an
+// IdempotentRequest with a new key and resent with the same key if it
+// fails, so that the node handles it only once even if a reply got lost.
+func (i *Identity) send(dst *network.ServerIdentity, msg interface{}, reply interface{}) error {
+	if i.Retries <= 0 {
+		return i.sendSigned(dst, msg, reply)
+	}
+	buf, err := protobuf.Encode(msg)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	req := &IdempotentRequest{
+		Key:     hex.EncodeToString(key),
+		Path:    requestPath(msg),
+		Request: buf,
+	}
+	for n := 0; ; n++ {
+		err = i.sendSigned(dst, req, reply)
+		if err == nil || n >= i.Retries {
+			return err
+		}
+		log.Lvl2("resending", req.Path, "after error:", err)
+	}
+}
+
+// sendSigned sends msg to dst, wrapped in an AuthenticatedRequest signed by
+// the device if AuthenticateRequests is set.
+func (i *Identity) sendSigned(dst *network.ServerIdentity, msg interface{}, reply interface{}) error {
+	if !i.AuthenticateRequests {
+		return i.Client.SendProtobuf(dst, msg, reply)
+	}
+	buf, err := protobuf.Encode(msg)
+	if err != nil {
+		return err
+	}
+	path := requestPath(msg)
+	cred := &ClientCredential{Public: i.Public, Time: time.Now().UnixNano()}
+	cred.Signature, err = schnorr.Sign(i.Client.Suite(), i.Private,
+		CredentialMessage(path, buf, cred.Time))
+	if err != nil {
+		return err
+	}
+	return i.Client.SendProtobuf(dst, &AuthenticatedRequest{
+		Path:       path,
+		Request:    buf,
+		Credential: cred,
+	}, reply)
+}
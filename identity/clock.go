@@ -0,0 +1,62 @@
+package identity
+
+import (
+	"time"
+)
+
+// Clock gives the time to the service. All features depending on the time,
+// like the expiry of proposals, delayed commits, the age of votes or the
+// heartbeats, use the clock of the service, so that tests can replace it.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f after the duration d, like time.AfterFunc.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is returned by Clock.AfterFunc, like time.Timer.
+type Timer interface {
+	// Stop prevents the timer from firing and returns false if it already
+	// fired or has been stopped.
+	Stop() bool
+}
+
+// realClock is the default clock, using the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// SetClock replaces the clock of the service, nil sets the real clock
+// again. It must be set on all nodes, as they check the times of each
+// other, and before timers are started, which keep the clock they were
+// started with.
+func (s *Service) SetClock(c Clock) {
+	s.clockMutex.Lock()
+	defer s.clockMutex.Unlock()
+	s.clock = c
+}
+
+// getClock returns the clock of the service.
+func (s *Service) getClock() Clock {
+	s.clockMutex.Lock()
+	defer s.clockMutex.Unlock()
+	if s.clock == nil {
+		return realClock{}
+	}
+	return s.clock
+}
+
+// now returns the current time of the clock of the service.
+func (s *Service) now() time.Time {
+	return s.getClock().Now()
+}
+
+// afterFunc starts a timer of the clock of the service.
+func (s *Service) afterFunc(d time.Duration, f func()) Timer {
+	return s.getClock().AfterFunc(d, f)
+}
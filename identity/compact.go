@@ -0,0 +1,218 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// The skipchain of a long-lived identity gets long, and every node or client
+// catching up has to follow it. Compacting the identity starts a new
+// skipchain, whose genesis-block holds the latest data together with a
+// Checkpoint pointing to the tip of the old skipchain. The following blocks
+// are added to the new skipchain. The ID of the identity doesn't change and
+// the old blocks stay stored, so that the data of the checkpoint can be
+// verified back to the first genesis-block.
+
+// compactWindow is how far the time of a compaction may be away from the
+// time of the node, in both directions.
+const compactWindow = 10 * time.Minute
+
+// Checkpoint is stored in the data of the genesis-block of a compacted
+// skipchain. Like the votes, it is not part of the hash of the data.
+type Checkpoint struct {
+	// Genesis is the genesis-block of the skipchain that has been
+	// compacted.
+	Genesis skipchain.SkipBlockID
+	// Tip is the last block of that skipchain and Index its index.
+	Tip   skipchain.SkipBlockID
+	Index int
+	// Time and Signatures of the devices on CompactMessage.
+	Time       int64
+	Signatures map[string][]byte
+}
+
+// CompactIdentity asks to compact the skipchain of the identity. It needs
+// the signatures of a threshold of devices and has to be sent to the leader
+// of the skipchain-roster.
+type CompactIdentity struct {
+	ID ID
+	// Time in unix-nanoseconds, must be close to the time of the nodes.
+	Time int64
+	// Signatures of the devices on CompactMessage, mapped by device.
+	Signatures map[string][]byte
+	// Checkpoint is the new genesis-block. It is set by the leader when
+	// propagating the request to the other nodes.
+	Checkpoint *skipchain.SkipBlock
+}
+
+// CompactIdentityReply returns the genesis-block of the new skipchain.
+type CompactIdentityReply struct {
+	Checkpoint *skipchain.SkipBlock
+}
+
+// CompactMessage returns the message the devices sign to compact the
+// skipchain of the identity ending at tip, at time t.
+func CompactMessage(id ID, tip skipchain.SkipBlockID, t int64) []byte {
+	var ts [8]byte
+	binary.LittleEndian.PutUint64(ts[:], uint64(t))
+	msg := append([]byte("identity-compact"), id...)
+	msg = append(msg, tip...)
+	return append(msg, ts[:]...)
+}
+
+// CompactIdentity creates the genesis-block of the new skipchain and
+// propagates it to all nodes.
+func (s *Service) CompactIdentity(req *CompactIdentity) (*CompactIdentityReply, error) {
+	if s.isReadReplica() {
+		return nil, ErrorReadReplica
+	}
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	// No block can be added while the new skipchain is created.
+	sid.commitMutex.Lock()
+	defer sid.commitMutex.Unlock()
+	sid.Lock()
+	err := s.checkCompact(req.ID, sid, req.Time, req.Signatures)
+	if err == nil && sid.Proposed != nil {
+		err = errors.New("can't compact an identity with a pending proposal")
+	}
+	tip := sid.LatestSkipblock
+	latest := sid.Latest
+	roster := s.withReplicas(unionRoster(tip.Roster, sid.votingRoster(sid.Latest)))
+	sid.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if !tip.Roster.Get(0).Equal(s.ServerIdentity()) {
+		return nil, errors.New("only the leader of the skipchain-roster can compact an identity")
+	}
+	genesis := s.skipchain.GetDB().GetByID(tip.SkipChainID())
+	if genesis == nil {
+		return nil, errors.New("didn't find genesis-block")
+	}
+
+	d := *latest
+	d.Checkpoint = &Checkpoint{
+		Genesis:    tip.SkipChainID(),
+		Tip:        tip.Hash,
+		Index:      tip.Index,
+		Time:       req.Time,
+		Signatures: req.Signatures,
+	}
+	sb := &skipchain.SkipBlock{
+		SkipBlockFix: &skipchain.SkipBlockFix{
+			Roster:        tip.Roster,
+			BaseHeight:    genesis.BaseHeight,
+			MaximumHeight: genesis.MaximumHeight,
+			VerifierIDs:   genesis.VerifierIDs,
+		},
+	}
+	reply, err := s.storeSkipBlock(sb, &d)
+	if err != nil {
+		return nil, err
+	}
+	log.Lvlf2("%s: compacted identity %x at block %d", s.ServerIdentity(),
+		[]byte(req.ID), tip.Index)
+	prop := *req
+	prop.Checkpoint = reply.Latest
+	if _, err := s.propagate(propagateKindData, roster, &prop, sid.propagateTimeout()); err != nil {
+		return nil, err
+	}
+	return &CompactIdentityReply{Checkpoint: reply.Latest}, nil
+}
+
+// checkCompact returns nil if enough devices signed to compact the
+// skipchain at its latest block at time t. It must be called with the lock
+// of sid held.
+func (s *Service) checkCompact(id ID, sid *IDBlock, t int64, sigs map[string][]byte) error {
+	if d := s.now().Sub(time.Unix(0, t)); d > compactWindow || d < -compactWindow {
+		return errors.New("time of request is too far from the time of the node")
+	}
+	return s.checkThresholdSigned(sid, CompactMessage(id, sid.LatestSkipblock.Hash, t), sigs)
+}
+
+// applyCompact switches the identity to the new skipchain if its
+// genesis-block is a valid checkpoint of the latest block. It must be
+// called with the lock of sid held.
+func (s *Service) applyCompact(id ID, sid *IDBlock, req *CompactIdentity) {
+	c, err := checkCheckpoint(req.Checkpoint, sid.LatestSkipblock, sid.Latest)
+	if err == nil {
+		err = s.checkCompact(id, sid, c.Time, c.Signatures)
+	}
+	if err != nil {
+		log.Error(s.ServerIdentity(), "refusing to compact identity:", err)
+		return
+	}
+	log.Lvlf2("%s: switching identity %x to skipchain %x", s.ServerIdentity(),
+		[]byte(id), []byte(req.Checkpoint.Hash))
+	sid.IndexOffset += c.Index
+	sid.LatestSkipblock = req.Checkpoint
+	sid.Proposed = nil
+	sid.ProposedBy = ""
+	s.closeVoteSubscriptions(id)
+}
+
+// checkCheckpoint returns the checkpoint of genesis if it is the
+// genesis-block of a skipchain continuing the one ending at tip, with the
+// same data as tipData.
+func checkCheckpoint(genesis, tip *skipchain.SkipBlock, tipData *Data) (*Checkpoint, error) {
+	if genesis == nil || genesis.Index != 0 || !genesis.Hash.Equal(genesis.CalculateHash()) {
+		return nil, errors.New("invalid genesis-block")
+	}
+	_, msg, err := network.Unmarshal(genesis.Data, cothority.Suite)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := msg.(*Data)
+	if !ok || d.Checkpoint == nil {
+		return nil, errors.New("genesis-block is not a checkpoint")
+	}
+	c := d.Checkpoint
+	if !c.Tip.Equal(tip.Hash) || c.Index != tip.Index || !c.Genesis.Equal(tip.SkipChainID()) {
+		return nil, errors.New("checkpoint doesn't point to the tip")
+	}
+	hash, err := d.Hash(cothority.Suite)
+	if err != nil {
+		return nil, err
+	}
+	tipHash, err := tipData.Hash(cothority.Suite)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hash, tipHash) {
+		return nil, errors.New("checkpoint doesn't hold the data of the tip")
+	}
+	return c, nil
+}
+
+// VerifyCheckpoint returns nil if genesis is a checkpoint of the identity
+// continuing its skipchain at tip, signed by a threshold of the devices of
+// tip. The signatures are checked like by a SchnorrVerifier. Together with
+// the skipchain from the genesis-block of the identity to tip, it proves
+// the data of the compacted skipchain.
+func VerifyCheckpoint(suite network.Suite, id ID, genesis, tip *skipchain.SkipBlock) error {
+	_, msg, err := network.Unmarshal(tip.Data, suite)
+	if err != nil {
+		return err
+	}
+	tipData, ok := msg.(*Data)
+	if !ok {
+		return errors.New("tip doesn't hold data")
+	}
+	c, err := checkCheckpoint(genesis, tip, tipData)
+	if err != nil {
+		return err
+	}
+	sv := &SchnorrVerifier{Suite: suite}
+	return thresholdSigned(tipData, CompactMessage(id, tip.Hash, c.Time), c.Signatures,
+		sv.VerifyMessage)
+}
@@ -0,0 +1,270 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+)
+
+// stateWindow is how far the time of a GetIdentityState may be away from
+// the time of the node, in both directions.
+const stateWindow = time.Minute
+
+// ErrorNotIdentityNode is returned if a GetIdentityState isn't signed by a
+// node of the identity.
+var ErrorNotIdentityNode = errors.New("only the nodes of the identity can ask for its state")
+
+// GetIdentityState asks a node for its view of an identity. It is sent by
+// the other nodes for VerifyConsistency, which sign it with the key of
+// their server identity, as it shows the votes of restricted identities.
+type GetIdentityState struct {
+	ID ID
+	// Node is the public key of the asking node.
+	Node kyber.Point
+	// Time in unix-nanoseconds, must be close to the time of the node.
+	Time int64
+	// Signature of Node on IdentityStateMessage.
+	Signature []byte
+}
+
+// IdentityState is the view of one node on an identity.
+type IdentityState struct {
+	// Latest is the hash of the latest skipblock and Index its index,
+	// counting the blocks of compacted skipchains.
+	Latest skipchain.SkipBlockID
+	Index  int
+	// Proposed is the hash of the proposal, nil if there is none.
+	Proposed []byte
+	// Votes are the names of the devices that voted on the proposal, in
+	// alphabetical order.
+	Votes []string
+}
+
+// VerifyConsistency asks a node to compare its state of the identity with
+// the state of all other nodes of the identity.
+type VerifyConsistency struct {
+	ID ID
+	// Auth is needed if the identity has readers.
+	Auth *ReadAuth
+}
+
+// VerifyConsistencyReply holds the state of the node and how the other
+// nodes differ. An empty Mismatches means all nodes agree.
+type VerifyConsistencyReply struct {
+	State      *IdentityState
+	Mismatches []*StateMismatch
+}
+
+// StateMismatch describes how the state of a node differs.
+type StateMismatch struct {
+	ServerIdentity *network.ServerIdentity
+	// Error is set if the node couldn't be asked for its state.
+	Error string
+	// Differences describes every field that differs.
+	Differences []string
+}
+
+// IdentityStateMessage returns the message a node signs to ask for the
+// state of the identity at time t.
+func IdentityStateMessage(id ID, t int64) []byte {
+	var ts [8]byte
+	binary.LittleEndian.PutUint64(ts[:], uint64(t))
+	msg := append([]byte("identity-state"), id...)
+	return append(msg, ts[:]...)
+}
+
+// GetIdentityState returns the state of the identity on this node, if the
+// request is signed by one of the nodes of the identity.
+func (s *Service) GetIdentityState(req *GetIdentityState) (*IdentityState, error) {
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	if err := s.checkStateRequest(sid, req); err != nil {
+		return nil, err
+	}
+	return s.identityState(sid)
+}
+
+// checkStateRequest returns nil if the request is recent and signed by a
+// node of the identity, including its read-replicas.
+func (s *Service) checkStateRequest(sid *IDBlock, req *GetIdentityState) error {
+	if d := s.now().Sub(time.Unix(0, req.Time)); d > stateWindow || d < -stateWindow {
+		return errors.New("time of request is too far from the time of the node")
+	}
+	if req.Node == nil {
+		return ErrorNotIdentityNode
+	}
+	sid.Lock()
+	roster := s.withReplicas(sid.votingRoster(sid.Latest))
+	sid.Unlock()
+	member := false
+	for _, si := range roster.List {
+		if si.Public.Equal(req.Node) {
+			member = true
+			break
+		}
+	}
+	if !member {
+		return ErrorNotIdentityNode
+	}
+	msg := IdentityStateMessage(req.ID, req.Time)
+	if schnorr.Verify(s.Suite(), req.Node, msg, req.Signature) != nil {
+		return ErrorNotIdentityNode
+	}
+	return nil
+}
+
+// stateRequest returns a GetIdentityState for id signed by this node.
+func (s *Service) stateRequest(id ID) (*GetIdentityState, error) {
+	req := &GetIdentityState{
+		ID:   id,
+		Node: s.ServerIdentity().Public,
+		Time: s.now().UnixNano(),
+	}
+	var err error
+	req.Signature, err = schnorr.Sign(s.Suite(), s.nodePrivate(),
+		IdentityStateMessage(id, req.Time))
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// identityState returns the state of the identity on this node.
+func (s *Service) identityState(sid *IDBlock) (*IdentityState, error) {
+	sid.Lock()
+	defer sid.Unlock()
+	st := &IdentityState{
+		Latest: sid.LatestSkipblock.Hash,
+		Index:  sid.index(),
+	}
+	if sid.Proposed != nil {
+		hash, err := sid.Proposed.Hash(s.Suite().(kyber.HashFactory))
+		if err != nil {
+			return nil, err
+		}
+		st.Proposed = hash
+		for name := range sid.Proposed.Votes {
+			st.Votes = append(st.Votes, name)
+		}
+		sort.Strings(st.Votes)
+	}
+	return st, nil
+}
+
+// VerifyConsistency asks all other nodes of the identity for their state
+// and returns every node whose state differs from the state of this node.
+func (s *Service) VerifyConsistency(req *VerifyConsistency) (*VerifyConsistencyReply, error) {
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	err := s.checkRead(req.ID, sid.Latest, req.Auth)
+	sid.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	own, err := s.identityState(sid)
+	if err != nil {
+		return nil, err
+	}
+	sid.Lock()
+	roster := sid.votingRoster(sid.Latest)
+	sid.Unlock()
+	stateReq, err := s.stateRequest(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &VerifyConsistencyReply{State: own}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, si := range roster.List {
+		if si.Equal(s.ServerIdentity()) {
+			continue
+		}
+		wg.Add(1)
+		go func(si *network.ServerIdentity) {
+			defer wg.Done()
+			m := &StateMismatch{ServerIdentity: si}
+			other := &IdentityState{}
+			err := onet.NewClient(s.Suite(), ServiceName).SendProtobuf(si,
+				stateReq, other)
+			if err != nil {
+				m.Error = err.Error()
+			} else {
+				m.Differences = own.diff(other)
+			}
+			if m.Error == "" && len(m.Differences) == 0 {
+				return
+			}
+			mutex.Lock()
+			reply.Mismatches = append(reply.Mismatches, m)
+			mutex.Unlock()
+		}(si)
+	}
+	wg.Wait()
+	// Keep the order of the roster.
+	sort.Slice(reply.Mismatches, func(i, j int) bool {
+		a, _ := roster.Search(reply.Mismatches[i].ServerIdentity.ID)
+		b, _ := roster.Search(reply.Mismatches[j].ServerIdentity.ID)
+		return a < b
+	})
+	return reply, nil
+}
+
+// diff returns a description of every field in which other differs.
+func (st *IdentityState) diff(other *IdentityState) []string {
+	var diffs []string
+	if st.Index != other.Index {
+		diffs = append(diffs, fmt.Sprintf("latest block has index %d instead of %d",
+			other.Index, st.Index))
+	} else if !bytes.Equal(st.Latest, other.Latest) {
+		diffs = append(diffs, fmt.Sprintf("latest block is %x instead of %x",
+			[]byte(other.Latest), []byte(st.Latest)))
+	}
+	switch {
+	case st.Proposed == nil && other.Proposed != nil:
+		diffs = append(diffs, "has a proposal")
+	case st.Proposed != nil && other.Proposed == nil:
+		diffs = append(diffs, "has no proposal")
+	case !bytes.Equal(st.Proposed, other.Proposed):
+		diffs = append(diffs, fmt.Sprintf("proposal is %x instead of %x",
+			other.Proposed, st.Proposed))
+	default:
+		if missing := missingNames(st.Votes, other.Votes); len(missing) > 0 {
+			diffs = append(diffs, fmt.Sprintf("misses the votes of %v", missing))
+		}
+		if extra := missingNames(other.Votes, st.Votes); len(extra) > 0 {
+			diffs = append(diffs, fmt.Sprintf("has additional votes of %v", extra))
+		}
+	}
+	return diffs
+}
+
+// missingNames returns the names of a that are not in b.
+func missingNames(a, b []string) []string {
+	in := make(map[string]bool)
+	for _, n := range b {
+		in[n] = true
+	}
+	var missing []string
+	for _, n := range a {
+		if !in[n] {
+			missing = append(missing, n)
+		}
+	}
+	return missing
+}
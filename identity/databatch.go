@@ -0,0 +1,104 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dedis/onet/network"
+)
+
+// Default limits on the data, see SetDataLimits. The whole data is kept
+// well below the maximum size of a message between the nodes.
+const (
+	defaultMaxValueSize = 64 << 10
+	defaultMaxDataSize  = 1 << 20
+)
+
+// ErrorDataTooLarge is returned if a key and its value or the whole data of
+// a proposal are over the limits of the node.
+var ErrorDataTooLarge = errors.New("data is too large")
+
+// ProposeDataBatch proposes to change several keys of the storage in one
+// proposal. The proposal still needs the votes of the devices.
+type ProposeDataBatch struct {
+	ID ID
+	// Upserts are the keys to add or change, with their new values.
+	Upserts map[string]string
+	// Deletes are the keys to remove. Missing keys are ignored.
+	Deletes []string
+}
+
+// ProposeDataBatchReply returns the new proposal.
+type ProposeDataBatchReply struct {
+	Propose *Data
+}
+
+// SetDataLimits sets how large a key together with its value, and the
+// marshalled data of a proposal made with ProposeDataBatch may be. A value
+// of 0 removes the corresponding limit.
+func (s *Service) SetDataLimits(value, total int) {
+	s.dataLimitsMutex.Lock()
+	defer s.dataLimitsMutex.Unlock()
+	s.maxValueSize = value
+	s.maxDataSize = total
+}
+
+// ProposeDataBatch applies all changes to a copy of the latest data and
+// proposes it like ProposeSend.
+func (s *Service) ProposeDataBatch(req *ProposeDataBatch) (*ProposeDataBatchReply, error) {
+	if s.isReadReplica() {
+		return nil, ErrorReadReplica
+	}
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	for _, k := range req.Deletes {
+		if _, ok := req.Upserts[k]; ok {
+			return nil, fmt.Errorf("key %s is both changed and deleted", k)
+		}
+	}
+	sid.Lock()
+	propose := sid.Latest.Copy()
+	sid.Unlock()
+	for k, v := range req.Upserts {
+		propose.Storage[k] = v
+	}
+	for _, k := range req.Deletes {
+		delete(propose.Storage, k)
+	}
+	if err := s.checkDataSize(req.Upserts, propose); err != nil {
+		return nil, err
+	}
+	if _, err := s.ProposeSend(&ProposeSend{ID: req.ID, Propose: propose}); err != nil {
+		return nil, err
+	}
+	return &ProposeDataBatchReply{Propose: propose}, nil
+}
+
+// checkDataSize returns ErrorDataTooLarge if one of the changed keys or the
+// whole data is over the limits.
+func (s *Service) checkDataSize(changed map[string]string, d *Data) error {
+	s.dataLimitsMutex.Lock()
+	maxValue, maxData := s.maxValueSize, s.maxDataSize
+	s.dataLimitsMutex.Unlock()
+	if maxValue > 0 {
+		for k, v := range changed {
+			if len(k)+len(v) > maxValue {
+				return fmt.Errorf("%s: key %s has %d bytes, only %d are allowed",
+					ErrorDataTooLarge, k, len(k)+len(v), maxValue)
+			}
+		}
+	}
+	if maxData > 0 {
+		buf, err := network.Marshal(d)
+		if err != nil {
+			return err
+		}
+		if len(buf) > maxData {
+			return fmt.Errorf("%s: %d bytes, only %d are allowed",
+				ErrorDataTooLarge, len(buf), maxData)
+		}
+	}
+	return nil
+}
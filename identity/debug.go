@@ -0,0 +1,91 @@
+package identity
+
+import (
+	"errors"
+	"os"
+
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// ErrorDebugDisabled is returned by the debug-requests if the node didn't
+// enable them.
+var ErrorDebugDisabled = errors.New("debug-requests are disabled on this node")
+
+// DebugEnv is the environment variable that enables the debug-requests when
+// set to "true" while the service is created.
+const DebugEnv = "COTHORITY_IDENTITY_DEBUG"
+
+// DumpState asks for the complete state of an identity on the node.
+type DumpState struct {
+	ID ID
+}
+
+// DumpStateReply holds a copy of the state of the identity, including the
+// proposal and all its votes.
+type DumpStateReply struct {
+	IDBlock *IDBlock
+}
+
+// SetDebug enables or disables the debug-requests. They are disabled by
+// default, as they return the state of the identities without checking
+// the readers.
+func (s *Service) SetDebug(debug bool) {
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	s.debug = debug
+}
+
+// debugFromEnv enables the debug-requests if DebugEnv is set.
+func (s *Service) debugFromEnv() {
+	if os.Getenv(DebugEnv) != "true" {
+		return
+	}
+	log.Lvl2(s.ServerIdentity(), "enabling debug-requests")
+	s.SetDebug(true)
+}
+
+// DumpState returns a copy of the stored state of the identity, if the
+// debug-requests are enabled.
+func (s *Service) DumpState(req *DumpState) (*DumpStateReply, error) {
+	s.storageMutex.Lock()
+	debug := s.debug
+	s.storageMutex.Unlock()
+	if !debug {
+		return nil, ErrorDebugDisabled
+	}
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	// The state is copied by marshalling it, so that the votes of the
+	// proposal can't change while the reply is sent.
+	sid.Lock()
+	buf, err := network.Marshal(&IDBlock{
+		Latest:           sid.Latest,
+		Proposed:         sid.Proposed,
+		LatestSkipblock:  sid.LatestSkipblock,
+		ProposedAt:       sid.ProposedAt,
+		ProposalExpires:  sid.ProposalExpires,
+		ProposedBy:       sid.ProposedBy,
+		SkipchainRoster:  sid.SkipchainRoster,
+		Suspended:        sid.Suspended,
+		SuspendChanged:   sid.SuspendChanged,
+		ProposalDelay:    sid.ProposalDelay,
+		CommitAt:         sid.CommitAt,
+		LastSeen:         sid.LastSeen,
+		Timestamps:       sid.Timestamps,
+		RevokedSessions:  sid.RevokedSessions,
+		IndexOffset:      sid.IndexOffset,
+		PropagateTimeout: sid.PropagateTimeout,
+	})
+	sid.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	_, msg, err := network.Unmarshal(buf, s.Suite())
+	if err != nil {
+		return nil, err
+	}
+	return &DumpStateReply{IDBlock: msg.(*IDBlock)}, nil
+}
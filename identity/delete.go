@@ -0,0 +1,102 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/dedis/onet/log"
+)
+
+// deleteWindow is how far the time of a delete-request may be away from the
+// time of the node, in both directions.
+const deleteWindow = 10 * time.Minute
+
+// ErrorVoteSignature is returned if a signature of a device doesn't verify.
+var ErrorVoteSignature = errors.New("invalid signature of a device")
+
+// DeleteIdentity asks all nodes to forget the identity. It needs the
+// signatures of a threshold of devices. The blocks stay in the skipchain
+// service.
+type DeleteIdentity struct {
+	ID ID
+	// Time in unix-nanoseconds, must be close to the time of the nodes.
+	Time int64
+	// Signatures of the devices on DeleteMessage, mapped by device.
+	Signatures map[string][]byte
+}
+
+// DeleteIdentityReply is empty.
+type DeleteIdentityReply struct{}
+
+// DeleteMessage returns the message the devices sign to delete the identity
+// at time t.
+func DeleteMessage(id ID, t int64) []byte {
+	var ts [8]byte
+	binary.LittleEndian.PutUint64(ts[:], uint64(t))
+	msg := append([]byte("identity-delete"), id...)
+	return append(msg, ts[:]...)
+}
+
+// DeleteIdentity checks the request and propagates it to all nodes.
+func (s *Service) DeleteIdentity(req *DeleteIdentity) (*DeleteIdentityReply, error) {
+	if s.isReadReplica() {
+		return nil, ErrorReadReplica
+	}
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	err := s.checkDelete(req.ID, sid, req)
+	roster := s.withReplicas(sid.votingRoster(sid.Latest))
+	sid.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.propagate(propagateKindData, roster, req, sid.propagateTimeout()); err != nil {
+		return nil, err
+	}
+	return &DeleteIdentityReply{}, nil
+}
+
+// checkDelete returns nil if a threshold of devices signed the request and
+// all signatures are valid. It must be called with the lock of sid held.
+func (s *Service) checkDelete(id ID, sid *IDBlock, req *DeleteIdentity) error {
+	if d := s.now().Sub(time.Unix(0, req.Time)); d > deleteWindow || d < -deleteWindow {
+		return errors.New("time of request is too far from the time of the node")
+	}
+	msg := DeleteMessage(id, req.Time)
+	for name, sig := range req.Signatures {
+		dev := sid.Latest.Device[name]
+		if dev == nil || s.verifyDevice(dev, msg, sig) != nil {
+			return ErrorVoteSignature
+		}
+	}
+	return s.checkThresholdSigned(sid, msg, req.Signatures)
+}
+
+// applyDelete removes the identity from the node if the request is valid.
+// It must be called with the lock of sid held.
+func (s *Service) applyDelete(id ID, sid *IDBlock, req *DeleteIdentity) {
+	if err := s.checkDelete(id, sid, req); err != nil {
+		log.Error(s.ServerIdentity(), "refusing to delete identity:", err)
+		return
+	}
+	log.Lvlf2("%s: deleting identity %x", s.ServerIdentity(), []byte(id))
+	s.stopCommitTimer(id)
+	s.closeVoteSubscriptions(id)
+	s.closeCommitSubscriptions(id)
+	s.searchIndex.drop(id)
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	delete(s.Storage.Identities, string(id))
+	// Else a retry of the creation would bring the identity back.
+	for hash, created := range s.Storage.Created {
+		if bytes.Equal(created, id) {
+			delete(s.Storage.Created, hash)
+		}
+	}
+	s.save()
+}
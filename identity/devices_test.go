@@ -0,0 +1,276 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/anon"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+	"github.com/stretchr/testify/require"
+)
+
+// testDevices simulates all devices of one identity. Proposals and votes go
+// through the client-API, so the same paths as for real devices are used.
+type testDevices struct {
+	service  *Service
+	services []onet.Service
+	Devices  []*Identity
+}
+
+// newTestNodes starts n nodes running the identity service and returns
+// them in one roster. The caller must close the LocalTest.
+func newTestNodes(n int) (*onet.LocalTest, []onet.Service, *onet.Roster) {
+	l := onet.NewTCPTest(tSuite)
+	hosts, roster, _ := l.GenTree(n, true)
+	return l, l.GetServices(hosts, identityService), roster
+}
+
+// setupTestDevices starts the nodes and creates an identity on them with
+// the given number of devices and threshold. The caller must close the
+// LocalTest.
+func setupTestDevices(t require.TestingT, nodes, devices, threshold int) (*onet.LocalTest, *testDevices) {
+	l, services, roster := newTestNodes(nodes)
+	var kps []*key.Pair
+	for i := 0; i < devices; i++ {
+		kps = append(kps, key.NewKeyPair(tSuite))
+	}
+	td, err := newTestDevices(l, services, roster, threshold, kps)
+	if err != nil {
+		l.CloseAll()
+	}
+	require.Nil(t, err)
+	return l, td
+}
+
+// newTestDevices creates an identity with one device for every key-pair,
+// named "dev0", "dev1", ..., and sets the threshold. The first device
+// creates the identity, the others attach to it.
+func newTestDevices(l *onet.LocalTest, services []onet.Service, roster *onet.Roster,
+	threshold int, kps []*key.Pair) (*testDevices, error) {
+	if len(kps) == 0 {
+		return nil, errors.New("need at least one device")
+	}
+	other := key.NewKeyPair(tSuite)
+	set := anon.Set([]kyber.Point{kps[0].Public, other.Public})
+	for _, srvc := range services {
+		s := srvc.(*Service)
+		s.Storage.Auth.sets = append(s.Storage.Auth.sets, set)
+	}
+	td := &testDevices{service: services[0].(*Service), services: services}
+	first := NewTestIdentity(roster, 1, "dev0", l, kps[0])
+	if err := first.CreateIdentity(PoPAuth, set, kps[0].Private); err != nil {
+		return nil, err
+	}
+	td.Devices = append(td.Devices, first)
+	for i, kp := range kps[1:] {
+		dev := NewTestIdentity(roster, 1, fmt.Sprintf("dev%d", i+1), l, kp)
+		if err := dev.AttachToIdentity(first.ID); err != nil {
+			return nil, err
+		}
+		// Until the threshold is set below, one vote accepts the new
+		// device.
+		if _, err := td.vote(td.all()...); err != nil {
+			return nil, err
+		}
+		td.Devices = append(td.Devices, dev)
+	}
+	if err := td.update(); err != nil {
+		return nil, err
+	}
+	if threshold != first.Data.Threshold {
+		data := first.Data.Copy()
+		data.Threshold = threshold
+		if err := td.propose(data); err != nil {
+			return nil, err
+		}
+		sb, err := td.vote(td.all()...)
+		if err != nil {
+			return nil, err
+		}
+		if sb == nil {
+			return nil, errors.New("threshold has not been changed")
+		}
+	}
+	return td, td.update()
+}
+
+// ID returns the ID of the identity.
+func (td *testDevices) ID() ID {
+	return td.Devices[0].ID
+}
+
+// all returns the indexes of all devices.
+func (td *testDevices) all() []int {
+	idx := make([]int, len(td.Devices))
+	for i := range idx {
+		idx[i] = i
+	}
+	return idx
+}
+
+// propose sends the data as a new proposal from the first device.
+func (td *testDevices) propose(data *Data) error {
+	return td.Devices[0].ProposeSend(data)
+}
+
+// vote lets the devices with the given indexes accept the current
+// proposal, in the given order. It returns the new block if the proposal
+// has been committed, or nil if the threshold has not been reached.
+func (td *testDevices) vote(devices ...int) (*skipchain.SkipBlock, error) {
+	for _, i := range devices {
+		if i < 0 || i >= len(td.Devices) {
+			return nil, fmt.Errorf("no device %d", i)
+		}
+		if err := proposeUpVote(td.Devices[i]); err != nil {
+			return nil, err
+		}
+		if td.Devices[i].Proposed == nil {
+			sid := td.service.getIdentityStorage(td.ID())
+			sid.Lock()
+			sb := sid.LatestSkipblock
+			sid.Unlock()
+			return sb, td.update()
+		}
+	}
+	return nil, nil
+}
+
+// votes returns the votes recorded so far on the current proposal.
+func (td *testDevices) votes() (map[string][]byte, error) {
+	if err := td.Devices[0].ProposeUpdate(); err != nil {
+		return nil, err
+	}
+	if td.Devices[0].Proposed == nil {
+		return nil, errors.New("no proposal")
+	}
+	return td.Devices[0].Proposed.Votes, nil
+}
+
+// update fetches the latest data for all devices.
+func (td *testDevices) update() error {
+	for _, dev := range td.Devices {
+		if err := dev.DataUpdate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fakeClock is a Clock whose time only changes with advance, so that the
+// tests of the features depending on the time don't need to sleep.
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	f     func()
+	done  bool
+}
+
+// useFakeClock sets a new fake clock, starting at the current time, on all
+// services and returns it.
+func useFakeClock(services []onet.Service) *fakeClock {
+	c := &fakeClock{now: time.Now()}
+	for _, s := range services {
+		s.(*Service).SetClock(c)
+	}
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.Lock()
+	defer c.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	if t.done {
+		return false
+	}
+	t.done = true
+	return true
+}
+
+// advance moves the time forward by d and calls the functions of the timers
+// that are due, ordered by their time, before it returns.
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	c.Unlock()
+	for {
+		c.Lock()
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if !t.done && !t.at.After(c.now) && (next == nil || t.at.Before(next.at)) {
+				next = t
+			}
+		}
+		if next == nil {
+			c.Unlock()
+			return
+		}
+		next.done = true
+		c.Unlock()
+		next.f()
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	var fired []int
+	c.AfterFunc(2*time.Second, func() { fired = append(fired, 2) })
+	c.AfterFunc(time.Second, func() { fired = append(fired, 1) })
+	stopped := c.AfterFunc(time.Second, func() { fired = append(fired, 0) })
+	require.True(t, stopped.Stop())
+	require.False(t, stopped.Stop())
+	c.advance(time.Second / 2)
+	require.Equal(t, 0, len(fired))
+	c.advance(2 * time.Second)
+	require.Equal(t, []int{1, 2}, fired)
+	require.Equal(t, time.Unix(0, 0).Add(5*time.Second/2), c.Now())
+}
+
+func TestTestDevices(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 2)
+	defer l.CloseAll()
+	require.Equal(t, 3, len(td.Devices[2].Data.Device))
+	require.Equal(t, 2, td.Devices[2].Data.Threshold)
+
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(1)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	votes, err := td.votes()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(votes))
+	require.NotNil(t, votes["dev1"])
+
+	sb, err = td.vote(2)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Equal(t, "value", td.Devices[0].Data.Storage["key"])
+	_, err = td.votes()
+	require.NotNil(t, err)
+}
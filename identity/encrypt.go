@@ -0,0 +1,271 @@
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/messaging"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// The propagation can be encrypted on top of the transport, so that only
+// the nodes of the roster read the proposals, votes and blocks. The
+// payload is encrypted with a new key, and this key is encrypted for every
+// node with a key derived from the ephemeral key of the message and the
+// public key of the node. Nodes only encrypt if all nodes of the roster
+// said they can decrypt, so that older nodes still get plain messages.
+
+// peerSupportRetry is how long a node that can't decrypt is asked again.
+const peerSupportRetry = time.Minute
+
+// encryptionKeyName is the protocol name of the tree node instance used to
+// get the private key of the node.
+const encryptionKeyName = "IdentityPropagationKey"
+
+// EncryptedPropagation is a propagated message encrypted for the nodes of
+// the roster.
+type EncryptedPropagation struct {
+	// Ephemeral is the public key the keys of the nodes are derived from.
+	Ephemeral kyber.Point
+	// Keys holds the key of the payload, encrypted for every node.
+	Keys    []*PropagationKey
+	Nonce   []byte
+	Payload []byte
+}
+
+// PropagationKey is the key of the payload encrypted for the node with the
+// public key Node.
+type PropagationKey struct {
+	Node kyber.Point
+	Key  []byte
+}
+
+// PropagationSupport asks a node whether it decrypts propagations.
+type PropagationSupport struct{}
+
+// PropagationSupportReply is sent by the nodes that decrypt propagations.
+type PropagationSupportReply struct {
+	Encryption bool
+}
+
+// peerSupport caches which nodes decrypt propagations.
+type peerSupport struct {
+	sync.Mutex
+	checked map[network.ServerIdentityID]peerCheck
+}
+
+type peerCheck struct {
+	ok bool
+	at time.Time
+}
+
+// PropagationSupport tells that this node decrypts propagations, whether
+// it encrypts its own or not.
+func (s *Service) PropagationSupport(req *PropagationSupport) (*PropagationSupportReply, error) {
+	return &PropagationSupportReply{Encryption: true}, nil
+}
+
+// SetEncryptPropagation makes the node encrypt the messages it propagates
+// to rosters where all nodes can decrypt them.
+func (s *Service) SetEncryptPropagation(on bool) {
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	s.Storage.EncryptPropagation = on
+	s.save()
+}
+
+// encryptsPropagation returns true if the propagations are encrypted.
+func (s *Service) encryptsPropagation() bool {
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	return s.Storage.EncryptPropagation
+}
+
+// canEncrypt returns true if all other nodes of the roster decrypt
+// propagations.
+func (s *Service) canEncrypt(roster *onet.Roster) bool {
+	for _, si := range roster.List {
+		if si.ID.Equal(s.ServerIdentity().ID) {
+			continue
+		}
+		if !s.peerDecrypts(si) {
+			return false
+		}
+	}
+	return true
+}
+
+// peerDecrypts asks the node whether it decrypts propagations, unless it
+// has been asked before.
+func (s *Service) peerDecrypts(si *network.ServerIdentity) bool {
+	now := s.now()
+	ps := &s.peerSupport
+	ps.Lock()
+	c, ok := ps.checked[si.ID]
+	ps.Unlock()
+	if ok && (c.ok || now.Sub(c.at) < peerSupportRetry) {
+		return c.ok
+	}
+	reply := &PropagationSupportReply{}
+	err := onet.NewClient(s.Suite(), ServiceName).SendProtobuf(si, &PropagationSupport{}, reply)
+	supported := err == nil && reply.Encryption
+	if !supported {
+		log.Lvl2(s.ServerIdentity(), "sending plain propagations to", si)
+	}
+	ps.Lock()
+	if ps.checked == nil {
+		ps.checked = make(map[network.ServerIdentityID]peerCheck)
+	}
+	ps.checked[si.ID] = peerCheck{ok: supported, at: now}
+	ps.Unlock()
+	return supported
+}
+
+// nodePrivate returns the private key of the node. The service only gets
+// it through a tree node instance, which is created once for a tree with
+// only this node.
+func (s *Service) nodePrivate() kyber.Scalar {
+	s.nodeKeyOnce.Do(func() {
+		roster := onet.NewRoster([]*network.ServerIdentity{s.ServerIdentity()})
+		tree := roster.GenerateBinaryTree()
+		tni := s.NewTreeNodeInstance(tree, tree.Root, encryptionKeyName)
+		s.nodeKey = tni.Private()
+		tni.Done()
+	})
+	return s.nodeKey
+}
+
+// propagationKEK returns the key that encrypts the key of the payload for
+// the node with the public key pub.
+func propagationKEK(shared, ephemeral, pub kyber.Point) ([]byte, error) {
+	h := sha256.New()
+	for _, p := range []kyber.Point{shared, ephemeral, pub} {
+		if _, err := p.MarshalTo(h); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// newGCM returns AES-GCM with the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealPropagation encrypts msg for all nodes of the roster.
+func sealPropagation(roster *onet.Roster, msg network.Message) (*EncryptedPropagation, error) {
+	buf, err := network.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	payloadKey := make([]byte, 32)
+	if _, err := rand.Read(payloadKey); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(payloadKey)
+	if err != nil {
+		return nil, err
+	}
+	ep := &EncryptedPropagation{Nonce: make([]byte, aead.NonceSize())}
+	if _, err := rand.Read(ep.Nonce); err != nil {
+		return nil, err
+	}
+	ep.Payload = aead.Seal(nil, ep.Nonce, buf, nil)
+
+	eph := key.NewKeyPair(cothority.Suite)
+	ep.Ephemeral = eph.Public
+	for _, si := range roster.List {
+		shared := cothority.Suite.Point().Mul(eph.Private, si.Public)
+		kek, err := propagationKEK(shared, eph.Public, si.Public)
+		if err != nil {
+			return nil, err
+		}
+		wrap, err := newGCM(kek)
+		if err != nil {
+			return nil, err
+		}
+		// Every key is only used once, so the nonce can be fixed.
+		ep.Keys = append(ep.Keys, &PropagationKey{
+			Node: si.Public,
+			Key:  wrap.Seal(nil, make([]byte, wrap.NonceSize()), payloadKey, nil),
+		})
+	}
+	return ep, nil
+}
+
+// openPropagation decrypts the message with the private key priv of the
+// node with the public key pub.
+func openPropagation(ep *EncryptedPropagation, pub kyber.Point, priv kyber.Scalar,
+	suite network.Suite) (network.Message, error) {
+	if ep.Ephemeral == nil {
+		return nil, errors.New("missing ephemeral key")
+	}
+	for _, k := range ep.Keys {
+		if !pointsEqual(k.Node, pub) {
+			continue
+		}
+		shared := cothority.Suite.Point().Mul(priv, ep.Ephemeral)
+		kek, err := propagationKEK(shared, ep.Ephemeral, pub)
+		if err != nil {
+			return nil, err
+		}
+		wrap, err := newGCM(kek)
+		if err != nil {
+			return nil, err
+		}
+		payloadKey, err := wrap.Open(nil, make([]byte, wrap.NonceSize()), k.Key, nil)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newGCM(payloadKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(ep.Nonce) != aead.NonceSize() {
+			return nil, errors.New("wrong nonce size")
+		}
+		buf, err := aead.Open(nil, ep.Nonce, ep.Payload, nil)
+		if err != nil {
+			return nil, err
+		}
+		_, msg, err := network.Unmarshal(buf, suite)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := msg.(*EncryptedPropagation); ok {
+			return nil, errors.New("nested encrypted propagation")
+		}
+		return msg, nil
+	}
+	return nil, errors.New("propagation is not encrypted for this node")
+}
+
+// decrypting returns a handler that decrypts encrypted messages before
+// passing them to h.
+func (s *Service) decrypting(h messaging.PropagationStore) messaging.PropagationStore {
+	return func(msg network.Message) {
+		if ep, ok := msg.(*EncryptedPropagation); ok {
+			var err error
+			msg, err = openPropagation(ep, s.ServerIdentity().Public, s.nodePrivate(), s.Suite())
+			if err != nil {
+				log.Error(s.ServerIdentity(), "couldn't decrypt propagation:", err)
+				return
+			}
+		}
+		h(msg)
+	}
+}
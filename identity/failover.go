@@ -0,0 +1,119 @@
+package identity
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// skipchainRetry is how long a node of a skipchain-roster that failed to
+// store a block is only tried after the other nodes.
+const skipchainRetry = time.Minute
+
+// skipchainHealth remembers when the nodes of the skipchain-rosters failed
+// to store a block.
+type skipchainHealth struct {
+	sync.Mutex
+	failed map[network.ServerIdentityID]time.Time
+}
+
+// markFailed remembers that si failed now.
+func (h *skipchainHealth) markFailed(si *network.ServerIdentity, now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	if h.failed == nil {
+		h.failed = make(map[network.ServerIdentityID]time.Time)
+	}
+	h.failed[si.ID] = now
+}
+
+// markHealthy forgets a failure of si.
+func (h *skipchainHealth) markHealthy(si *network.ServerIdentity) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.failed, si.ID)
+}
+
+// order returns the nodes of r in the order they are asked to store a
+// block: first the nodes that didn't fail lately, in the order of the
+// roster, then the others, the oldest failure first.
+func (h *skipchainHealth) order(r *onet.Roster, now time.Time) []*network.ServerIdentity {
+	h.Lock()
+	defer h.Unlock()
+	var healthy, failed []*network.ServerIdentity
+	for _, si := range r.List {
+		if t, ok := h.failed[si.ID]; ok && now.Sub(t) < skipchainRetry {
+			failed = append(failed, si)
+		} else {
+			healthy = append(healthy, si)
+		}
+	}
+	sort.SliceStable(failed, func(i, j int) bool {
+		return h.failed[failed[i].ID].Before(h.failed[failed[j].ID])
+	})
+	return append(healthy, failed...)
+}
+
+// ledBy returns a roster with the same nodes as r, but si first, so that si
+// can store the block as the leader.
+func ledBy(r *onet.Roster, si *network.ServerIdentity) *onet.Roster {
+	list := []*network.ServerIdentity{si}
+	for _, other := range r.List {
+		if !other.ID.Equal(si.ID) {
+			list = append(list, other)
+		}
+	}
+	return onet.NewRoster(list)
+}
+
+// storeWithFailover stores a new block of an existing identity on the
+// first node of its roster that accepts it. As the skipchain only accepts
+// new blocks from the first node of their roster, the roster is reordered
+// for every node tried. The genesis-block can't be moved to another node,
+// as the roster is part of the identity-ID.
+func (s *Service) storeWithFailover(sb *skipchain.SkipBlock) (*skipchain.StoreSkipBlockReply, error) {
+	var errs []string
+	for _, si := range s.skipchainHealth.order(sb.Roster, s.now()) {
+		try := sb.Copy()
+		if !si.Equal(sb.Roster.Get(0)) {
+			try.Roster = ledBy(sb.Roster, si)
+		}
+		var reply *skipchain.StoreSkipBlockReply
+		var err error
+		if si.Equal(s.ServerIdentity()) {
+			reply, err = s.storeLocal(try)
+		} else {
+			reply, err = s.forwardBlock(si, try)
+		}
+		if err == nil {
+			s.skipchainHealth.markHealthy(si)
+			return reply, nil
+		}
+		log.Lvl2(s.ServerIdentity(), "couldn't store block on", si, err)
+		s.skipchainHealth.markFailed(si, s.now())
+		errs = append(errs, si.String()+": "+err.Error())
+	}
+	return nil, errors.New("no node stored the block: " + strings.Join(errs, "; "))
+}
+
+// forwardBlock sends the block to the identity service of the leader of
+// its roster, which stores it.
+func (s *Service) forwardBlock(leader *network.ServerIdentity, sb *skipchain.SkipBlock) (*skipchain.StoreSkipBlockReply, error) {
+	reply := &ForwardBlockReply{}
+	err := onet.NewClient(s.Suite(), ServiceName).SendProtobuf(leader,
+		&ForwardBlock{ID: ID(sb.GenesisID), Block: sb}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return &skipchain.StoreSkipBlockReply{
+		Previous: reply.Previous,
+		Latest:   reply.Latest,
+	}, nil
+}
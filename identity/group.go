@@ -0,0 +1,175 @@
+package identity
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/cosi"
+	"github.com/dedis/onet/network"
+)
+
+// DeviceGroup turns a device into a team that decides with its own
+// threshold. A credential of such a device is a collective signature of at
+// least Threshold of the Keys, and the Point of the device is the aggregate
+// of all Keys. The threshold of the identity counts the team as one device,
+// so the thresholds are nested: a proposal needs the threshold of the
+// devices, and every team voting needs its own threshold of members.
+type DeviceGroup struct {
+	Keys      []kyber.Point
+	Threshold int
+}
+
+// NewGroupDevice returns a device for the team of keys, whose credentials
+// need threshold of them.
+func NewGroupDevice(keys []kyber.Point, threshold int) (*Device, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys given")
+	}
+	g := &DeviceGroup{Keys: keys, Threshold: threshold}
+	agg := keys[0].Clone().Null()
+	for _, k := range keys {
+		agg.Add(agg, k)
+	}
+	if err := g.check(agg); err != nil {
+		return nil, err
+	}
+	return &Device{Point: agg, Group: g}, nil
+}
+
+// check returns an error if the threshold is not between 1 and the number
+// of keys or if point is not the aggregate of the keys.
+func (g *DeviceGroup) check(point kyber.Point) error {
+	if g.Threshold < 1 || g.Threshold > len(g.Keys) {
+		return fmt.Errorf("group threshold %d is not between 1 and %d",
+			g.Threshold, len(g.Keys))
+	}
+	if point == nil {
+		return errors.New("missing public key")
+	}
+	agg := point.Clone().Null()
+	for _, k := range g.Keys {
+		if k == nil {
+			return errors.New("missing key in group")
+		}
+		agg.Add(agg, k)
+	}
+	if !agg.Equal(point) {
+		return errors.New("public key is not the aggregate of the group")
+	}
+	return nil
+}
+
+// verify returns nil if sig is a collective signature on msg of at least
+// the threshold of the keys of the group.
+func (g *DeviceGroup) verify(suite network.Suite, point kyber.Point, msg, sig []byte) error {
+	cs, ok := suite.(cosi.Suite)
+	if !ok {
+		return errors.New("suite can't verify collective signatures")
+	}
+	if err := g.check(point); err != nil {
+		return err
+	}
+	return cosi.Verify(cs, g.Keys, msg, sig, cosi.NewThresholdPolicy(g.Threshold))
+}
+
+// write adds the threshold and the keys of the group to the hash.
+func (g *DeviceGroup) write(h hash.Hash) error {
+	if err := writeString(h, "group"); err != nil {
+		return err
+	}
+	err := binary.Write(h, binary.LittleEndian, int32(g.Threshold))
+	if err != nil {
+		return err
+	}
+	for _, k := range g.Keys {
+		if k == nil {
+			return errors.New("missing key in group")
+		}
+		if _, err := k.MarshalTo(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// equal returns true if both groups have the same threshold and keys.
+func (g *DeviceGroup) equal(other *DeviceGroup) bool {
+	if g == nil || other == nil {
+		return g == other
+	}
+	if g.Threshold != other.Threshold || len(g.Keys) != len(other.Keys) {
+		return false
+	}
+	for i, k := range g.Keys {
+		if !pointsEqual(k, other.Keys[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// PrepareGroupVote returns the vote of the group device signer accepting
+// proposed, signed by the members of g whose private keys are given.
+func PrepareGroupVote(id ID, signer string, proposed *Data, g *DeviceGroup,
+	privates map[int]kyber.Scalar) (*ProposeVote, error) {
+	if proposed == nil {
+		return nil, errors.New("No proposed data")
+	}
+	msg, err := proposed.Hash(cothority.Suite)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := SignGroup(cothority.Suite, g, msg, privates)
+	if err != nil {
+		return nil, err
+	}
+	return &ProposeVote{ID: id, Signer: signer, Signature: sig}, nil
+}
+
+// SignGroup returns the collective signature on msg of the members of the
+// group whose private keys are given, mapped by their index in Keys. It is
+// meant for members that can sign together; members on different machines
+// follow the same steps of kyber/sign/cosi: commit, challenge and response.
+func SignGroup(suite cosi.Suite, g *DeviceGroup, msg []byte, privates map[int]kyber.Scalar) ([]byte, error) {
+	mask, err := cosi.NewMask(suite, g.Keys, nil)
+	if err != nil {
+		return nil, err
+	}
+	var signers []int
+	for i := range privates {
+		signers = append(signers, i)
+	}
+	sort.Ints(signers)
+	secrets := make(map[int]kyber.Scalar)
+	commitment := suite.Point().Null()
+	for _, i := range signers {
+		if err := mask.SetBit(i, true); err != nil {
+			return nil, err
+		}
+		v, V := cosi.Commit(suite)
+		secrets[i] = v
+		commitment.Add(commitment, V)
+	}
+	challenge, err := cosi.Challenge(suite, commitment, mask.AggregatePublic, msg)
+	if err != nil {
+		return nil, err
+	}
+	var responses []kyber.Scalar
+	for _, i := range signers {
+		r, err := cosi.Response(suite, privates[i], secrets[i], challenge)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, r)
+	}
+	response, err := cosi.AggregateResponses(suite, responses)
+	if err != nil {
+		return nil, err
+	}
+	return cosi.Sign(suite, commitment, response, mask)
+}
@@ -0,0 +1,217 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/dedis/onet/log"
+)
+
+// DynamicThreshold lowers the number of votes needed for a proposal when
+// devices have been offline for a long time. The devices show they're
+// online by sending signed heartbeats.
+type DynamicThreshold struct {
+	// Percent of the devices seen online that need to vote.
+	Percent int
+	// Floor is the minimal number of votes needed, regardless of how
+	// many devices are online.
+	Floor int
+	// Window in nanoseconds during which a heartbeat marks a device as
+	// online.
+	Window int64
+}
+
+// heartbeatTag prefixes the message of a heartbeat, so that its signature
+// can't be used for another message of the device.
+const heartbeatTag = "identity-heartbeat"
+
+// Heartbeat is sent by a device to show that it is online.
+type Heartbeat struct {
+	ID     ID
+	Device string
+	// Time in unix-nanoseconds when the heartbeat has been created.
+	Time int64
+	// Signature of the device on the tag, ID, Device and Time.
+	Signature []byte
+}
+
+// HeartbeatReply is empty.
+type HeartbeatReply struct{}
+
+// message returns the bytes signed by the device.
+func (h *Heartbeat) message() []byte {
+	var t [8]byte
+	binary.LittleEndian.PutUint64(t[:], uint64(h.Time))
+	msg := []byte(heartbeatTag)
+	msg = append(msg, h.ID...)
+	msg = append(msg, []byte(h.Device)...)
+	return append(msg, t[:]...)
+}
+
+// verify returns an error if the heartbeat is not for the identity id, not
+// signed by a device of latest or more than window away from now.
+func (h *Heartbeat) verify(s *Service, id ID, latest *Data, now, window int64) error {
+	if !bytes.Equal(h.ID, id) {
+		return errors.New("heartbeat of another identity")
+	}
+	dev := latest.Device[h.Device]
+	if dev == nil {
+		return errors.New("unknown device " + h.Device)
+	}
+	age := now - h.Time
+	if age > window || age < -window {
+		return errors.New("heartbeat is outside of the window")
+	}
+	return s.verifyDevice(dev, h.message(), h.Signature)
+}
+
+// SetDynamicThreshold enables the dynamic threshold: a proposal needs the
+// votes of percent of the devices that are online, but at least floor
+// votes. It never needs more votes than the static threshold, and it only
+// applies to identities whose data has AllowDynamicThreshold set, all
+// others always need the static threshold. A percent of 0 disables the
+// dynamic threshold. All nodes of an identity must use the same settings,
+// else the nodes with the higher threshold refuse the new blocks.
+func (s *Service) SetDynamicThreshold(percent, floor int, window time.Duration) error {
+	if percent != 0 && (percent < 0 || percent > 100 || floor < 1 || window <= 0) {
+		return errors.New("invalid dynamic threshold")
+	}
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	if percent == 0 {
+		s.Storage.DynamicThreshold = nil
+	} else {
+		s.Storage.DynamicThreshold = &DynamicThreshold{
+			Percent: percent,
+			Floor:   floor,
+			Window:  int64(window),
+		}
+	}
+	s.save()
+	return nil
+}
+
+// dynamicThreshold returns the configuration of the dynamic threshold, or
+// nil if it is not enabled.
+func (s *Service) dynamicThreshold() *DynamicThreshold {
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	return s.Storage.DynamicThreshold
+}
+
+// Heartbeat records that the device is online and propagates the heartbeat
+// to the other nodes of the identity.
+func (s *Service) Heartbeat(h *Heartbeat) (*HeartbeatReply, error) {
+	sid := s.getIdentityStorage(h.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	err := s.checkHeartbeat(sid.Latest, h)
+	roster := sid.votingRoster(sid.Latest)
+	sid.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.propagate(propagateKindData, roster, h, sid.propagateTimeout()); err != nil {
+		return nil, err
+	}
+	return &HeartbeatReply{}, nil
+}
+
+// checkHeartbeat returns an error if the heartbeat is not signed by a
+// device of latest or is outside of the window.
+func (s *Service) checkHeartbeat(latest *Data, h *Heartbeat) error {
+	dt := s.dynamicThreshold()
+	if dt == nil {
+		return errors.New("dynamic threshold is not enabled")
+	}
+	return h.verify(s, h.ID, latest, s.now().UnixNano(), dt.Window)
+}
+
+// recordHeartbeat stores the heartbeat if it is valid and newer than the
+// last one of the device, and adds the heartbeats to the proposal of the
+// identity. It must be called with the lock of the identity held.
+func (s *Service) recordHeartbeat(sid *IDBlock, h *Heartbeat) {
+	if err := s.checkHeartbeat(sid.Latest, h); err != nil {
+		log.Lvl2(s.ServerIdentity(), "refusing heartbeat:", err)
+		return
+	}
+	s.heartbeatMutex.Lock()
+	if s.heartbeats == nil {
+		s.heartbeats = make(map[string]map[string]*Heartbeat)
+	}
+	devices := s.heartbeats[string(h.ID)]
+	if devices == nil {
+		devices = make(map[string]*Heartbeat)
+		s.heartbeats[string(h.ID)] = devices
+	}
+	if last := devices[h.Device]; last == nil || h.Time > last.Time {
+		devices[h.Device] = h
+	}
+	s.heartbeatMutex.Unlock()
+	sid.markSeen(h.Device, s.now())
+	s.attachHeartbeats(h.ID, sid)
+}
+
+// attachHeartbeats sets the heartbeats of the proposal of the identity to
+// the last heartbeat of every device. When the proposal is stored, they
+// are used by all nodes to compute the dynamic threshold. It must be called
+// with the lock of the identity held.
+func (s *Service) attachHeartbeats(id ID, sid *IDBlock) {
+	if sid.Proposed == nil {
+		return
+	}
+	s.heartbeatMutex.Lock()
+	defer s.heartbeatMutex.Unlock()
+	var hbs []*Heartbeat
+	for _, name := range sid.Latest.deviceNames() {
+		if h := s.heartbeats[string(id)][name]; h != nil {
+			hbs = append(hbs, h)
+		}
+	}
+	sid.Proposed.Heartbeats = hbs
+}
+
+// onlineDevices returns the weight of the devices of latest that voted for
+// proposed or have a valid heartbeat in proposed, at most window before now.
+func (s *Service) onlineDevices(id ID, latest, proposed *Data, now time.Time, window int64) int {
+	online := make(map[string]bool)
+	for name := range proposed.Votes {
+		if latest.Device[name] != nil {
+			online[name] = true
+		}
+	}
+	for _, h := range proposed.Heartbeats {
+		if h.verify(s, id, latest, now.UnixNano(), window) == nil {
+			online[h.Device] = true
+		}
+	}
+	var names []string
+	for name := range online {
+		names = append(names, name)
+	}
+	return latest.weightOf(names)
+}
+
+// votesNeeded returns how many votes are needed to accept proposed. With a
+// dynamic threshold and an identity allowing it, it can be lower than
+// requiredVotes, but never lower than the floor. As it only depends on the
+// data and the heartbeats in proposed, all nodes agree on it.
+func (s *Service) votesNeeded(id ID, latest, proposed *Data, strict bool, dt *DynamicThreshold) int {
+	required := requiredVotes(latest, proposed, strict)
+	if dt == nil || proposed == nil || !latest.AllowDynamicThreshold {
+		return required
+	}
+	online := s.onlineDevices(id, latest, proposed, s.now(), dt.Window)
+	dynamic := (online*dt.Percent + 99) / 100
+	if dynamic < dt.Floor {
+		dynamic = dt.Floor
+	}
+	if dynamic < required {
+		return dynamic
+	}
+	return required
+}
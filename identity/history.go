@@ -0,0 +1,287 @@
+package identity
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// maxTimestampSkew is how far the timestamp of a new block may be away from
+// the clock of the nodes signing it.
+const maxTimestampSkew = time.Minute
+
+// maxHistoryDepth is the highest number of blocks returned by
+// GetDataHistory.
+const maxHistoryDepth = 1000
+
+// ErrorBlockMissing is returned if the identity or one of its blocks is not
+// stored on the node.
+var ErrorBlockMissing = errors.New("didn't find block")
+
+// ErrorDataMismatch is returned if the data stored by the node doesn't have
+// the hash of the data in its latest block.
+var ErrorDataMismatch = errors.New("stored data doesn't match the skipchain")
+
+// GetLatest asks for the latest data of the identity.
+type GetLatest struct {
+	ID ID
+	// Auth is needed if the identity has readers.
+	Auth *ReadAuth
+}
+
+// GetLatestReply holds the latest data with the index and the hash of the
+// block holding it. Index counts the blocks of compacted skipchains.
+type GetLatestReply struct {
+	Data  *Data
+	Index int
+	Hash  skipchain.SkipBlockID
+}
+
+// GetDataAtTime asks for the data that was the latest at Time.
+type GetDataAtTime struct {
+	ID ID
+	// Time in unix-nanoseconds.
+	Time int64
+	// Auth is needed if the identity has readers.
+	Auth *ReadAuth
+}
+
+// GetDataAtTimeReply holds the data and the block holding it.
+type GetDataAtTimeReply struct {
+	Data  *Data
+	Block *skipchain.SkipBlock
+}
+
+// GetDataHistory asks for the data of the latest blocks of the identity.
+type GetDataHistory struct {
+	ID ID
+	// MaxDepth is the number of blocks to return. If it is 0 or above
+	// maxHistoryDepth, maxHistoryDepth blocks are returned.
+	MaxDepth int
+	// Auth is needed if the identity has readers.
+	Auth *ReadAuth
+}
+
+// GetDataHistoryReply holds the data of the blocks, oldest first.
+type GetDataHistoryReply struct {
+	History []*HistoryEntry
+}
+
+// HistoryEntry is the data of one block and the index of the block,
+// counting the blocks of compacted skipchains.
+type HistoryEntry struct {
+	Index int
+	Data  *Data
+}
+
+// checkTimestamp returns an error if the timestamp of the data in a new
+// block is missing, older than the timestamp of latest or too far away from
+// now.
+func checkTimestamp(d, latest *Data, now time.Time) error {
+	if d.Timestamp == 0 {
+		return errors.New("block without timestamp")
+	}
+	if d.Timestamp < latest.Timestamp {
+		return errors.New("timestamp is before the one of the previous block")
+	}
+	skew := time.Duration(now.UnixNano() - d.Timestamp)
+	if skew > maxTimestampSkew || skew < -maxTimestampSkew {
+		return errors.New("timestamp is too far from our clock")
+	}
+	return nil
+}
+
+// nextTimestamp returns the timestamp for a new block following latest:
+// the current time, unless the clock is behind the previous block.
+func nextTimestamp(latest *Data, now time.Time) int64 {
+	if t := now.UnixNano(); t > latest.Timestamp {
+		return t
+	}
+	return latest.Timestamp
+}
+
+// GetLatest returns the latest data of the identity, after checking that
+// it has the same hash as the data in the latest block of the skipchain.
+func (s *Service) GetLatest(req *GetLatest) (*GetLatestReply, error) {
+	if s.isReadReplica() {
+		return nil, errors.New("a read-replica doesn't hold the skipchain")
+	}
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, ErrorBlockMissing
+	}
+	sid.Lock()
+	latest := sid.Latest
+	id := sid.LatestSkipblock.Hash
+	offset := sid.IndexOffset
+	reader, err := s.authorizeRead(req.ID, latest, req.Auth)
+	sid.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	sb, d, err := s.blockData(sid, id)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := latest.Hash(s.Suite())
+	if err != nil {
+		return nil, err
+	}
+	inBlock, err := d.Hash(s.Suite())
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(stored, inBlock) {
+		log.Errorf("%s: data of identity %x doesn't match block %x",
+			s.ServerIdentity(), []byte(req.ID), []byte(sb.Hash))
+		return nil, ErrorDataMismatch
+	}
+	return &GetLatestReply{
+		Data:  latest.readableBy(reader, latest),
+		Index: offset + sb.Index,
+		Hash:  sb.Hash,
+	}, nil
+}
+
+// GetDataAtTime searches the skipchain of the identity for the last block
+// stored at or before the given time. As the timestamps of the blocks never
+// decrease, it follows the highest forward-link that doesn't go past the
+// time. If the identity has been compacted, it starts with the skipchain
+// holding the time. Blocks stored before the timestamps were introduced count as
+// stored at time 0.
+func (s *Service) GetDataAtTime(req *GetDataAtTime) (*GetDataAtTimeReply, error) {
+	if s.isReadReplica() {
+		return nil, errors.New("a read-replica doesn't hold the skipchain")
+	}
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	latest := sid.Latest
+	start := sid.LatestSkipblock.SkipChainID()
+	reader, err := s.authorizeRead(req.ID, latest, req.Auth)
+	sid.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	sb, d, err := s.blockData(sid, start)
+	if err != nil {
+		return nil, err
+	}
+	// Go back to the compacted skipchain holding the time.
+	for d.Checkpoint != nil && d.Timestamp > req.Time {
+		sb, d, err = s.blockData(sid, d.Checkpoint.Genesis)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if d.Timestamp > req.Time {
+		return nil, errors.New("time is before the creation of the identity")
+	}
+	for {
+		var next *skipchain.SkipBlock
+		var nextData *Data
+		for h := len(sb.ForwardLink) - 1; h >= 0 && next == nil; h-- {
+			cand, candData, err := s.blockData(sid, sb.ForwardLink[h].To)
+			if err != nil {
+				return nil, err
+			}
+			if candData.Timestamp <= req.Time {
+				next, nextData = cand, candData
+			}
+		}
+		if next == nil {
+			return &GetDataAtTimeReply{Data: d.readableBy(reader, latest), Block: sb}, nil
+		}
+		sb, d = next, nextData
+	}
+}
+
+// GetDataHistory follows the back-links from the latest block of the
+// identity and returns the data of up to MaxDepth blocks. The genesis-blocks
+// of compacted skipchains are skipped, as they only repeat the data of the
+// tip they point to.
+func (s *Service) GetDataHistory(req *GetDataHistory) (*GetDataHistoryReply, error) {
+	if s.isReadReplica() {
+		return nil, errors.New("a read-replica doesn't hold the skipchain")
+	}
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, ErrorBlockMissing
+	}
+	depth := req.MaxDepth
+	if depth <= 0 || depth > maxHistoryDepth {
+		depth = maxHistoryDepth
+	}
+	sid.Lock()
+	latest := sid.Latest
+	id := sid.LatestSkipblock.Hash
+	offset := sid.IndexOffset
+	reader, err := s.authorizeRead(req.ID, latest, req.Auth)
+	sid.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]*HistoryEntry, 0, depth)
+	for len(history) < depth {
+		sb, d, err := s.blockData(sid, id)
+		if err != nil {
+			return nil, err
+		}
+		if sb.Index == 0 && d.Checkpoint != nil {
+			id = d.Checkpoint.Tip
+			offset -= d.Checkpoint.Index
+			continue
+		}
+		history = append(history, &HistoryEntry{
+			Index: offset + sb.Index,
+			Data:  d.readableBy(reader, latest),
+		})
+		if len(sb.BackLinkIDs) == 0 {
+			break
+		}
+		id = sb.BackLinkIDs[0]
+	}
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+	return &GetDataHistoryReply{History: history}, nil
+}
+
+// blockData returns the block with the given id and the data stored in it.
+// If the skipchain is stored on a separate roster, the block is fetched
+// from there.
+func (s *Service) blockData(sid *IDBlock, id skipchain.SkipBlockID) (*skipchain.SkipBlock, *Data, error) {
+	sb := s.skipchain.GetDB().GetByID(id)
+	if sb == nil {
+		sid.Lock()
+		roster := sid.LatestSkipblock.Roster
+		separate := sid.SkipchainRoster != nil
+		sid.Unlock()
+		if !separate {
+			return nil, nil, ErrorBlockMissing
+		}
+		var err error
+		sb, err = skipchain.NewClient().GetSingleBlock(roster, id)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	_, msg, err := network.Unmarshal(sb.Data, s.Suite())
+	if err != nil {
+		return nil, nil, err
+	}
+	d, ok := msg.(*Data)
+	if !ok {
+		return nil, nil, errors.New("block doesn't hold data")
+	}
+	return sb, d, nil
+}
@@ -0,0 +1,155 @@
+package identity
+
+import (
+	"time"
+
+	"github.com/dedis/onet/log"
+)
+
+// EventType describes what happened to an identity.
+type EventType int
+
+// EventType consts
+const (
+	// EventCommit is sent when a new block has been stored for an identity.
+	EventCommit EventType = iota + 1
+	// EventQuorumUnreachable is sent when a proposal has been open for
+	// longer than the quorum-timeout and can't reach the threshold anymore,
+	// even if all devices that didn't vote yet approve it.
+	EventQuorumUnreachable
+)
+
+// Event is given to all hooks registered with the service.
+type Event struct {
+	Type EventType
+	// ID of the identity the event is about.
+	ID ID
+	// Data is the latest data for EventCommit, or the proposed data
+	// for EventQuorumUnreachable.
+	Data *Data
+	// Index of the latest skipblock of the identity, counting the blocks
+	// of compacted skipchains.
+	Index int
+	// Votes holds the weight of the votes received on the proposal, the
+	// number of votes if the devices have no weights.
+	Votes int
+	// Threshold is the weight of the votes needed to accept the proposal.
+	Threshold int
+}
+
+// Hook is called by the service for every event. It is called in its own
+// goroutine, so it must not expect the events to arrive in order. Hooks are
+// only called for the events of the node they are registered with and are
+// not saved, so they have to be registered every time the service starts.
+type Hook func(ev *Event)
+
+// defaultQuorumTimeout is how long a proposal may stay below the threshold
+// before the service sends an EventQuorumUnreachable.
+const defaultQuorumTimeout = 24 * time.Hour
+
+// RegisterHook adds h to the list of hooks that are called for every event.
+func (s *Service) RegisterHook(h Hook) {
+	s.hooksMutex.Lock()
+	defer s.hooksMutex.Unlock()
+	s.hooks = append(s.hooks, h)
+}
+
+// SetQuorumTimeout sets how long a proposal may stay below the threshold
+// before an EventQuorumUnreachable is sent. A value of 0 disables the
+// detection.
+func (s *Service) SetQuorumTimeout(d time.Duration) {
+	s.hooksMutex.Lock()
+	defer s.hooksMutex.Unlock()
+	s.quorumTimeout = d
+}
+
+// emit sends the event to all registered hooks.
+func (s *Service) emit(ev *Event) {
+	s.hooksMutex.Lock()
+	hooks := make([]Hook, len(s.hooks))
+	copy(hooks, s.hooks)
+	s.hooksMutex.Unlock()
+	for _, h := range hooks {
+		go h(ev)
+	}
+}
+
+// CheckQuorum goes through all identities and sends an
+// EventQuorumUnreachable for every proposal that has been open for longer
+// than the quorum-timeout and can't reach the threshold anymore. Every
+// proposal is reported only once.
+func (s *Service) CheckQuorum() {
+	s.storageMutex.Lock()
+	ids := make(map[string]*IDBlock)
+	for id, sid := range s.Storage.Identities {
+		ids[id] = sid
+	}
+	s.storageMutex.Unlock()
+	for id, sid := range ids {
+		if ev := s.checkQuorum(ID(id), sid); ev != nil {
+			s.emit(ev)
+		}
+	}
+}
+
+// checkQuorum returns an EventQuorumUnreachable if the proposal of sid is
+// stuck, or nil if it isn't or has already been reported. A proposal is
+// stuck if the approvals together with the weight of the devices that
+// still can approve it are below the threshold.
+func (s *Service) checkQuorum(id ID, sid *IDBlock) *Event {
+	s.hooksMutex.Lock()
+	timeout := s.quorumTimeout
+	s.hooksMutex.Unlock()
+	if timeout == 0 {
+		return nil
+	}
+	strict := s.isStrictThreshold()
+	dt := s.dynamicThreshold()
+	sid.Lock()
+	defer sid.Unlock()
+	if sid.Proposed == nil || sid.quorumReported {
+		return nil
+	}
+	if s.now().Sub(time.Unix(0, sid.ProposedAt)) < timeout {
+		return nil
+	}
+	votes := approvals(sid.Latest, sid.Proposed.Votes)
+	required := s.votesNeeded(id, sid.Latest, sid.Proposed, strict, dt)
+	if votes+sid.undecidedWeight() >= required {
+		return nil
+	}
+	log.Warn(s.ServerIdentity(), "proposal is stuck with", votes,
+		"out of", required, "votes")
+	sid.quorumReported = true
+	return &Event{
+		Type:      EventQuorumUnreachable,
+		ID:        id,
+		Data:      sid.Proposed,
+		Index:     sid.index(),
+		Votes:     votes,
+		Threshold: required,
+	}
+}
+
+// undecidedWeight returns the weight of the devices of the latest data that
+// neither approved nor rejected the proposal and whose session hasn't been
+// revoked. It must be called with the lock of sid held.
+func (sid *IDBlock) undecidedWeight() int {
+	var names []string
+	for name, dev := range sid.Latest.Device {
+		if len(sid.Proposed.Votes[name]) > 0 || sid.rejected[name] {
+			continue
+		}
+		revoked := false
+		for _, r := range sid.RevokedSessions {
+			if dev != nil && dev.Point != nil && r.Equal(dev.Point) {
+				revoked = true
+				break
+			}
+		}
+		if !revoked {
+			names = append(names, name)
+		}
+	}
+	return sid.Latest.weightOf(names)
+}
@@ -0,0 +1,122 @@
+package identity
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// idempotencyTTL is how long the reply to a request with an idempotency key
+// is kept.
+const idempotencyTTL = 10 * time.Minute
+
+// idempotencyLimit is how many replies are kept at most. The oldest ones
+// are dropped first.
+const idempotencyLimit = 1024
+
+// IdempotentRequest wraps a request to the service with a key chosen by the
+// client. A request that has already been handled successfully with the
+// same key gets the same reply again, without being handled a second time,
+// so that the client can resend it if the reply got lost. Path is the name
+// of the request, like it is used by onet.
+type IdempotentRequest struct {
+	Key     string
+	Path    string
+	Request []byte
+}
+
+// idempotentEntry is a request with a key, while it is handled and after.
+type idempotentEntry struct {
+	key    string
+	digest [sha256.Size]byte
+	added  time.Time
+	// done is closed when reply and err are set.
+	done  chan struct{}
+	reply []byte
+	err   error
+}
+
+// idempotency holds the replies to the requests with a key. They are only
+// kept in memory, so a restarted node handles a resent request again.
+type idempotency struct {
+	sync.Mutex
+	entries map[string]*idempotentEntry
+	// order holds the entries in the order they have been added.
+	order []*idempotentEntry
+}
+
+// prune drops the entries older than the TTL and the oldest entries above
+// the limit. It must be called with the lock held.
+func (id *idempotency) prune(now time.Time) {
+	for len(id.order) > 0 {
+		e := id.order[0]
+		live := id.entries[e.key] == e
+		if live && now.Sub(e.added) < idempotencyTTL && len(id.entries) < idempotencyLimit {
+			return
+		}
+		id.order = id.order[1:]
+		if live {
+			delete(id.entries, e.key)
+		}
+	}
+}
+
+// processIdempotent handles the request, which is only looked up among the
+// replies if it is an IdempotentRequest with a key.
+func (s *Service) processIdempotent(path string, buf []byte) ([]byte, error) {
+	if path != requestPath(&IdempotentRequest{}) {
+		return s.ServiceProcessor.ProcessClientRequest(path, buf)
+	}
+	ir := &IdempotentRequest{}
+	err := protobuf.DecodeWithConstructors(buf, ir, network.DefaultConstructors(s.Suite()))
+	if err != nil {
+		return nil, err
+	}
+	if ir.Key == "" {
+		return s.ServiceProcessor.ProcessClientRequest(ir.Path, ir.Request)
+	}
+	digest := sha256.Sum256(append([]byte(ir.Path+"\x00"), ir.Request...))
+
+	id := &s.idempotency
+	id.Lock()
+	id.prune(s.now())
+	if e, ok := id.entries[ir.Key]; ok {
+		id.Unlock()
+		if e.digest != digest {
+			return nil, errors.New("idempotency key used for another request")
+		}
+		log.Lvl2(s.ServerIdentity(), "replying to repeated", ir.Path)
+		<-e.done
+		return e.reply, e.err
+	}
+	if id.entries == nil {
+		id.entries = make(map[string]*idempotentEntry)
+	}
+	e := &idempotentEntry{
+		key:    ir.Key,
+		digest: digest,
+		added:  s.now(),
+		done:   make(chan struct{}),
+	}
+	id.entries[ir.Key] = e
+	id.order = append(id.order, e)
+	id.Unlock()
+
+	e.reply, e.err = s.ServiceProcessor.ProcessClientRequest(ir.Path, ir.Request)
+	if e.err != nil {
+		// A failed request is handled again when it is resent, only
+		// the requests waiting for it get the same error.
+		id.Lock()
+		if id.entries[ir.Key] == e {
+			delete(id.entries, ir.Key)
+		}
+		id.Unlock()
+	}
+	close(e.done)
+	return e.reply, e.err
+}
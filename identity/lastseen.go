@@ -0,0 +1,69 @@
+package identity
+
+import (
+	"errors"
+	"time"
+)
+
+// The last-seen times are operational data of every node and not part of
+// the skipchain. Each node records them from the votes and heartbeats it
+// receives through the propagation, and from the votes of the blocks it
+// stores, so they are computed the same way on all nodes, but with the
+// clock of the node. They are saved with the identity.
+
+// LastSeen asks for the last time every device of the identity voted or
+// sent a heartbeat.
+type LastSeen struct {
+	ID ID
+	// Auth is needed if the identity has readers.
+	Auth *ReadAuth
+}
+
+// LastSeenReply maps the devices to the time in unix-nanoseconds they were
+// last seen by the node. Devices never seen are missing.
+type LastSeenReply struct {
+	Devices map[string]int64
+}
+
+// LastSeen returns when the devices of the identity were last seen.
+func (s *Service) LastSeen(req *LastSeen) (*LastSeenReply, error) {
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	defer sid.Unlock()
+	if err := s.checkRead(req.ID, sid.Latest, req.Auth); err != nil {
+		return nil, err
+	}
+	reply := &LastSeenReply{Devices: make(map[string]int64)}
+	for name, t := range sid.LastSeen {
+		reply.Devices[name] = t
+	}
+	return reply, nil
+}
+
+// markSeen records that the device of latest has been seen at now. Older
+// times don't replace newer ones. It must be called with the lock of sid
+// held.
+func (sid *IDBlock) markSeen(name string, now time.Time) {
+	if sid.Latest.Device[name] == nil {
+		return
+	}
+	if sid.LastSeen == nil {
+		sid.LastSeen = make(map[string]int64)
+	}
+	if t := now.UnixNano(); t > sid.LastSeen[name] {
+		sid.LastSeen[name] = t
+	}
+}
+
+// pruneSeen forgets the devices that are not part of the latest data
+// anymore. It must be called with the lock of sid held.
+func (sid *IDBlock) pruneSeen() {
+	for name := range sid.LastSeen {
+		if sid.Latest.Device[name] == nil {
+			delete(sid.LastSeen, name)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/dedis/kyber"
+)
+
+// From HashMerkle on, the storage is hashed as a Merkle tree over the keys
+// in alphabetical order. Every leaf hashes a key and its value, and a node
+// without a sibling is moved up unchanged. The hash of the data only
+// includes the root, so a value can be proven by the path from its leaf to
+// the root and the data without storage. A missing key is proven by its
+// neighbours in the sorted keys, which have to be next to each other.
+
+// merkleLeaf returns the hash of the leaf for key and value.
+func merkleLeaf(suite kyber.HashFactory, key, value string) ([]byte, error) {
+	h := suite.Hash()
+	h.Write([]byte{0})
+	if err := writeString(h, key); err != nil {
+		return nil, err
+	}
+	if err := writeString(h, value); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// merkleNode returns the hash of the node with the children left and right.
+func merkleNode(suite kyber.HashFactory, left, right []byte) []byte {
+	h := suite.Hash()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleRoot returns the root of a storage with n keys, where top is the
+// top node of the tree, nil if there are no keys. The number of keys is
+// hashed, so that the positions of the keys in a proof can't be changed.
+func merkleRoot(suite kyber.HashFactory, n int, top []byte) []byte {
+	h := suite.Hash()
+	h.Write([]byte{2})
+	binary.Write(h, binary.LittleEndian, int64(n))
+	h.Write(top)
+	return h.Sum(nil)
+}
+
+// storageTree returns the levels of the Merkle tree of the storage, from
+// the leaves to the root, and the keys of the leaves.
+func (d *Data) storageTree(suite kyber.HashFactory) ([][][]byte, []string, error) {
+	keys := d.storageKeys()
+	level := make([][]byte, len(keys))
+	for i, k := range keys {
+		leaf, err := merkleLeaf(suite, k, d.Storage[k])
+		if err != nil {
+			return nil, nil, err
+		}
+		level[i] = leaf
+	}
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleNode(suite, level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels, keys, nil
+}
+
+// StorageRoot returns the root of the Merkle tree of the storage.
+func (d *Data) StorageRoot(suite kyber.HashFactory) ([]byte, error) {
+	levels, keys, err := d.storageTree(suite)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return merkleRoot(suite, 0, nil), nil
+	}
+	return merkleRoot(suite, len(keys), levels[len(levels)-1][0]), nil
+}
+
+// ValueProof proves the value of a key, or that the key is missing, for
+// data hashed with HashMerkle or later.
+type ValueProof struct {
+	Key string
+	// Entries holds the key if it is present. Else it holds the keys just
+	// before and after it, or only one of them at the ends.
+	Entries []*ProofEntry
+	// Leaves is the number of keys of the storage.
+	Leaves int
+	// Data is the data without storage and votes.
+	Data *Data
+}
+
+// ProofEntry is a key and its value with the path from its leaf to the
+// root of the storage.
+type ProofEntry struct {
+	Key   string
+	Value string
+	// Index is the position of the key in the sorted keys.
+	Index int
+	// Siblings are the hashes next to the path, from the leaf up.
+	Siblings [][]byte
+}
+
+// ProveValue returns the proof for the value of key in the data.
+func (d *Data) ProveValue(suite kyber.HashFactory, key string) (*ValueProof, error) {
+	if d.HashVersion < HashMerkle {
+		return nil, errors.New("data is not hashed with a Merkle tree")
+	}
+	levels, keys, err := d.storageTree(suite)
+	if err != nil {
+		return nil, err
+	}
+	stripped := d.Copy()
+	if stripped == nil {
+		return nil, errors.New("couldn't copy data")
+	}
+	stripped.Storage = map[string]string{}
+	stripped.Votes = nil
+	stripped.Heartbeats = nil
+	p := &ValueProof{Key: key, Leaves: len(keys), Data: stripped}
+
+	pos := sort.SearchStrings(keys, key)
+	var indexes []int
+	if pos < len(keys) && keys[pos] == key {
+		indexes = []int{pos}
+	} else {
+		if pos > 0 {
+			indexes = append(indexes, pos-1)
+		}
+		if pos < len(keys) {
+			indexes = append(indexes, pos)
+		}
+	}
+	for _, i := range indexes {
+		e := &ProofEntry{Key: keys[i], Value: d.Storage[keys[i]], Index: i}
+		for l, idx := 0, i; l < len(levels)-1; l, idx = l+1, idx/2 {
+			sibling := idx ^ 1
+			if sibling < len(levels[l]) {
+				e.Siblings = append(e.Siblings, levels[l][sibling])
+			}
+		}
+		p.Entries = append(p.Entries, e)
+	}
+	return p, nil
+}
+
+// top returns the top node of the tree of a storage with n keys, computed
+// from the entry.
+func (e *ProofEntry) top(suite kyber.HashFactory, n int) ([]byte, error) {
+	if e.Index < 0 || e.Index >= n {
+		return nil, errors.New("index out of range")
+	}
+	h, err := merkleLeaf(suite, e.Key, e.Value)
+	if err != nil {
+		return nil, err
+	}
+	used := 0
+	for i := e.Index; n > 1; i, n = i/2, (n+1)/2 {
+		if i%2 == 1 || i+1 < n {
+			if used >= len(e.Siblings) {
+				return nil, errors.New("missing sibling")
+			}
+			if i%2 == 1 {
+				h = merkleNode(suite, e.Siblings[used], h)
+			} else {
+				h = merkleNode(suite, h, e.Siblings[used])
+			}
+			used++
+		}
+	}
+	if used != len(e.Siblings) {
+		return nil, errors.New("too many siblings")
+	}
+	return h, nil
+}
+
+// Verify checks the proof against the hash of the data, as signed by the
+// devices. It returns the value of the key and whether it is present.
+func (p *ValueProof) Verify(suite kyber.HashFactory, dataHash []byte) (string, bool, error) {
+	if p.Data == nil || p.Data.HashVersion < HashMerkle {
+		return "", false, errors.New("data is not hashed with a Merkle tree")
+	}
+	if len(p.Data.Storage) > 0 {
+		return "", false, errors.New("data of the proof has a storage")
+	}
+	root, err := p.root(suite)
+	if err != nil {
+		return "", false, err
+	}
+	h, err := p.Data.hash(suite, root)
+	if err != nil {
+		return "", false, err
+	}
+	if !bytes.Equal(h, dataHash) {
+		return "", false, errors.New("proof doesn't match the hash of the data")
+	}
+	if len(p.Entries) == 1 && p.Entries[0].Key == p.Key {
+		return p.Entries[0].Value, true, nil
+	}
+	return "", false, nil
+}
+
+// root returns the root of the storage the entries lead to, after checking
+// that they show the key or the place where it is missing.
+func (p *ValueProof) root(suite kyber.HashFactory) ([]byte, error) {
+	if p.Leaves < 0 {
+		return nil, errors.New("negative number of keys")
+	}
+	if p.Leaves == 0 {
+		if len(p.Entries) > 0 {
+			return nil, errors.New("entries for an empty storage")
+		}
+		return merkleRoot(suite, 0, nil), nil
+	}
+	var top []byte
+	for _, e := range p.Entries {
+		if e == nil {
+			return nil, errors.New("missing entry")
+		}
+		t, err := e.top(suite, p.Leaves)
+		if err != nil {
+			return nil, err
+		}
+		if top != nil && !bytes.Equal(t, top) {
+			return nil, errors.New("entries lead to different roots")
+		}
+		top = t
+	}
+	root := merkleRoot(suite, p.Leaves, top)
+	switch len(p.Entries) {
+	case 1:
+		e := p.Entries[0]
+		if e.Key == p.Key ||
+			(e.Key < p.Key && e.Index == p.Leaves-1) ||
+			(e.Key > p.Key && e.Index == 0) {
+			return root, nil
+		}
+	case 2:
+		before, after := p.Entries[0], p.Entries[1]
+		if before.Key < p.Key && p.Key < after.Key && after.Index == before.Index+1 {
+			return root, nil
+		}
+	}
+	return nil, errors.New("entries don't show the key")
+}
@@ -0,0 +1,207 @@
+package identity
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/dedis/kyber"
+)
+
+// maxPendingVotes is the maximum number of proposals returned by
+// PendingVotes.
+const maxPendingVotes = 100
+
+// PendingVotes asks for the open proposals of all identities on the node
+// where the device with the public key Device can vote and didn't vote yet.
+// Identities with readers are not searched.
+type PendingVotes struct {
+	Device kyber.Point
+	// Max is the maximum number of proposals returned. If it is 0 or
+	// bigger than maxPendingVotes, maxPendingVotes is used.
+	Max int
+}
+
+// PendingVotesReply holds the proposals, sorted by the ID of their
+// identity.
+type PendingVotesReply struct {
+	Proposals []*PendingProposal
+	// More is true if there are more proposals than returned.
+	More bool
+}
+
+// PendingProposal describes an open proposal of an identity.
+type PendingProposal struct {
+	ID ID
+	// Device is the name of the device in the identity.
+	Device string
+	// Hash of the proposal, which the vote has to sign.
+	Hash       []byte
+	ProposedBy string
+	ProposedAt int64
+	// Expires is the time in unix-nanoseconds when the proposal is
+	// removed, 0 if never.
+	Expires int64
+	// Votes is the weight of the votes so far and Threshold the weight
+	// needed. Without weights, every device has a weight of 1.
+	Votes     int
+	Threshold int
+}
+
+// PendingVotes returns the proposals the device can still vote on. Every
+// identity is locked on its own, so that the scan doesn't block the other
+// requests.
+func (s *Service) PendingVotes(req *PendingVotes) (*PendingVotesReply, error) {
+	if req.Device == nil {
+		return nil, errors.New("no device given")
+	}
+	max := req.Max
+	if max <= 0 || max > maxPendingVotes {
+		max = maxPendingVotes
+	}
+	strict := s.isStrictThreshold()
+	dt := s.dynamicThreshold()
+	s.storageMutex.Lock()
+	var keys []string
+	ids := make(map[string]*IDBlock)
+	for id, sid := range s.Storage.Identities {
+		keys = append(keys, id)
+		ids[id] = sid
+	}
+	s.storageMutex.Unlock()
+	sort.Strings(keys)
+
+	reply := &PendingVotesReply{}
+	now := s.now()
+	for _, id := range keys {
+		p, err := s.pendingProposal(ID(id), ids[id], req.Device, now, strict, dt)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			continue
+		}
+		if len(reply.Proposals) == max {
+			reply.More = true
+			break
+		}
+		reply.Proposals = append(reply.Proposals, p)
+	}
+	return reply, nil
+}
+
+// pendingProposal returns the open proposal of the identity if the device
+// can still vote on it, else nil.
+func (s *Service) pendingProposal(id ID, sid *IDBlock, device kyber.Point, now time.Time,
+	strict bool, dt *DynamicThreshold) (*PendingProposal, error) {
+	sid.Lock()
+	defer sid.Unlock()
+	if sid.Proposed == nil || sid.Suspended || sid.proposalExpired(now) ||
+		len(sid.Latest.Readers) > 0 {
+		return nil, nil
+	}
+	name := ""
+	for n, d := range sid.Latest.Device {
+		if d != nil && pointsEqual(d.Point, device) {
+			name = n
+			break
+		}
+	}
+	if name == "" || sid.Proposed.Votes[name] != nil {
+		return nil, nil
+	}
+	hash, err := sid.Proposed.Hash(s.Suite().(kyber.HashFactory))
+	if err != nil {
+		return nil, err
+	}
+	return &PendingProposal{
+		ID:         id,
+		Device:     name,
+		Hash:       hash,
+		ProposedBy: sid.ProposedBy,
+		ProposedAt: sid.ProposedAt,
+		Expires:    sid.ProposalExpires,
+		Votes:      approvals(sid.Latest, sid.Proposed.Votes),
+		Threshold:  s.votesNeeded(id, sid.Latest, sid.Proposed, strict, dt),
+	}, nil
+}
+
+// ErrorNoProposal is returned by ProposeStatus if the identity has no open
+// proposal.
+var ErrorNoProposal = errors.New("no open proposal")
+
+// ProposeStatus asks for the votes on the open proposal of an identity.
+type ProposeStatus struct {
+	ID ID
+	// Auth is needed if the identity has readers.
+	Auth *ReadAuth
+}
+
+// ProposeStatusReply describes the votes on the open proposal.
+type ProposeStatusReply struct {
+	Propose *Data
+	// Voted are the names of the devices that voted, sorted.
+	Voted []string
+	// Valid is the weight of the votes with a valid signature.
+	Valid int
+	// Threshold of the latest data and Required the weight of the votes
+	// needed, which differs from Threshold for a strict, dynamic or
+	// percentage threshold.
+	Threshold int
+	Required  int
+	// OneMore is true if the vote of one more device commits the
+	// proposal.
+	OneMore bool
+	// PropagateTimeout in nanoseconds is the timeout of the propagations
+	// of the identity.
+	PropagateTimeout int64
+	// Remaining is the time in nanoseconds until the proposal expires, 0
+	// if it doesn't expire.
+	Remaining int64
+}
+
+// ProposeStatus returns who voted on the open proposal and how many votes
+// are missing.
+func (s *Service) ProposeStatus(req *ProposeStatus) (*ProposeStatusReply, error) {
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	strict := s.isStrictThreshold()
+	dt := s.dynamicThreshold()
+	sid.Lock()
+	defer sid.Unlock()
+	reader, err := s.authorizeRead(req.ID, sid.Latest, req.Auth)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	if sid.Proposed == nil || sid.proposalExpired(now) {
+		return nil, ErrorNoProposal
+	}
+	valid, _ := s.validVotes(sid.Proposed, sid.Latest.Device, sid.Proposed.Votes)
+	reply := &ProposeStatusReply{
+		Propose:          sid.Proposed.readableBy(reader, sid.Latest),
+		Valid:            sid.Latest.weightOf(valid),
+		Threshold:        sid.Latest.Threshold,
+		Required:         s.votesNeeded(req.ID, sid.Latest, sid.Proposed, strict, dt),
+		PropagateTimeout: int64(sid.propagateTimeout()),
+	}
+	for name, sig := range sid.Proposed.Votes {
+		if len(sig) > 0 {
+			reply.Voted = append(reply.Voted, name)
+		}
+	}
+	sort.Strings(reply.Voted)
+	if sid.ProposalExpires > 0 {
+		reply.Remaining = sid.ProposalExpires - now.UnixNano()
+	}
+	heaviest := 0
+	for name := range sid.Latest.Device {
+		if w := sid.Latest.weight(name); len(sid.Proposed.Votes[name]) == 0 && w > heaviest {
+			heaviest = w
+		}
+	}
+	reply.OneMore = reply.Valid+heaviest >= reply.Required
+	return reply, nil
+}
@@ -0,0 +1,99 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dedis/cothority/messaging"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+)
+
+// propagationKind tells which of the propagation-functions of the service
+// to use.
+type propagationKind int
+
+const (
+	propagateKindIdentity propagationKind = iota
+	propagateKindData
+	propagateKindSkipBlock
+)
+
+// PropagationTopologyEnv is the environment variable that chooses how the
+// service propagates its messages when it is created: "flat" sends them
+// from the leader to all nodes directly, a number n uses a tree where every
+// node has at most n children. Without it, messaging.DefaultTopology is
+// used.
+const PropagationTopologyEnv = "COTHORITY_IDENTITY_PROPAGATION"
+
+// topologyFromEnv returns the topology set in PropagationTopologyEnv.
+func topologyFromEnv() (messaging.Topology, error) {
+	switch v := os.Getenv(PropagationTopologyEnv); v {
+	case "":
+		return messaging.DefaultTopology, nil
+	case "flat":
+		return messaging.FlatTopology, nil
+	default:
+		branches, err := strconv.Atoi(v)
+		if err != nil || branches < 1 {
+			return nil, fmt.Errorf("invalid %s: %q", PropagationTopologyEnv, v)
+		}
+		return messaging.TreeTopology(branches), nil
+	}
+}
+
+// propagationInterceptor can replace the propagation of messages. It is
+// used in tests to control the order in which the nodes receive the
+// messages.
+type propagationInterceptor func(kind propagationKind, roster *onet.Roster, msg network.Message) (int, error)
+
+// propagate sends msg to all nodes in the roster, using the propagation
+// function of the given kind. It returns the number of nodes that stored
+// the message.
+func (s *Service) propagate(kind propagationKind, roster *onet.Roster, msg network.Message, timeout time.Duration) (int, error) {
+	if s.encryptsPropagation() && s.canEncrypt(roster) {
+		ep, err := sealPropagation(roster, msg)
+		if err != nil {
+			return 0, err
+		}
+		msg = ep
+	}
+	if s.interceptor != nil {
+		return s.interceptor(kind, roster, msg)
+	}
+	pf := s.propagationFunc(kind)
+	if pf == nil {
+		return 0, errors.New("unknown propagation")
+	}
+	return pf(roster, msg, timeout)
+}
+
+// propagationFunc returns the propagation function of the given kind.
+func (s *Service) propagationFunc(kind propagationKind) messaging.PropagationFunc {
+	switch kind {
+	case propagateKindIdentity:
+		return s.propagateIdentity
+	case propagateKindData:
+		return s.propagateData
+	case propagateKindSkipBlock:
+		return s.propagateSkipBlock
+	}
+	return nil
+}
+
+// propagationHandler returns the handler that stores messages of the
+// given kind, decrypting them if needed.
+func (s *Service) propagationHandler(kind propagationKind) messaging.PropagationStore {
+	switch kind {
+	case propagateKindIdentity:
+		return s.decrypting(s.propagateIdentityHandler)
+	case propagateKindData:
+		return s.decrypting(s.propagateDataHandler)
+	case propagateKindSkipBlock:
+		return s.decrypting(s.propagateSkipBlockHandler)
+	}
+	return nil
+}
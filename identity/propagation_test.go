@@ -0,0 +1,358 @@
+package identity
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/stretchr/testify/require"
+)
+
+// delivery is one propagated message waiting to be delivered to a node.
+type delivery struct {
+	kind propagationKind
+	to   int
+	buf  []byte
+}
+
+// faults tells how the propagation corrupts the messages. The probabilities
+// apply to every message sent to a node other than the sender.
+type faults struct {
+	rand *rand.Rand
+	// Drop only applies to proposals and votes, as a node missing a block
+	// stays behind until it asks for an update.
+	Drop      float64
+	Duplicate float64
+	// Delay holds a message back for a later round of settle.
+	Delay float64
+	// Reorder delivers the messages of every round in a random order.
+	Reorder bool
+}
+
+// orderedPropagation replaces the propagation of the services, so that the
+// test decides in which order the nodes receive the messages. The node
+// starting a propagation stores its own message directly.
+type orderedPropagation struct {
+	sync.Mutex
+	services []*Service
+	pending  []delivery
+	faults   *faults
+}
+
+func newOrderedPropagation(services []onet.Service) *orderedPropagation {
+	op := &orderedPropagation{}
+	for i, srvc := range services {
+		s := srvc.(*Service)
+		op.services = append(op.services, s)
+		from := i
+		s.interceptor = func(kind propagationKind, roster *onet.Roster, msg network.Message) (int, error) {
+			return op.intercept(from, kind, roster, msg)
+		}
+	}
+	return op
+}
+
+// intercept stores the message for all nodes of the roster except the
+// sender, which gets it directly.
+func (op *orderedPropagation) intercept(from int, kind propagationKind, roster *onet.Roster, msg network.Message) (int, error) {
+	// Marshal the message so that every node gets its own copy, as
+	// it would with the real propagation.
+	buf, err := network.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	_, local, err := network.Unmarshal(buf, tSuite)
+	if err != nil {
+		return 0, err
+	}
+	op.services[from].propagationHandler(kind)(local)
+	op.Lock()
+	defer op.Unlock()
+	for i, s := range op.services {
+		if i == from {
+			continue
+		}
+		if idx, _ := roster.Search(s.ServerIdentity().ID); idx < 0 {
+			continue
+		}
+		copies := 1
+		if f := op.faults; f != nil {
+			if kind == propagateKindData && f.rand.Float64() < f.Drop {
+				copies = 0
+			} else if f.rand.Float64() < f.Duplicate {
+				copies = 2
+			}
+		}
+		for c := 0; c < copies; c++ {
+			op.pending = append(op.pending, delivery{kind, i, buf})
+		}
+	}
+	return len(roster.List), nil
+}
+
+// settle delivers the pending messages in rounds, following the faults,
+// until no message is left.
+func (op *orderedPropagation) settle(t *testing.T) {
+	for {
+		op.Lock()
+		round := op.pending
+		op.pending = nil
+		f := op.faults
+		op.Unlock()
+		if len(round) == 0 {
+			return
+		}
+		if f != nil && f.Reorder {
+			f.rand.Shuffle(len(round), func(i, j int) {
+				round[i], round[j] = round[j], round[i]
+			})
+		}
+		delivered := 0
+		for i, d := range round {
+			// The last message of a round is never delayed, so that
+			// every round makes progress.
+			if f != nil && i < len(round)-1 && f.rand.Float64() < f.Delay {
+				op.Lock()
+				op.pending = append(op.pending, d)
+				op.Unlock()
+				continue
+			}
+			_, msg, err := network.Unmarshal(d.buf, tSuite)
+			require.Nil(t, err)
+			op.services[d.to].propagationHandler(d.kind)(msg)
+			delivered++
+		}
+		require.NotEqual(t, 0, delivered)
+	}
+}
+
+// requireConverged checks that all nodes hold the same latest block,
+// proposal and votes of the identity.
+func requireConverged(t *testing.T, services []onet.Service, id ID) {
+	var first *IdentityState
+	var firstVotes map[string][]byte
+	for i, srvc := range services {
+		s := srvc.(*Service)
+		state, err := s.identityState(s.getIdentityStorage(id))
+		require.Nil(t, err, "node %d", i)
+		votes := make(map[string][]byte)
+		sid := s.getIdentityStorage(id)
+		sid.Lock()
+		if sid.Proposed != nil {
+			for name, sig := range sid.Proposed.Votes {
+				votes[name] = sig
+			}
+		}
+		sid.Unlock()
+		if first == nil {
+			first, firstVotes = state, votes
+			continue
+		}
+		require.Equal(t, []string(nil), first.diff(state), "node %d", i)
+		require.Equal(t, firstVotes, votes, "node %d", i)
+	}
+}
+
+// deliver sends all pending messages of a node. The order holds the
+// indexes of the pending messages of this node in the order they have to
+// be delivered. If order is nil, they are delivered as they arrived.
+func (op *orderedPropagation) deliver(t *testing.T, node int, order []int) {
+	op.Lock()
+	var mine, rest []delivery
+	for _, d := range op.pending {
+		if d.to == node {
+			mine = append(mine, d)
+		} else {
+			rest = append(rest, d)
+		}
+	}
+	op.pending = rest
+	op.Unlock()
+	if order == nil {
+		for i := range mine {
+			order = append(order, i)
+		}
+	}
+	require.Equal(t, len(mine), len(order))
+	for _, i := range order {
+		_, msg, err := network.Unmarshal(mine[i].buf, tSuite)
+		require.Nil(t, err)
+		op.services[node].propagationHandler(mine[i].kind)(msg)
+	}
+}
+
+func TestPropagation_Ordering(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 3)
+	defer l.CloseAll()
+	services := td.services
+	c1, c2, c3 := td.Devices[0], td.Devices[1], td.Devices[2]
+	require.Equal(t, 3, len(c1.Data.Device))
+
+	op := newOrderedPropagation(services)
+	data := c1.Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, c1.ProposeSend(data))
+	op.deliver(t, 1, nil)
+	op.deliver(t, 2, nil)
+
+	// Node 1 and 2 get the votes in a different order.
+	require.Nil(t, proposeUpVote(c1))
+	require.Nil(t, proposeUpVote(c2))
+	op.deliver(t, 1, []int{0, 1})
+	op.deliver(t, 2, []int{1, 0})
+	sid1 := services[1].(*Service).getIdentityStorage(c1.ID)
+	sid2 := services[2].(*Service).getIdentityStorage(c1.ID)
+	require.Equal(t, 2, len(sid1.Proposed.Votes))
+	require.Equal(t, sid1.Proposed.Votes, sid2.Proposed.Votes)
+
+	// The last vote commits on node 0, then node 1 gets the vote before
+	// the new block and node 2 the new block before the vote.
+	require.Nil(t, proposeUpVote(c3))
+	op.deliver(t, 1, []int{0, 1})
+	op.deliver(t, 2, []int{1, 0})
+	latest := services[0].(*Service).getIdentityStorage(c1.ID).LatestSkipblock
+	for i, s := range services {
+		sid := s.(*Service).getIdentityStorage(c1.ID)
+		log.Lvl2("Checking node", i)
+		require.Nil(t, sid.Proposed)
+		require.True(t, latest.Hash.Equal(sid.LatestSkipblock.Hash))
+		require.Equal(t, "value", sid.Latest.Storage["key"])
+	}
+}
+
+func TestPropagation_Faults(t *testing.T) {
+	for seed := int64(0); seed < 4; seed++ {
+		log.Lvl1("Testing with seed", seed)
+		l, td := setupTestDevices(t, 4, 3, 2)
+		op := newOrderedPropagation(td.services)
+		op.faults = &faults{
+			rand:      rand.New(rand.NewSource(seed)),
+			Duplicate: 0.3,
+			Delay:     0.3,
+			Reorder:   true,
+		}
+		for round := 0; round < 3; round++ {
+			data := td.Devices[0].Data.Copy()
+			data.Storage["key"] = fmt.Sprintf("%d-%d", seed, round)
+			require.Nil(t, td.propose(data))
+			op.settle(t)
+			requireConverged(t, td.services, td.ID())
+			_, err := td.vote(0)
+			require.Nil(t, err)
+			op.settle(t)
+			requireConverged(t, td.services, td.ID())
+			sb, err := td.vote(1)
+			require.Nil(t, err)
+			require.NotNil(t, sb)
+			op.settle(t)
+			requireConverged(t, td.services, td.ID())
+		}
+
+		// Dropped votes leave the nodes with different votes, but they
+		// converge once the proposal is committed.
+		op.faults.Drop = 0.5
+		data := td.Devices[0].Data.Copy()
+		data.Storage["key"] = "dropped"
+		require.Nil(t, td.propose(data))
+		op.settle(t)
+		_, err := td.vote(0)
+		require.Nil(t, err)
+		sb, err := td.vote(1)
+		require.Nil(t, err)
+		require.NotNil(t, sb)
+		op.settle(t)
+		requireConverged(t, td.services, td.ID())
+		l.CloseAll()
+	}
+}
+
+func TestPropagation_Encrypted(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	for _, srvc := range td.services {
+		srvc.(*Service).SetEncryptPropagation(true)
+	}
+
+	// Record what an eavesdropper on the propagation would see.
+	s := td.services[0].(*Service)
+	var sent []network.Message
+	var sentMutex sync.Mutex
+	s.interceptor = func(kind propagationKind, r *onet.Roster, msg network.Message) (int, error) {
+		sentMutex.Lock()
+		sent = append(sent, msg)
+		sentMutex.Unlock()
+		return s.propagationFunc(kind)(r, msg, propagateTimeout)
+	}
+	data := td.Devices[0].Data.Copy()
+	data.Storage["secret"] = "plaintext-value"
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0, 1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	for _, srvc := range td.services {
+		sid := srvc.(*Service).getIdentityStorage(td.ID())
+		require.Equal(t, "plaintext-value", sid.Latest.Storage["secret"])
+	}
+
+	sentMutex.Lock()
+	defer sentMutex.Unlock()
+	require.NotEqual(t, 0, len(sent))
+	for _, msg := range sent {
+		require.IsType(t, &EncryptedPropagation{}, msg)
+		buf, err := network.Marshal(msg)
+		require.Nil(t, err)
+		require.False(t, bytes.Contains(buf, []byte("plaintext-value")))
+	}
+
+	// Only the nodes of the roster can decrypt.
+	roster := onet.NewRoster(td.Devices[0].Roster().List[:2])
+	ep, err := sealPropagation(roster, &PropagationSupport{})
+	require.Nil(t, err)
+	n1 := td.services[1].(*Service)
+	msg, err := openPropagation(ep, n1.ServerIdentity().Public, n1.nodePrivate(), n1.Suite())
+	require.Nil(t, err)
+	require.IsType(t, &PropagationSupport{}, msg)
+	n2 := td.services[2].(*Service)
+	_, err = openPropagation(ep, n2.ServerIdentity().Public, n2.nodePrivate(), n2.Suite())
+	require.NotNil(t, err)
+	ep.Keys[1].Node = n2.ServerIdentity().Public
+	_, err = openPropagation(ep, n2.ServerIdentity().Public, n2.nodePrivate(), n2.Suite())
+	require.NotNil(t, err)
+
+	// A node that doesn't decrypt gets plain messages.
+	s.peerSupport.Lock()
+	s.peerSupport.checked[n2.ServerIdentity().ID] = peerCheck{ok: false, at: s.now()}
+	s.peerSupport.Unlock()
+	sent = nil
+	sentMutex.Unlock()
+	data = td.Devices[0].Data.Copy()
+	data.Storage["secret"] = "other-value"
+	require.Nil(t, td.propose(data))
+	sentMutex.Lock()
+	require.NotEqual(t, 0, len(sent))
+	for _, msg := range sent {
+		_, encrypted := msg.(*EncryptedPropagation)
+		require.False(t, encrypted)
+	}
+}
+
+func TestTopologyFromEnv(t *testing.T) {
+	defer os.Unsetenv(PropagationTopologyEnv)
+	for _, v := range []string{"", "flat", "3"} {
+		os.Setenv(PropagationTopologyEnv, v)
+		topology, err := topologyFromEnv()
+		require.Nil(t, err)
+		require.NotNil(t, topology)
+	}
+	for _, v := range []string{"0", "star"} {
+		os.Setenv(PropagationTopologyEnv, v)
+		_, err := topologyFromEnv()
+		require.NotNil(t, err)
+	}
+}
@@ -0,0 +1,60 @@
+package identity
+
+import (
+	"errors"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+)
+
+// proposerTag prefixes the message signed by the author of a proposal, so
+// that the signature can't be used as a vote on the proposal.
+const proposerTag = "identity-proposer"
+
+// ProposerMessage returns the bytes a device signs to show that it authored
+// the proposal with the given hash for the identity id.
+func ProposerMessage(id ID, hash []byte) []byte {
+	msg := []byte(proposerTag)
+	msg = append(msg, id...)
+	return append(msg, hash...)
+}
+
+// verifyProposer returns nil if the proposal is anonymous or signed by the
+// device named in Proposer, which must be part of latest.
+func (p *ProposeSend) verifyProposer(s *Service, latest *Data) error {
+	if p.Proposer == "" {
+		return nil
+	}
+	if p.Propose == nil || latest == nil {
+		return errors.New("no data to verify the proposer")
+	}
+	dev := latest.Device[p.Proposer]
+	if dev == nil {
+		return errors.New("unknown proposer " + p.Proposer)
+	}
+	hash, err := p.Propose.Hash(s.Suite().(kyber.HashFactory))
+	if err != nil {
+		return err
+	}
+	return s.verifyDevice(dev, ProposerMessage(p.ID, hash), p.Signature)
+}
+
+// signProposal returns the proposal of d signed by this device, or an
+// anonymous proposal if the device is not part of the current data.
+func (i *Identity) signProposal(d *Data, receipt bool) (*ProposeSend, error) {
+	p := &ProposeSend{ID: i.ID, Propose: d, Receipt: receipt}
+	if i.Data == nil || i.Data.Device[i.DeviceName] == nil {
+		return p, nil
+	}
+	hash, err := d.Hash(i.Client.Suite().(kyber.HashFactory))
+	if err != nil {
+		return nil, err
+	}
+	sig, err := schnorr.Sign(i.Client.Suite(), i.Private, ProposerMessage(i.ID, hash))
+	if err != nil {
+		return nil, err
+	}
+	p.Proposer = i.DeviceName
+	p.Signature = sig
+	return p, nil
+}
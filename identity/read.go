@@ -0,0 +1,86 @@
+package identity
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/util/random"
+)
+
+// readChallengeTimeout is how long a read-challenge can be used.
+const readChallengeTimeout = time.Minute
+
+// ErrorReadNotAuthorized is returned if the identity restricts reading and
+// the request is not signed by a reader.
+var ErrorReadNotAuthorized = errors.New("not authorized to read this identity")
+
+// ReadChallenge asks for a nonce to sign for a read-request.
+type ReadChallenge struct {
+	ID ID
+}
+
+// ReadChallengeReply holds the nonce to sign. It can be used only once.
+type ReadChallengeReply struct {
+	Nonce []byte
+}
+
+// ReadAuth proves that a read-request comes from a reader of the identity.
+type ReadAuth struct {
+	Nonce []byte
+	// Reader is the public key of one of the readers or devices.
+	Reader kyber.Point
+	// Signature on the nonce and the ID of the identity.
+	Signature []byte
+}
+
+// readMessage returns the bytes signed by the reader.
+func readMessage(id ID, nonce []byte) []byte {
+	return append(append([]byte{}, nonce...), id...)
+}
+
+// NewReadAuth signs the nonce of a ReadChallengeReply for the identity.
+func NewReadAuth(id ID, nonce []byte, priv kyber.Scalar) (*ReadAuth, error) {
+	sig, err := schnorr.Sign(cothority.Suite, priv, readMessage(id, nonce))
+	if err != nil {
+		return nil, err
+	}
+	return &ReadAuth{
+		Nonce:     nonce,
+		Reader:    cothority.Suite.Point().Mul(priv, nil),
+		Signature: sig,
+	}, nil
+}
+
+// ReadChallenge returns a new nonce for a read-request.
+func (s *Service) ReadChallenge(rc *ReadChallenge) (*ReadChallengeReply, error) {
+	if s.getIdentityStorage(rc.ID) == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	nonce := make([]byte, nonceSize)
+	random.Bytes(nonce, s.Suite().RandomStream())
+	now := s.now()
+	s.readMutex.Lock()
+	defer s.readMutex.Unlock()
+	if s.readNonces == nil {
+		s.readNonces = make(map[string]time.Time)
+	}
+	for n, expiry := range s.readNonces {
+		if now.After(expiry) {
+			delete(s.readNonces, n)
+		}
+	}
+	s.readNonces[string(nonce)] = now.Add(readChallengeTimeout)
+	return &ReadChallengeReply{Nonce: nonce}, nil
+}
+
+// checkRead returns nil if d can be read with the given authentication.
+// If d has no readers, everybody can read it. Else the nonce of auth is
+// used up. Requests returning values use authorizeRead instead, to know
+// the reader for the read-rules.
+func (s *Service) checkRead(id ID, d *Data, auth *ReadAuth) error {
+	_, err := s.authorizeRead(id, d, auth)
+	return err
+}
@@ -0,0 +1,83 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/cosi/crypto"
+	cosiservice "github.com/dedis/cothority/cosi/service"
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet"
+)
+
+// ProposeReceipt is returned for a ProposeSend with Receipt set. It holds a
+// collective signature of the roster of the identity, so that the proposer
+// can prove later that the proposal has been accepted.
+type ProposeReceipt struct {
+	ID ID
+	// Hash of the proposed data.
+	Hash []byte
+	// Timestamp in nanoseconds since the epoch when the proposal has been
+	// accepted.
+	Timestamp int64
+	// Signature is the collective signature of the roster on ID, Hash and
+	// Timestamp.
+	Signature []byte
+}
+
+// Verify returns nil if the receipt holds a valid signature of the roster
+// for the proposal d.
+func (r *ProposeReceipt) Verify(roster *onet.Roster, d *Data) error {
+	if roster == nil || d == nil {
+		return errors.New("need a roster and data to verify the receipt")
+	}
+	hash, err := d.Hash(cothority.Suite)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, r.Hash) {
+		return errors.New("receipt is for another proposal")
+	}
+	if len(r.Signature) < cothority.Suite.PointLen()+cothority.Suite.ScalarLen() {
+		return errors.New("receipt-signature is too short")
+	}
+	return crypto.VerifySignature(cothority.Suite, roster.Publics(), r.message(), r.Signature)
+}
+
+// message returns the bytes signed by the roster.
+func (r *ProposeReceipt) message() []byte {
+	var ts [8]byte
+	binary.LittleEndian.PutUint64(ts[:], uint64(r.Timestamp))
+	msg := append([]byte{}, r.ID...)
+	msg = append(msg, r.Hash...)
+	return append(msg, ts[:]...)
+}
+
+// signReceipt asks the roster to collectively sign a receipt for the
+// proposal d of the identity.
+func (s *Service) signReceipt(id ID, roster *onet.Roster, d *Data) (*ProposeReceipt, error) {
+	hash, err := d.Hash(s.Suite().(kyber.HashFactory))
+	if err != nil {
+		return nil, err
+	}
+	r := &ProposeReceipt{
+		ID:        id,
+		Hash:      hash,
+		Timestamp: s.now().UnixNano(),
+	}
+	cs, ok := s.Service(cosiservice.ServiceName).(*cosiservice.CoSi)
+	if !ok {
+		return nil, errors.New("didn't find the cosi-service")
+	}
+	reply, err := cs.SignatureRequest(&cosiservice.SignatureRequest{
+		Message: r.message(),
+		Roster:  roster,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.Signature = reply.(*cosiservice.SignatureResponse).Signature
+	return r, nil
+}
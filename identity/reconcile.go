@@ -0,0 +1,113 @@
+package identity
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// catchUp asks the skipchain for blocks newer than the latest block of the
+// identity and stores the newest one, like a propagated block. This heals
+// nodes that missed the propagation of a block. It returns true if a newer
+// block has been found. It must be called with the lock of sid held.
+func (s *Service) catchUp(id ID, sid *IDBlock) (bool, error) {
+	var reply *skipchain.GetUpdateChainReply
+	var err error
+	if sid.SkipchainRoster != nil {
+		// The skipchain might not be stored on this node.
+		reply, err = skipchain.NewClient().GetUpdateChain(sid.LatestSkipblock.Roster,
+			sid.LatestSkipblock.Hash)
+	} else {
+		reply, err = s.skipchain.GetUpdateChain(&skipchain.GetUpdateChain{LatestID: sid.LatestSkipblock.Hash})
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(reply.Update) <= 1 {
+		return false, nil
+	}
+	// TODO: check that update-chain has correct forward-links and fits into existing blocks
+	latest := reply.Update[len(reply.Update)-1]
+	_, dataInt, err := network.Unmarshal(latest.Data, s.Suite())
+	if err != nil {
+		return false, err
+	}
+	data, ok := dataInt.(*Data)
+	if !ok {
+		return false, errors.New("did get invalid block from skipchain")
+	}
+	log.Lvlf2("%s: catching up identity %x to block %d", s.ServerIdentity(),
+		[]byte(id), latest.Index)
+	sid.LatestSkipblock = latest
+	sid.Latest = data
+	sid.Proposed = nil
+	sid.ProposedBy = ""
+	s.closeVoteSubscriptions(id)
+	s.emit(&Event{
+		Type:      EventCommit,
+		ID:        id,
+		Data:      data,
+		Index:     sid.index(),
+		Threshold: data.Threshold,
+	})
+	return true, nil
+}
+
+// reconcile catches up all identities whose skipchain is stored on this
+// node, so that a node that crashed after a block has been stored, but
+// before the storage has been saved, restarts with the latest block. The
+// identities with a separate skipchain-roster are left to sweepLagging, so
+// that the start doesn't wait for other nodes. It returns how many
+// identities changed.
+func (s *Service) reconcile() int {
+	if s.isReadReplica() {
+		return 0
+	}
+	s.storageMutex.Lock()
+	ids := make(map[string]*IDBlock)
+	for id, sid := range s.Storage.Identities {
+		ids[id] = sid
+	}
+	s.storageMutex.Unlock()
+
+	changed := 0
+	for id, sid := range ids {
+		sid.Lock()
+		if sid.SkipchainRoster == nil {
+			ok, err := s.catchUp(ID(id), sid)
+			if err != nil {
+				log.Lvlf2("%s: couldn't reconcile identity %x: %s",
+					s.ServerIdentity(), []byte(id), err)
+			}
+			if ok {
+				changed++
+			}
+		}
+		sid.Unlock()
+	}
+	if changed > 0 {
+		s.storageMutex.Lock()
+		s.save()
+		s.storageMutex.Unlock()
+	}
+	return changed
+}
+
+// sweepLagging is a sweeper that catches up identities whose latest block
+// is behind the skipchain, for example because the propagation of a new
+// block failed after it has been stored. A read-replica doesn't hold the
+// skipchain and only relies on the propagations.
+func (s *Service) sweepLagging(id ID, sid *IDBlock, now time.Time) bool {
+	if s.isReadReplica() {
+		return false
+	}
+	changed, err := s.catchUp(id, sid)
+	if err != nil {
+		log.Lvlf2("%s: couldn't catch up identity %x: %s", s.ServerIdentity(),
+			[]byte(id), err)
+	}
+	return changed
+}
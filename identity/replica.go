@@ -0,0 +1,104 @@
+package identity
+
+import (
+	"errors"
+	"os"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// ErrorReadReplica is returned by all handlers that change an identity if
+// the node is a read-replica.
+var ErrorReadReplica = errors.New("this node is a read-replica")
+
+// ReadReplicaEnv is the environment variable that puts the node in
+// read-replica mode when set to "true" while the service is created.
+const ReadReplicaEnv = "COTHORITY_IDENTITY_READ_REPLICA"
+
+// SetReadReplica puts the node in read-replica mode. A read-replica
+// stores all identities propagated to it and answers read-requests, but
+// refuses to create identities, store proposals or votes. The mode is
+// stored, so it is restored when the service is created again.
+func (s *Service) SetReadReplica(replica bool) {
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	s.Storage.ReadReplica = replica
+	s.save()
+}
+
+// AddReplica adds a read-replica to this node. All identities created or
+// updated from this node will also be propagated to the replica.
+func (s *Service) AddReplica(si *network.ServerIdentity) {
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	for _, r := range s.Storage.Replicas {
+		if r.ID.Equal(si.ID) {
+			return
+		}
+	}
+	s.Storage.Replicas = append(s.Storage.Replicas, si)
+	s.save()
+}
+
+// readReplicaFromEnv switches to read-replica mode if ReadReplicaEnv is
+// set. Without the variable, the stored mode is kept.
+func (s *Service) readReplicaFromEnv() {
+	if os.Getenv(ReadReplicaEnv) != "true" {
+		return
+	}
+	log.Lvl2(s.ServerIdentity(), "starting as read-replica")
+	s.SetReadReplica(true)
+}
+
+// isReadReplica returns true if this node is a read-replica.
+func (s *Service) isReadReplica() bool {
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	return s.Storage.ReadReplica
+}
+
+// withReplicas returns a roster to propagate to, holding all nodes of r
+// and the read-replicas of this node.
+func (s *Service) withReplicas(r *onet.Roster) *onet.Roster {
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	if len(s.Storage.Replicas) == 0 {
+		return r
+	}
+	list := append([]*network.ServerIdentity{}, r.List...)
+	for _, si := range s.Storage.Replicas {
+		if i, _ := r.Search(si.ID); i < 0 {
+			list = append(list, si)
+		}
+	}
+	log.Lvl3("Propagating to", len(list)-len(r.List), "replicas")
+	return onet.NewRoster(list)
+}
+
+// verifyUpdate checks that the new block is forward-linked from the latest
+// block of sid and signed by its roster. A read-replica doesn't hold the
+// skipchain, so this is the only check before it serves the new data. It
+// must be called with the lock of sid held.
+func verifyUpdate(sid *IDBlock, usb *UpdateSkipBlock) error {
+	latest, prev := usb.Latest, usb.Previous
+	if latest == nil || prev == nil {
+		return errors.New("missing block")
+	}
+	if !latest.Hash.Equal(latest.CalculateHash()) {
+		return errors.New("wrong hash of new block")
+	}
+	if !prev.Hash.Equal(sid.LatestSkipblock.Hash) {
+		return errors.New("new block doesn't follow the latest block")
+	}
+	if len(latest.BackLinkIDs) == 0 || !latest.BackLinkIDs[0].Equal(prev.Hash) {
+		return errors.New("new block doesn't link back to the latest block")
+	}
+	fl := prev.GetForward(0)
+	if fl == nil || !fl.From.Equal(prev.Hash) || !fl.To.Equal(latest.Hash) {
+		return errors.New("no forward-link to the new block")
+	}
+	return fl.Verify(cothority.Suite, sid.LatestSkipblock.Roster.Publics())
+}
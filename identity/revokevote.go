@@ -0,0 +1,97 @@
+package identity
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/log"
+)
+
+// RevokeVote asks to remove the vote of a device from the current proposal,
+// as long as it has not been committed.
+type RevokeVote struct {
+	ID ID
+	// Hash of the proposal, so that the vote on a newer proposal is not
+	// removed.
+	Hash []byte
+	// Signer is the name of the device and Signature its signature on
+	// RevokeVoteMessage.
+	Signer    string
+	Signature []byte
+}
+
+// RevokeVoteReply is empty.
+type RevokeVoteReply struct{}
+
+// RevokeVoteMessage returns the message a device signs to revoke its vote on
+// the proposal with the given hash. Unlike the vote itself, it starts with a
+// tag, so that a vote can't be used to revoke it.
+func RevokeVoteMessage(id ID, hash []byte) []byte {
+	msg := append([]byte("identity-revoke-vote"), id...)
+	return append(msg, hash...)
+}
+
+// RevokeVote checks the request and propagates it to all nodes.
+func (s *Service) RevokeVote(req *RevokeVote) (*RevokeVoteReply, error) {
+	if s.isReadReplica() {
+		return nil, ErrorReadReplica
+	}
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	err := s.checkRevokeVote(sid, req)
+	roster := s.withReplicas(sid.votingRoster(sid.Latest))
+	sid.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.propagate(propagateKindData, roster, req, sid.propagateTimeout()); err != nil {
+		return nil, err
+	}
+	return &RevokeVoteReply{}, nil
+}
+
+// checkRevokeVote returns nil if the request is signed by the device and
+// the device voted on the current proposal of sid. It must be called with
+// the lock of sid held.
+func (s *Service) checkRevokeVote(sid *IDBlock, req *RevokeVote) error {
+	if sid.Proposed == nil {
+		return errors.New("no open proposal, it might have been committed")
+	}
+	hash, err := sid.Proposed.Hash(s.Suite().(kyber.HashFactory))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, req.Hash) {
+		return errors.New("not the current proposal")
+	}
+	dev := sid.Latest.Device[req.Signer]
+	if dev == nil {
+		return errors.New("unknown device " + req.Signer)
+	}
+	if err := s.verifyDevice(dev, RevokeVoteMessage(req.ID, req.Hash), req.Signature); err != nil {
+		return err
+	}
+	if len(sid.Proposed.Votes[req.Signer]) == 0 {
+		return errors.New("device didn't vote on the proposal")
+	}
+	return nil
+}
+
+// applyRevokeVote removes the vote if the request is valid. A delayed
+// commit is stopped, so that the delay starts again once the proposal has
+// enough votes. It must be called with the lock of sid held.
+func (s *Service) applyRevokeVote(id ID, sid *IDBlock, req *RevokeVote) {
+	if err := s.checkRevokeVote(sid, req); err != nil {
+		log.Error(s.ServerIdentity(), "refusing to revoke vote:", err)
+		return
+	}
+	log.Lvlf2("%s: %s revoked its vote on the proposal of %x", s.ServerIdentity(),
+		req.Signer, []byte(id))
+	delete(sid.Proposed.Votes, req.Signer)
+	sid.CommitAt = 0
+	s.stopCommitTimer(id)
+}
@@ -0,0 +1,162 @@
+package identity
+
+import (
+	"errors"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// ProposeRosterChange proposes to move the identity to a new roster. Once
+// the devices accepted the proposal, the new block is stored with the new
+// roster. The new nodes get the state of the identity before the block is
+// stored, and the old nodes get the new block, so that they can tell the
+// clients where the identity moved to.
+type ProposeRosterChange struct {
+	ID     ID
+	Roster *onet.Roster
+}
+
+// ProposeRosterChangeReply returns the proposal that has been stored.
+type ProposeRosterChangeReply struct {
+	Propose *Data
+}
+
+// HandoffIdentity gives the state of an identity to the nodes that are part
+// of its new roster but didn't hold it yet.
+type HandoffIdentity struct {
+	ID      ID
+	IDBlock *IDBlock
+	// Roster is the new roster of the identity.
+	Roster *onet.Roster
+}
+
+// ProposeRosterChange creates a proposal from the latest data with the new
+// roster and stores it like ProposeSend. Identities with a separate
+// skipchain-roster can't be moved, as their skipchain doesn't follow the
+// roster of the data.
+func (s *Service) ProposeRosterChange(prc *ProposeRosterChange) (*ProposeRosterChangeReply, error) {
+	if s.isReadReplica() {
+		return nil, ErrorReadReplica
+	}
+	if err := checkRoster(prc.Roster); err != nil {
+		return nil, err
+	}
+	sid := s.getIdentityStorage(prc.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	separate := sid.SkipchainRoster != nil
+	leader, _ := sid.LatestSkipblock.Roster.Search(prc.Roster.List[0].ID)
+	propose := sid.Latest.Copy()
+	sid.Unlock()
+	if separate {
+		return nil, errors.New("can't move an identity with a separate skipchain-roster")
+	}
+	// The skipchain only accepts a new block from the leader of its
+	// roster, which must also be part of the previous roster.
+	if leader < 0 {
+		return nil, errors.New("the first node of the new roster must be part of the current roster")
+	}
+	propose.Roster = prc.Roster
+	if _, err := s.ProposeSend(&ProposeSend{ID: prc.ID, Propose: propose}); err != nil {
+		return nil, err
+	}
+	return &ProposeRosterChangeReply{Propose: propose}, nil
+}
+
+// checkRoster returns an error if the roster is empty or holds a node twice.
+func checkRoster(r *onet.Roster) error {
+	if r == nil || len(r.List) == 0 {
+		return errors.New("empty roster")
+	}
+	seen := make(map[network.ServerIdentityID]bool)
+	for _, si := range r.List {
+		if si == nil {
+			return errors.New("missing node in roster")
+		}
+		if seen[si.ID] {
+			return errors.New("node " + si.String() + " is twice in the roster")
+		}
+		seen[si.ID] = true
+	}
+	return nil
+}
+
+// addedNodes returns the nodes of to that are not in from, or nil if there
+// are none.
+func addedNodes(from, to *onet.Roster) *onet.Roster {
+	var list []*network.ServerIdentity
+	for _, si := range to.List {
+		if i, _ := from.Search(si.ID); i < 0 {
+			list = append(list, si)
+		}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return onet.NewRoster(list)
+}
+
+// handoff sends the state of the identity to the nodes that are in the new
+// roster but not in the current one, so that they can verify and store the
+// block moving the identity to them.
+func (s *Service) handoff(id ID, sid *IDBlock, to *onet.Roster) error {
+	sid.Lock()
+	added := addedNodes(sid.LatestSkipblock.Roster, to)
+	h := &HandoffIdentity{
+		ID: id,
+		IDBlock: &IDBlock{
+			Latest:           sid.Latest,
+			LatestSkipblock:  sid.LatestSkipblock,
+			PropagateTimeout: sid.PropagateTimeout,
+		},
+		Roster: to,
+	}
+	sid.Unlock()
+	if added == nil {
+		return nil
+	}
+	// The propagation starts from this node, which already holds the
+	// identity.
+	roster := unionRoster(onet.NewRoster([]*network.ServerIdentity{s.ServerIdentity()}), added)
+	replies, err := s.propagate(propagateKindIdentity, roster, h, sid.propagateTimeout())
+	if err != nil {
+		return err
+	}
+	if replies != len(roster.List) {
+		return errors.New("not all new nodes got the identity")
+	}
+	return nil
+}
+
+// storeHandoff stores the identity if this node is part of the new roster
+// and doesn't hold it yet.
+func (s *Service) storeHandoff(h *HandoffIdentity) {
+	if h.IDBlock == nil || h.Roster == nil {
+		log.Error("Got an empty handoff")
+		return
+	}
+	if s.getIdentityStorage(h.ID) != nil {
+		return
+	}
+	if i, _ := h.Roster.Search(s.ServerIdentity().ID); i < 0 {
+		log.Error("Got a handoff but we're not in the new roster")
+		return
+	}
+	log.Lvlf2("%s: taking over identity %x", s.ServerIdentity(), []byte(h.ID))
+	s.setIdentityStorage(h.ID, h.IDBlock)
+}
+
+// unionRoster returns a roster with all nodes of a followed by the nodes of b
+// that are not in a.
+func unionRoster(a, b *onet.Roster) *onet.Roster {
+	added := addedNodes(a, b)
+	if added == nil {
+		return a
+	}
+	return onet.NewRoster(append(append([]*network.ServerIdentity{}, a.List...),
+		added.List...))
+}
@@ -0,0 +1,301 @@
+package identity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/dedis/kyber/util/random"
+	"github.com/dedis/onet/log"
+)
+
+// Default limits of the RPC-log, see rpcLog.
+const (
+	defaultRPCLogChunk     = 256
+	defaultRPCLogMaxChunks = 64
+)
+
+// rpcLogHeadKey is the key of the rpcLogHead in the database. The chunks
+// are stored under the key followed by their number.
+var rpcLogHeadKey = []byte("rpclog")
+
+// RPCLogEntry is one entry of the log of all requests that change the
+// state of the service. Every entry holds the hash of the previous entry,
+// so that removing or reordering entries breaks the chain.
+type RPCLogEntry struct {
+	Index int
+	// Time in unix-nanoseconds when the request has been handled.
+	Time int64
+	// Method is the name of the request.
+	Method string
+	// IDHash is the hash of Salt and the ID of the identity the request
+	// is about, or nil if the request is not about an identity.
+	IDHash []byte
+	// ID and Salt are not part of the hash of the entry and are left out
+	// for identities that restrict reading.
+	ID   ID
+	Salt []byte
+	// Error returned by the request, or an empty string.
+	Error string
+	// Prev is the hash of the previous entry, nil for the first one.
+	Prev []byte
+	// Hash of this entry, including Prev.
+	Hash []byte
+}
+
+// GetRPCLog asks for Count entries of the log, starting at Start. A Count
+// of 0 returns all entries up to the end. A negative Start only returns the
+// head of the log.
+type GetRPCLog struct {
+	Start int
+	Count int
+}
+
+// GetRPCLogReply returns the requested entries and the head of the log,
+// which clients can pin to verify later entries with RPCLogSince.
+type GetRPCLogReply struct {
+	Entries []*RPCLogEntry
+	// First is the index of the oldest entry that has not been pruned.
+	First int
+	// Length is the index of the next entry.
+	Length int
+	// Head is the hash of the latest entry.
+	Head []byte
+}
+
+// rpcLogHead is stored apart from the chunks of the log.
+type rpcLogHead struct {
+	// First is the index of the oldest entry kept.
+	First int
+	// Anchor is the hash of the entry before First, or nil if nothing
+	// has been pruned.
+	Anchor []byte
+}
+
+// rpcLogChunk holds the entries stored under one key.
+type rpcLogChunk struct {
+	Entries []*RPCLogEntry
+}
+
+// rpcLog holds the entries that have not been pruned. Every chunk of
+// entries is saved under its own key, so that adding an entry only
+// rewrites its chunk. Once more than maxChunks chunks are full, the oldest
+// one is pruned.
+type rpcLog struct {
+	sync.Mutex
+	head      rpcLogHead
+	entries   []*RPCLogEntry
+	chunk     int
+	maxChunks int
+}
+
+// calculateHash returns the hash over all fields of the entry except ID,
+// Salt and Hash.
+func (e *RPCLogEntry) calculateHash() []byte {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, int64(e.Index))
+	binary.Write(h, binary.LittleEndian, e.Time)
+	for _, s := range []string{e.Method, string(e.IDHash), e.Error, string(e.Prev)} {
+		writeString(h, s)
+	}
+	return h.Sum(nil)
+}
+
+// rpcLogIDHash returns the hash of the salt and the ID.
+func rpcLogIDHash(salt []byte, id ID) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(id)
+	return h.Sum(nil)
+}
+
+// VerifyRPCLog checks that every entry has a correct hash and points to the
+// entry before it. The first entry must point to prev, which is nil if
+// entries starts at the beginning of the log.
+func VerifyRPCLog(entries []*RPCLogEntry, prev []byte) error {
+	for i, e := range entries {
+		if i > 0 && e.Index != entries[i-1].Index+1 {
+			return fmt.Errorf("entry %d doesn't follow entry %d", e.Index,
+				entries[i-1].Index)
+		}
+		if !bytes.Equal(e.Prev, prev) {
+			return fmt.Errorf("entry %d doesn't point to the previous entry", e.Index)
+		}
+		if !bytes.Equal(e.Hash, e.calculateHash()) {
+			return fmt.Errorf("entry %d has a wrong hash", e.Index)
+		}
+		if len(e.ID) > 0 && !bytes.Equal(e.IDHash, rpcLogIDHash(e.Salt, e.ID)) {
+			return fmt.Errorf("entry %d has a wrong ID", e.Index)
+		}
+		prev = e.Hash
+	}
+	return nil
+}
+
+// rpcLogChunkKey returns the key of the chunk with the given number.
+func rpcLogChunkKey(chunk int) []byte {
+	return []byte(fmt.Sprintf("%s-%d", rpcLogHeadKey, chunk))
+}
+
+// logRPC appends an entry for the request to the log and saves the chunk
+// of the entry.
+func (s *Service) logRPC(method string, id ID, err error) {
+	l := &s.rpcLog
+	l.Lock()
+	defer l.Unlock()
+	e := &RPCLogEntry{
+		Index:  l.head.First + len(l.entries),
+		Time:   s.now().UnixNano(),
+		Method: method,
+		Prev:   l.head.Anchor,
+	}
+	if len(id) > 0 {
+		e.ID = id
+		e.Salt = make([]byte, 16)
+		random.Bytes(e.Salt, s.Suite().RandomStream())
+		e.IDHash = rpcLogIDHash(e.Salt, id)
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if len(l.entries) > 0 {
+		e.Prev = l.entries[len(l.entries)-1].Hash
+	}
+	e.Hash = e.calculateHash()
+	l.entries = append(l.entries, e)
+
+	if len(l.entries) > l.chunk*l.maxChunks {
+		pruned := l.head.First / l.chunk
+		l.head.Anchor = l.entries[l.chunk-1].Hash
+		l.head.First += l.chunk
+		l.entries = l.entries[l.chunk:]
+		if err := s.Save(rpcLogHeadKey, &l.head); err != nil {
+			log.Error(s.ServerIdentity(), "couldn't save RPC-log:", err)
+		}
+		if err := s.Save(rpcLogChunkKey(pruned), &rpcLogChunk{}); err != nil {
+			log.Error(s.ServerIdentity(), "couldn't prune RPC-log:", err)
+		}
+	}
+	chunk := e.Index / l.chunk
+	start := chunk*l.chunk - l.head.First
+	if err := s.Save(rpcLogChunkKey(chunk),
+		&rpcLogChunk{Entries: l.entries[start:]}); err != nil {
+		log.Error(s.ServerIdentity(), "couldn't save RPC-log:", err)
+	}
+}
+
+// loadRPCLog reads the head and all chunks of the log and verifies them.
+func (s *Service) loadRPCLog() error {
+	l := &s.rpcLog
+	l.Lock()
+	defer l.Unlock()
+	if l.chunk == 0 {
+		l.chunk, l.maxChunks = defaultRPCLogChunk, defaultRPCLogMaxChunks
+	}
+	l.head, l.entries = rpcLogHead{}, nil
+	msg, err := s.Load(rpcLogHeadKey)
+	if err != nil {
+		return err
+	}
+	if msg != nil {
+		head, ok := msg.(*rpcLogHead)
+		if !ok {
+			return errors.New("RPC-log head of wrong type")
+		}
+		l.head = *head
+	}
+	for chunk := l.head.First / l.chunk; ; chunk++ {
+		msg, err := s.Load(rpcLogChunkKey(chunk))
+		if err != nil {
+			return err
+		}
+		c, ok := msg.(*rpcLogChunk)
+		if !ok || len(c.Entries) == 0 {
+			break
+		}
+		l.entries = append(l.entries, c.Entries...)
+	}
+	if err := VerifyRPCLog(l.entries, l.head.Anchor); err != nil {
+		log.Error(s.ServerIdentity(), "stored RPC-log has been tampered with:", err)
+	}
+	return nil
+}
+
+// logged returns a handler that calls f and logs the request in the
+// RPC-log. f must be a handler as accepted by RegisterHandlers.
+func (s *Service) logged(f interface{}) interface{} {
+	fv := reflect.ValueOf(f)
+	return reflect.MakeFunc(fv.Type(), func(args []reflect.Value) []reflect.Value {
+		out := fv.Call(args)
+		method := args[0].Type().Elem().Name()
+		var id ID
+		if field := args[0].Elem().FieldByName("ID"); field.IsValid() &&
+			field.Type() == reflect.TypeOf(id) {
+			id = field.Interface().(ID)
+		}
+		err, _ := out[1].Interface().(error)
+		s.logRPC(method, id, err)
+		return out
+	}).Interface()
+}
+
+// GetRPCLog returns entries of the RPC-log. The kept part of the log is
+// verified first, and an error is returned if it has been tampered with.
+// Entries of identities that restrict reading are returned without ID and
+// salt.
+func (s *Service) GetRPCLog(req *GetRPCLog) (*GetRPCLogReply, error) {
+	l := &s.rpcLog
+	l.Lock()
+	if err := VerifyRPCLog(l.entries, l.head.Anchor); err != nil {
+		l.Unlock()
+		log.Error(s.ServerIdentity(), "RPC-log has been tampered with:", err)
+		return nil, errors.New("RPC-log is broken: " + err.Error())
+	}
+	reply := &GetRPCLogReply{
+		First:  l.head.First,
+		Length: l.head.First + len(l.entries),
+		Head:   l.head.Anchor,
+	}
+	if len(l.entries) > 0 {
+		reply.Head = l.entries[len(l.entries)-1].Hash
+	}
+	var entries []*RPCLogEntry
+	if req.Start >= 0 {
+		if req.Start < reply.First || req.Start > reply.Length {
+			l.Unlock()
+			return nil, errors.New("start is out of range or has been pruned")
+		}
+		end := reply.Length
+		if req.Count > 0 && req.Start+req.Count < end {
+			end = req.Start + req.Count
+		}
+		entries = l.entries[req.Start-reply.First : end-reply.First]
+	}
+	l.Unlock()
+
+	for _, e := range entries {
+		if len(e.ID) > 0 && s.isRestricted(e.ID) {
+			redacted := *e
+			redacted.ID, redacted.Salt = nil, nil
+			e = &redacted
+		}
+		reply.Entries = append(reply.Entries, e)
+	}
+	return reply, nil
+}
+
+// isRestricted returns true if the latest data of the identity has
+// readers.
+func (s *Service) isRestricted(id ID) bool {
+	sid := s.getIdentityStorage(id)
+	if sid == nil {
+		return false
+	}
+	sid.Lock()
+	defer sid.Unlock()
+	return len(sid.Latest.Readers) > 0
+}
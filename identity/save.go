@@ -0,0 +1,157 @@
+package identity
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/onet/network"
+)
+
+// saver writes the storage for the propagation handlers in the background,
+// so that they only hold the lock of the identity while changing the state
+// in memory. A single worker saves, and all saves requested while it is
+// busy are done together in its next save.
+type saver struct {
+	sync.Mutex
+	// blocking makes the handlers save before they return.
+	blocking bool
+	// pending is true if the state changed since the worker started its
+	// last save.
+	pending bool
+	running bool
+	wg      sync.WaitGroup
+}
+
+// SetSyncSave makes the propagation handlers save the storage before they
+// return if on is true. By default they leave it to the background worker.
+func (s *Service) SetSyncSave(on bool) {
+	s.saver.Lock()
+	s.saver.blocking = on
+	s.saver.Unlock()
+	if on {
+		s.flushSaves()
+	}
+}
+
+// saveLater asks the worker to save the storage, starting it if it isn't
+// running.
+func (s *Service) saveLater() {
+	s.saver.Lock()
+	if s.saver.blocking {
+		s.saver.Unlock()
+		s.save()
+		return
+	}
+	s.saver.pending = true
+	if s.saver.running {
+		s.saver.Unlock()
+		return
+	}
+	s.saver.running = true
+	s.saver.wg.Add(1)
+	s.saver.Unlock()
+	go s.saveWorker()
+}
+
+// saveWorker saves the storage until no new save has been asked for.
+func (s *Service) saveWorker() {
+	defer s.saver.wg.Done()
+	for {
+		s.saver.Lock()
+		if !s.saver.pending {
+			s.saver.running = false
+			s.saver.Unlock()
+			return
+		}
+		s.saver.pending = false
+		s.saver.Unlock()
+		s.storageMutex.Lock()
+		s.save()
+		s.storageMutex.Unlock()
+	}
+}
+
+// flushSaves waits for the worker to save all changes.
+func (s *Service) flushSaves() {
+	s.saver.wg.Wait()
+}
+
+// writeStorage writes the storage under storageTmpKey first. Only if that
+// write is complete and can be read back, it is swapped in as the primary
+// copy, and the previous primary becomes the backup, in one transaction.
+// A crash at any point leaves a primary or a backup that can be read.
+func (s *Service) writeStorage() error {
+	buf, err := network.Marshal(s.Storage)
+	if err != nil {
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Put(storageTmpKey, buf)
+	})
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		tmp := append([]byte(nil), b.Get(storageTmpKey)...)
+		if !bytes.Equal(tmp, buf) {
+			return errors.New("couldn't read back the new storage")
+		}
+		if old := b.Get(storageKey); old != nil {
+			err := b.Put(storageBackupKey, append([]byte(nil), old...))
+			if err != nil {
+				return err
+			}
+		}
+		if err := b.Put(storageKey, tmp); err != nil {
+			return err
+		}
+		return b.Delete(storageTmpKey)
+	})
+}
+
+// readStorage returns the storage saved under key in the bucket of the
+// service, or nil if there is none.
+func (s *Service) readStorage(key []byte) (*Storage, error) {
+	var buf []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buf = append([]byte(nil), tx.Bucket(s.bucket).Get(key)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.decodeStorage(buf)
+}
+
+// decodeStorage unmarshals a saved storage, returning nil if buf is empty.
+func (s *Service) decodeStorage(buf []byte) (*Storage, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	_, msg, err := network.Unmarshal(buf, s.Suite())
+	if err != nil {
+		return nil, err
+	}
+	storage, ok := msg.(*Storage)
+	if !ok {
+		return nil, errors.New("Data of wrong type")
+	}
+	return storage, nil
+}
+
+// loadLegacyStorage returns the storage saved by nodes from before the
+// storage got its own bucket, or nil if there is none.
+func (s *Service) loadLegacyStorage() (*Storage, error) {
+	msg, err := s.Load(storageKey)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+	storage, ok := msg.(*Storage)
+	if !ok {
+		return nil, errors.New("Data of wrong type")
+	}
+	return storage, nil
+}
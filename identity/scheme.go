@@ -0,0 +1,126 @@
+package identity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+// SigScheme is the signature scheme a device signs its votes and messages
+// with. The devices of one identity can use different schemes, so that
+// they can be replaced one by one.
+type SigScheme int
+
+// SigScheme consts
+const (
+	// SchemeSchnorr devices sign with a schnorr-signature verifiable by
+	// Device.Point. It is the default.
+	SchemeSchnorr SigScheme = iota
+	// SchemeECDSA devices sign the SHA-256 hash of the message with ECDSA
+	// on P-256. Device.Key holds the uncompressed public key, and the
+	// signature is ASN.1 encoded.
+	SchemeECDSA
+)
+
+// NewECDSADevice returns a device using SchemeECDSA with the given P-256
+// public key.
+func NewECDSADevice(pub *ecdsa.PublicKey) (*Device, error) {
+	if pub == nil || pub.Curve != elliptic.P256() {
+		return nil, errors.New("need a P-256 public key")
+	}
+	return &Device{
+		Scheme: SchemeECDSA,
+		Key:    elliptic.Marshal(elliptic.P256(), pub.X, pub.Y),
+	}, nil
+}
+
+// checkKey returns an error if the device has no valid public key for its
+// scheme or uses an unknown scheme.
+func (dev *Device) checkKey() error {
+	switch dev.Scheme {
+	case SchemeSchnorr:
+		if dev.Point == nil {
+			return errors.New("no public key")
+		}
+		if dev.Group != nil {
+			return dev.Group.check(dev.Point)
+		}
+		return nil
+	case SchemeECDSA:
+		if dev.Point != nil || dev.Group != nil {
+			return errors.New("ECDSA device with a point or a group")
+		}
+		_, err := dev.ecdsaKey()
+		return err
+	}
+	return fmt.Errorf("unknown signature scheme %d", dev.Scheme)
+}
+
+// keyString returns the public key of the device as a string that is
+// different for all keys of all schemes.
+func (dev *Device) keyString() string {
+	if dev.Scheme == SchemeSchnorr {
+		if dev.Point == nil {
+			return ""
+		}
+		return dev.Point.String()
+	}
+	return fmt.Sprintf("%d:%s", dev.Scheme, hex.EncodeToString(dev.Key))
+}
+
+// writeKey adds the public key of the device to the hash. Only the keys of
+// other schemes than SchemeSchnorr are tagged, so that the hash of the
+// existing devices doesn't change.
+func (dev *Device) writeKey(h hash.Hash) error {
+	switch dev.Scheme {
+	case SchemeSchnorr:
+		if dev.Point == nil {
+			return errors.New("no public key")
+		}
+		_, err := dev.Point.MarshalTo(h)
+		return err
+	case SchemeECDSA:
+		if err := writeString(h, "ecdsa-p256"); err != nil {
+			return err
+		}
+		return writeString(h, string(dev.Key))
+	}
+	return fmt.Errorf("unknown signature scheme %d", dev.Scheme)
+}
+
+// ecdsaKey returns the public key of an ECDSA device.
+func (dev *Device) ecdsaKey() (*ecdsa.PublicKey, error) {
+	x, y := elliptic.Unmarshal(elliptic.P256(), dev.Key)
+	if x == nil {
+		return nil, errors.New("invalid P-256 public key")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+// verifyECDSA returns nil if sig is a valid ECDSA signature of the device on
+// msg.
+func (dev *Device) verifyECDSA(msg, sig []byte) error {
+	pub, err := dev.ecdsaKey()
+	if err != nil {
+		return err
+	}
+	var rs struct{ R, S *big.Int }
+	rest, err := asn1.Unmarshal(sig, &rs)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errors.New("trailing data after signature")
+	}
+	h := sha256.Sum256(msg)
+	if !ecdsa.Verify(pub, h[:], rs.R, rs.S) {
+		return errors.New("invalid ECDSA signature")
+	}
+	return nil
+}
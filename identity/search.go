@@ -0,0 +1,188 @@
+package identity
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/dedis/onet/log"
+)
+
+// ErrorNoSearchIndex is returned by Search if the node doesn't index the
+// identities.
+var ErrorNoSearchIndex = errors.New("this node has no search-index")
+
+// SearchIndexEnv is the environment variable that enables the search-index
+// when set to "true" while the service is created.
+const SearchIndexEnv = "COTHORITY_IDENTITY_SEARCH_INDEX"
+
+// Search asks for all keys of the latest data of the identities on the
+// node whose key or value is equal to Query.
+type Search struct {
+	Query string
+}
+
+// SearchReply holds the matches, sorted by identity and key.
+type SearchReply struct {
+	Matches []*SearchMatch
+}
+
+// SearchMatch is a key of an identity that matches the query.
+type SearchMatch struct {
+	ID    ID
+	Key   string
+	Value string
+}
+
+// searchIndex maps the keys and values of the identities to where they are
+// used. Identities with readers are not indexed.
+type searchIndex struct {
+	sync.Mutex
+	enabled bool
+	// storage holds the indexed data of every identity and the index of
+	// its block, so that older commits don't replace newer ones.
+	storage map[string]map[string]string
+	indexes map[string]int
+	// terms maps every key and value to the identities and keys using it.
+	terms map[string]map[searchEntry]bool
+}
+
+// searchEntry is one key of an identity.
+type searchEntry struct {
+	id  string
+	key string
+}
+
+// EnableSearchIndex builds the search-index from all identities of the node
+// and keeps it up to date with every commit. The index is not saved, so it
+// has to be enabled every time the service starts.
+func (s *Service) EnableSearchIndex() {
+	s.searchIndex.Lock()
+	if s.searchIndex.enabled {
+		s.searchIndex.Unlock()
+		return
+	}
+	s.searchIndex.enabled = true
+	s.searchIndex.storage = make(map[string]map[string]string)
+	s.searchIndex.indexes = make(map[string]int)
+	s.searchIndex.terms = make(map[string]map[searchEntry]bool)
+	s.searchIndex.Unlock()
+
+	s.RegisterHook(func(ev *Event) {
+		if ev.Type == EventCommit {
+			s.searchIndex.update(ev.ID, ev.Index, ev.Data)
+		}
+	})
+	s.storageMutex.Lock()
+	ids := make(map[string]*IDBlock)
+	for id, sid := range s.Storage.Identities {
+		ids[id] = sid
+	}
+	s.storageMutex.Unlock()
+	for id, sid := range ids {
+		sid.Lock()
+		s.searchIndex.update(ID(id), sid.index(), sid.Latest)
+		sid.Unlock()
+	}
+}
+
+// searchIndexFromEnv enables the search-index if SearchIndexEnv is set.
+func (s *Service) searchIndexFromEnv() {
+	if os.Getenv(SearchIndexEnv) != "true" {
+		return
+	}
+	log.Lvl2(s.ServerIdentity(), "enabling search-index")
+	s.EnableSearchIndex()
+}
+
+// update replaces the indexed data of the identity, unless a newer block
+// has already been indexed.
+func (si *searchIndex) update(id ID, index int, d *Data) {
+	si.Lock()
+	defer si.Unlock()
+	if !si.enabled {
+		return
+	}
+	key := string(id)
+	if old, ok := si.indexes[key]; ok && old > index {
+		return
+	}
+	for k, v := range si.storage[key] {
+		si.remove(k, searchEntry{key, k})
+		si.remove(v, searchEntry{key, k})
+	}
+	delete(si.storage, key)
+	si.indexes[key] = index
+	if d == nil || len(d.Readers) > 0 {
+		return
+	}
+	stored := make(map[string]string)
+	// Only the values everybody can read are indexed.
+	for k, v := range d.readableBy(nil, nil).Storage {
+		stored[k] = v
+		si.add(k, searchEntry{key, k})
+		si.add(v, searchEntry{key, k})
+	}
+	si.storage[key] = stored
+}
+
+// drop removes the identity from the index.
+func (si *searchIndex) drop(id ID) {
+	si.Lock()
+	defer si.Unlock()
+	if !si.enabled {
+		return
+	}
+	key := string(id)
+	for k, v := range si.storage[key] {
+		si.remove(k, searchEntry{key, k})
+		si.remove(v, searchEntry{key, k})
+	}
+	delete(si.storage, key)
+	delete(si.indexes, key)
+}
+
+// add adds the entry to the term. It must be called with the lock held.
+func (si *searchIndex) add(term string, e searchEntry) {
+	if si.terms[term] == nil {
+		si.terms[term] = make(map[searchEntry]bool)
+	}
+	si.terms[term][e] = true
+}
+
+// remove removes the entry from the term. It must be called with the lock
+// held.
+func (si *searchIndex) remove(term string, e searchEntry) {
+	delete(si.terms[term], e)
+	if len(si.terms[term]) == 0 {
+		delete(si.terms, term)
+	}
+}
+
+// Search returns all keys of the indexed identities whose key or value is
+// equal to the query.
+func (s *Service) Search(req *Search) (*SearchReply, error) {
+	s.searchIndex.Lock()
+	defer s.searchIndex.Unlock()
+	if !s.searchIndex.enabled {
+		return nil, ErrorNoSearchIndex
+	}
+	reply := &SearchReply{}
+	for e := range s.searchIndex.terms[req.Query] {
+		reply.Matches = append(reply.Matches, &SearchMatch{
+			ID:    ID(e.id),
+			Key:   e.key,
+			Value: s.searchIndex.storage[e.id][e.key],
+		})
+	}
+	sort.Slice(reply.Matches, func(i, j int) bool {
+		a, b := reply.Matches[i], reply.Matches[j]
+		if c := bytes.Compare(a.ID, b.ID); c != 0 {
+			return c < 0
+		}
+		return a.Key < b.Key
+	})
+	return reply, nil
+}
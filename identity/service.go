@@ -10,12 +10,16 @@
 package identity
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"math/big"
 	"reflect"
+	"sort"
 	"sync"
+	"time"
 
+	bolt "github.com/coreos/bbolt"
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/messaging"
 	"github.com/dedis/cothority/skipchain"
@@ -39,6 +43,12 @@ const nonceSize = 64
 // Default number of skipchains, each user can create
 const defaultNumberSkipchains = 5
 
+// Height-parameters of the identity-skipchains
+const (
+	genesisBaseHeight    = 10
+	genesisMaximumHeight = 10
+)
+
 var identityService onet.ServiceID
 
 // VerificationIdentity gives a combined VerifyBase + verifyIdentity.
@@ -49,10 +59,21 @@ var VerifyIdentity = skipchain.VerifierID(uuid.NewV5(uuid.NamespaceURL, "Identit
 
 var storageKey = []byte("storage")
 
+// The storage is kept in its own bucket under storageKey. A new copy is
+// first written to storageTmpKey, and the copy it replaces is kept under
+// storageBackupKey for tryLoad in case the primary copy is broken.
+var (
+	storageBucket    = []byte("identity-storage")
+	storageTmpKey    = []byte("storage.tmp")
+	storageBackupKey = []byte("storage.bak")
+)
+
 func init() {
 	identityService, _ = onet.RegisterNewService(ServiceName, newIdentityService)
 	network.RegisterMessage(&Storage{})
 	network.RegisterMessage(&IDBlock{})
+	network.RegisterMessage(&rpcLogHead{})
+	network.RegisterMessage(&rpcLogChunk{})
 }
 
 // Service handles.Storage.Identities
@@ -65,10 +86,83 @@ type Service struct {
 	propagateData      messaging.PropagationFunc
 	storageMutex       sync.Mutex
 	skipchain          *skipchain.Service
+	// db and bucket hold the storage, see writeStorage.
+	db     *bolt.DB
+	bucket []byte
 	// limits on number of skipchain creation. Map keys are link tags
 	tagsLimits map[string]int8
 	// limits on number of skipchain creation. Map keys are public keys
 	pointsLimits map[string]int8
+	// interceptor replaces the propagation functions in tests
+	interceptor propagationInterceptor
+	// hooks are called for every event
+	hooks         []Hook
+	quorumTimeout time.Duration
+	hooksMutex    sync.Mutex
+	// sweepers remove expired state from the identities
+	sweepers       []sweeper
+	sweepInterval  time.Duration
+	sweepTimer     Timer
+	sweepGen       int
+	proposalMaxAge time.Duration
+	sweepMutex     sync.Mutex
+	// subscriptions to the progress of proposals
+	subscriptions subscriptions
+	// votes waiting to be propagated together
+	voteWindow  time.Duration
+	voteBatches map[string]*voteBatch
+	batchMutex  sync.Mutex
+	// last heartbeat of every device, mapped by identity and device
+	heartbeats     map[string]map[string]*Heartbeat
+	heartbeatMutex sync.Mutex
+	// verifiers check the votes of the devices
+	verifiers     []VoteVerifier
+	batchVerify   bool
+	voteMaxAge    time.Duration
+	verifierMutex sync.Mutex
+	// nonces for read-requests and when they expire
+	readNonces map[string]time.Time
+	readMutex  sync.Mutex
+	// log of all requests changing the state
+	rpcLog rpcLog
+	// running propagations of every identity
+	inflight         map[string]chan struct{}
+	propagationLimit int
+	propagationWait  time.Duration
+	inflightMutex    sync.Mutex
+	// nodes of the skipchain-rosters that failed to store blocks
+	skipchainHealth skipchainHealth
+	// clientAuth, if set, decides which clients are served
+	clientAuth clientAuth
+	// searchIndex maps the keys and values to the identities, if enabled
+	searchIndex searchIndex
+	// debug enables the debug-requests, protected by storageMutex
+	debug bool
+	// createMutex makes sure an identity is only created once
+	createMutex sync.Mutex
+	// saver saves the storage for the propagation handlers
+	saver saver
+	// limits on the data proposed with ProposeDataBatch
+	maxValueSize    int
+	maxDataSize     int
+	dataLimitsMutex sync.Mutex
+	// commitTimers hold the delayed commits, mapped by identity
+	commitTimers      map[string]Timer
+	commitTimersMutex sync.Mutex
+	// timestamps are the requests running to the timestamp authority
+	timestamps sync.WaitGroup
+	// idempotency holds the replies to requests with a key
+	idempotency idempotency
+	// clock gives the time, the real one if nil
+	clock      Clock
+	clockMutex sync.Mutex
+	// peerSupport caches which nodes decrypt propagations
+	peerSupport peerSupport
+	// nodeKey is the private key of the node, see nodePrivate
+	nodeKey     kyber.Scalar
+	nodeKeyOnce sync.Once
+	// sessions are the devices sending authenticated requests
+	sessions sessions
 }
 
 // Storage holds the map to the storages so it can be marshaled.
@@ -81,6 +175,24 @@ type Storage struct {
 	SkipchainKeyPair *key.Pair
 	// Auth is a list of all authentications allowed for this service
 	Auth *authData
+	// ReadReplica is true if this node only serves read-requests
+	ReadReplica bool
+	// Replicas get all identities propagated from this node
+	Replicas []*network.ServerIdentity
+	// StrictThreshold makes threshold changes need the higher threshold
+	StrictThreshold bool
+	// DynamicThreshold, if set, lowers the threshold when devices are
+	// offline
+	DynamicThreshold *DynamicThreshold
+	// Created maps the hash of the requests that created an identity on
+	// this node to its ID, so that a retried request returns the same
+	// identity.
+	Created map[string]ID
+	// TimestampAuthority, if set, timestamps every new block
+	TimestampAuthority *TimestampAuthority
+	// EncryptPropagation encrypts the propagations, see
+	// SetEncryptPropagation
+	EncryptPropagation bool
 }
 
 // IDBlock stores one identity together with the skipblocks.
@@ -89,6 +201,92 @@ type IDBlock struct {
 	Latest          *Data
 	Proposed        *Data
 	LatestSkipblock *skipchain.SkipBlock
+	// ProposedAt is the time in unix-nanoseconds when Proposed has been
+	// received by the node propagating it, the same on all nodes.
+	ProposedAt int64
+	// ProposalExpires is the time in unix-nanoseconds when Proposed is
+	// removed, 0 if never. Like ProposedAt it is the same on all nodes.
+	ProposalExpires int64
+	// ProposedBy is the device that signed Proposed, empty if it has
+	// been proposed anonymously.
+	ProposedBy string
+	// quorumReported is true if the proposal has already been reported
+	// as stuck.
+	quorumReported bool
+	// rejected holds the devices that rejected Proposed. As rejections
+	// aren't signed, it is only used to detect a stuck proposal.
+	rejected map[string]bool
+	// SkipchainRoster is the roster the skipchain has been created with,
+	// if it is different from the roster of the data. Else it is nil.
+	SkipchainRoster *onet.Roster
+	// Suspended identities refuse all proposals and votes.
+	Suspended bool
+	// SuspendChanged is the time of the last suspend or resume.
+	SuspendChanged int64
+	// ProposalDelay is the Delay of the ProposeSend of Proposed.
+	// CommitAt is the time in unix-nanoseconds when Proposed will be
+	// committed, set by the node that collected enough votes, 0 before.
+	ProposalDelay int64
+	CommitAt      int64
+	// LastSeen maps the devices to the last time in unix-nanoseconds they
+	// voted or sent a heartbeat to this node.
+	LastSeen map[string]int64
+	// Timestamps are the tokens of the timestamp authority for the blocks
+	// stored by this node.
+	Timestamps []*BlockTimestamp
+	// RevokedSessions are the keys of the devices whose credentials are
+	// refused.
+	RevokedSessions []kyber.Point
+	// PropagateTimeout in nanoseconds is the timeout of the propagations
+	// of the identity, 0 for propagateTimeout. It never changes after the
+	// identity has been created.
+	PropagateTimeout int64
+	// proposing is true while this node propagates a new proposal, so
+	// that a concurrent ProposeSend can't replace it.
+	proposing bool
+	// IndexOffset is the index of the last block before the latest
+	// compaction of the skipchain, counting the blocks of all compacted
+	// skipchains. Added to the index of a block of the current skipchain,
+	// it gives the index of the block in the history of the identity.
+	IndexOffset int
+	// commitMutex is held while storing a new block, so that concurrent
+	// votes don't store the same proposal twice. It must be taken before
+	// the lock of the IDBlock.
+	commitMutex sync.Mutex
+}
+
+// skipchainRoster returns the roster for the skipblock storing proposed.
+// With a separate skipchain-roster it doesn't change with the data.
+func (sid *IDBlock) skipchainRoster(proposed *Data) *onet.Roster {
+	if sid.SkipchainRoster != nil {
+		return sid.LatestSkipblock.Roster
+	}
+	return proposed.Roster
+}
+
+// index returns the index of the latest block in the history of the
+// identity, which keeps increasing when the skipchain is compacted.
+func (sid *IDBlock) index() int {
+	return sid.IndexOffset + sid.LatestSkipblock.Index
+}
+
+// propagateTimeout returns the timeout of the propagations of the
+// identity. As it never changes, it can be called without holding the lock
+// of sid.
+func (sid *IDBlock) propagateTimeout() time.Duration {
+	if sid.PropagateTimeout == 0 {
+		return propagateTimeout
+	}
+	return time.Duration(sid.PropagateTimeout)
+}
+
+// votingRoster returns the roster of the nodes that handle proposals and
+// votes for the data d.
+func (sid *IDBlock) votingRoster(d *Data) *onet.Roster {
+	if sid.SkipchainRoster != nil && d.Roster != nil {
+		return d.Roster
+	}
+	return sid.LatestSkipblock.Roster
 }
 
 type authData struct {
@@ -222,6 +420,9 @@ func (s *Service) Authenticate(ap *Authenticate) (*Authenticate, error) {
 // CreateIdentity will register a new SkipChain and add it to our list of
 // managed identities.
 func (s *Service) CreateIdentity(ai *CreateIdentity) (*CreateIdentityReply, error) {
+	if s.isReadReplica() {
+		return nil, ErrorReadReplica
+	}
 	ctx := []byte(ServiceName + s.ServerIdentity().String())
 	if _, ok := s.Storage.Auth.nonces[string(ai.Nonce)]; !ok {
 		log.Error("Given nonce is not stored on ", s.ServerIdentity())
@@ -284,25 +485,62 @@ func (s *Service) CreateIdentity(ai *CreateIdentity) (*CreateIdentityReply, erro
 // tag and pubStr can be "" if called from an internal service.
 func (s *Service) CreateIdentityInternal(ai *CreateIdentity, tag, pubStr string) (*CreateIdentityReply, error) {
 	log.Lvlf3("%s Creating new identity with data %+v", s.ServerIdentity(), ai.Data)
+	if ai.Data.Timestamp != 0 {
+		if err := checkTimestamp(ai.Data, &Data{}, s.now()); err != nil {
+			return nil, err
+		}
+	}
+	if t := time.Duration(ai.PropagateTimeout); t != 0 &&
+		(t < minPropagateTimeout || t > maxPropagateTimeout) {
+		return nil, fmt.Errorf("propagation timeout must be between %s and %s",
+			minPropagateTimeout, maxPropagateTimeout)
+	}
 	ids := &IDBlock{
-		Latest: ai.Data,
+		Latest:           ai.Data,
+		PropagateTimeout: ai.PropagateTimeout,
 	}
-	log.Lvl3("Creating Data-skipchain", ai.Data)
-	sb := &skipchain.SkipBlock{
-		SkipBlockFix: &skipchain.SkipBlockFix{
-			Roster:        ai.Data.Roster,
-			BaseHeight:    10,
-			MaximumHeight: 10,
-			VerifierIDs:   VerificationIdentity,
-		},
+	s.createMutex.Lock()
+	defer s.createMutex.Unlock()
+	hash, err := ai.genesisHash(nil)
+	if err != nil {
+		return nil, err
 	}
-	reply, err := s.storeSkipBlock(sb, ai.Data)
+	genesis, err := s.createdGenesis(hash)
 	if err != nil {
 		return nil, err
 	}
-	ids.LatestSkipblock = reply.Latest
-	roster := ai.Data.Roster
-	replies, err := s.propagateIdentity(roster, &PropagateIdentity{ids, tag, pubStr}, propagateTimeout)
+	if genesis != nil && s.getIdentityStorage(ID(genesis.Hash)) != nil {
+		log.Lvlf2("%s: identity %x has already been created", s.ServerIdentity(),
+			[]byte(genesis.Hash))
+		return &CreateIdentityReply{Genesis: genesis}, nil
+	}
+	if genesis == nil {
+		log.Lvl3("Creating Data-skipchain", ai.Data)
+		sb := ai.genesisBlock()
+		for _, v := range sb.VerifierIDs {
+			if !s.skipchain.HasVerification(v) {
+				return nil, fmt.Errorf("verification function %x is not registered", v)
+			}
+		}
+		reply, err := s.storeSkipBlock(sb, ai.Data)
+		if err != nil {
+			return nil, err
+		}
+		genesis = reply.Latest
+		s.storageMutex.Lock()
+		if s.Storage.Created == nil {
+			s.Storage.Created = make(map[string]ID)
+		}
+		s.Storage.Created[string(hash)] = ID(genesis.Hash)
+		s.storageMutex.Unlock()
+		s.save()
+	}
+	// If the propagation of a created identity failed, it is propagated
+	// again.
+	ids.SkipchainRoster = ai.SkipchainRoster
+	ids.LatestSkipblock = genesis
+	roster := s.withReplicas(ai.Data.Roster)
+	replies, err := s.propagate(propagateKindIdentity, roster, &PropagateIdentity{ids, tag, pubStr}, ids.propagateTimeout())
 	if err != nil {
 		return nil, err
 	}
@@ -316,18 +554,66 @@ func (s *Service) CreateIdentityInternal(ai *CreateIdentity, tag, pubStr string)
 	}, nil
 }
 
+// createdGenesis returns the genesis-block of the identity created by the
+// request with the given hash on this node, or nil if there is none.
+func (s *Service) createdGenesis(hash []byte) (*skipchain.SkipBlock, error) {
+	s.storageMutex.Lock()
+	id, ok := s.Storage.Created[string(hash)]
+	s.storageMutex.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return s.skipchain.GetSingleBlock(&skipchain.GetSingleBlock{ID: skipchain.SkipBlockID(id)})
+}
+
+// genesisBlock returns the genesis-block of the new identity-skipchain,
+// without the data. It is stored on the SkipchainRoster if given and uses
+// VerificationIdentity if no verifiers are given. VerifyGenesis uses the
+// same block.
+func (ci *CreateIdentity) genesisBlock() *skipchain.SkipBlock {
+	roster := ci.Data.Roster
+	if ci.SkipchainRoster != nil {
+		roster = ci.SkipchainRoster
+	}
+	verifiers := ci.Verifiers
+	if len(verifiers) == 0 {
+		verifiers = VerificationIdentity
+	}
+	return &skipchain.SkipBlock{
+		SkipBlockFix: &skipchain.SkipBlockFix{
+			Roster:        roster,
+			BaseHeight:    genesisBaseHeight,
+			MaximumHeight: genesisMaximumHeight,
+			VerifierIDs:   verifiers,
+		},
+	}
+}
+
 func (s *Service) storeSkipBlock(sb *skipchain.SkipBlock, data network.Message) (*skipchain.StoreSkipBlockReply, error) {
 	d, err := network.Marshal(data)
 	if err != nil {
 		return nil, err
 	}
 	sb.Data = d
+	if !sb.GenesisID.IsNull() {
+		return s.storeWithFailover(sb)
+	}
+	if leader := sb.Roster.Get(0); !leader.Equal(s.ServerIdentity()) {
+		// Only the leader of the skipchain-roster can store new
+		// blocks, and the roster is part of the identity-ID.
+		return nil, errors.New("only the leader of the skipchain-roster can create an identity")
+	}
+	return s.storeLocal(sb)
+}
+
+// storeLocal signs the block with the key of this node, if the skipchain
+// service needs it, and stores it.
+func (s *Service) storeLocal(sb *skipchain.SkipBlock) (*skipchain.StoreSkipBlockReply, error) {
 	ssb := &skipchain.StoreSkipBlock{
 		TargetSkipChainID: sb.GenesisID,
 		NewBlock:          sb,
 	}
-	priv := s.verifySkipchainAuth()
-	if priv != nil {
+	if priv := s.verifySkipchainAuth(); priv != nil {
 		sig, err := schnorr.Sign(cothority.Suite, priv, sb.CalculateHash())
 		if err != nil {
 			return nil, errors.New("couldn't sign block: " + err.Error())
@@ -337,6 +623,38 @@ func (s *Service) storeSkipBlock(sb *skipchain.SkipBlock, data network.Message)
 	return s.skipchain.StoreSkipBlock(ssb)
 }
 
+// ForwardBlock stores a new block of an identity for a node that is not the
+// leader of the skipchain-roster. This node only signs the block for its
+// skipchain service if the skipchain verifies the votes of the devices, so
+// that a block without enough votes is still refused.
+func (s *Service) ForwardBlock(fb *ForwardBlock) (*ForwardBlockReply, error) {
+	sb := fb.Block
+	if sb == nil || sb.GenesisID.IsNull() || !bytes.Equal(sb.GenesisID, fb.ID) {
+		return nil, errors.New("only new blocks of an existing identity can be forwarded")
+	}
+	if sb.Roster == nil || !sb.Roster.Get(0).Equal(s.ServerIdentity()) {
+		return nil, errors.New("not the leader of the skipchain-roster")
+	}
+	genesis := s.skipchain.GetDB().GetByID(sb.GenesisID)
+	if genesis == nil {
+		return nil, errors.New("unknown skipchain")
+	}
+	verified := false
+	for _, v := range genesis.VerifierIDs {
+		if v == VerifyIdentity {
+			verified = true
+		}
+	}
+	if !verified {
+		return nil, errors.New("skipchain doesn't verify the votes")
+	}
+	reply, err := s.storeLocal(sb)
+	if err != nil {
+		return nil, err
+	}
+	return &ForwardBlockReply{Previous: reply.Previous, Latest: reply.Latest}, nil
+}
+
 // DataUpdate returns a new data-update
 func (s *Service) DataUpdate(cu *DataUpdate) (*DataUpdateReply, error) {
 	// Check if there is something new on the skipchain - in case we've been
@@ -347,47 +665,236 @@ func (s *Service) DataUpdate(cu *DataUpdate) (*DataUpdateReply, error) {
 	}
 	sid.Lock()
 	defer sid.Unlock()
-	reply, err := s.skipchain.GetUpdateChain(&skipchain.GetUpdateChain{LatestID: sid.LatestSkipblock.Hash})
-	if err != nil {
-		return nil, err
-	}
-	if len(reply.Update) > 1 {
-		log.Lvl3("Got new data")
-		// TODO: check that update-chain has correct forward-links and fits into existing blocks
-		sid.LatestSkipblock = reply.Update[len(reply.Update)-1]
-		_, dataInt, err := network.Unmarshal(sid.LatestSkipblock.Data, s.Suite())
+	if s.isReadReplica() {
+		// A read-replica doesn't hold the skipchain and only
+		// relies on the propagations.
+		reader, err := s.authorizeRead(cu.ID, sid.Latest, cu.Auth)
 		if err != nil {
 			return nil, err
 		}
-		var ok bool
-		sid.Latest, ok = dataInt.(*Data)
-		if !ok {
-			return nil, errors.New("did get invalid block from skipchain")
-		}
+		return &DataUpdateReply{
+			Data: sid.Latest.readableBy(reader, nil),
+		}, nil
+	}
+	changed, err := s.catchUp(cu.ID, sid)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		s.save()
+	}
+	// The readers of the newest data decide.
+	reader, err := s.authorizeRead(cu.ID, sid.Latest, cu.Auth)
+	if err != nil {
+		return nil, err
 	}
 	log.Lvl3(s, "Sending data-update")
 	return &DataUpdateReply{
-		Data: sid.Latest,
+		Data: sid.Latest.readableBy(reader, nil),
+	}, nil
+}
+
+// GetValuesByPrefix returns the values of the latest data whose keys start
+// with the prefix, so that a client doesn't need to fetch the whole data.
+func (s *Service) GetValuesByPrefix(req *GetValuesByPrefix) (*GetValuesByPrefixReply, error) {
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	defer sid.Unlock()
+	reader, err := s.authorizeRead(req.ID, sid.Latest, req.Auth)
+	if err != nil {
+		return nil, err
+	}
+	return &GetValuesByPrefixReply{
+		Values: sid.Latest.readableBy(reader, nil).GetValuesByPrefix(req.Prefix),
 	}, nil
 }
 
+// ListIdentities returns a summary of all identities stored on this node
+// that don't restrict reading, sorted by their ID.
+func (s *Service) ListIdentities(req *ListIdentities) (*ListIdentitiesReply, error) {
+	s.storageMutex.Lock()
+	var keys []string
+	ids := make(map[string]*IDBlock)
+	for id, sid := range s.Storage.Identities {
+		keys = append(keys, id)
+		ids[id] = sid
+	}
+	s.storageMutex.Unlock()
+	sort.Strings(keys)
+	reply := &ListIdentitiesReply{}
+	for _, id := range keys {
+		sid := ids[id]
+		sid.Lock()
+		if len(sid.Latest.Readers) > 0 ||
+			(req.Device != "" && sid.Latest.Device[req.Device] == nil) {
+			sid.Unlock()
+			continue
+		}
+		reply.Identities = append(reply.Identities, &IdentitySummary{
+			ID:        ID(id),
+			Metadata:  sid.Latest.Metadata,
+			Devices:   len(sid.Latest.Device),
+			Threshold: sid.Latest.Threshold,
+			Index:     sid.index(),
+		})
+		sid.Unlock()
+	}
+	return reply, nil
+}
+
+// ErrorNoChange is returned for proposals equal to the latest data, which
+// would only add an empty block.
+var ErrorNoChange = errors.New("proposal doesn't change the data")
+
+// ErrorProposalActive is returned for a proposal sent while another one is
+// open and not forced.
+var ErrorProposalActive = errors.New("another proposal is open")
+
 // ProposeSend only stores the proposed data internally. Signatures
-// come later.
+// come later. If a receipt is asked for, the roster collectively signs
+// the accepted proposal. An open proposal is only replaced if the new one
+// is forced by a device.
 func (s *Service) ProposeSend(p *ProposeSend) (network.Message, error) {
 	log.Lvl2(s, "Storing new proposal")
+	if s.isReadReplica() {
+		return nil, ErrorReadReplica
+	}
 	sid := s.getIdentityStorage(p.ID)
 	if sid == nil {
 		return nil, errors.New("Didn't find Identity")
 	}
-	roster := sid.LatestSkipblock.Roster
-	replies, err := s.propagateData(roster, p, propagateTimeout)
+	sid.Lock()
+	suspended := sid.Suspended
+	voting := sid.votingRoster(sid.Latest)
+	p.Index = sid.index()
+	versionErr := p.Propose.checkHashVersion(sid.Latest)
+	if versionErr == nil {
+		versionErr = p.Propose.checkNewBlock()
+	}
+	proposerErr := p.verifyProposer(s, sid.Latest)
+	unchanged := p.Propose.Equal(sid.Latest)
+	sid.Unlock()
+	if suspended {
+		return nil, ErrorSuspended
+	}
+	if versionErr != nil {
+		return nil, versionErr
+	}
+	if proposerErr != nil {
+		return nil, proposerErr
+	}
+	if unchanged {
+		return nil, ErrorNoChange
+	}
+	if p.Delay < 0 {
+		return nil, errors.New("negative delay")
+	}
+	if p.TTL < 0 {
+		return nil, errors.New("negative TTL")
+	}
+	if p.Force && p.Proposer == "" {
+		return nil, errors.New("only a device can force a proposal")
+	}
+	sid.Lock()
+	if !p.Force && (sid.proposing || sid.Proposed != nil && !sid.proposalExpired(s.now())) {
+		sid.Unlock()
+		return nil, ErrorProposalActive
+	}
+	sid.proposing = true
+	sid.Unlock()
+	defer func() {
+		sid.Lock()
+		sid.proposing = false
+		sid.Unlock()
+	}()
+	release, err := s.acquirePropagation(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	roster := s.withReplicas(voting)
+	p.Time = s.now().UnixNano()
+	p.Expires = s.proposalExpiry(p.Time, time.Duration(p.TTL))
+	replies, err := s.propagate(propagateKindData, roster, p, sid.propagateTimeout())
 	if err != nil {
 		return nil, err
 	}
 	if replies != len(roster.List) {
 		log.Warn("Did only get", replies, "out of", len(roster.List))
 	}
-	return nil, nil
+	if !p.Receipt {
+		return nil, nil
+	}
+	receipt, err := s.signReceipt(p.ID, voting, p.Propose)
+	if err != nil {
+		return nil, errors.New("couldn't sign receipt: " + err.Error())
+	}
+	return &ProposeSendReply{Receipt: receipt}, nil
+}
+
+// ProposeReplace creates a proposal from the latest data where all devices
+// and the threshold are replaced, and stores it like ProposeSend. The new
+// devices are checked before the proposal is accepted.
+func (s *Service) ProposeReplace(pr *ProposeReplace) (*ProposeReplaceReply, error) {
+	if s.isReadReplica() {
+		return nil, ErrorReadReplica
+	}
+	sid := s.getIdentityStorage(pr.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	propose := sid.Latest.Copy()
+	sid.Unlock()
+	propose.Device = pr.Devices
+	propose.Threshold = pr.Threshold
+	if err := propose.CheckDevices(); err != nil {
+		return nil, err
+	}
+	if _, err := s.ProposeSend(&ProposeSend{ID: pr.ID, Propose: propose}); err != nil {
+		return nil, err
+	}
+	return &ProposeReplaceReply{Propose: propose}, nil
+}
+
+// ErrorAccountMissing is returned if the device to remove is not part of the
+// identity.
+var ErrorAccountMissing = errors.New("device is not part of the identity")
+
+// ProposeRemoveDevice proposes the latest data without the device. The
+// remaining devices must still be able to reach the threshold.
+func (s *Service) ProposeRemoveDevice(pr *ProposeRemoveDevice) (*ProposeRemoveDeviceReply, error) {
+	if s.isReadReplica() {
+		return nil, ErrorReadReplica
+	}
+	sid := s.getIdentityStorage(pr.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	propose := sid.Latest.Copy()
+	sid.Unlock()
+	if _, ok := propose.Device[pr.Device]; !ok {
+		return nil, ErrorAccountMissing
+	}
+	if len(propose.Device) == 1 {
+		return nil, errors.New("can't remove the last device")
+	}
+	delete(propose.Device, pr.Device)
+	if propose.Threshold > len(propose.Device) {
+		return nil, fmt.Errorf("threshold %d can't be reached with %d devices",
+			propose.Threshold, len(propose.Device))
+	}
+	if err := propose.CheckDevices(); err != nil {
+		return nil, err
+	}
+	if _, err := s.ProposeSend(&ProposeSend{ID: pr.ID, Propose: propose}); err != nil {
+		return nil, err
+	}
+	return &ProposeRemoveDeviceReply{Propose: propose}, nil
 }
 
 // ProposeUpdate returns an eventual data-proposition
@@ -399,9 +906,22 @@ func (s *Service) ProposeUpdate(cnc *ProposeUpdate) (*ProposeUpdateReply, error)
 	}
 	sid.Lock()
 	defer sid.Unlock()
-	return &ProposeUpdateReply{
-		Propose: sid.Proposed,
-	}, nil
+	reader, err := s.authorizeRead(cnc.ID, sid.Latest, cnc.Auth)
+	if err != nil {
+		return nil, err
+	}
+	reply := &ProposeUpdateReply{
+		Propose:    sid.Proposed.readableBy(reader, sid.Latest),
+		ProposedBy: sid.ProposedBy,
+	}
+	if sid.Proposed != nil {
+		var err error
+		reply.Hash, err = sid.Proposed.Hash(s.Suite().(kyber.HashFactory))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return reply, nil
 }
 
 // ProposeVote takes int account a vote for the proposed data. It also verifies
@@ -409,6 +929,9 @@ func (s *Service) ProposeUpdate(cnc *ProposeUpdate) (*ProposeUpdateReply, error)
 // An empty signature signifies that the vote has been rejected.
 func (s *Service) ProposeVote(v *ProposeVote) (*ProposeVoteReply, error) {
 	log.Lvl2(s, "Voting on proposal")
+	if s.isReadReplica() {
+		return nil, ErrorReadReplica
+	}
 	// First verify if the signature is legitimate
 	sid := s.getIdentityStorage(v.ID)
 	if sid == nil {
@@ -420,6 +943,9 @@ func (s *Service) ProposeVote(v *ProposeVote) (*ProposeVoteReply, error) {
 	err := func() error {
 		sid.Lock()
 		defer sid.Unlock()
+		if sid.Suspended {
+			return ErrorSuspended
+		}
 		owner, ok := sid.Latest.Device[v.Signer]
 		if !ok {
 			return errors.New("Didn't find signer")
@@ -427,22 +953,20 @@ func (s *Service) ProposeVote(v *ProposeVote) (*ProposeVoteReply, error) {
 		if sid.Proposed == nil {
 			return errors.New("No proposed block")
 		}
-		log.Lvl3("Voting on", sid.Proposed.Device)
-		hash, err := sid.Proposed.Hash(s.Suite().(kyber.HashFactory))
-		if err != nil {
-			return errors.New("Couldn't get hash")
+		if sid.proposalExpired(s.now()) {
+			return errors.New("proposal expired")
 		}
+		log.Lvl3("Voting on", sid.Proposed.Device)
 		if oldvote := sid.Proposed.Votes[v.Signer]; oldvote != nil {
 			// It can either be an update-vote (accepted), or a second
 			// vote (refused).
-			if schnorr.Verify(s.Suite(), owner.Point, hash, oldvote) == nil {
+			if s.verifyVote(sid.Proposed, owner, oldvote) == nil {
 				log.Lvl2("Already voted for that block")
 			}
 		}
 		log.Lvl3(v.Signer, "voted", v.Signature)
-		if v.Signature != nil {
-			err = schnorr.Verify(s.Suite(), owner.Point, hash, v.Signature)
-			if err != nil {
+		if v.Signature != nil && !s.deferVote(sid.Proposed, v.Signer) {
+			if err := s.verifyVote(sid.Proposed, owner, v.Signature); err != nil {
 				return errors.New("Wrong signature: " + err.Error())
 			}
 		}
@@ -453,40 +977,123 @@ func (s *Service) ProposeVote(v *ProposeVote) (*ProposeVoteReply, error) {
 	}
 
 	// Propagate the vote
-	_, err = s.propagateData(sid.LatestSkipblock.Roster, v, propagateTimeout)
+	sid.Lock()
+	roster := s.withReplicas(sid.votingRoster(sid.Latest))
+	sid.Unlock()
+	if window := s.coalescingWindow(); window > 0 {
+		return s.batchVote(v, sid, roster, window)
+	}
+	release, err := s.acquirePropagation(v.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	_, err = s.propagate(propagateKindData, roster, v, sid.propagateTimeout())
 	if err != nil {
 		return nil, err
 	}
-	votesCnt := len(sid.Proposed.Votes)
-	if votesCnt >= sid.Latest.Threshold ||
-		votesCnt == len(sid.Latest.Device) {
+	return s.commitProposal(v.ID, sid)
+}
+
+// commitProposal stores the proposal of the identity in a new skipblock if
+// it has enough votes. Only one commit per identity runs at a time, so that
+// concurrent votes don't try to store the same proposal twice, while other
+// identities can commit in parallel.
+func (s *Service) commitProposal(id ID, sid *IDBlock) (*ProposeVoteReply, error) {
+	sid.commitMutex.Lock()
+	defer sid.commitMutex.Unlock()
+	strict := s.isStrictThreshold()
+	dt := s.dynamicThreshold()
+	sid.Lock()
+	if sid.Proposed == nil {
+		// Already committed by another vote.
+		sid.Unlock()
+		return &ProposeVoteReply{}, nil
+	}
+	required := s.votesNeeded(id, sid.Latest, sid.Proposed, strict, dt)
+	if approvals(sid.Latest, sid.Proposed.Votes) >= required && (s.batchVerification() || s.maxVoteAge() > 0) {
+		_, invalid := s.validVotes(sid.Proposed, sid.Latest.Device, sid.Proposed.Votes)
+		for _, name := range invalid {
+			log.Lvl2("Removing invalid vote of", name)
+			delete(sid.Proposed.Votes, name)
+		}
+	}
+	// The timestamp is only added to the stored block, as it isn't part
+	// of the hash the devices voted on.
+	stamped := *sid.Proposed
+	stamped.Timestamp = nextTimestamp(sid.Latest, s.now())
+	proposed := &stamped
+	votesCnt := approvals(sid.Latest, proposed.Votes)
+	sbRoster := sid.skipchainRoster(proposed)
+	separate := sid.SkipchainRoster != nil
+	delayed := votesCnt >= required && s.delayCommit(id, sid, s.now())
+	sid.Unlock()
+	if delayed {
+		s.save()
+		return &ProposeVoteReply{}, nil
+	}
+	if votesCnt >= required {
 		// If we have enough signatures, make a new data-skipblock and
 		// propagate it
 		log.Lvl3("Having majority or all votes")
 
+		// The new nodes need the identity to verify the new block.
+		moving := !separate && proposed.Roster != nil
+		if moving {
+			if err := s.handoff(id, sid, proposed.Roster); err != nil {
+				return nil, err
+			}
+		}
+
 		// Making a new data-skipblock
-		log.Lvl3("Sending data-block with", sid.Proposed.Device)
+		log.Lvl3("Sending data-block with", proposed.Device)
 		sb := &skipchain.SkipBlock{
 			SkipBlockFix: &skipchain.SkipBlockFix{
 				GenesisID: sid.LatestSkipblock.SkipChainID(),
-				Roster:    sid.Proposed.Roster,
+				Roster:    sbRoster,
 			},
 		}
-		reply, err := s.storeSkipBlock(sb, sid.Proposed)
+		reply, err := s.storeSkipBlock(sb, proposed)
 		if err != nil {
 			return nil, err
 		}
 		_, msg, _ := network.Unmarshal(reply.Latest.Data, s.Suite())
 		log.Lvl3("SB signed is", msg.(*Data).Device)
 		usb := &UpdateSkipBlock{
-			ID:     v.ID,
-			Latest: reply.Latest,
+			ID:       id,
+			Latest:   reply.Latest,
+			Previous: reply.Previous,
+		}
+		roster := reply.Latest.Roster
+		if separate && msg.(*Data).Roster != nil {
+			roster = msg.(*Data).Roster
+		}
+		if moving {
+			// The old nodes hand off with the block pointing to the
+			// new roster.
+			roster = unionRoster(roster, reply.Previous.Roster)
 		}
-		_, err = s.propagateSkipBlock(reply.Latest.Roster, usb, propagateTimeout)
+		_, err = s.propagate(propagateKindSkipBlock, s.withReplicas(roster), usb, sid.propagateTimeout())
 		if err != nil {
-			return nil, err
+			// The block is stored, so the nodes that missed it
+			// catch up with the skipchain during the next sweep or
+			// data-update.
+			log.Warn(s.ServerIdentity(), "couldn't propagate new block:", err)
+			sid.Lock()
+			if _, err := s.catchUp(id, sid); err != nil {
+				log.Error("couldn't catch up with the new block:", err)
+			}
+			s.save()
+			sid.Unlock()
 		}
-		return &ProposeVoteReply{sid.LatestSkipblock}, nil
+		pvr := &ProposeVoteReply{Data: reply.Latest}
+		if reply.Previous != nil && len(reply.Previous.ForwardLink) > 0 {
+			pvr.Link = reply.Previous.ForwardLink[0].Copy()
+		}
+		return pvr, nil
+	}
+	if ev := s.checkQuorum(id, sid); ev != nil {
+		s.emit(ev)
 	}
 	return &ProposeVoteReply{}, nil
 }
@@ -508,8 +1115,10 @@ func (s *Service) VerifyBlock(sbID []byte, sb *skipchain.SkipBlock) bool {
 		if !ok {
 			return fmt.Errorf("got packet-type %s", reflect.TypeOf(dataInt))
 		}
-		hash, err := data.Hash(s.Suite().(kyber.HashFactory))
-		if err != nil {
+		if data.Checkpoint != nil {
+			return errors.New("only a genesis-block can be a checkpoint")
+		}
+		if err := data.checkNewBlock(); err != nil {
 			return err
 		}
 		// Verify that all signatures work out
@@ -518,10 +1127,14 @@ func (s *Service) VerifyBlock(sbID []byte, sb *skipchain.SkipBlock) bool {
 		}
 		s.storageMutex.Lock()
 		defer s.storageMutex.Unlock()
+		// The ID of a compacted identity is the genesis-block of its
+		// first skipchain.
+		id := ID(sb.SkipChainID())
 		var latest *skipchain.SkipBlock
-		for _, id := range s.Storage.Identities {
-			if id.LatestSkipblock.Hash.Equal(sb.BackLinkIDs[0]) {
-				latest = id.LatestSkipblock
+		for key, sid := range s.Storage.Identities {
+			if sid.LatestSkipblock.Hash.Equal(sb.BackLinkIDs[0]) {
+				latest = sid.LatestSkipblock
+				id = ID(key)
 			}
 		}
 		if latest == nil {
@@ -543,19 +1156,21 @@ func (s *Service) VerifyBlock(sbID []byte, sb *skipchain.SkipBlock) bool {
 			return err
 		}
 		dataLatest := dataInt.(*Data)
-		sigCnt := 0
-		for dev, sig := range data.Votes {
-			if pub := dataLatest.Device[dev]; pub != nil {
-				log.Lvl3("Against public-key", pub.Point)
-				if err := schnorr.Verify(s.Suite(), pub.Point, hash, sig); err == nil {
-					log.Lvl2("Found correct signature of device", dev)
-					sigCnt++
-				}
-			} else {
-				log.Lvl2("Not representative signature detected:", dev)
-			}
+		if name := data.duplicateDevice(); name != "" {
+			return fmt.Errorf("public key of device %s is used twice", name)
 		}
-		if sigCnt >= dataLatest.Threshold || sigCnt == len(dataLatest.Device) {
+		if err := data.checkHashVersion(dataLatest); err != nil {
+			return err
+		}
+		if err := checkTimestamp(data, dataLatest, s.now()); err != nil {
+			return err
+		}
+		valid, invalid := s.validVotes(data, dataLatest.Device, data.Votes)
+		if len(invalid) > 0 {
+			log.Lvl2("Invalid or not representative signatures of", invalid)
+		}
+		if dataLatest.weightOf(valid) >= s.votesNeeded(id, dataLatest, data,
+			s.Storage.StrictThreshold, s.Storage.DynamicThreshold) {
 			return nil
 		}
 		return errors.New("not enough signatures")
@@ -580,6 +1195,24 @@ func (s *Service) propagateDataHandler(msg network.Message) {
 		id = msg.(*ProposeSend).ID
 	case *ProposeVote:
 		id = msg.(*ProposeVote).ID
+	case *PropagateVotes:
+		id = msg.(*PropagateVotes).ID
+	case *Heartbeat:
+		id = msg.(*Heartbeat).ID
+	case *SuspendIdentity:
+		id = msg.(*SuspendIdentity).ID
+	case *ResumeIdentity:
+		id = msg.(*ResumeIdentity).ID
+	case *CancelProposal:
+		id = msg.(*CancelProposal).ID
+	case *RevokeSession:
+		id = msg.(*RevokeSession).ID
+	case *CompactIdentity:
+		id = msg.(*CompactIdentity).ID
+	case *RevokeVote:
+		id = msg.(*RevokeVote).ID
+	case *DeleteIdentity:
+		id = msg.(*DeleteIdentity).ID
 	default:
 		log.Errorf("Got an unidentified propagation-request: %v", msg)
 		return
@@ -594,34 +1227,115 @@ func (s *Service) propagateDataHandler(msg network.Message) {
 		sid.Lock()
 		defer sid.Unlock()
 		switch msg.(type) {
-		case *ProposeSend:
-			p := msg.(*ProposeSend)
-			sid.Proposed = p.Propose
-		case *ProposeVote:
-			v := msg.(*ProposeVote)
-			d := sid.Latest.Device[v.Signer]
-			if d == nil {
-				log.Error("Got signature from unknown device", v.Signer)
+		case *ProposeSend, *ProposeVote, *PropagateVotes:
+			if sid.Suspended {
+				log.Lvl2(s.ServerIdentity(), "ignoring proposal or vote of suspended identity")
 				return
 			}
-			hash, err := sid.Proposed.Hash(s.Suite().(kyber.HashFactory))
-			if err != nil {
-				log.Error("Couldn't hash proposed block:", err)
+		}
+		switch msg.(type) {
+		case *ProposeSend:
+			p := msg.(*ProposeSend)
+			// A replayed or delayed proposal must not replace a
+			// newer one or come back after it has been committed.
+			if p.Index < sid.index() || p.Time <= sid.ProposedAt {
+				log.Lvl2(s.ServerIdentity(), "ignoring old proposal")
 				return
 			}
-			err = schnorr.Verify(s.Suite(), d.Point, hash, v.Signature)
-			if err != nil {
-				log.Error("Got invalid signature:", err)
+			if err := p.verifyProposer(s, sid.Latest); err != nil {
+				log.Error("Invalid proposer:", err)
 				return
 			}
-			if len(sid.Proposed.Votes) == 0 {
-				// Make sure the map is initialised
-				sid.Proposed.Votes = make(map[string][]byte)
+			sid.Proposed = p.Propose
+			sid.ProposedBy = p.Proposer
+			sid.ProposedAt = p.Time
+			sid.ProposalExpires = p.Expires
+			sid.ProposalDelay = p.Delay
+			sid.CommitAt = 0
+			sid.quorumReported = false
+			sid.rejected = nil
+			s.attachHeartbeats(id, sid)
+			s.closeVoteSubscriptions(id)
+		case *ProposeVote:
+			s.applyVote(id, sid, msg.(*ProposeVote))
+		case *PropagateVotes:
+			for _, v := range msg.(*PropagateVotes).Votes {
+				s.applyVote(id, sid, v)
 			}
-			sid.Proposed.Votes[v.Signer] = v.Signature
+		case *Heartbeat:
+			s.recordHeartbeat(sid, msg.(*Heartbeat))
+			return
+		case *SuspendIdentity:
+			r := msg.(*SuspendIdentity)
+			s.applySuspend(id, sid, true, r.Time, r.Signatures)
+		case *ResumeIdentity:
+			r := msg.(*ResumeIdentity)
+			s.applySuspend(id, sid, false, r.Time, r.Signatures)
+		case *CancelProposal:
+			s.applyCancel(id, sid, msg.(*CancelProposal))
+		case *RevokeSession:
+			s.applyRevoke(id, sid, msg.(*RevokeSession))
+		case *CompactIdentity:
+			s.applyCompact(id, sid, msg.(*CompactIdentity))
+		case *RevokeVote:
+			s.applyRevokeVote(id, sid, msg.(*RevokeVote))
+		case *DeleteIdentity:
+			s.applyDelete(id, sid, msg.(*DeleteIdentity))
 		}
-		s.save()
+		s.saveLater()
+	}
+}
+
+// applyVote verifies the vote and adds it to the proposal of the identity.
+// It must be called with the lock of sid held.
+func (s *Service) applyVote(id ID, sid *IDBlock, v *ProposeVote) {
+	d := sid.Latest.Device[v.Signer]
+	if d == nil {
+		log.Error("Got signature from unknown device", v.Signer)
+		return
+	}
+	if sid.Proposed == nil {
+		log.Lvl2("Got vote without a proposal - probably already committed")
+		return
+	}
+	if sid.proposalExpired(s.now()) {
+		log.Lvl2("Got vote for an expired proposal")
+		return
+	}
+	if len(v.Signature) == 0 {
+		// A rejection isn't signed, so storing it would let anybody
+		// remove the approval of the device.
+		log.Lvl2("Device", v.Signer, "rejected the proposal")
+		if sid.rejected == nil {
+			sid.rejected = make(map[string]bool)
+		}
+		sid.rejected[v.Signer] = true
+		return
+	}
+	hash, err := sid.Proposed.Hash(s.Suite().(kyber.HashFactory))
+	if err != nil {
+		log.Error("Couldn't hash proposed block:", err)
+		return
+	}
+	if !s.deferVote(sid.Proposed, v.Signer) {
+		if err := s.verifyVote(sid.Proposed, d, v.Signature); err != nil {
+			log.Error("Got invalid signature:", err)
+			return
+		}
+		sid.markSeen(v.Signer, s.now())
 	}
+	if len(sid.Proposed.Votes) == 0 {
+		// Make sure the map is initialised
+		sid.Proposed.Votes = make(map[string][]byte)
+	}
+	sid.Proposed.Votes[v.Signer] = v.Signature
+	s.notifyVote(hash, &VoteProgress{
+		ID:     id,
+		Signer: v.Signer,
+		Votes:  approvals(sid.Latest, sid.Proposed.Votes),
+		Threshold: s.votesNeeded(id, sid.Latest, sid.Proposed,
+			s.isStrictThreshold(), s.dynamicThreshold()),
+	})
 }
 
 // propagateSkipBlock saves a new skipblock to the identity
@@ -644,9 +1358,21 @@ func (s *Service) propagateSkipBlockHandler(msg network.Message) {
 		return
 	}
 
+	replica := s.isReadReplica()
 	sid := s.getIdentityStorage(usb.ID)
+	if sid == nil && replica {
+		log.Error("read-replica can't verify a skipblock of an unknown identity")
+		return
+	}
 	if sid == nil {
-		if i, _ := skipblock.Roster.Search(s.ServerIdentity().ID); i < 0 {
+		inRoster := func(r *onet.Roster) bool {
+			if r == nil {
+				return false
+			}
+			i, _ := r.Search(s.ServerIdentity().ID)
+			return i >= 0
+		}
+		if !inRoster(skipblock.Roster) && !inRoster(al.Roster) {
 			log.Error("asked to store new skipblock but we're not in the roster")
 			return
 		}
@@ -658,16 +1384,58 @@ func (s *Service) propagateSkipBlockHandler(msg network.Message) {
 		s.setIdentityStorage(usb.ID, sid)
 	}
 	sid.Lock()
-	defer sid.Unlock()
+	if !skipblock.SkipChainID().Equal(sid.LatestSkipblock.SkipChainID()) {
+		// A late block of a compacted skipchain.
+		sid.Unlock()
+		log.Lvl2(s.ServerIdentity(), "ignoring skipblock of another skipchain")
+		return
+	}
+	if skipblock.Index < sid.LatestSkipblock.Index ||
+		skipblock.Hash.Equal(sid.LatestSkipblock.Hash) {
+		// Already caught up with the skipchain.
+		sid.Unlock()
+		log.Lvl2(s.ServerIdentity(), "ignoring old skipblock")
+		return
+	}
+	if replica {
+		if err := verifyUpdate(sid, usb); err != nil {
+			sid.Unlock()
+			log.Error(s.ServerIdentity(), "refusing skipblock:", err)
+			return
+		}
+	}
+	// The votes of the block have been verified with the block.
+	now := s.now()
+	for name := range al.Votes {
+		sid.markSeen(name, now)
+	}
 	sid.LatestSkipblock = skipblock
 	sid.Latest = al
 	sid.Proposed = nil
-	s.save()
+	sid.ProposedBy = ""
+	sid.pruneSeen()
+	s.saveLater()
+	s.closeVoteSubscriptions(usb.ID)
+	index := sid.index()
+	sid.Unlock()
+	s.timestampLater(usb.ID, skipblock)
+	s.notifyCommit(usb.ID, index, al)
+	s.emit(&Event{
+		Type:      EventCommit,
+		ID:        usb.ID,
+		Data:      al,
+		Index:     index,
+		Threshold: al.Threshold,
+	})
 }
 
 // propagateIdentity stores a new identity in all nodes.
 func (s *Service) propagateIdentityHandler(msg network.Message) {
 	log.Lvlf4("Got msg %+v %v", msg, reflect.TypeOf(msg).String())
+	if h, ok := msg.(*HandoffIdentity); ok {
+		s.storeHandoff(h)
+		return
+	}
 	pi, ok := msg.(*PropagateIdentity)
 	if !ok {
 		log.Error("Got a wrong message for propagation")
@@ -725,6 +1493,9 @@ func (s *Service) setIdentityStorage(id ID, is *IDBlock) {
 	log.Lvlf3("%s %x %v", s.Context.ServerIdentity(), id[0:8], is.Latest.Device)
 	s.Storage.Identities[string(id)] = is
 	s.save()
+	if is.LatestSkipblock != nil {
+		s.searchIndex.update(id, is.index(), is.Latest)
+	}
 }
 
 // verifySkipchainAuth adds a new key for authentication to the
@@ -747,8 +1518,7 @@ func (s *Service) verifySkipchainAuth() kyber.Scalar {
 // saves the actual identity
 func (s *Service) save() {
 	log.Lvl3("Saving service")
-	err := s.Save(storageKey, s.Storage)
-	if err != nil {
+	if err := s.writeStorage(); err != nil {
 		log.Error("Couldn't save file:", err)
 	}
 }
@@ -760,17 +1530,23 @@ func (s *Service) clearIdentities() {
 // Tries to load the configuration and updates if a configuration
 // is found, else it returns an error.
 func (s *Service) tryLoad() error {
-	msg, err := s.Load(storageKey)
+	storage, err := s.readStorage(storageKey)
 	if err != nil {
-		return err
-	}
-	if msg != nil {
-		var ok bool
-		s.Storage, ok = msg.(*Storage)
-		if !ok {
-			return errors.New("Data of wrong type")
+		log.Error(s.ServerIdentity(), "storage is corrupt, trying backup:", err)
+		backup, errBak := s.readStorage(storageBackupKey)
+		if errBak != nil || backup == nil {
+			return err
+		}
+		storage = backup
+	} else if storage == nil {
+		storage, err = s.loadLegacyStorage()
+		if err != nil {
+			return err
 		}
 	}
+	if storage != nil {
+		s.Storage = storage
+	}
 	if s.Storage == nil {
 		s.Storage = &Storage{}
 	}
@@ -792,6 +1568,9 @@ func (s *Service) tryLoad() error {
 	if s.Storage.Auth.adminKeys == nil {
 		s.Storage.Auth.adminKeys = []kyber.Point{}
 	}
+	if err := s.loadRPCLog(); err != nil {
+		return err
+	}
 	log.Lvl3("Successfully loaded")
 	return nil
 }
@@ -801,25 +1580,35 @@ func newIdentityService(c *onet.Context) (onet.Service, error) {
 		ServiceProcessor: onet.NewServiceProcessor(c),
 		skipchain:        c.Service(skipchain.ServiceName).(*skipchain.Service),
 	}
+	s.db, s.bucket = c.GetAdditionalBucket(storageBucket)
 	if as, ok := c.Suite().(anon.Suite); ok {
 		s.anonSuite = as
 	} else {
 		return nil, errors.New("suite does not implement anon.Suite")
 	}
 
-	var err error
+	topology, err := topologyFromEnv()
+	if err != nil {
+		return nil, err
+	}
 	s.propagateIdentity, err =
-		messaging.NewPropagationFunc(c, "IdentityPropagateID", s.propagateIdentityHandler, 0)
+		messaging.NewPropagationFunc(c, "IdentityPropagateID",
+			s.propagationHandler(propagateKindIdentity), 0,
+			topology)
 	if err != nil {
 		return nil, err
 	}
 	s.propagateSkipBlock, err =
-		messaging.NewPropagationFunc(c, "IdentityPropagateSB", s.propagateSkipBlockHandler, 0)
+		messaging.NewPropagationFunc(c, "IdentityPropagateSB",
+			s.propagationHandler(propagateKindSkipBlock), 0,
+			topology)
 	if err != nil {
 		return nil, err
 	}
 	s.propagateData, err =
-		messaging.NewPropagationFunc(c, "IdentityPropagateConf", s.propagateDataHandler, 0)
+		messaging.NewPropagationFunc(c, "IdentityPropagateConf",
+			s.propagationHandler(propagateKindData), 0,
+			topology)
 	if err != nil {
 		return nil, err
 	}
@@ -827,14 +1616,41 @@ func newIdentityService(c *onet.Context) (onet.Service, error) {
 		log.Error(err)
 		return nil, err
 	}
-	if err := s.RegisterHandlers(s.ProposeSend, s.ProposeVote,
-		s.CreateIdentity, s.ProposeUpdate, s.DataUpdate, s.PinRequest,
-		s.StoreKeys, s.Authenticate); err != nil {
+	s.readReplicaFromEnv()
+	if n := s.reconcile(); n > 0 {
+		log.Lvl2(s.ServerIdentity(), "reconciled", n, "identities with their skipchain")
+	}
+	s.debugFromEnv()
+	s.searchIndexFromEnv()
+	// Only the requests changing the state are logged.
+	handlers := []interface{}{s.ProposeUpdate, s.DataUpdate, s.Authenticate,
+		s.GetValuesByPrefix, s.Heartbeat, s.ReadChallenge, s.ListIdentities,
+		s.GetRPCLog, s.GetDataAtTime, s.GetIdentityState, s.VerifyConsistency,
+		s.DumpState, s.Search, s.PendingVotes, s.LastSeen,
+		s.GetTimestamp, s.PropagationSupport, s.ListSessions, s.ProposeStatus, s.GetDataHistory,
+		s.GetLatest}
+	for _, h := range []interface{}{s.ProposeSend, s.ProposeVote,
+		s.CreateIdentity, s.PinRequest, s.StoreKeys, s.ProposeReplace,
+		s.SuspendIdentity, s.ResumeIdentity, s.ForwardBlock,
+		s.ProposeRosterChange, s.CancelProposal, s.RevokeSession,
+		s.CompactIdentity, s.ProposeRemoveDevice, s.RevokeVote, s.DeleteIdentity,
+		s.ProposeDataBatch} {
+		handlers = append(handlers, s.logged(h))
+	}
+	if err := s.RegisterHandlers(handlers...); err != nil {
 		log.Error("Registration error:", err)
 		return nil, err
 	}
 	skipchain.RegisterVerification(c, VerifyIdentity, s.VerifyBlock)
 	s.tagsLimits = make(map[string]int8)
 	s.pointsLimits = make(map[string]int8)
+	s.quorumTimeout = defaultQuorumTimeout
+	s.sweepers = []sweeper{s.sweepProposal, s.sweepLagging, s.sweepDelayed}
+	s.verifiers = []VoteVerifier{&SchnorrVerifier{Suite: s.Suite()}}
+	s.SetSubscriptionLimits(defaultMaxSubscriptions,
+		defaultMaxClientSubscriptions, defaultSubscriptionIdle)
+	s.SetSweepInterval(defaultSweepInterval)
+	s.SetPropagationLimit(defaultPropagationLimit, defaultPropagationWait)
+	s.SetDataLimits(defaultMaxValueSize, defaultMaxDataSize)
 	return s, nil
 }
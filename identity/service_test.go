@@ -1,8 +1,21 @@
 package identity
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/sign/anon"
 	"github.com/dedis/kyber/sign/schnorr"
@@ -10,7 +23,11 @@ import (
 	"github.com/dedis/kyber/util/random"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/satori/go.uuid.v1"
 )
 
 func TestMain(m *testing.M) {
@@ -28,7 +45,7 @@ func TestService_CreateIdentity2(t *testing.T) {
 	set := anon.Set([]kyber.Point{kp.Public, kp2.Public})
 	service.Storage.Auth.sets = append(service.Storage.Auth.sets, set)
 
-	da := NewData(ro, 50, kp.Public, "one")
+	da := NewData(ro, 1, kp.Public, "one")
 	ci := &CreateIdentity{}
 	ci.Type = PoPAuth
 	ci.Data = da
@@ -57,7 +74,7 @@ func TestService_CreateIdentity3(t *testing.T) {
 	kp := key.NewKeyPair(tSuite)
 	service.Storage.Auth.keys = append(service.Storage.Auth.keys, kp.Public)
 
-	da := NewData(ro, 50, kp.Public, "one")
+	da := NewData(ro, 1, kp.Public, "one")
 	ci := &CreateIdentity{}
 	ci.Type = PublicAuth
 	ci.Data = da
@@ -76,3 +93,2574 @@ func TestService_CreateIdentity3(t *testing.T) {
 	assert.True(t, ok)
 	assert.NotNil(t, id)
 }
+
+func TestService_CreateIdentityVerifiers(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	_, ro, s := local.MakeSRS(tSuite, 3, identityService)
+	service := s.(*Service)
+
+	kp := key.NewKeyPair(tSuite)
+	ci := &CreateIdentity{Data: NewData(ro, 1, kp.Public, "one")}
+	air, err := service.CreateIdentityInternal(ci, "", "")
+	require.Nil(t, err)
+	require.Equal(t, VerificationIdentity, air.Genesis.VerifierIDs)
+
+	ci.Verifiers = []skipchain.VerifierID{VerifyIdentity, skipchain.VerifyBase}
+	air, err = service.CreateIdentityInternal(ci, "", "")
+	require.Nil(t, err)
+	require.Equal(t, ci.Verifiers, air.Genesis.VerifierIDs)
+
+	unknown := skipchain.VerifierID(uuid.NewV5(uuid.NamespaceURL, "Unknown"))
+	ci.Verifiers = []skipchain.VerifierID{VerifyIdentity, unknown}
+	_, err = service.CreateIdentityInternal(ci, "", "")
+	require.NotNil(t, err)
+}
+
+func TestService_CreateIdentityPropagateTimeout(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	_, ro, s := local.MakeSRS(tSuite, 3, identityService)
+	service := s.(*Service)
+
+	kp := key.NewKeyPair(tSuite)
+	ci := &CreateIdentity{Data: NewData(ro, 1, kp.Public, "one")}
+	for _, t0 := range []time.Duration{time.Millisecond, 5 * time.Minute} {
+		ci.PropagateTimeout = int64(t0)
+		_, err := service.CreateIdentityInternal(ci, "", "")
+		require.NotNil(t, err)
+	}
+
+	ci.PropagateTimeout = 0
+	air, err := service.CreateIdentityInternal(ci, "", "")
+	require.Nil(t, err)
+	sid := service.getIdentityStorage(ID(air.Genesis.Hash))
+	require.Equal(t, propagateTimeout, sid.propagateTimeout())
+
+	ci.Data.Storage["other"] = "identity"
+	ci.PropagateTimeout = int64(time.Second)
+	air, err = service.CreateIdentityInternal(ci, "", "")
+	require.Nil(t, err)
+	sid = service.getIdentityStorage(ID(air.Genesis.Hash))
+	require.Equal(t, time.Second, sid.propagateTimeout())
+}
+
+func TestService_CreateIdentityIdempotent(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	_, ro, s := local.MakeSRS(tSuite, 3, identityService)
+	service := s.(*Service)
+	blocks := func() int {
+		reply, err := service.skipchain.GetAllSkipchains(&skipchain.GetAllSkipchains{})
+		require.Nil(t, err)
+		return len(reply.SkipChains)
+	}
+
+	kp := key.NewKeyPair(tSuite)
+	ci := &CreateIdentity{Data: NewData(ro, 1, kp.Public, "one")}
+	ci.Data.Timestamp = time.Now().UnixNano()
+	air, err := service.CreateIdentityInternal(ci, "", "")
+	require.Nil(t, err)
+	stored := blocks()
+	// A retry returns the same identity.
+	again, err := service.CreateIdentityInternal(ci, "", "")
+	require.Nil(t, err)
+	require.True(t, air.Genesis.Hash.Equal(again.Genesis.Hash))
+	require.Equal(t, stored, blocks())
+	require.Equal(t, 1, len(service.Storage.Identities))
+
+	// Another request creates another identity.
+	ci.Data.Timestamp++
+	other, err := service.CreateIdentityInternal(ci, "", "")
+	require.Nil(t, err)
+	require.False(t, air.Genesis.Hash.Equal(other.Genesis.Hash))
+}
+
+func TestService_QuorumUnreachable(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 2)
+	defer l.CloseAll()
+	s := td.service
+	events := make(chan *Event, 10)
+	s.RegisterHook(func(ev *Event) {
+		if ev.Type == EventQuorumUnreachable {
+			events <- ev
+		}
+	})
+	noEvent := func(msg string) {
+		s.CheckQuorum()
+		select {
+		case <-events:
+			t.Fatal(msg)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	reject := func(i int) {
+		dev := td.Devices[i]
+		reply := &ProposeVoteReply{}
+		require.Nil(t, dev.send(dev.Data.Roster.List[0],
+			PrepareReject(td.ID(), dev.DeviceName), reply))
+		require.Nil(t, reply.Data)
+	}
+
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+
+	s.SetQuorumTimeout(0)
+	noEvent("quorum-event without timeout")
+	s.SetQuorumTimeout(time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	// The proposal is slow, but dev1 and dev2 can still approve it.
+	noEvent("quorum-event for a reachable proposal")
+	// With dev2 still undecided, the threshold of 2 can be reached.
+	reject(1)
+	noEvent("quorum-event with an undecided device")
+
+	// All devices voted, but only one approved: the proposal is stuck.
+	reject(2)
+	s.CheckQuorum()
+	select {
+	case ev := <-events:
+		require.Equal(t, 1, ev.Votes)
+		require.Equal(t, 2, ev.Threshold)
+		require.Equal(t, td.ID(), ev.ID)
+	case <-time.After(time.Second):
+		t.Fatal("didn't get quorum-event")
+	}
+
+	// It is only reported once.
+	noEvent("quorum-event sent twice")
+}
+
+func TestService_Sweep(t *testing.T) {
+	l, services, roster := newTestNodes(3)
+	defer l.CloseAll()
+	for _, s := range services {
+		s.(*Service).SetSweepInterval(0)
+	}
+	clock := useFakeClock(services)
+	s := services[0].(*Service)
+
+	propose := func(name string) *Identity {
+		c := createIdentity(l, services, roster, name)
+		data := c.Data.Copy()
+		data.Storage["key"] = "value"
+		require.Nil(t, c.ProposeSend(data))
+		return c
+	}
+	// Only the node getting the proposal needs a maximum age.
+	s.SetProposalMaxAge(time.Minute)
+	expired := propose("one")
+	s.SetProposalMaxAge(0)
+	fresh := propose("two")
+
+	// All nodes store the time and expiry of the node that got the
+	// proposal.
+	sid := s.getIdentityStorage(expired.ID)
+	for _, other := range services[1:] {
+		osid := other.(*Service).getIdentityStorage(expired.ID)
+		require.Equal(t, sid.ProposedAt, osid.ProposedAt)
+		require.Equal(t, sid.ProposalExpires, osid.ProposalExpires)
+	}
+
+	clock.advance(2 * time.Minute)
+	require.NotNil(t, proposeUpVote(expired))
+	for _, other := range services {
+		other.(*Service).Sweep()
+		require.Nil(t, other.(*Service).getIdentityStorage(expired.ID).Proposed)
+		require.NotNil(t, other.(*Service).getIdentityStorage(fresh.ID).Proposed)
+	}
+}
+
+func TestService_ProposalTTL(t *testing.T) {
+	l, services, roster := newTestNodes(3)
+	defer l.CloseAll()
+	for _, s := range services {
+		s.(*Service).SetSweepInterval(0)
+	}
+	clock := useFakeClock(services)
+	s := services[0].(*Service)
+	c := createIdentity(l, services, roster, "one")
+
+	// Without a maximum age, the TTL of the proposal is used.
+	data := c.Data.Copy()
+	data.Storage["key"] = "one"
+	require.Nil(t, c.ProposeSendTTL(data, time.Minute))
+	st, err := c.ProposeStatus()
+	require.Nil(t, err)
+	require.Equal(t, int64(time.Minute), st.Remaining)
+	require.NotNil(t, c.ProposeSendTTL(data, -time.Minute))
+
+	// A longer TTL than the maximum age is cut.
+	s.SetProposalMaxAge(30 * time.Second)
+	clock.advance(2 * time.Minute)
+	data.Storage["key"] = "two"
+	require.Nil(t, c.ProposeSendTTL(data, time.Minute))
+	st, err = c.ProposeStatus()
+	require.Nil(t, err)
+	require.Equal(t, int64(30*time.Second), st.Remaining)
+
+	clock.advance(40 * time.Second)
+	_, err = c.ProposeStatus()
+	require.NotNil(t, err)
+	for _, other := range services {
+		other.(*Service).Sweep()
+		require.Nil(t, other.(*Service).getIdentityStorage(c.ID).Proposed)
+	}
+}
+
+func TestService_SweepInterval(t *testing.T) {
+	l, services, _ := newTestNodes(1)
+	defer l.CloseAll()
+	s := services[0].(*Service)
+
+	// Changing the interval replaces the timer instead of adding one.
+	s.SetSweepInterval(time.Hour)
+	s.sweepMutex.Lock()
+	first := s.sweepTimer
+	s.sweepMutex.Unlock()
+	s.SetSweepInterval(time.Minute)
+	s.sweepMutex.Lock()
+	require.False(t, first.Stop())
+	gen := s.sweepGen
+	s.sweepMutex.Unlock()
+	// A sweep of an old timer doesn't re-arm it.
+	s.sweepAndReschedule(gen - 1)
+	s.sweepMutex.Lock()
+	require.Equal(t, gen, s.sweepGen)
+	s.sweepMutex.Unlock()
+
+	require.Nil(t, s.Close())
+	s.sweepMutex.Lock()
+	require.Nil(t, s.sweepTimer)
+	s.sweepMutex.Unlock()
+}
+
+func TestService_SubscribeVotes(t *testing.T) {
+	l, services, roster := newTestNodes(3)
+	defer l.CloseAll()
+	s := services[0].(*Service)
+
+	c := createIdentity(l, services, roster, "one")
+	_, _, err := s.SubscribeVotes(c.ID, "client")
+	require.NotNil(t, err)
+
+	data := c.Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, c.ProposeSend(data))
+	progress, cancel, err := s.SubscribeVotes(c.ID, "client")
+	require.Nil(t, err)
+	defer cancel()
+
+	require.Nil(t, proposeUpVote(c))
+	select {
+	case vp := <-progress:
+		require.Equal(t, "one", vp.Signer)
+		require.Equal(t, 1, vp.Votes)
+	case <-time.After(time.Second):
+		t.Fatal("didn't get vote-progress")
+	}
+	// The proposal got committed, so the channel must be closed.
+	select {
+	case _, ok := <-progress:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("subscription has not been closed")
+	}
+}
+
+func TestService_SubscribeCommits(t *testing.T) {
+	l, services, roster := newTestNodes(3)
+	defer l.CloseAll()
+	s := services[1].(*Service)
+
+	c := createIdentity(l, services, roster, "one")
+	_, _, err := s.SubscribeCommits(ID("unknown"), "client")
+	require.NotNil(t, err)
+	blocks, cancel, err := s.SubscribeCommits(c.ID, "client")
+	require.Nil(t, err)
+
+	// The subscription stays open over several blocks.
+	for i := 1; i <= 2; i++ {
+		data := c.Data.Copy()
+		data.Storage["key"] = strconv.Itoa(i)
+		require.Nil(t, c.ProposeSend(data))
+		require.Nil(t, proposeUpVote(c))
+		hash, err := data.Hash(tSuite)
+		require.Nil(t, err)
+		select {
+		case nb := <-blocks:
+			require.Equal(t, c.ID, nb.ID)
+			require.Equal(t, i, nb.Index)
+			require.Equal(t, hash, nb.Hash)
+		case <-time.After(time.Second):
+			t.Fatal("didn't get new block")
+		}
+	}
+
+	cancel()
+	_, ok := <-blocks
+	require.False(t, ok)
+	s.subscriptions.Lock()
+	require.Equal(t, 0, s.subscriptions.total)
+	s.subscriptions.Unlock()
+}
+
+func TestService_SubscriptionsLocal(t *testing.T) {
+	l, services, roster := newTestNodes(3)
+	defer l.CloseAll()
+	// The client talks to the first node, the subscription and the hook
+	// are on the second one.
+	s := services[1].(*Service)
+	events := make(chan *Event, 10)
+	s.RegisterHook(func(ev *Event) { events <- ev })
+
+	c := createIdentity(l, services, roster, "one")
+	data := c.Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, c.ProposeSend(data))
+	progress, cancel, err := s.SubscribeVotes(c.ID, "client")
+	require.Nil(t, err)
+	defer cancel()
+
+	// Neither is known to the other nodes.
+	for _, other := range []onet.Service{services[0], services[2]} {
+		o := other.(*Service)
+		o.subscriptions.Lock()
+		require.Equal(t, 0, o.subscriptions.total)
+		o.subscriptions.Unlock()
+		o.hooksMutex.Lock()
+		require.Equal(t, 0, len(o.hooks))
+		o.hooksMutex.Unlock()
+	}
+
+	require.Nil(t, proposeUpVote(c))
+	select {
+	case vp := <-progress:
+		require.Equal(t, "one", vp.Signer)
+	case <-time.After(time.Second):
+		t.Fatal("didn't get vote-progress")
+	}
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == EventCommit && ev.Index > 0 {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("didn't get commit-event")
+		}
+	}
+}
+
+func TestService_SubscriptionLimits(t *testing.T) {
+	l, services, roster := newTestNodes(3)
+	defer l.CloseAll()
+	s := services[0].(*Service)
+	s.SetSweepInterval(0)
+	s.SetSubscriptionLimits(3, 2, time.Hour)
+
+	c := createIdentity(l, services, roster, "one")
+	data := c.Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, c.ProposeSend(data))
+
+	_, cancel, err := s.SubscribeVotes(c.ID, "one")
+	require.Nil(t, err)
+	_, _, err = s.SubscribeVotes(c.ID, "one")
+	require.Nil(t, err)
+	_, _, err = s.SubscribeVotes(c.ID, "one")
+	require.Equal(t, ErrorTooManySubscriptions, err)
+	_, _, err = s.SubscribeVotes(c.ID, "two")
+	require.Nil(t, err)
+	_, _, err = s.SubscribeVotes(c.ID, "three")
+	require.Equal(t, ErrorTooManySubscriptions, err)
+
+	cancel()
+	_, _, err = s.SubscribeVotes(c.ID, "three")
+	require.Nil(t, err)
+}
+
+func TestService_SubscriptionIdle(t *testing.T) {
+	l, services, roster := newTestNodes(3)
+	defer l.CloseAll()
+	s := services[0].(*Service)
+	s.SetSweepInterval(0)
+	s.SetSubscriptionLimits(2, 0, 200*time.Millisecond)
+
+	c := createIdentity(l, services, roster, "one")
+	data := c.Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, c.ProposeSend(data))
+	active, _, err := s.SubscribeVotes(c.ID, "active")
+	require.Nil(t, err)
+	idle, _, err := s.SubscribeVotes(c.ID, "idle")
+	require.Nil(t, err)
+
+	// Only the idle client gets its subscription removed, which makes
+	// room for a new one.
+	time.Sleep(300 * time.Millisecond)
+	s.KeepAlive("active")
+	s.Sweep()
+	_, ok := <-idle
+	require.False(t, ok)
+	_, _, err = s.SubscribeVotes(c.ID, "new")
+	require.Nil(t, err)
+	_, _, err = s.SubscribeVotes(c.ID, "other")
+	require.Equal(t, ErrorTooManySubscriptions, err)
+	select {
+	case <-active:
+		t.Fatal("active subscription has been closed")
+	default:
+	}
+}
+
+func TestService_StrictThreshold(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 1)
+	defer l.CloseAll()
+	setThreshold := func(threshold int, votes ...int) *skipchain.SkipBlock {
+		data := td.Devices[0].Data.Copy()
+		data.Threshold = threshold
+		require.Nil(t, td.propose(data))
+		sb, err := td.vote(votes...)
+		require.Nil(t, err)
+		return sb
+	}
+
+	// Without strict threshold, the old threshold is enough.
+	require.NotNil(t, setThreshold(2, 0))
+	require.NotNil(t, setThreshold(1, 0, 1))
+
+	for _, s := range td.services {
+		s.(*Service).SetStrictThreshold(true)
+	}
+	// Raising the threshold needs the new threshold.
+	require.Nil(t, setThreshold(3, 0))
+	_, err := td.vote(1)
+	require.Nil(t, err)
+	sb, err := td.vote(2)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Equal(t, 3, td.Devices[0].Data.Threshold)
+
+	// Lowering the threshold needs the old threshold.
+	require.Nil(t, setThreshold(2, 0, 1))
+	sb, err = td.vote(2)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Equal(t, 2, td.Devices[0].Data.Threshold)
+}
+
+func TestService_DynamicThreshold(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 4, 4)
+	defer l.CloseAll()
+	require.NotNil(t, td.Devices[0].SendHeartbeat())
+
+	for _, s := range td.services {
+		require.NotNil(t, s.(*Service).SetDynamicThreshold(101, 1, time.Minute))
+		require.Nil(t, s.(*Service).SetDynamicThreshold(100, 1, time.Minute))
+	}
+	require.Nil(t, td.Devices[0].SendHeartbeat())
+	require.Nil(t, td.Devices[1].SendHeartbeat())
+	// A heartbeat signed with the wrong key is refused.
+	priv := td.Devices[2].Private
+	td.Devices[2].Private = td.Devices[3].Private
+	require.NotNil(t, td.Devices[2].SendHeartbeat())
+	td.Devices[2].Private = priv
+
+	// As long as the identity doesn't allow it, the static threshold is
+	// used.
+	data := td.Devices[0].Data.Copy()
+	data.AllowDynamicThreshold = true
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0, 1)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	sb, err = td.vote(2, 3)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.True(t, td.Devices[0].Data.AllowDynamicThreshold)
+
+	// Only the two devices that are online need to vote, and the block
+	// holds their heartbeats.
+	require.Nil(t, td.Devices[0].SendHeartbeat())
+	require.Nil(t, td.Devices[1].SendHeartbeat())
+	data = td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	sb, err = td.vote(0)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	sb, err = td.vote(1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Equal(t, "value", td.Devices[0].Data.Storage["key"])
+	_, msg, err := network.Unmarshal(sb.Data, td.service.Suite())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(msg.(*Data).Heartbeats))
+
+	// Once disabled, all devices need to vote again.
+	for _, s := range td.services {
+		require.Nil(t, s.(*Service).SetDynamicThreshold(0, 0, 0))
+	}
+	data = td.Devices[0].Data.Copy()
+	data.Storage["key"] = "other"
+	require.Nil(t, td.propose(data))
+	sb, err = td.vote(0, 1, 2)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	sb, err = td.vote(3)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+}
+
+// tokenVerifier accepts a vote if the credential is the token of the
+// device.
+type tokenVerifier struct{}
+
+func (tv *tokenVerifier) VerifyVote(proposed *Data, device *Device, credential []byte) error {
+	if string(credential) != "token-"+device.Point.String() {
+		return errors.New("wrong token")
+	}
+	return nil
+}
+
+func TestService_VoteVerifiers(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	for _, s := range td.services {
+		require.NotNil(t, s.(*Service).SetVoteVerifiers())
+		require.Nil(t, s.(*Service).SetVoteVerifiers(&tokenVerifier{}))
+	}
+
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	// Schnorr-signatures are not accepted anymore.
+	_, err := td.vote(0)
+	require.NotNil(t, err)
+
+	s := td.service
+	_, err = s.ProposeVote(&ProposeVote{ID: td.ID(), Signer: "dev0",
+		Signature: []byte("token")})
+	require.NotNil(t, err)
+	reply, err := s.ProposeVote(&ProposeVote{ID: td.ID(), Signer: "dev0",
+		Signature: []byte("token-" + td.Devices[0].Public.String())})
+	require.Nil(t, err)
+	require.Nil(t, reply.Data)
+	reply, err = s.ProposeVote(&ProposeVote{ID: td.ID(), Signer: "dev1",
+		Signature: []byte("token-" + td.Devices[1].Public.String())})
+	require.Nil(t, err)
+	require.NotNil(t, reply.Data)
+
+	// The other messages of the devices are checked by the verifiers,
+	// too. A tokenVerifier doesn't check them, so they are refused.
+	for _, s := range td.services {
+		require.Nil(t, s.(*Service).SetDynamicThreshold(100, 1, time.Minute))
+	}
+	require.NotNil(t, td.Devices[0].SendHeartbeat())
+	now := time.Now().UnixNano()
+	sigs := map[string][]byte{}
+	for _, dev := range td.Devices {
+		sigs[dev.DeviceName], err = dev.SignSuspend(true, now)
+		require.Nil(t, err)
+	}
+	require.NotNil(t, td.Devices[0].Suspend(now, sigs))
+	for _, s := range td.services {
+		require.Nil(t, s.(*Service).SetVoteVerifiers(&tokenVerifier{},
+			&SchnorrVerifier{Suite: tSuite}))
+	}
+	require.Nil(t, td.Devices[0].SendHeartbeat())
+}
+
+func TestService_Readers(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 1, 1)
+	defer l.CloseAll()
+	reader := key.NewKeyPair(tSuite)
+	data := td.Devices[0].Data.Copy()
+	data.Readers = []kyber.Point{reader.Public}
+	require.Nil(t, td.propose(data))
+	// The device needs to authenticate to fetch the new data.
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Equal(t, 1, len(td.Devices[0].Data.Readers))
+	_, err = td.Devices[0].GetValuesByPrefix("")
+	require.Nil(t, err)
+
+	s := td.service
+	_, err = s.DataUpdate(&DataUpdate{ID: td.ID()})
+	require.Equal(t, ErrorReadNotAuthorized, err)
+	_, err = s.ProposeUpdate(&ProposeUpdate{ID: td.ID()})
+	require.Equal(t, ErrorReadNotAuthorized, err)
+	_, err = s.VerifyConsistency(&VerifyConsistency{ID: td.ID()})
+	require.Equal(t, ErrorReadNotAuthorized, err)
+	mismatches, err := td.Devices[0].VerifyConsistency()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(mismatches))
+
+	challenge := func(priv kyber.Scalar) *ReadAuth {
+		rc, err := s.ReadChallenge(&ReadChallenge{ID: td.ID()})
+		require.Nil(t, err)
+		auth, err := NewReadAuth(td.ID(), rc.Nonce, priv)
+		require.Nil(t, err)
+		return auth
+	}
+	auth := challenge(reader.Private)
+	reply, err := s.DataUpdate(&DataUpdate{ID: td.ID(), Auth: auth})
+	require.Nil(t, err)
+	require.True(t, reply.Data.Equal(td.Devices[0].Data))
+	// A challenge can only be used once.
+	_, err = s.DataUpdate(&DataUpdate{ID: td.ID(), Auth: auth})
+	require.NotNil(t, err)
+	_, err = s.ProposeUpdate(&ProposeUpdate{ID: td.ID(),
+		Auth: challenge(key.NewKeyPair(tSuite).Private)})
+	require.Equal(t, ErrorReadNotAuthorized, err)
+
+	// Neither the list of identities nor the RPC-log show the identity.
+	list, err := td.Devices[0].ListIdentities()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(list))
+	entries, err := td.Devices[0].GetRPCLog(0, 0)
+	require.Nil(t, err)
+	for _, e := range entries {
+		require.Nil(t, e.ID)
+	}
+}
+
+func TestService_ReadRules(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 1, 1)
+	defer l.CloseAll()
+	reader := key.NewKeyPair(tSuite)
+	data := td.Devices[0].Data.Copy()
+	data.Storage["public/name"] = "team"
+	data.Storage["secret/key"] = "1234"
+	data.ReadRules = []*ReadRule{{Prefix: "secret/", Readers: []kyber.Point{reader.Public}}}
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	// The device reads all values.
+	require.Equal(t, "1234", td.Devices[0].Data.Storage["secret/key"])
+	values, err := td.Devices[0].GetValuesByPrefix("")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(values))
+
+	s := td.service
+	challenge := func(priv kyber.Scalar) *ReadAuth {
+		rc, err := s.ReadChallenge(&ReadChallenge{ID: td.ID()})
+		require.Nil(t, err)
+		auth, err := NewReadAuth(td.ID(), rc.Nonce, priv)
+		require.Nil(t, err)
+		return auth
+	}
+	// Anonymous and other readers only get the public values.
+	for _, auth := range []*ReadAuth{nil, challenge(key.NewKeyPair(tSuite).Private)} {
+		reply, err := s.GetValuesByPrefix(&GetValuesByPrefix{ID: td.ID(), Auth: auth})
+		require.Nil(t, err)
+		require.Equal(t, map[string]string{"public/name": "team"}, reply.Values)
+	}
+	up, err := s.DataUpdate(&DataUpdate{ID: td.ID()})
+	require.Nil(t, err)
+	require.Equal(t, "", up.Data.Storage["secret/key"])
+	require.Equal(t, "team", up.Data.Storage["public/name"])
+
+	reply, err := s.GetValuesByPrefix(&GetValuesByPrefix{ID: td.ID(), Prefix: "secret/",
+		Auth: challenge(reader.Private)})
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"secret/key": "1234"}, reply.Values)
+
+	// The rules are part of the hash, so they can't be changed without a
+	// vote.
+	h1, err := data.Hash(tSuite)
+	require.Nil(t, err)
+	data.ReadRules[0].Readers = nil
+	h2, err := data.Hash(tSuite)
+	require.Nil(t, err)
+	require.NotEqual(t, h1, h2)
+}
+
+func TestService_Metadata(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 1, 1)
+	defer l.CloseAll()
+	meta := &Metadata{
+		Name:        "team",
+		Description: "keys of the team",
+		Created:     time.Now().UnixNano(),
+		Owner:       "admin@example.com",
+	}
+	data := td.Devices[0].Data.Copy()
+	data.Metadata = meta
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Equal(t, meta, td.Devices[0].Data.Metadata)
+
+	list, err := td.Devices[0].ListIdentities()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(list))
+	require.Equal(t, td.ID(), list[0].ID)
+	require.Equal(t, meta, list[0].Metadata)
+	require.Equal(t, 1, list[0].Devices)
+	require.Equal(t, sb.Index, list[0].Index)
+
+	// Only the identities with the device are listed.
+	list, err = td.Devices[0].ListIdentitiesWithDevice("dev0")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(list))
+	list, err = td.Devices[0].ListIdentitiesWithDevice("unknown")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(list))
+
+	// With readers, the identity is not listed.
+	data = td.Devices[0].Data.Copy()
+	data.Readers = []kyber.Point{key.NewKeyPair(tSuite).Public}
+	require.Nil(t, td.propose(data))
+	_, err = td.vote(0)
+	require.Nil(t, err)
+	require.Equal(t, meta, td.Devices[0].Data.Metadata)
+	list, err = td.Devices[0].ListIdentities()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(list))
+}
+
+func TestService_ECDSAVote(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 1, 1)
+	defer l.CloseAll()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	hw, err := NewECDSADevice(&priv.PublicKey)
+	require.Nil(t, err)
+
+	// A schnorr- and an ECDSA-device can be part of the same identity.
+	data := td.Devices[0].Data.Copy()
+	data.Device["hw"] = hw
+	data.Threshold = 2
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+
+	data = td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	_, err = td.vote(0)
+	require.Nil(t, err)
+	hash, err := data.Hash(tSuite)
+	require.Nil(t, err)
+	digest := sha256.Sum256(hash)
+	sig, err := priv.Sign(rand.Reader, digest[:], nil)
+	require.Nil(t, err)
+	_, err = td.service.ProposeVote(&ProposeVote{ID: td.ID(), Signer: "hw",
+		Signature: []byte("signature")})
+	require.NotNil(t, err)
+	_, err = td.service.ProposeVote(&ProposeVote{ID: td.ID(), Signer: "hw", Signature: sig})
+	require.Nil(t, err)
+	require.Nil(t, td.update())
+	require.Equal(t, "value", td.Devices[0].Data.Storage["key"])
+}
+
+func TestService_ProposalActive(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+
+	// Of concurrent proposals, only one is accepted.
+	errs := make(chan error, len(td.Devices))
+	for i, c := range td.Devices {
+		data := c.Data.Copy()
+		data.Storage["key"] = strconv.Itoa(i)
+		go func(c *Identity, data *Data) {
+			errs <- c.ProposeSend(data)
+		}(c, data)
+	}
+	var accepted int
+	for range td.Devices {
+		if err := <-errs; err == nil {
+			accepted++
+		} else {
+			require.Contains(t, err.Error(), ErrorProposalActive.Error())
+		}
+	}
+	require.Equal(t, 1, accepted)
+	_, err := td.vote(0)
+	require.Nil(t, err)
+
+	// A device can force a new proposal, which drops the votes.
+	data := td.Devices[1].Data.Copy()
+	data.Storage["key"] = "forced"
+	_, err = td.service.ProposeSend(&ProposeSend{ID: td.ID(), Propose: data, Force: true})
+	require.NotNil(t, err)
+	require.Nil(t, td.Devices[1].ProposeSendForced(data))
+	sid := td.service.getIdentityStorage(td.ID())
+	sid.Lock()
+	require.Equal(t, "forced", sid.Proposed.Storage["key"])
+	require.Equal(t, 0, len(sid.Proposed.Votes))
+	sid.Unlock()
+	sb, err := td.vote(0, 1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Equal(t, "forced", td.Devices[0].Data.Storage["key"])
+}
+
+func TestService_ProposedBy(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	data := td.Devices[1].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.Devices[1].ProposeSend(data))
+	for _, srvc := range td.services {
+		sid := srvc.(*Service).getIdentityStorage(td.ID())
+		sid.Lock()
+		require.Equal(t, "dev1", sid.ProposedBy)
+		sid.Unlock()
+	}
+	require.Nil(t, td.Devices[0].ProposeUpdate())
+	require.Equal(t, "dev1", td.Devices[0].ProposedBy)
+
+	// Claiming to be another device needs its signature.
+	_, err := td.service.ProposeSend(&ProposeSend{ID: td.ID(), Propose: data,
+		Proposer: "dev0", Signature: []byte("signature")})
+	require.NotNil(t, err)
+	require.Nil(t, td.Devices[0].ProposeUpdate())
+	require.Equal(t, "dev1", td.Devices[0].ProposedBy)
+
+	sb, err := td.vote(0, 1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	sid := td.service.getIdentityStorage(td.ID())
+	sid.Lock()
+	require.Equal(t, "", sid.ProposedBy)
+	sid.Unlock()
+}
+
+func TestService_ProposeNoChange(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	err := td.propose(td.Devices[0].Data.Copy())
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrorNoChange.Error())
+	sid := td.service.getIdentityStorage(td.ID())
+	sid.Lock()
+	require.Nil(t, sid.Proposed)
+	sid.Unlock()
+
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0, 1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+
+	// Once committed, the same data doesn't change anything anymore.
+	err = td.propose(data)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrorNoChange.Error())
+}
+
+func TestService_RejectedVotes(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		l, td := setupTestDevices(t, 3, 3, 2)
+		for _, s := range td.services {
+			s.(*Service).SetBatchVerification(batch)
+		}
+		data := td.Devices[0].Data.Copy()
+		data.Storage["key"] = "value"
+		require.Nil(t, td.propose(data))
+		sb, err := td.vote(0)
+		require.Nil(t, err)
+		require.Nil(t, sb)
+
+		// All devices voted, but only one approved.
+		for _, dev := range td.Devices[1:] {
+			reply := &ProposeVoteReply{}
+			require.Nil(t, dev.send(dev.Data.Roster.List[0],
+				PrepareReject(td.ID(), dev.DeviceName), reply))
+			require.Nil(t, reply.Data)
+		}
+		for _, s := range td.services {
+			sid := s.(*Service).getIdentityStorage(td.ID())
+			sid.Lock()
+			require.NotNil(t, sid.Proposed)
+			require.Equal(t, 1, approvals(sid.Latest, sid.Proposed.Votes))
+			sid.Unlock()
+		}
+		require.Nil(t, td.update())
+		require.Equal(t, "", td.Devices[0].Data.Storage["key"])
+
+		// A device that rejected can still approve.
+		sb, err = td.vote(1)
+		require.Nil(t, err)
+		require.NotNil(t, sb)
+		require.Equal(t, "value", td.Devices[0].Data.Storage["key"])
+		l.CloseAll()
+	}
+}
+
+func TestService_WeightedVotes(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 2)
+	defer l.CloseAll()
+	data := td.Devices[0].Data.Copy()
+	data.Weights = map[string]int{"dev0": 0, "dev1": 0}
+	require.NotNil(t, td.propose(data))
+
+	data.Weights = map[string]int{"dev0": 2}
+	require.Nil(t, td.propose(data))
+	// The latest data has no weights, so every device counts once.
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	sb, err = td.vote(1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Equal(t, 2, td.Devices[0].Data.Weights["dev0"])
+
+	// dev1 and dev2 together weigh as much as dev0.
+	data = td.Devices[0].Data.Copy()
+	data.Storage["key"] = "one"
+	require.Nil(t, td.propose(data))
+	sb, err = td.vote(1)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	sb, err = td.vote(2)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+
+	data = td.Devices[0].Data.Copy()
+	data.Storage["key"] = "two"
+	require.Nil(t, td.propose(data))
+	sb, err = td.vote(0)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Equal(t, "two", td.Devices[0].Data.Storage["key"])
+}
+
+func TestService_ProposeVoteLink(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	sid := td.service.getIdentityStorage(td.ID())
+	sid.Lock()
+	previous := sid.LatestSkipblock
+	sid.Unlock()
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+
+	vote, err := PrepareVote(td.ID(), "dev0", data, td.Devices[0].Private)
+	require.Nil(t, err)
+	reply, err := td.service.ProposeVote(vote)
+	require.Nil(t, err)
+	require.Nil(t, reply.Data)
+	require.Nil(t, reply.Link)
+	require.NotNil(t, reply.Verify(tSuite, previous))
+
+	vote, err = PrepareVote(td.ID(), "dev1", data, td.Devices[1].Private)
+	require.Nil(t, err)
+	reply, err = td.service.ProposeVote(vote)
+	require.Nil(t, err)
+	require.NotNil(t, reply.Data)
+	require.NotNil(t, reply.Link)
+	require.Nil(t, reply.Verify(tSuite, previous))
+	// The link only proves the block following previous.
+	require.NotNil(t, reply.Verify(tSuite, reply.Data))
+	reply.Link.Signature.Sig[0] ^= 1
+	require.NotNil(t, reply.Verify(tSuite, previous))
+}
+
+func TestService_ThresholdPercent(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 4, 1)
+	defer l.CloseAll()
+	data := td.Devices[0].Data.Copy()
+	data.ThresholdPercent = 101
+	require.NotNil(t, td.propose(data))
+	data.ThresholdPercent = 60
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+
+	// 60% of 4 devices are 3 votes. Removing a device still needs them,
+	// as the devices of the latest data vote.
+	data = td.Devices[0].Data.Copy()
+	delete(data.Device, "dev3")
+	require.Nil(t, td.propose(data))
+	sb, err = td.vote(0, 1)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	sb, err = td.vote(2)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+
+	// With 3 devices left, 2 votes are enough.
+	data = td.Devices[0].Data.Copy()
+	data.Threshold = 3
+	require.Nil(t, td.propose(data))
+	sb, err = td.vote(0)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	sb, err = td.vote(1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+
+	// The threshold is the minimum, even if the percentage needs less.
+	data = td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	sb, err = td.vote(0, 1)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	sb, err = td.vote(2)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+}
+
+func TestService_VerifyBlockData(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	sid := td.service.getIdentityStorage(td.ID())
+	sid.Lock()
+	latest := sid.LatestSkipblock
+	sid.Unlock()
+	block := func(d *Data) *skipchain.SkipBlock {
+		d.Timestamp = time.Now().UnixNano()
+		hash, err := d.Hash(tSuite)
+		require.Nil(t, err)
+		for _, dev := range td.Devices {
+			sig, err := schnorr.Sign(tSuite, dev.Private, hash)
+			require.Nil(t, err)
+			d.Votes[dev.DeviceName] = sig
+		}
+		buf, err := network.Marshal(d)
+		require.Nil(t, err)
+		return &skipchain.SkipBlock{SkipBlockFix: &skipchain.SkipBlockFix{
+			Index:       latest.Index + 1,
+			BackLinkIDs: []skipchain.SkipBlockID{latest.Hash},
+			Data:        buf,
+		}}
+	}
+
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.True(t, td.service.VerifyBlock(nil, block(data)))
+	// Even with all votes, data that doesn't need votes anymore is
+	// refused.
+	data.Threshold = 0
+	require.False(t, td.service.VerifyBlock(nil, block(data)))
+	// Neither is a threshold the devices can't reach.
+	data.Threshold = 3
+	require.False(t, td.service.VerifyBlock(nil, block(data)))
+	data = td.Devices[0].Data.Copy()
+	data.Weights = map[string]int{"dev0": 0, "dev1": 0}
+	require.False(t, td.service.VerifyBlock(nil, block(data)))
+	require.NotNil(t, td.propose(data))
+}
+
+func TestService_DataAtTime(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 1, 1)
+	defer l.CloseAll()
+	c := td.Devices[0]
+	_, _, err := c.GetDataAtTime(time.Now().Add(-time.Hour))
+	require.NotNil(t, err)
+
+	var times []time.Time
+	var blocks []*skipchain.SkipBlock
+	for i := 0; i < 5; i++ {
+		data := c.Data.Copy()
+		data.Storage["key"] = strconv.Itoa(i)
+		require.Nil(t, td.propose(data))
+		sb, err := td.vote(0)
+		require.Nil(t, err)
+		require.NotNil(t, sb)
+		times = append(times, time.Now())
+		blocks = append(blocks, sb)
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, ti := range times {
+		data, sb, err := c.GetDataAtTime(ti)
+		require.Nil(t, err)
+		require.Equal(t, strconv.Itoa(i), data.Storage["key"])
+		require.True(t, blocks[i].Hash.Equal(sb.Hash))
+	}
+
+	// A block with a wrong timestamp is refused.
+	latest := &Data{Timestamp: time.Now().UnixNano()}
+	now := time.Now()
+	require.Nil(t, checkTimestamp(&Data{Timestamp: nextTimestamp(latest, now)}, latest, now))
+	require.NotNil(t, checkTimestamp(&Data{}, latest, now))
+	require.NotNil(t, checkTimestamp(&Data{Timestamp: latest.Timestamp - 1}, latest, now))
+	future := now.Add(2 * maxTimestampSkew).UnixNano()
+	require.NotNil(t, checkTimestamp(&Data{Timestamp: future}, latest, now))
+}
+
+func TestService_DataHistory(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 1, 1)
+	defer l.CloseAll()
+	c := td.Devices[0]
+	var sb *skipchain.SkipBlock
+	for i := 0; i < 3; i++ {
+		data := c.Data.Copy()
+		data.Storage["key"] = strconv.Itoa(i)
+		require.Nil(t, td.propose(data))
+		var err error
+		sb, err = td.vote(0)
+		require.Nil(t, err)
+		require.NotNil(t, sb)
+	}
+
+	history, err := c.GetDataHistory(0)
+	require.Nil(t, err)
+	require.Equal(t, sb.Index+1, len(history))
+	for i, h := range history {
+		require.Equal(t, i, h.Index)
+	}
+	require.Equal(t, "", history[0].Data.Storage["key"])
+
+	history, err = c.GetDataHistory(2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(history))
+	require.Equal(t, sb.Index, history[1].Index)
+	require.Equal(t, "1", history[0].Data.Storage["key"])
+	require.Equal(t, "2", history[1].Data.Storage["key"])
+
+	_, err = td.service.GetDataHistory(&GetDataHistory{ID: ID("unknown")})
+	require.Equal(t, ErrorBlockMissing, err)
+}
+
+func TestService_GetLatest(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 1, 1)
+	defer l.CloseAll()
+	c := td.Devices[0]
+	data := c.Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+
+	reply, err := c.GetLatest()
+	require.Nil(t, err)
+	require.Equal(t, sb.Index, reply.Index)
+	require.Equal(t, sb.Hash, reply.Hash)
+	require.Equal(t, "value", reply.Data.Storage["key"])
+
+	_, err = td.service.GetLatest(&GetLatest{ID: ID("unknown")})
+	require.Equal(t, ErrorBlockMissing, err)
+
+	// Change the data behind the back of the skipchain.
+	sid := td.service.getIdentityStorage(td.ID())
+	sid.Lock()
+	sid.Latest = sid.Latest.Copy()
+	sid.Latest.Storage["key"] = "tampered"
+	sid.Unlock()
+	_, err = td.service.GetLatest(&GetLatest{ID: td.ID()})
+	require.Equal(t, ErrorDataMismatch, err)
+}
+
+func TestService_ClientAuth(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 1, 1)
+	defer l.CloseAll()
+	c := td.Devices[0]
+	for _, srvc := range td.services {
+		s := srvc.(*Service)
+		s.SetClientAuthenticator(&DeviceAuthenticator{Service: s})
+	}
+	err := c.DataUpdate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrorNotAuthenticated.Error())
+
+	c.AuthenticateRequests = true
+	require.Nil(t, c.DataUpdate())
+	data := c.Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+
+	// A key that is not a device is refused.
+	stranger := NewTestIdentity(c.Data.Roster, 1, "stranger", l, key.NewKeyPair(tSuite))
+	stranger.ID = c.ID
+	stranger.AuthenticateRequests = true
+	require.NotNil(t, stranger.DataUpdate())
+
+	// A credential for another request is refused.
+	buf, err := network.Marshal(&DataUpdate{ID: c.ID})
+	require.Nil(t, err)
+	cred := &ClientCredential{Public: c.Public, Time: time.Now().UnixNano()}
+	cred.Signature, err = schnorr.Sign(tSuite, c.Private,
+		CredentialMessage("DataUpdate", buf, cred.Time))
+	require.Nil(t, err)
+	auth := &DeviceAuthenticator{Service: td.service}
+	require.NotNil(t, auth.AuthenticateClient("ProposeSend", buf, cred))
+	require.Nil(t, auth.AuthenticateClient("DataUpdate", buf, cred))
+
+	for _, srvc := range td.services {
+		srvc.(*Service).SetClientAuthenticator(nil)
+	}
+	c.AuthenticateRequests = false
+	require.Nil(t, c.DataUpdate())
+}
+
+func TestService_Sessions(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 2)
+	defer l.CloseAll()
+	for _, srvc := range td.services {
+		s := srvc.(*Service)
+		s.SetClientAuthenticator(&DeviceAuthenticator{Service: s})
+	}
+	for _, dev := range td.Devices {
+		dev.AuthenticateRequests = true
+	}
+	require.Nil(t, td.Devices[0].DataUpdate())
+	require.Nil(t, td.Devices[1].DataUpdate())
+	sessions, err := td.Devices[0].ListSessions()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(sessions))
+	require.Equal(t, "dev0", sessions[0].Device)
+	require.True(t, sessions[0].Requests >= 2)
+	require.Equal(t, "dev1", sessions[1].Device)
+	require.True(t, sessions[1].Public.Equal(td.Devices[1].Public))
+
+	// Revoking needs a threshold of devices.
+	compromised := td.Devices[1].Public
+	now := time.Now().UnixNano()
+	sigs := map[string][]byte{}
+	sigs["dev0"], err = td.Devices[0].SignRevokeSession(compromised, now)
+	require.Nil(t, err)
+	require.NotNil(t, td.Devices[0].RevokeSession(compromised, now, sigs))
+	sigs["dev2"], err = td.Devices[2].SignRevokeSession(compromised, now)
+	require.Nil(t, err)
+	require.Nil(t, td.Devices[0].RevokeSession(compromised, now, sigs))
+
+	err = td.Devices[1].DataUpdate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrorSessionRevoked.Error())
+	for _, srvc := range td.services {
+		require.True(t, srvc.(*Service).sessionRevoked(compromised))
+	}
+	require.Nil(t, td.Devices[2].DataUpdate())
+	sessions, err = td.Devices[0].ListSessions()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(sessions))
+	require.Equal(t, "dev0", sessions[0].Device)
+	require.Equal(t, "dev2", sessions[1].Device)
+
+	// Sessions without requests end.
+	clock := useFakeClock(td.services)
+	clock.advance(sessionIdle + time.Minute)
+	reply, err := td.service.ListSessions(&ListSessions{ID: td.ID()})
+	require.Nil(t, err)
+	require.Equal(t, 0, len(reply.Sessions))
+}
+
+func TestService_Idempotency(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 1, 1)
+	defer l.CloseAll()
+	c := td.Devices[0]
+	s := td.service
+	data := c.Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	require.Nil(t, c.ProposeUpdate())
+	vote, err := PrepareVote(c.ID, c.DeviceName, c.Proposed, c.Private)
+	require.Nil(t, err)
+	buf, err := protobuf.Encode(vote)
+	require.Nil(t, err)
+	send := func(key string, req []byte) ([]byte, error) {
+		ir, err := protobuf.Encode(&IdempotentRequest{Key: key, Path: "ProposeVote",
+			Request: req})
+		require.Nil(t, err)
+		return s.ProcessClientRequest("IdempotentRequest", ir)
+	}
+	countVotes := func() int {
+		entries, err := c.GetRPCLog(0, 0)
+		require.Nil(t, err)
+		n := 0
+		for _, e := range entries {
+			if e.Method == "ProposeVote" {
+				n++
+			}
+		}
+		return n
+	}
+
+	reply, err := send("vote", buf)
+	require.Nil(t, err)
+	require.Equal(t, 1, countVotes())
+	// The retry gets the same reply without voting again, while the same
+	// vote without the key fails, as the proposal has been committed.
+	retry, err := send("vote", buf)
+	require.Nil(t, err)
+	require.Equal(t, reply, retry)
+	require.Equal(t, 1, countVotes())
+	_, err = s.ProcessClientRequest("ProposeVote", buf)
+	require.NotNil(t, err)
+	require.Equal(t, 2, countVotes())
+
+	// A key can't be used for another request.
+	_, err = send("vote", append(buf, 0))
+	require.NotNil(t, err)
+
+	// The client resends its requests with a key.
+	c.Retries = 2
+	require.Nil(t, c.DataUpdate())
+	require.Equal(t, "value", c.Data.Storage["key"])
+}
+
+func TestService_RPCLog(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 1, 1)
+	defer l.CloseAll()
+	dev := td.Devices[0]
+	entries, err := dev.GetRPCLog(0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(entries))
+	require.Equal(t, "CreateIdentity", entries[0].Method)
+	require.Equal(t, "ProposeVote", entries[2].Method)
+	require.Equal(t, td.ID(), entries[2].ID)
+
+	part, err := dev.GetRPCLog(1, 1)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(part))
+	require.Equal(t, entries[1].Hash, part[0].Hash)
+
+	// Reading doesn't change the log, proposing does.
+	index, head, err := dev.RPCLogHead()
+	require.Nil(t, err)
+	require.Equal(t, 2, index)
+	require.Nil(t, td.update())
+	_, err = dev.GetValuesByPrefix("")
+	require.Nil(t, err)
+	data := dev.Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	since, err := dev.RPCLogSince(index, head)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(since))
+	require.Equal(t, "ProposeSend", since[0].Method)
+	_, err = dev.RPCLogSince(index, entries[1].Hash)
+	require.NotNil(t, err)
+
+	// Removing an entry breaks the chain.
+	s := td.service
+	s.rpcLog.Lock()
+	stored := s.rpcLog.entries
+	s.rpcLog.entries = append([]*RPCLogEntry{stored[0]}, stored[2:]...)
+	s.rpcLog.Unlock()
+	_, err = dev.GetRPCLog(0, 0)
+	require.NotNil(t, err)
+
+	changed := *stored[1]
+	changed.Method = "ProposeReplace"
+	require.NotNil(t, VerifyRPCLog([]*RPCLogEntry{stored[0], &changed}, nil))
+	require.Nil(t, VerifyRPCLog(stored[:2], nil))
+}
+
+func TestService_RPCLogPrune(t *testing.T) {
+	l, services, _ := newTestNodes(1)
+	defer l.CloseAll()
+	s := services[0].(*Service)
+	s.rpcLog.Lock()
+	s.rpcLog.chunk, s.rpcLog.maxChunks = 2, 2
+	s.rpcLog.Unlock()
+	for i := 0; i < 7; i++ {
+		s.logRPC("Test", ID{byte(i)}, nil)
+	}
+	reply, err := s.GetRPCLog(&GetRPCLog{Start: 4})
+	require.Nil(t, err)
+	require.Equal(t, 4, reply.First)
+	require.Equal(t, 7, reply.Length)
+	require.Equal(t, 3, len(reply.Entries))
+	_, err = s.GetRPCLog(&GetRPCLog{Start: 3})
+	require.NotNil(t, err)
+
+	// Only the kept chunks are loaded again, and they still link to the
+	// last pruned entry.
+	require.Nil(t, s.loadRPCLog())
+	again, err := s.GetRPCLog(&GetRPCLog{Start: 4})
+	require.Nil(t, err)
+	require.Equal(t, reply.Entries, again.Entries)
+	require.Equal(t, reply.Head, again.Head)
+}
+
+func TestService_SkipchainRoster(t *testing.T) {
+	l := onet.NewTCPTest(tSuite)
+	hosts, _, _ := l.GenTree(5, true)
+	services := l.GetServices(hosts, identityService)
+	defer l.CloseAll()
+	voting := l.GenRosterFromHost(hosts[0:3]...)
+	storage := l.GenRosterFromHost(hosts[2:5]...)
+	s := services[0].(*Service)
+	leader := services[2].(*Service)
+	// Only blocks signed by the identity service of the leader are
+	// accepted by its skipchain service.
+	leader.skipchain.AddClientKey(key.NewKeyPair(tSuite).Public)
+
+	kp := key.NewKeyPair(tSuite)
+	ci := &CreateIdentity{
+		Data:            NewData(voting, 1, kp.Public, "one"),
+		SkipchainRoster: storage,
+	}
+	_, err := s.CreateIdentityInternal(ci, "", "")
+	require.NotNil(t, err)
+	air, err := leader.CreateIdentityInternal(ci, "", "")
+	require.Nil(t, err)
+	require.True(t, storage.ID.Equal(air.Genesis.Roster.ID))
+
+	c := NewTestIdentity(voting, 1, "one", l, kp)
+	c.ID = ID(air.Genesis.Hash)
+	require.Nil(t, c.DataUpdate())
+	data := c.Data.Copy()
+	data.Storage["key"] = "value"
+	// The vote is sent to the first node, which is not the leader of the
+	// skipchain-roster.
+	require.Nil(t, c.ProposeSend(data))
+	require.Nil(t, proposeUpVote(c))
+	require.Nil(t, c.DataUpdate())
+	require.Equal(t, "value", c.Data.Storage["key"])
+
+	// A block without votes is not stored, even if it is forwarded.
+	sid := s.getIdentityStorage(c.ID)
+	sid.Lock()
+	latest := sid.LatestSkipblock
+	noVotes := sid.Latest.Copy()
+	sid.Unlock()
+	noVotes.Storage["key"] = "other"
+	sb := &skipchain.SkipBlock{SkipBlockFix: &skipchain.SkipBlockFix{
+		GenesisID: latest.SkipChainID(),
+		Roster:    latest.Roster,
+	}}
+	sb.Data, err = network.Marshal(noVotes)
+	require.Nil(t, err)
+	_, err = leader.ForwardBlock(&ForwardBlock{ID: c.ID, Block: sb})
+	require.NotNil(t, err)
+
+	// The skipchain stays with the storage-roster, while only the
+	// voting-roster holds the identity.
+	sid = s.getIdentityStorage(c.ID)
+	require.Equal(t, 1, sid.LatestSkipblock.Index)
+	require.True(t, storage.ID.Equal(sid.LatestSkipblock.Roster.ID))
+	for i, srvc := range services {
+		stored := srvc.(*Service).getIdentityStorage(c.ID)
+		if i < 3 {
+			require.NotNil(t, stored)
+			require.Equal(t, 1, stored.LatestSkipblock.Index)
+		} else {
+			require.Nil(t, stored)
+		}
+	}
+}
+
+func TestService_RosterChange(t *testing.T) {
+	l := onet.NewTCPTest(tSuite)
+	hosts, _, _ := l.GenTree(5, true)
+	services := l.GetServices(hosts, identityService)
+	defer l.CloseAll()
+	old := l.GenRosterFromHost(hosts[0:3]...)
+	moved := l.GenRosterFromHost(hosts[2:5]...)
+	td, err := newTestDevices(l, services, old, 1, []*key.Pair{key.NewKeyPair(tSuite)})
+	require.Nil(t, err)
+	c := td.Devices[0]
+
+	// The new leader has to be part of the current roster.
+	require.NotNil(t, c.ProposeRosterChange(l.GenRosterFromHost(hosts[3:5]...)))
+
+	require.Nil(t, c.ProposeRosterChange(moved))
+	for _, i := range []int{3, 4} {
+		require.Nil(t, services[i].(*Service).getIdentityStorage(td.ID()))
+	}
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.True(t, moved.ID.Equal(sb.Roster.ID))
+	require.True(t, moved.ID.Equal(c.Data.Roster.ID))
+	// The new nodes hold the identity, and the old nodes know where it
+	// moved to.
+	for i, srvc := range services {
+		sid := srvc.(*Service).getIdentityStorage(td.ID())
+		require.NotNil(t, sid, "node %d", i)
+		sid.Lock()
+		require.Equal(t, sb.Index, sid.LatestSkipblock.Index)
+		require.True(t, moved.ID.Equal(sid.Latest.Roster.ID))
+		sid.Unlock()
+	}
+
+	// The identity continues on the new roster.
+	data := c.Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	_, err = td.vote(0)
+	require.Nil(t, err)
+	require.Equal(t, "value", c.Data.Storage["key"])
+	sid := services[4].(*Service).getIdentityStorage(td.ID())
+	sid.Lock()
+	require.Equal(t, sb.Index+1, sid.LatestSkipblock.Index)
+	sid.Unlock()
+}
+
+func TestService_ReadReplica(t *testing.T) {
+	l := onet.NewTCPTest(tSuite)
+	hosts, _, _ := l.GenTree(4, true)
+	services := l.GetServices(hosts, identityService)
+	defer l.CloseAll()
+	roster := l.GenRosterFromHost(hosts[0:3]...)
+	replica := services[3].(*Service)
+	replica.SetReadReplica(true)
+	services[0].(*Service).AddReplica(hosts[3].ServerIdentity)
+
+	c := createIdentity(l, services, roster, "one")
+	require.NotNil(t, replica.getIdentityStorage(c.ID))
+	data := c.Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, c.ProposeSend(data))
+	require.Nil(t, proposeUpVote(c))
+
+	reply, err := replica.DataUpdate(&DataUpdate{ID: c.ID})
+	require.Nil(t, err)
+	require.Equal(t, "value", reply.Data.Storage["key"])
+
+	// A block that is not signed by the nodes is refused.
+	sid := services[0].(*Service).getIdentityStorage(c.ID)
+	sid.Lock()
+	forged := sid.LatestSkipblock.Copy()
+	sid.Unlock()
+	evil := data.Copy()
+	evil.Storage["key"] = "evil"
+	forged.Data, err = network.Marshal(evil)
+	require.Nil(t, err)
+	forged.Hash = forged.CalculateHash()
+	prev, err := services[0].(*Service).skipchain.GetSingleBlock(
+		&skipchain.GetSingleBlock{ID: forged.BackLinkIDs[0]})
+	require.Nil(t, err)
+	replica.propagateSkipBlockHandler(&UpdateSkipBlock{ID: c.ID, Latest: forged, Previous: prev})
+	reply, err = replica.DataUpdate(&DataUpdate{ID: c.ID})
+	require.Nil(t, err)
+	require.Equal(t, "value", reply.Data.Storage["key"])
+
+	_, err = replica.ProposeSend(&ProposeSend{ID: c.ID, Propose: data})
+	require.Equal(t, ErrorReadReplica, err)
+	_, err = replica.ProposeVote(&ProposeVote{ID: c.ID, Signer: "one"})
+	require.Equal(t, ErrorReadReplica, err)
+}
+
+func TestService_ReadReplicaEnv(t *testing.T) {
+	require.Nil(t, os.Setenv(ReadReplicaEnv, "true"))
+	l := onet.NewTCPTest(tSuite)
+	hosts, _, _ := l.GenTree(2, true)
+	services := l.GetServices(hosts, identityService)
+	defer l.CloseAll()
+	require.Nil(t, os.Unsetenv(ReadReplicaEnv))
+	for _, s := range services {
+		require.True(t, s.(*Service).isReadReplica())
+	}
+}
+
+func TestService_VoteCoalescing(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 3)
+	defer l.CloseAll()
+
+	// Count the propagations of votes, but propagate them normally.
+	s := td.services[0].(*Service)
+	var rounds []network.Message
+	var roundsMutex sync.Mutex
+	s.interceptor = func(kind propagationKind, r *onet.Roster, msg network.Message) (int, error) {
+		if kind == propagateKindData {
+			roundsMutex.Lock()
+			rounds = append(rounds, msg)
+			roundsMutex.Unlock()
+		}
+		return s.propagationFunc(kind)(r, msg, propagateTimeout)
+	}
+	s.SetVoteCoalescing(500 * time.Millisecond)
+
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	roundsMutex.Lock()
+	rounds = nil
+	roundsMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, dev := range td.Devices {
+		wg.Add(1)
+		go func(dev *Identity) {
+			defer wg.Done()
+			require.Nil(t, proposeUpVote(dev))
+		}(dev)
+	}
+	wg.Wait()
+	require.Equal(t, 1, len(rounds))
+	require.Equal(t, 3, len(rounds[0].(*PropagateVotes).Votes))
+	for _, srvc := range td.services {
+		sid := srvc.(*Service).getIdentityStorage(td.ID())
+		require.Nil(t, sid.Proposed)
+		require.Equal(t, "value", sid.Latest.Storage["key"])
+	}
+}
+
+// benchmarkVotes lets all devices vote concurrently on b.N proposals.
+func TestService_PropagationLimit(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 3)
+	defer l.CloseAll()
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	for _, dev := range td.Devices {
+		require.Nil(t, dev.ProposeUpdate())
+	}
+
+	// Hold the propagation of the votes until released.
+	s := td.service
+	s.SetPropagationLimit(1, 0)
+	started := make(chan bool, len(td.Devices))
+	release := make(chan bool)
+	s.interceptor = func(kind propagationKind, r *onet.Roster, msg network.Message) (int, error) {
+		if _, ok := msg.(*ProposeVote); ok {
+			started <- true
+			<-release
+		}
+		return s.propagationFunc(kind)(r, msg, propagateTimeout)
+	}
+	errs := make(chan error, len(td.Devices))
+	for _, dev := range td.Devices {
+		go func(dev *Identity) {
+			errs <- dev.ProposeVote(true)
+		}(dev)
+	}
+	<-started
+	// Only one vote propagates, the others are refused.
+	for i := 1; i < len(td.Devices); i++ {
+		err := <-errs
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), ErrorBusy.Error())
+	}
+	close(release)
+	require.Nil(t, <-errs)
+	require.Equal(t, 0, len(started))
+	votes, err := td.votes()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(votes))
+}
+
+func benchmarkVotes(b *testing.B, window time.Duration) {
+	l, td := setupTestDevices(b, 3, 8, 8)
+	defer l.CloseAll()
+	td.service.SetVoteCoalescing(window)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		data := td.Devices[0].Data.Copy()
+		data.Storage["key"] = fmt.Sprintf("%d", n)
+		require.Nil(b, td.propose(data))
+		var wg sync.WaitGroup
+		for _, dev := range td.Devices {
+			wg.Add(1)
+			go func(dev *Identity) {
+				defer wg.Done()
+				if err := proposeUpVote(dev); err != nil {
+					b.Error(err)
+				}
+			}(dev)
+		}
+		wg.Wait()
+		require.Nil(b, td.Devices[0].DataUpdate())
+	}
+}
+
+func BenchmarkVotes(b *testing.B) {
+	benchmarkVotes(b, 0)
+}
+
+func BenchmarkVotesCoalesced(b *testing.B) {
+	benchmarkVotes(b, 10*time.Millisecond)
+}
+
+// benchmarkPropagationBurst measures how long the propagation handler takes
+// to apply new proposals, with the storage saved by the handler or by the
+// background worker.
+func benchmarkPropagationBurst(b *testing.B, blocking bool) {
+	l, td := setupTestDevices(b, 3, 2, 2)
+	defer l.CloseAll()
+	td.service.SetSyncSave(blocking)
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	start := time.Now().UnixNano()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		td.service.propagateDataHandler(&ProposeSend{
+			ID:      td.ID(),
+			Propose: data,
+			Time:    start + int64(n),
+		})
+	}
+	td.service.flushSaves()
+}
+
+func BenchmarkPropagationBurstSync(b *testing.B) {
+	benchmarkPropagationBurst(b, true)
+}
+
+func BenchmarkPropagationBurst(b *testing.B) {
+	benchmarkPropagationBurst(b, false)
+}
+
+func TestService_Suspend(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 2)
+	defer l.CloseAll()
+	sign := func(suspend bool, now int64, devices ...int) map[string][]byte {
+		sigs := make(map[string][]byte)
+		for _, i := range devices {
+			sig, err := td.Devices[i].SignSuspend(suspend, now)
+			require.Nil(t, err)
+			sigs[td.Devices[i].DeviceName] = sig
+		}
+		return sigs
+	}
+
+	// One signature is not enough.
+	now := time.Now().UnixNano()
+	require.NotNil(t, td.Devices[0].Suspend(now, sign(true, now, 0)))
+	// A request too far in the future is refused.
+	future := now + int64(time.Hour)
+	require.NotNil(t, td.Devices[0].Suspend(future, sign(true, future, 0, 1)))
+	// A signature on a resume cannot be used to suspend.
+	require.NotNil(t, td.Devices[0].Suspend(now, sign(false, now, 0, 1)))
+	require.Nil(t, td.Devices[0].Suspend(now, sign(true, now, 0, 1)))
+	// The same request cannot be replayed.
+	require.NotNil(t, td.Devices[0].Resume(now, sign(false, now, 0, 1)))
+
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	err := td.propose(data)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrorSuspended.Error())
+	// Reading still works.
+	require.Nil(t, td.update())
+
+	now = time.Now().UnixNano()
+	require.Nil(t, td.Devices[1].Resume(now, sign(false, now, 1, 2)))
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0, 1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Equal(t, "value", td.Devices[0].Data.Storage["key"])
+}
+
+func TestService_DeleteIdentity(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 2)
+	defer l.CloseAll()
+	now := time.Now().UnixNano()
+	sign := func(devices ...int) map[string][]byte {
+		sigs := make(map[string][]byte)
+		for _, i := range devices {
+			sig, err := td.Devices[i].SignDelete(now)
+			require.Nil(t, err)
+			sigs[td.Devices[i].DeviceName] = sig
+		}
+		return sigs
+	}
+
+	// One signature is not enough, and a bad one is refused.
+	require.NotNil(t, td.Devices[0].Delete(now, sign(0)))
+	sigs := sign(0, 1)
+	sigs["dev2"] = []byte("signature")
+	err := td.Devices[0].Delete(now, sigs)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrorVoteSignature.Error())
+	for _, srvc := range td.services {
+		require.NotNil(t, srvc.(*Service).getIdentityStorage(td.ID()))
+	}
+
+	require.Nil(t, td.Devices[0].Delete(now, sign(0, 1)))
+	for _, srvc := range td.services {
+		require.Nil(t, srvc.(*Service).getIdentityStorage(td.ID()))
+	}
+	require.NotNil(t, td.update())
+}
+
+func TestService_Compact(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 2)
+	defer l.CloseAll()
+	for _, v := range []string{"one", "two"} {
+		data := td.Devices[0].Data.Copy()
+		data.Storage["key"] = v
+		require.Nil(t, td.propose(data))
+		_, err := td.vote(0, 1)
+		require.Nil(t, err)
+	}
+	sid := td.service.getIdentityStorage(td.ID())
+	sid.Lock()
+	tip := sid.LatestSkipblock
+	sid.Unlock()
+	sign := func(now int64, devices ...int) map[string][]byte {
+		sigs := make(map[string][]byte)
+		for _, i := range devices {
+			sig, err := td.Devices[i].SignCompact(tip.Hash, now)
+			require.Nil(t, err)
+			sigs[td.Devices[i].DeviceName] = sig
+		}
+		return sigs
+	}
+
+	now := time.Now().UnixNano()
+	_, err := td.Devices[0].Compact(now, sign(now, 0))
+	require.NotNil(t, err)
+	genesis, err := td.Devices[0].Compact(now, sign(now, 0, 1))
+	require.Nil(t, err)
+	require.Equal(t, 0, genesis.Index)
+	require.Nil(t, VerifyCheckpoint(tSuite, td.ID(), genesis, tip))
+	// The signatures are bound to the tip.
+	require.NotNil(t, VerifyCheckpoint(tSuite, ID(genesis.Hash), genesis, tip))
+	for _, s := range td.services {
+		sid := s.(*Service).getIdentityStorage(td.ID())
+		sid.Lock()
+		require.True(t, sid.LatestSkipblock.Hash.Equal(genesis.Hash))
+		require.Equal(t, tip.Index, sid.index())
+		sid.Unlock()
+	}
+	// The old skipchain is still reachable from the ID of the identity.
+	chain, err := td.service.skipchain.GetUpdateChain(&skipchain.GetUpdateChain{
+		LatestID: skipchain.SkipBlockID(td.ID())})
+	require.Nil(t, err)
+	require.True(t, chain.Update[len(chain.Update)-1].Hash.Equal(tip.Hash))
+	// The request can't be replayed.
+	_, err = td.Devices[0].Compact(now, sign(now, 0, 1))
+	require.NotNil(t, err)
+
+	// New blocks are verified against the checkpoint.
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "three"
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0, 1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.True(t, sb.GenesisID.Equal(genesis.Hash))
+	require.Equal(t, 1, sb.Index)
+	require.Nil(t, td.Devices[2].DataUpdate())
+	require.Equal(t, "three", td.Devices[2].Data.Storage["key"])
+}
+
+func TestService_VerifyConsistency(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	c := td.Devices[0]
+	mismatches, err := c.VerifyConsistency()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(mismatches))
+
+	data := c.Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	mismatches, err = c.VerifyConsistency()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(mismatches))
+
+	// Remove the vote on the last node.
+	last := td.services[2].(*Service)
+	sid := last.getIdentityStorage(td.ID())
+	sid.Lock()
+	delete(sid.Proposed.Votes, "dev0")
+	sid.Unlock()
+	mismatches, err = c.VerifyConsistency()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(mismatches))
+	require.True(t, mismatches[0].ServerIdentity.Equal(last.ServerIdentity()))
+	require.Equal(t, "", mismatches[0].Error)
+	require.Equal(t, []string{"misses the votes of [dev0]"}, mismatches[0].Differences)
+}
+
+func TestService_GetIdentityState(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	s := td.services[0].(*Service)
+	other := td.services[1].(*Service)
+
+	_, err := s.GetIdentityState(&GetIdentityState{ID: td.ID()})
+	require.NotNil(t, err)
+
+	req, err := other.stateRequest(td.ID())
+	require.Nil(t, err)
+	state, err := s.GetIdentityState(req)
+	require.Nil(t, err)
+	require.Equal(t, s.getIdentityStorage(td.ID()).LatestSkipblock.Hash, state.Latest)
+
+	// A signature of a key outside of the roster is refused.
+	kp := key.NewKeyPair(tSuite)
+	req.Node = kp.Public
+	req.Signature, err = schnorr.Sign(tSuite, kp.Private,
+		IdentityStateMessage(td.ID(), req.Time))
+	require.Nil(t, err)
+	_, err = s.GetIdentityState(req)
+	require.Equal(t, ErrorNotIdentityNode, err)
+
+	// An old request is refused.
+	req, err = other.stateRequest(td.ID())
+	require.Nil(t, err)
+	req.Time -= int64(2 * stateWindow)
+	_, err = s.GetIdentityState(req)
+	require.NotNil(t, err)
+}
+
+func TestService_DumpState(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	c := td.Devices[0]
+	_, err := c.DumpState()
+	require.NotNil(t, err)
+
+	data := c.Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	_, err = td.vote(1)
+	require.Nil(t, err)
+	for _, srvc := range td.services {
+		srvc.(*Service).SetDebug(true)
+	}
+	state, err := c.DumpState()
+	require.Nil(t, err)
+	require.Equal(t, "value", state.Proposed.Storage["key"])
+	require.Equal(t, 1, len(state.Proposed.Votes))
+	require.NotNil(t, state.Proposed.Votes["dev1"])
+	sid := td.service.getIdentityStorage(td.ID())
+	sid.Lock()
+	require.True(t, state.LatestSkipblock.Hash.Equal(sid.LatestSkipblock.Hash))
+	sid.Unlock()
+}
+
+func TestService_BatchVerification(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 2)
+	defer l.CloseAll()
+	for _, srvc := range td.services {
+		srvc.(*Service).SetBatchVerification(true)
+	}
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+
+	// The invalid vote is only found once there are enough votes.
+	bogus := make([]byte, 64)
+	random.Bytes(bogus, random.New())
+	_, err := td.service.ProposeVote(&ProposeVote{ID: td.ID(), Signer: "dev2",
+		Signature: bogus})
+	require.Nil(t, err)
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	votes, err := td.votes()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(votes))
+	require.NotNil(t, votes["dev0"])
+
+	sb, err = td.vote(1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	_, msg, err := network.Unmarshal(sb.Data, tSuite)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(msg.(*Data).Votes))
+	require.Nil(t, msg.(*Data).Votes["dev2"])
+}
+
+// batchVotes returns a proposal with n devices and their votes.
+func batchVotes(tb testing.TB, n int) (*Data, []*Device, [][]byte) {
+	d := NewData(nil, n, nil, "")
+	d.Device = map[string]*Device{}
+	var kps []*key.Pair
+	for i := 0; i < n; i++ {
+		kp := key.NewKeyPair(tSuite)
+		kps = append(kps, kp)
+		d.Device[fmt.Sprintf("dev%d", i)] = &Device{Point: kp.Public}
+	}
+	hash, err := d.Hash(tSuite)
+	require.Nil(tb, err)
+	var devices []*Device
+	var sigs [][]byte
+	for _, kp := range kps {
+		sig, err := schnorr.Sign(tSuite, kp.Private, hash)
+		require.Nil(tb, err)
+		devices = append(devices, &Device{Point: kp.Public})
+		sigs = append(sigs, sig)
+	}
+	return d, devices, sigs
+}
+
+func TestSchnorrVerifier_VerifyVotes(t *testing.T) {
+	d, devices, sigs := batchVotes(t, 10)
+	sv := &SchnorrVerifier{Suite: tSuite}
+	require.Nil(t, sv.VerifyVotes(d, devices, sigs))
+	sigs[3], sigs[4] = sigs[4], sigs[3]
+	require.NotNil(t, sv.VerifyVotes(d, devices, sigs))
+
+	s := &Service{verifiers: []VoteVerifier{sv}, batchVerify: true}
+	votes := map[string][]byte{}
+	for i, sig := range sigs {
+		votes[fmt.Sprintf("dev%d", i)] = sig
+	}
+	votes["unknown"] = sigs[0]
+	valid, invalid := s.validVotes(d, d.Device, votes)
+	require.Equal(t, 8, len(valid))
+	require.Equal(t, []string{"dev3", "dev4", "unknown"}, invalid)
+}
+
+func benchmarkVerifyVotes(b *testing.B, n int, batch bool) {
+	d, devices, sigs := batchVotes(b, n)
+	sv := &SchnorrVerifier{Suite: tSuite}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if batch {
+			require.Nil(b, sv.VerifyVotes(d, devices, sigs))
+			continue
+		}
+		for j := range sigs {
+			require.Nil(b, sv.VerifyVote(d, devices[j], sigs[j]))
+		}
+	}
+}
+
+func BenchmarkVerifyVotes64(b *testing.B)       { benchmarkVerifyVotes(b, 64, false) }
+func BenchmarkVerifyVotes64Batch(b *testing.B)  { benchmarkVerifyVotes(b, 64, true) }
+func BenchmarkVerifyVotes256(b *testing.B)      { benchmarkVerifyVotes(b, 256, false) }
+func BenchmarkVerifyVotes256Batch(b *testing.B) { benchmarkVerifyVotes(b, 256, true) }
+
+func TestSkipchainHealth(t *testing.T) {
+	l := onet.NewTCPTest(tSuite)
+	defer l.CloseAll()
+	_, roster, _ := l.GenTree(4, false)
+	list := roster.List
+	var h skipchainHealth
+	now := time.Now()
+	require.Equal(t, list, h.order(roster, now))
+
+	h.markFailed(list[1], now)
+	h.markFailed(list[0], now.Add(time.Second))
+	require.Equal(t, []*network.ServerIdentity{list[2], list[3], list[1], list[0]},
+		h.order(roster, now.Add(time.Second)))
+	h.markHealthy(list[0])
+	require.Equal(t, []*network.ServerIdentity{list[0], list[2], list[3], list[1]},
+		h.order(roster, now.Add(time.Second)))
+	// After skipchainRetry the node is tried in its place again.
+	require.Equal(t, list, h.order(roster, now.Add(skipchainRetry)))
+
+	led := ledBy(roster, list[2])
+	require.Equal(t, []*network.ServerIdentity{list[2], list[0], list[1], list[3]}, led.List)
+}
+
+func TestService_Search(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 1, 1)
+	defer l.CloseAll()
+	c := td.Devices[0]
+	_, err := c.Search("value")
+	require.Equal(t, ErrorNoSearchIndex.Error(), err.Error())
+
+	data := c.Data.Copy()
+	data.Storage["first"] = "value"
+	data.Storage["second"] = "other"
+	require.Nil(t, td.propose(data))
+	_, err = td.vote(0)
+	require.Nil(t, err)
+
+	// The index is built from the stored identities.
+	td.service.EnableSearchIndex()
+	matches, err := c.Search("value")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(matches))
+	require.Equal(t, "first", matches[0].Key)
+	require.Equal(t, "value", matches[0].Value)
+	require.True(t, bytes.Equal(td.ID(), matches[0].ID))
+	matches, err = c.Search("second")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(matches))
+
+	// Overwritten and deleted keys are removed from the index.
+	data = c.Data.Copy()
+	data.Storage["first"] = "changed"
+	delete(data.Storage, "second")
+	require.Nil(t, td.propose(data))
+	_, err = td.vote(0)
+	require.Nil(t, err)
+	// The hooks run in their own goroutine.
+	for i := 0; i < 100; i++ {
+		matches, err = c.Search("changed")
+		require.Nil(t, err)
+		if len(matches) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 1, len(matches))
+	for _, q := range []string{"value", "second", "other"} {
+		matches, err = c.Search(q)
+		require.Nil(t, err)
+		require.Equal(t, 0, len(matches), q)
+	}
+}
+
+func TestService_CatchUp(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 1, 1)
+	defer l.CloseAll()
+	// The new block is stored, but its propagation fails.
+	for _, srvc := range td.services {
+		s := srvc.(*Service)
+		s.interceptor = func(kind propagationKind, roster *onet.Roster, msg network.Message) (int, error) {
+			if kind == propagateKindSkipBlock {
+				return 0, errors.New("propagation failed")
+			}
+			return s.propagationFunc(kind)(roster, msg, propagateTimeout)
+		}
+	}
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Equal(t, "value", td.Devices[0].Data.Storage["key"])
+
+	lagging := func(i int) bool {
+		sid := td.services[i].(*Service).getIdentityStorage(td.ID())
+		sid.Lock()
+		defer sid.Unlock()
+		return sid.LatestSkipblock.Index < sb.Index || sid.Proposed != nil
+	}
+	require.True(t, lagging(1))
+	require.True(t, lagging(2))
+
+	// The sweep and a data-update catch up with the skipchain.
+	td.services[1].(*Service).Sweep()
+	require.False(t, lagging(1))
+	_, err = td.services[2].(*Service).DataUpdate(&DataUpdate{ID: td.ID()})
+	require.Nil(t, err)
+	require.False(t, lagging(2))
+}
+
+func TestService_PendingVotes(t *testing.T) {
+	l, services, roster := newTestNodes(3)
+	defer l.CloseAll()
+	shared := key.NewKeyPair(tSuite)
+	td1, err := newTestDevices(l, services, roster, 2,
+		[]*key.Pair{shared, key.NewKeyPair(tSuite)})
+	require.Nil(t, err)
+	td2, err := newTestDevices(l, services, roster, 2,
+		[]*key.Pair{key.NewKeyPair(tSuite), shared})
+	require.Nil(t, err)
+	td3, err := newTestDevices(l, services, roster, 1,
+		[]*key.Pair{key.NewKeyPair(tSuite)})
+	require.Nil(t, err)
+	for _, td := range []*testDevices{td1, td2, td3} {
+		data := td.Devices[0].Data.Copy()
+		data.Storage["key"] = "value"
+		require.Nil(t, td.propose(data))
+	}
+
+	dev := td2.Devices[1]
+	pending, more, err := dev.PendingVotes(0)
+	require.Nil(t, err)
+	require.False(t, more)
+	require.Equal(t, 2, len(pending))
+	pending, more, err = dev.PendingVotes(1)
+	require.Nil(t, err)
+	require.True(t, more)
+	require.Equal(t, 1, len(pending))
+
+	// Once the device voted, the proposal is not pending anymore.
+	sb, err := td1.vote(0)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	pending, more, err = dev.PendingVotes(0)
+	require.Nil(t, err)
+	require.False(t, more)
+	require.Equal(t, 1, len(pending))
+	p := pending[0]
+	require.True(t, p.ID.Equal(td2.ID()))
+	require.Equal(t, "dev1", p.Device)
+	require.Equal(t, "dev0", p.ProposedBy)
+	require.Equal(t, 0, p.Votes)
+	require.Equal(t, 2, p.Threshold)
+	require.Nil(t, dev.ProposeUpdate())
+	require.Equal(t, dev.ProposedHash, p.Hash)
+
+	pending, _, err = td3.Devices[0].PendingVotes(0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(pending))
+	require.True(t, pending[0].ID.Equal(td3.ID()))
+}
+
+func TestService_DelayedCommit(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 2)
+	defer l.CloseAll()
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	clock := useFakeClock(td.services)
+	require.NotNil(t, td.Devices[0].ProposeSendDelayed(data, -time.Second))
+	require.Nil(t, td.Devices[0].ProposeSendDelayed(data, time.Hour))
+	sb, err := td.vote(0, 1)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	// Voting again doesn't commit before the delay.
+	require.Nil(t, proposeUpVote(td.Devices[2]))
+	clock.advance(time.Minute)
+	require.Nil(t, td.update())
+	require.Equal(t, "", td.Devices[0].Data.Storage["key"])
+
+	clock.advance(time.Hour)
+	require.Nil(t, td.update())
+	require.Equal(t, "value", td.Devices[0].Data.Storage["key"])
+	sid := td.service.getIdentityStorage(td.ID())
+	sid.Lock()
+	require.Nil(t, sid.Proposed)
+	sid.Unlock()
+}
+
+func TestService_CancelDelayedCommit(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 2)
+	defer l.CloseAll()
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	sid := td.service.getIdentityStorage(td.ID())
+	sid.Lock()
+	index := sid.LatestSkipblock.Index
+	sid.Unlock()
+	// Proposals without delay can't be cancelled.
+	require.Nil(t, td.propose(data))
+	require.Nil(t, td.Devices[1].ProposeUpdate())
+	require.NotNil(t, td.Devices[1].CancelProposal())
+
+	require.Nil(t, td.Devices[0].ProposeSendDelayed(data, 500*time.Millisecond))
+	sb, err := td.vote(0, 1)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	require.Nil(t, td.Devices[2].ProposeUpdate())
+	require.Nil(t, td.Devices[2].CancelProposal())
+	for _, srvc := range td.services {
+		other := srvc.(*Service).getIdentityStorage(td.ID())
+		other.Lock()
+		require.Nil(t, other.Proposed)
+		other.Unlock()
+	}
+
+	time.Sleep(time.Second)
+	require.Nil(t, td.update())
+	require.Equal(t, "", td.Devices[0].Data.Storage["key"])
+	sid.Lock()
+	require.Equal(t, index, sid.LatestSkipblock.Index)
+	sid.Unlock()
+}
+
+func TestService_RevokeVote(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 2)
+	defer l.CloseAll()
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	// Nothing to revoke before voting.
+	dev := td.Devices[0]
+	require.Nil(t, dev.ProposeUpdate())
+	require.NotNil(t, dev.RevokeVote())
+
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	hash, err := dev.Proposed.Hash(tSuite)
+	require.Nil(t, err)
+	// A vote can't be used to revoke itself.
+	sid := td.service.getIdentityStorage(td.ID())
+	sid.Lock()
+	vote := sid.Proposed.Votes["dev0"]
+	sid.Unlock()
+	_, err = td.service.RevokeVote(&RevokeVote{ID: td.ID(), Hash: hash,
+		Signer: "dev0", Signature: vote})
+	require.NotNil(t, err)
+
+	require.Nil(t, dev.RevokeVote())
+	for _, srvc := range td.services {
+		other := srvc.(*Service).getIdentityStorage(td.ID())
+		other.Lock()
+		require.Equal(t, 0, approvals(other.Latest, other.Proposed.Votes))
+		other.Unlock()
+	}
+	// The revoked vote doesn't count anymore.
+	sb, err = td.vote(1)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	sb, err = td.vote(0)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+
+	// Once committed, the vote can't be revoked.
+	sig, err := schnorr.Sign(tSuite, dev.Private, RevokeVoteMessage(td.ID(), hash))
+	require.Nil(t, err)
+	_, err = td.service.RevokeVote(&RevokeVote{ID: td.ID(), Hash: hash,
+		Signer: "dev0", Signature: sig})
+	require.NotNil(t, err)
+}
+
+func TestService_ProposeStatus(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 3)
+	defer l.CloseAll()
+	c := td.Devices[2]
+	_, err := c.ProposeStatus()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrorNoProposal.Error())
+
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	st, err := c.ProposeStatus()
+	require.Nil(t, err)
+	require.Equal(t, "value", st.Propose.Storage["key"])
+	require.Equal(t, 0, len(st.Voted))
+	require.Equal(t, 3, st.Threshold)
+	require.Equal(t, 3, st.Required)
+	require.False(t, st.OneMore)
+	require.Equal(t, int64(propagateTimeout), st.PropagateTimeout)
+
+	_, err = td.vote(1, 0)
+	require.Nil(t, err)
+	st, err = c.ProposeStatus()
+	require.Nil(t, err)
+	require.Equal(t, []string{"dev0", "dev1"}, st.Voted)
+	require.Equal(t, 2, st.Valid)
+	require.True(t, st.OneMore)
+}
+
+func TestService_LastSeen(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 2)
+	defer l.CloseAll()
+	seen, err := td.Devices[0].LastSeen()
+	require.Nil(t, err)
+
+	before := time.Now().UnixNano()
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(2)
+	require.Nil(t, err)
+	require.Nil(t, sb)
+	seen2, err := td.Devices[0].LastSeen()
+	require.Nil(t, err)
+	require.True(t, seen2["dev2"] >= before)
+	require.Equal(t, seen["dev1"], seen2["dev1"])
+
+	// Removed devices are forgotten.
+	data = td.Devices[0].Data.Copy()
+	delete(data.Device, "dev2")
+	require.Nil(t, td.propose(data))
+	sb, err = td.vote(1, 2)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	for _, srvc := range td.services {
+		sid := srvc.(*Service).getIdentityStorage(td.ID())
+		sid.Lock()
+		require.True(t, sid.LastSeen["dev1"] >= before)
+		require.Equal(t, int64(0), sid.LastSeen["dev2"])
+		sid.Unlock()
+	}
+}
+
+func TestService_GroupDevice(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	var keys []kyber.Point
+	privates := make(map[int]kyber.Scalar)
+	for i := 0; i < 3; i++ {
+		kp := key.NewKeyPair(tSuite)
+		keys = append(keys, kp.Public)
+		privates[i] = kp.Private
+	}
+	team, err := NewGroupDevice(keys, 2)
+	require.Nil(t, err)
+	_, err = NewGroupDevice(keys, 4)
+	require.NotNil(t, err)
+
+	// The team is added like any other device and counts as one device
+	// for the threshold of the identity.
+	data := td.Devices[0].Data.Copy()
+	data.Device["team"] = team
+	data.Threshold = 2
+	require.Nil(t, data.CheckDevices())
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0, 1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.NotNil(t, td.Devices[0].Data.Device["team"].Group)
+
+	// Changing the keys of the group changes the hash.
+	changed := data.Copy()
+	changed.Device["team"].Group.Threshold = 1
+	h1, err := data.Hash(tSuite)
+	require.Nil(t, err)
+	h2, err := changed.Hash(tSuite)
+	require.Nil(t, err)
+	require.NotEqual(t, h1, h2)
+	require.False(t, data.Equal(changed))
+
+	data = td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	c := td.Devices[0]
+	group := c.Data.Device["team"].Group
+	// One member of the team is not enough to vote for it, nor is a
+	// plain signature of the aggregate key.
+	vote, err := PrepareGroupVote(c.ID, "team", c.Proposed, group,
+		map[int]kyber.Scalar{0: privates[0]})
+	require.Nil(t, err)
+	require.NotNil(t, c.SendVote(vote))
+	vote, err = PrepareVote(c.ID, "team", c.Proposed, privates[0])
+	require.Nil(t, err)
+	require.NotNil(t, c.SendVote(vote))
+
+	vote, err = PrepareGroupVote(c.ID, "team", c.Proposed, group,
+		map[int]kyber.Scalar{0: privates[0], 2: privates[2]})
+	require.Nil(t, err)
+	require.Nil(t, c.SendVote(vote))
+	votes, err := td.votes()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(votes))
+	sb, err = td.vote(1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Equal(t, "value", td.Devices[1].Data.Storage["key"])
+}
+
+func TestService_ReconcileOnLoad(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 1, 1)
+	defer l.CloseAll()
+	s := td.services[1].(*Service)
+	sid := s.getIdentityStorage(td.ID())
+	sid.Lock()
+	oldSB := sid.LatestSkipblock
+	oldData := sid.Latest
+	sid.Unlock()
+
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(0)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+
+	// The node saved its state before it got the new block.
+	sid.Lock()
+	sid.LatestSkipblock = oldSB
+	sid.Latest = oldData
+	sid.Proposed = data
+	sid.Unlock()
+	s.storageMutex.Lock()
+	s.save()
+	s.storageMutex.Unlock()
+
+	require.Nil(t, s.tryLoad())
+	sid = s.getIdentityStorage(td.ID())
+	sid.Lock()
+	require.Equal(t, oldSB.Index, sid.LatestSkipblock.Index)
+	sid.Unlock()
+	require.Equal(t, 1, s.reconcile())
+	sid = s.getIdentityStorage(td.ID())
+	sid.Lock()
+	require.Equal(t, sb.Index, sid.LatestSkipblock.Index)
+	require.Equal(t, "value", sid.Latest.Storage["key"])
+	require.Nil(t, sid.Proposed)
+	sid.Unlock()
+	require.Equal(t, 0, s.reconcile())
+}
+
+func TestService_LoadBackup(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 1, 1)
+	defer l.CloseAll()
+	s := td.services[1].(*Service)
+	s.storageMutex.Lock()
+	s.save()
+	s.save()
+	s.storageMutex.Unlock()
+
+	// truncate simulates a crash in the middle of writing the primary.
+	truncate := func() {
+		require.Nil(t, s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(s.bucket)
+			buf := append([]byte(nil), b.Get(storageKey)...)
+			require.NotEqual(t, 0, len(buf))
+			return b.Put(storageKey, buf[:len(buf)/2])
+		}))
+	}
+	identities := func() int {
+		s.storageMutex.Lock()
+		defer s.storageMutex.Unlock()
+		return len(s.Storage.Identities)
+	}
+
+	truncate()
+	s.clearIdentities()
+	require.Nil(t, s.tryLoad())
+	require.Equal(t, 1, identities())
+	sid := s.getIdentityStorage(td.ID())
+	require.NotNil(t, sid)
+	sid.Lock()
+	require.Equal(t, 1, len(sid.Latest.Device))
+	sid.Unlock()
+
+	// Without a backup the error is returned instead of an empty storage.
+	require.Nil(t, s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete(storageBackupKey)
+	}))
+	truncate()
+	require.NotNil(t, s.tryLoad())
+	require.Equal(t, 1, identities())
+
+	// A node from before the storage bucket loads its old storage.
+	require.Nil(t, s.Save(storageKey, s.Storage))
+	require.Nil(t, s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete(storageKey)
+	}))
+	s.clearIdentities()
+	require.Nil(t, s.tryLoad())
+	require.Equal(t, 1, identities())
+}
+
+func TestService_MaxVoteAge(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 3, 2)
+	defer l.CloseAll()
+	for _, srvc := range td.services {
+		require.Nil(t, srvc.(*Service).SetMaxVoteAge(time.Hour))
+	}
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	c := td.Devices[1]
+	require.Nil(t, c.ProposeUpdate())
+	hash, err := c.Proposed.Hash(tSuite)
+	require.Nil(t, err)
+
+	// Votes without a time, stale votes and votes from the future are
+	// refused.
+	require.NotNil(t, c.ProposeVote(true))
+	stale, err := PrepareTimedVote(c.ID, c.DeviceName, hash, c.Private,
+		time.Now().Add(-2*time.Hour))
+	require.Nil(t, err)
+	require.NotNil(t, c.SendVote(stale))
+	future, err := PrepareTimedVote(c.ID, c.DeviceName, hash, c.Private,
+		time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	require.NotNil(t, c.SendVote(future))
+	// The time is part of the signed message.
+	fresh, err := PrepareTimedVote(c.ID, c.DeviceName, hash, c.Private, time.Now())
+	require.Nil(t, err)
+	_, sig, err := splitTimedCredential(fresh.Signature)
+	require.Nil(t, err)
+	forged := &ProposeVote{ID: c.ID, Signer: c.DeviceName,
+		Signature: TimedCredential(time.Now().Add(time.Minute).UnixNano(), sig)}
+	require.NotNil(t, c.SendVote(forged))
+
+	for _, dev := range td.Devices {
+		dev.TimedVotes = true
+	}
+	sb, err := td.vote(1, 2)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+	require.Equal(t, "value", td.Devices[0].Data.Storage["key"])
+}
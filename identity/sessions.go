@@ -0,0 +1,242 @@
+package identity
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/log"
+)
+
+// A device that sends authenticated requests to a node has a session on
+// this node, which lasts as long as the device sends requests. A threshold
+// of devices can revoke the session of a compromised device, after which
+// all nodes refuse the credentials of its key, without having to wait for
+// a proposal removing the device.
+
+// sessionIdle is how long a session lasts without requests.
+const sessionIdle = 10 * time.Minute
+
+// revokeWindow is how far the time of a RevokeSession may be away from the
+// time of the node, in both directions.
+const revokeWindow = 10 * time.Minute
+
+// ErrorSessionRevoked is returned for requests signed by a device whose
+// session has been revoked.
+var ErrorSessionRevoked = errors.New("session of the device has been revoked")
+
+// Session is the activity of a device on a node.
+type Session struct {
+	// Device is the name of the device in the identity.
+	Device string
+	Public kyber.Point
+	// Started and LastSeen are the times in unix-nanoseconds of the first
+	// and the last request of the session.
+	Started  int64
+	LastSeen int64
+	// Requests is the number of requests of the session.
+	Requests int
+}
+
+// ListSessions asks for the sessions of the devices of an identity on the
+// node.
+type ListSessions struct {
+	ID ID
+	// Auth is needed if the identity has readers.
+	Auth *ReadAuth
+}
+
+// ListSessionsReply holds the sessions sorted by device.
+type ListSessionsReply struct {
+	Sessions []*Session
+}
+
+// RevokeSession asks all nodes to refuse the credentials of the device
+// with the key Public. It needs the signatures of a threshold of devices.
+type RevokeSession struct {
+	ID     ID
+	Public kyber.Point
+	// Time in unix-nanoseconds, must be close to the time of the nodes.
+	Time int64
+	// Signatures of the devices on RevokeSessionMessage, mapped by device.
+	Signatures map[string][]byte
+}
+
+// RevokeSessionReply is empty.
+type RevokeSessionReply struct{}
+
+// sessions holds the active sessions of the node, mapped by the key of the
+// device. They are only kept in memory.
+type sessions struct {
+	sync.Mutex
+	active map[string]*Session
+}
+
+// RevokeSessionMessage returns the message the devices sign to revoke the
+// session of the device with the key pub at time t.
+func RevokeSessionMessage(id ID, pub kyber.Point, t int64) ([]byte, error) {
+	buf, err := pub.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	var ts [8]byte
+	binary.LittleEndian.PutUint64(ts[:], uint64(t))
+	msg := append([]byte("identity-revoke-session"), id...)
+	msg = append(msg, buf...)
+	return append(msg, ts[:]...), nil
+}
+
+// ListSessions returns the active sessions of the devices of the identity.
+func (s *Service) ListSessions(req *ListSessions) (*ListSessionsReply, error) {
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	if err := s.checkRead(req.ID, sid.Latest, req.Auth); err != nil {
+		sid.Unlock()
+		return nil, err
+	}
+	devices := make(map[string]kyber.Point)
+	for name, dev := range sid.Latest.Device {
+		if dev != nil && dev.Point != nil {
+			devices[name] = dev.Point
+		}
+	}
+	sid.Unlock()
+
+	reply := &ListSessionsReply{}
+	now := s.now()
+	s.sessions.Lock()
+	for name, pub := range devices {
+		sess := s.sessions.active[pub.String()]
+		if sess == nil || now.Sub(time.Unix(0, sess.LastSeen)) > sessionIdle {
+			continue
+		}
+		c := *sess
+		c.Device = name
+		reply.Sessions = append(reply.Sessions, &c)
+	}
+	s.sessions.Unlock()
+	sort.Slice(reply.Sessions, func(i, j int) bool {
+		return reply.Sessions[i].Device < reply.Sessions[j].Device
+	})
+	return reply, nil
+}
+
+// RevokeSession checks the request and propagates it to all nodes.
+func (s *Service) RevokeSession(req *RevokeSession) (*RevokeSessionReply, error) {
+	if s.isReadReplica() {
+		return nil, ErrorReadReplica
+	}
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	err := s.checkRevoke(req.ID, sid, req)
+	roster := s.withReplicas(sid.votingRoster(sid.Latest))
+	sid.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.propagate(propagateKindData, roster, req, sid.propagateTimeout()); err != nil {
+		return nil, err
+	}
+	return &RevokeSessionReply{}, nil
+}
+
+// checkRevoke returns nil if the key is a device of the identity and enough
+// devices signed to revoke its session. It must be called with the lock of
+// sid held.
+func (s *Service) checkRevoke(id ID, sid *IDBlock, req *RevokeSession) error {
+	if req.Public == nil || !sid.Latest.isDevice(req.Public) {
+		return errors.New("not a device of the identity")
+	}
+	if d := s.now().Sub(time.Unix(0, req.Time)); d > revokeWindow || d < -revokeWindow {
+		return errors.New("time of request is too far from the time of the node")
+	}
+	msg, err := RevokeSessionMessage(id, req.Public, req.Time)
+	if err != nil {
+		return err
+	}
+	return s.checkThresholdSigned(sid, msg, req.Signatures)
+}
+
+// applyRevoke stores the revocation if the request is valid and ends the
+// session. It must be called with the lock of sid held.
+func (s *Service) applyRevoke(id ID, sid *IDBlock, req *RevokeSession) {
+	if err := s.checkRevoke(id, sid, req); err != nil {
+		log.Error(s.ServerIdentity(), "refusing to revoke session:", err)
+		return
+	}
+	for _, pub := range sid.RevokedSessions {
+		if pub.Equal(req.Public) {
+			return
+		}
+	}
+	log.Lvlf2("%s: revoking session of %s in %x", s.ServerIdentity(), req.Public, []byte(id))
+	sid.RevokedSessions = append(sid.RevokedSessions, req.Public)
+	s.sessions.Lock()
+	delete(s.sessions.active, req.Public.String())
+	s.sessions.Unlock()
+}
+
+// startSession refuses the credentials of a revoked device, else it records
+// the request in the session of the device.
+func (s *Service) startSession(pub kyber.Point) error {
+	if s.sessionRevoked(pub) {
+		return ErrorSessionRevoked
+	}
+	now := s.now()
+	key := pub.String()
+	ss := &s.sessions
+	ss.Lock()
+	defer ss.Unlock()
+	for k, sess := range ss.active {
+		if now.Sub(time.Unix(0, sess.LastSeen)) > sessionIdle {
+			delete(ss.active, k)
+		}
+	}
+	if ss.active == nil {
+		ss.active = make(map[string]*Session)
+	}
+	sess := ss.active[key]
+	if sess == nil {
+		sess = &Session{Public: pub, Started: now.UnixNano()}
+		ss.active[key] = sess
+	}
+	sess.LastSeen = now.UnixNano()
+	sess.Requests++
+	return nil
+}
+
+// sessionRevoked returns true if one of the identities revoked the session
+// of pub. A revoked key is refused for all identities, as it has to be
+// considered as compromised.
+func (s *Service) sessionRevoked(pub kyber.Point) bool {
+	s.storageMutex.Lock()
+	sids := make([]*IDBlock, 0, len(s.Storage.Identities))
+	for _, sid := range s.Storage.Identities {
+		sids = append(sids, sid)
+	}
+	s.storageMutex.Unlock()
+	for _, sid := range sids {
+		sid.Lock()
+		revoked := false
+		for _, r := range sid.RevokedSessions {
+			if r.Equal(pub) {
+				revoked = true
+				break
+			}
+		}
+		sid.Unlock()
+		if revoked {
+			return true
+		}
+	}
+	return false
+}
@@ -3,7 +3,9 @@ package identity
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"sort"
 	"strings"
 	"time"
@@ -12,6 +14,7 @@ import (
 	"github.com/dedis/cothority/pop/service"
 	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/cosi"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 	"github.com/dedis/onet/network"
@@ -20,6 +23,12 @@ import (
 // How many msec to wait before a timeout is generated in the propagation
 const propagateTimeout = 10000 * time.Millisecond
 
+// The range of the propagation timeout an identity can be created with.
+const (
+	minPropagateTimeout = 100 * time.Millisecond
+	maxPropagateTimeout = 120 * time.Second
+)
+
 // ID represents one skipblock and corresponds to its Hash.
 type ID skipchain.SkipBlockID
 
@@ -49,22 +58,96 @@ type Data struct {
 	// This has to be verified with the previous data-block, because only
 	// the previous data-block has the authority to sign for a new block.
 	Votes map[string][]byte
+	// Readers, if not empty, restricts reading the data to the readers
+	// and the devices, which have to sign a read-challenge. This only
+	// protects the requests to the identity service: the skipchain
+	// service of the same nodes still stores and serves the blocks in
+	// clear, so secrets must not be stored in restricted data.
+	Readers []kyber.Point
+	// ReadRules restrict reading some of the values, see ReadRule.
+	ReadRules []*ReadRule
+	// Metadata describes the identity - nil if none is given
+	Metadata *Metadata
+	// AllowDynamicThreshold lets the nodes accept less votes than
+	// Threshold if they run with a dynamic threshold and devices are
+	// offline.
+	AllowDynamicThreshold bool
+	// Heartbeats are added by the node storing the block, so that all
+	// nodes compute the dynamic threshold from the same heartbeats. Like
+	// the votes, they are not part of the hash.
+	Heartbeats []*Heartbeat
+	// Timestamp in unix-nanoseconds is set by the node storing the block
+	// and checked by the nodes signing it. It is 0 for the blocks stored
+	// before it was introduced. Like the votes, it is not part of the
+	// hash.
+	Timestamp int64
+	// Weights, if not empty, gives the weight of the vote of the devices,
+	// mapped by device. The weights of the votes must add up to
+	// Threshold. A device that is not in Weights has a weight of 1.
+	Weights map[string]int
+	// HashVersion tells how the data is hashed. Data stored before the
+	// versions were introduced has HashLegacy and keeps its hash.
+	HashVersion int
+	// Checkpoint is only set in the genesis-block of a compacted
+	// skipchain, see CompactIdentity.
+	Checkpoint *Checkpoint
+	// ThresholdPercent, if not 0, is the percentage of the total weight of
+	// the devices whose votes are needed, rounded up. It is evaluated when
+	// the votes are counted, so it follows the devices being added and
+	// removed. Threshold is then the minimum weight needed.
+	ThresholdPercent int
+}
+
+// The versions of the hash of the data.
+const (
+	// HashLegacy writes the device-names and the storage-values one after
+	// the other and doesn't include the storage-keys, so that different
+	// data can result in the same hash.
+	HashLegacy = iota
+	// HashPrefixed prefixes every name, key and value by its length.
+	HashPrefixed
+	// HashMerkle hashes the root of the Merkle tree of the storage instead
+	// of all keys and values, so that single values can be proven with a
+	// ValueProof.
+	HashMerkle
+	// HashCurrent is the version used for new data.
+	HashCurrent = HashMerkle
+)
+
+// Metadata holds optional information about an identity, e.g. for
+// dashboards. Like the rest of the data it can only be changed by a vote.
+type Metadata struct {
+	// Name is a human-readable name of the identity.
+	Name string
+	// Description of what the identity is used for.
+	Description string
+	// Created is the time of creation in unix-nanoseconds.
+	Created int64
+	// Owner is how to contact the owner of the identity.
+	Owner string
 }
 
 // Device is represented by a public key.
 type Device struct {
 	// Point is the public key of that device
 	Point kyber.Point
+	// Group, if set, makes the device a team of keys, see DeviceGroup.
+	Group *DeviceGroup
+	// Scheme of the signatures of the device. For other schemes than
+	// SchemeSchnorr, Point is nil and Key holds the public key.
+	Scheme SigScheme
+	Key    []byte
 }
 
 // NewData returns a new List with the first owner initialised.
 func NewData(roster *onet.Roster, threshold int, pub kyber.Point, owner string) *Data {
 	return &Data{
-		Roster:    roster,
-		Threshold: threshold,
-		Device:    map[string]*Device{owner: {pub}},
-		Storage:   make(map[string]string),
-		Votes:     map[string][]byte{},
+		Roster:      roster,
+		Threshold:   threshold,
+		Device:      map[string]*Device{owner: {Point: pub}},
+		Storage:     make(map[string]string),
+		Votes:       map[string][]byte{},
+		HashVersion: HashCurrent,
 	}
 }
 
@@ -84,14 +167,109 @@ func (d *Data) Copy() *Data {
 		dNew.Storage = make(map[string]string)
 	}
 	dNew.Votes = map[string][]byte{}
+	dNew.Heartbeats = nil
+	dNew.Timestamp = 0
+	dNew.Checkpoint = nil
 
 	return dNew
 }
 
+// IsReader returns true if pub is one of the readers or the key of one of
+// the devices.
+func (d *Data) IsReader(pub kyber.Point) bool {
+	for _, r := range d.Readers {
+		if r.Equal(pub) {
+			return true
+		}
+	}
+	for _, dev := range d.Device {
+		if dev != nil && dev.Point != nil && dev.Point.Equal(pub) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckDevices returns an error if the devices can't be used as a complete
+// replacement of the devices of an identity: there must be at least one
+// device, the threshold must be between 1 and the total weight of the
+// devices, a percentage between 1 and 100, no public key may be used twice
+// and the weights must be valid.
+func (d *Data) CheckDevices() error {
+	if len(d.Device) == 0 {
+		return errors.New("no devices given")
+	}
+	if total := d.totalWeight(); d.Threshold < 1 || d.Threshold > total {
+		return fmt.Errorf("threshold %d is not between 1 and %d",
+			d.Threshold, total)
+	}
+	if err := d.checkThresholdPercent(); err != nil {
+		return err
+	}
+	for name, dev := range d.Device {
+		if dev == nil {
+			return fmt.Errorf("device %s has no public key", name)
+		}
+		if err := dev.checkKey(); err != nil {
+			return fmt.Errorf("device %s: %s", name, err)
+		}
+	}
+	if name := d.duplicateDevice(); name != "" {
+		return fmt.Errorf("public key of device %s is used twice", name)
+	}
+	return d.checkWeights()
+}
+
+// duplicateDevice returns the name of a device that has the same public key
+// as another device, or an empty string if all keys are different.
+func (d *Data) duplicateDevice() string {
+	seen := make(map[string]bool)
+	for _, name := range d.deviceNames() {
+		dev := d.Device[name]
+		if dev == nil {
+			continue
+		}
+		key := dev.keyString()
+		if key == "" {
+			continue
+		}
+		if seen[key] {
+			return name
+		}
+		seen[key] = true
+	}
+	return ""
+}
+
 // Hash makes a cryptographic hash of the data-file - this
 // can be used as an ID. The vote of the devices is not included in the hash!
+// The hash is canonical: two Data for which Equal returns true have the
+// same hash, independent of the order of the maps. From HashPrefixed on,
+// every name, key and value is prefixed by its length, so that different
+// data don't result in the same input to the hash, and the version is
+// hashed, too. From HashMerkle on, the storage is hashed by the root of its
+// Merkle tree.
 func (d *Data) Hash(suite kyber.HashFactory) ([]byte, error) {
+	return d.hash(suite, nil)
+}
+
+// hash returns the hash of the data. For HashMerkle and later, storageRoot is
+// hashed instead of the storage if it is not nil.
+func (d *Data) hash(suite kyber.HashFactory, storageRoot []byte) ([]byte, error) {
+	if d.HashVersion < HashLegacy || d.HashVersion > HashCurrent {
+		return nil, fmt.Errorf("unknown hash-version %d", d.HashVersion)
+	}
+	legacy := d.HashVersion == HashLegacy
 	hash := suite.Hash()
+	if !legacy {
+		if err := writeString(hash, "identity-data"); err != nil {
+			return nil, err
+		}
+		err := binary.Write(hash, binary.LittleEndian, int32(d.HashVersion))
+		if err != nil {
+			return nil, err
+		}
+	}
 	err := binary.Write(hash, binary.LittleEndian, int32(d.Threshold))
 	if err != nil {
 		return nil, err
@@ -99,52 +277,269 @@ func (d *Data) Hash(suite kyber.HashFactory) ([]byte, error) {
 
 	// Write all devices in alphabetical order, because golang
 	// randomizes the maps.
-	var owners []string
-	for s := range d.Device {
-		owners = append(owners, s)
+	for _, s := range d.deviceNames() {
+		dev := d.Device[s]
+		if dev == nil {
+			return nil, fmt.Errorf("device %s has no public key", s)
+		}
+		if legacy {
+			_, err = hash.Write([]byte(s))
+		} else {
+			err = writeString(hash, s)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = dev.writeKey(hash); err != nil {
+			return nil, fmt.Errorf("device %s: %s", s, err)
+		}
+		// Only written for groups, so that the hash of the other
+		// devices doesn't change.
+		if dev.Group != nil {
+			if err = dev.Group.write(hash); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if d.HashVersion >= HashMerkle {
+		if storageRoot == nil {
+			if storageRoot, err = d.StorageRoot(suite); err != nil {
+				return nil, err
+			}
+		}
+		if err = writeString(hash, "storage-root"); err != nil {
+			return nil, err
+		}
+		if _, err = hash.Write(storageRoot); err != nil {
+			return nil, err
+		}
+	} else {
+		// And write all keys in alphabetical order, because golang
+		// randomizes the maps.
+		for _, k := range d.storageKeys() {
+			if legacy {
+				_, err = hash.Write([]byte(d.Storage[k]))
+			} else if err = writeString(hash, k); err == nil {
+				err = writeString(hash, d.Storage[k])
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if d.Roster != nil && d.Roster.Aggregate != nil {
+		d.Roster.Aggregate.MarshalTo(hash)
 	}
-	sort.Strings(owners)
-	for _, s := range owners {
-		_, err = hash.Write([]byte(s))
+
+	if d.Metadata != nil {
+		if err = d.Metadata.write(hash); err != nil {
+			return nil, err
+		}
+	}
+
+	// The readers are only hashed if present, so that the hash of data
+	// without readers doesn't change.
+	if len(d.Readers) > 0 {
+		err = binary.Write(hash, binary.LittleEndian, int32(len(d.Readers)))
 		if err != nil {
 			return nil, err
 		}
-		_, err = d.Device[s].Point.MarshalTo(hash)
+		for _, r := range d.Readers {
+			if r == nil {
+				return nil, errors.New("reader without public key")
+			}
+			if _, err = r.MarshalTo(hash); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if d.AllowDynamicThreshold {
+		if err = writeString(hash, "dynamic-threshold"); err != nil {
+			return nil, err
+		}
+	}
+
+	// Like the readers, the read-rules are only hashed if present.
+	if len(d.ReadRules) > 0 {
+		if err = d.writeReadRules(hash); err != nil {
+			return nil, err
+		}
+	}
+
+	// The same for the weights.
+	if len(d.Weights) > 0 {
+		if err = writeString(hash, "weights"); err != nil {
+			return nil, err
+		}
+		var names []string
+		for name := range d.Weights {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err = writeString(hash, name); err != nil {
+				return nil, err
+			}
+			err = binary.Write(hash, binary.LittleEndian, int32(d.Weights[name]))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if d.ThresholdPercent != 0 {
+		if err = writeString(hash, "threshold-percent"); err != nil {
+			return nil, err
+		}
+		err = binary.Write(hash, binary.LittleEndian, int32(d.ThresholdPercent))
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	// And write all keys in alphabetical order, because golang
-	// randomizes the maps.
+	return hash.Sum(nil), nil
+}
+
+// write writes all fields of the metadata, prefixed by a marker so that
+// they can't be confused with the other fields of the data.
+func (m *Metadata) write(w io.Writer) error {
+	if err := writeString(w, "metadata"); err != nil {
+		return err
+	}
+	for _, s := range []string{m.Name, m.Description, m.Owner} {
+		if err := writeString(w, s); err != nil {
+			return err
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, m.Created)
+}
+
+// deviceNames returns the names of all devices in alphabetical order.
+func (d *Data) deviceNames() []string {
+	var names []string
+	for name := range d.Device {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// storageKeys returns all keys of the storage in alphabetical order.
+func (d *Data) storageKeys() []string {
 	var keys []string
 	for k := range d.Storage {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
-	for _, k := range keys {
-		_, err = hash.Write([]byte(d.Storage[k]))
-		if err != nil {
-			return nil, err
+	return keys
+}
+
+// writeString writes the length of str followed by str.
+func writeString(w io.Writer, str string) error {
+	if err := binary.Write(w, binary.LittleEndian, int32(len(str))); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte(str))
+	return err
+}
+
+// Equal returns true if both data have the same hash-version, threshold,
+// devices, storage and roster, where rosters are compared by their aggregate
+// key. Like for Hash, the votes and heartbeats are not compared. Missing
+// devices and public keys are only equal to missing ones.
+func (d *Data) Equal(other *Data) bool {
+	if d == nil || other == nil {
+		return d == other
+	}
+	if d.HashVersion != other.HashVersion ||
+		d.Threshold != other.Threshold ||
+		d.ThresholdPercent != other.ThresholdPercent ||
+		d.AllowDynamicThreshold != other.AllowDynamicThreshold ||
+		len(d.Device) != len(other.Device) ||
+		len(d.Storage) != len(other.Storage) {
+		return false
+	}
+	for name, dev := range d.Device {
+		otherDev, ok := other.Device[name]
+		if !ok {
+			return false
+		}
+		if (dev == nil) != (otherDev == nil) {
+			return false
+		}
+		if dev != nil && (!pointsEqual(dev.Point, otherDev.Point) ||
+			!dev.Group.equal(otherDev.Group) || dev.Scheme != otherDev.Scheme ||
+			!bytes.Equal(dev.Key, otherDev.Key)) {
+			return false
 		}
 	}
+	for k, v := range d.Storage {
+		if ov, ok := other.Storage[k]; !ok || ov != v {
+			return false
+		}
+	}
+	if (d.Metadata == nil) != (other.Metadata == nil) ||
+		(d.Metadata != nil && *d.Metadata != *other.Metadata) {
+		return false
+	}
+	if len(d.Readers) != len(other.Readers) {
+		return false
+	}
+	for i, r := range d.Readers {
+		if !pointsEqual(r, other.Readers[i]) {
+			return false
+		}
+	}
+	if !d.readRulesEqual(other) {
+		return false
+	}
+	if len(d.Weights) != len(other.Weights) {
+		return false
+	}
+	for name, w := range d.Weights {
+		if ow, ok := other.Weights[name]; !ok || ow != w {
+			return false
+		}
+	}
+	if d.Roster == nil || other.Roster == nil {
+		return d.Roster == other.Roster
+	}
+	return pointsEqual(d.Roster.Aggregate, other.Roster.Aggregate)
+}
 
-	if d.Roster != nil {
-		d.Roster.Aggregate.MarshalTo(hash)
+// pointsEqual is like kyber.Point.Equal, but accepts nil points, which are
+// only equal to nil.
+func pointsEqual(a, b kyber.Point) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
 	}
+	return a.Equal(b)
+}
 
-	return hash.Sum(nil), nil
+// checkHashVersion returns an error if d would replace latest with an older
+// hash-version, which would allow the ambiguous legacy hash again.
+func (d *Data) checkHashVersion(latest *Data) error {
+	if d == nil || latest == nil {
+		return nil
+	}
+	if d.HashVersion < latest.HashVersion {
+		return fmt.Errorf("hash-version %d is older than the current %d",
+			d.HashVersion, latest.HashVersion)
+	}
+	return nil
 }
 
-// String returns a nicely formatted output of the AccountList
 func (d *Data) String() string {
 	var owners []string
-	for n := range d.Device {
+	for _, n := range d.deviceNames() {
 		owners = append(owners, fmt.Sprintf("Owner: %s", n))
 	}
 	var data []string
-	for k, v := range d.Storage {
-		data = append(data, fmt.Sprintf("Data: %s/%s", k, v))
+	for _, k := range d.storageKeys() {
+		data = append(data, fmt.Sprintf("Data: %s/%s", k, d.Storage[k]))
 	}
 	return fmt.Sprintf("Threshold: %d\n%s\n%s", d.Threshold,
 		strings.Join(owners, "\n"), strings.Join(data, "\n"))
@@ -206,6 +601,18 @@ func (d *Data) GetIntermediateColumn(prefix, suffix string) []string {
 	return sortUniq(ret)
 }
 
+// GetValuesByPrefix returns all keys and values of the storage where the
+// key starts with prefix. If no key matches, an empty map is returned.
+func (d *Data) GetValuesByPrefix(prefix string) map[string]string {
+	ret := make(map[string]string)
+	for k, v := range d.Storage {
+		if strings.HasPrefix(k, prefix) {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
 // sortUniq sorts the slice of strings and deletes duplicates
 func sortUniq(slice []string) []string {
 	sorted := make([]string, len(slice))
@@ -250,6 +657,17 @@ type CreateIdentity struct {
 	Sig []byte
 	// Nonce plays in this case message of authentication
 	Nonce []byte
+	// Verifiers are the verification functions of the new skipchain. If
+	// empty, VerificationIdentity is used.
+	Verifiers []skipchain.VerifierID
+	// SkipchainRoster is the roster storing the skipchain. If nil, the
+	// roster of Data is used. Proposals and votes are always handled by
+	// the roster of Data.
+	SkipchainRoster *onet.Roster
+	// PropagateTimeout in nanoseconds is used for all propagations of the
+	// identity, between minPropagateTimeout and maxPropagateTimeout. If
+	// 0, propagateTimeout is used.
+	PropagateTimeout int64
 }
 
 // CreateIdentityReply is the reply when a new Identity has been added. It
@@ -261,6 +679,8 @@ type CreateIdentityReply struct {
 // DataUpdate verifies if a new update is available.
 type DataUpdate struct {
 	ID ID
+	// Auth is needed if the identity has readers.
+	Auth *ReadAuth
 }
 
 // DataUpdateReply returns the updated data.
@@ -268,21 +688,126 @@ type DataUpdateReply struct {
 	Data *Data
 }
 
+// GetValuesByPrefix asks for all values of the latest data whose keys start
+// with Prefix.
+type GetValuesByPrefix struct {
+	ID     ID
+	Prefix string
+	// Auth is needed if the identity has readers.
+	Auth *ReadAuth
+}
+
+// GetValuesByPrefixReply returns the matching keys and values.
+type GetValuesByPrefixReply struct {
+	Values map[string]string
+}
+
+// ListIdentities asks for all identities stored on the node.
+type ListIdentities struct {
+	// Device, if not empty, only lists the identities with a device of
+	// that name.
+	Device string
+}
+
+// ListIdentitiesReply holds a summary for every identity.
+type ListIdentitiesReply struct {
+	Identities []*IdentitySummary
+}
+
+// IdentitySummary describes one identity. Identities with readers are not
+// listed.
+type IdentitySummary struct {
+	ID       ID
+	Metadata *Metadata
+	// Devices is the number of devices.
+	Devices   int
+	Threshold int
+	// Index of the latest block, counting the blocks of compacted
+	// skipchains.
+	Index int
+}
+
 // ProposeSend sends a new proposition to be stored in all identities. It
-// either replies a nil-message for success or an error.
+// either replies a nil-message for success or an error. If Receipt is set,
+// it replies a ProposeSendReply instead.
 type ProposeSend struct {
 	ID      ID
 	Propose *Data
+	Receipt bool
+	// Time in unix-nanoseconds is set by the node receiving the proposal,
+	// so that all nodes store the same age of the proposal.
+	Time int64
+	// Expires is set together with Time from TTL and the maximum age of
+	// proposals of that node, 0 if the proposal doesn't expire.
+	Expires int64
+	// TTL in nanoseconds after which the proposal is removed if it didn't
+	// get enough votes. If it is 0 or longer than the maximum age of
+	// proposals of the node receiving it, that maximum age is used.
+	TTL int64
+	// Force replaces an open proposal, which is refused otherwise. Only a
+	// device of the latest data can force a proposal, so Proposer must be
+	// set.
+	Force bool
+	// Index of the latest block of the node receiving the proposal. Nodes
+	// that already hold a newer block ignore the proposal.
+	Index int
+	// Proposer is the name of the device that made the proposal, empty for
+	// an anonymous proposal. Signature is the signature of that device on
+	// ProposerMessage.
+	Proposer  string
+	Signature []byte
+	// Delay in nanoseconds between the proposal reaching the threshold
+	// and its commit, 0 to commit at once. During the delay every device
+	// can cancel the proposal with CancelProposal.
+	Delay int64
+}
+
+// ProposeSendReply holds the receipt for the proposal.
+type ProposeSendReply struct {
+	Receipt *ProposeReceipt
+}
+
+// ProposeReplace proposes to replace all devices and the threshold of the
+// identity at once. The proposal still needs the votes of the current
+// devices.
+type ProposeReplace struct {
+	ID        ID
+	Devices   map[string]*Device
+	Threshold int
+}
+
+// ProposeReplaceReply returns the new proposal.
+type ProposeReplaceReply struct {
+	Propose *Data
+}
+
+// ProposeRemoveDevice proposes to remove one device of the identity, keeping
+// the threshold. The proposal still needs the votes of the current devices.
+type ProposeRemoveDevice struct {
+	ID     ID
+	Device string
+}
+
+// ProposeRemoveDeviceReply returns the new proposal.
+type ProposeRemoveDeviceReply struct {
+	Propose *Data
 }
 
 // ProposeUpdate verifies if new data is available.
 type ProposeUpdate struct {
 	ID ID
+	// Auth is needed if the identity has readers.
+	Auth *ReadAuth
 }
 
 // ProposeUpdateReply returns the updated propose-data.
 type ProposeUpdateReply struct {
 	Propose *Data
+	// ProposedBy is the device that made the proposal, empty if unknown.
+	ProposedBy string
+	// Hash of Propose computed by the node, which is what the votes have
+	// to sign. It is empty if there is no proposal.
+	Hash []byte
 }
 
 // ProposeVote sends the signature for a specific IdentityList. It replies nil
@@ -297,6 +822,29 @@ type ProposeVote struct {
 // votes have arrived.
 type ProposeVoteReply struct {
 	Data *skipchain.SkipBlock
+	// Link is the forward link from the previous block to Data. Its
+	// collective signature proves that the nodes accepted the new block,
+	// see Verify.
+	Link *skipchain.ForwardLink
+}
+
+// Verify returns nil if the reply holds a new block following previous,
+// with a forward link to it signed by the roster of previous.
+func (r *ProposeVoteReply) Verify(suite cosi.Suite, previous *skipchain.SkipBlock) error {
+	if r.Data == nil || r.Link == nil {
+		return errors.New("no new block in the reply")
+	}
+	if !r.Data.Hash.Equal(r.Data.CalculateHash()) {
+		return errors.New("wrong hash of the new block")
+	}
+	if !r.Link.From.Equal(previous.Hash) || !r.Link.To.Equal(r.Data.Hash) {
+		return errors.New("forward link doesn't point from previous to the new block")
+	}
+	if r.Link.NewRoster != nil && (r.Data.Roster == nil ||
+		!r.Link.NewRoster.ID.Equal(r.Data.Roster.ID)) {
+		return errors.New("forward link has another roster than the new block")
+	}
+	return r.Link.Verify(suite, previous.Roster.Publics())
 }
 
 // Messages to be sent from one identity to another
@@ -308,10 +856,35 @@ type PropagateIdentity struct {
 	PubStr string
 }
 
+// PropagateVotes sends all votes collected during the coalescing window
+// in one propagation.
+type PropagateVotes struct {
+	ID    ID
+	Votes []*ProposeVote
+}
+
 // UpdateSkipBlock asks the service to fetch the latest SkipBlock
 type UpdateSkipBlock struct {
 	ID     ID
 	Latest *skipchain.SkipBlock
+	// Previous holds the forward-link to Latest, so that nodes without
+	// the skipchain can verify Latest.
+	Previous *skipchain.SkipBlock
+}
+
+// ForwardBlock is sent by a node of the voting-roster to the leader of a
+// separate skipchain-roster to store a new block of an identity. The block
+// is forwarded as it has been created, with the votes of the devices.
+type ForwardBlock struct {
+	ID    ID
+	Block *skipchain.SkipBlock
+}
+
+// ForwardBlockReply holds the previous block with the new forward-link and
+// the stored block.
+type ForwardBlockReply struct {
+	Previous *skipchain.SkipBlock
+	Latest   *skipchain.SkipBlock
 }
 
 // Authenticate first message of authentication protocol
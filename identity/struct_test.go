@@ -1,9 +1,19 @@
 package identity
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"testing"
 
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetKeys(t *testing.T) {
@@ -29,6 +39,356 @@ func TestKvGetIntKeys(t *testing.T) {
 	assert.Equal(t, "gh", s2)
 }
 
+func TestGetValuesByPrefix(t *testing.T) {
+	cfg := setupConfig()
+	assert.Equal(t, map[string]string{"web:one": "1", "web:one:one": "2",
+		"web:two": "3"}, cfg.GetValuesByPrefix("web:"))
+	assert.Equal(t, map[string]string{"ssh:mbp:gh": "4"},
+		cfg.GetValuesByPrefix("ssh:mbp:g"))
+	assert.Equal(t, map[string]string{}, cfg.GetValuesByPrefix("acl/"))
+	assert.Equal(t, len(cfg.Storage), len(cfg.GetValuesByPrefix("")))
+}
+
+func TestCheckDevices(t *testing.T) {
+	p1 := tSuite.Point().Pick(tSuite.XOF([]byte("one")))
+	p2 := tSuite.Point().Pick(tSuite.XOF([]byte("two")))
+	d := &Data{Threshold: 2, Device: map[string]*Device{"one": {Point: p1}, "two": {Point: p2}}}
+	assert.Nil(t, d.CheckDevices())
+	assert.Nil(t, d.checkNewBlock())
+	d.Threshold = 3
+	assert.NotNil(t, d.CheckDevices())
+	assert.NotNil(t, d.checkNewBlock())
+	d.Threshold = 0
+	assert.NotNil(t, d.CheckDevices())
+	d.Threshold = 1
+	d.Device["three"] = &Device{Point: p1}
+	assert.NotNil(t, d.CheckDevices())
+	assert.Equal(t, "three", d.duplicateDevice())
+	d.Device = map[string]*Device{}
+	assert.NotNil(t, d.CheckDevices())
+
+	// With weights, the threshold is compared to the total weight.
+	d = &Data{Threshold: 3, Device: map[string]*Device{"one": {Point: p1}, "two": {Point: p2}},
+		Weights: map[string]int{"one": 2}}
+	assert.Nil(t, d.CheckDevices())
+	assert.Nil(t, d.checkNewBlock())
+	d.Threshold = 4
+	assert.NotNil(t, d.CheckDevices())
+	assert.NotNil(t, d.checkNewBlock())
+	d.Threshold = 1
+	d.Weights = map[string]int{"one": -1}
+	assert.NotNil(t, d.CheckDevices())
+	d.Weights = map[string]int{"three": 1}
+	assert.NotNil(t, d.CheckDevices())
+
+	// A percentage must be between 1 and 100.
+	d = &Data{Threshold: 1, Device: map[string]*Device{"one": {Point: p1}, "two": {Point: p2}}}
+	for _, percent := range []int{1, 60, 100} {
+		d.ThresholdPercent = percent
+		assert.Nil(t, d.CheckDevices(), "percent %d", percent)
+		assert.Nil(t, d.checkNewBlock(), "percent %d", percent)
+	}
+	for _, percent := range []int{-1, 101} {
+		d.ThresholdPercent = percent
+		assert.NotNil(t, d.CheckDevices(), "percent %d", percent)
+		assert.NotNil(t, d.checkNewBlock(), "percent %d", percent)
+	}
+}
+
+func TestDataEqualHash(t *testing.T) {
+	p1 := tSuite.Point().Pick(tSuite.XOF([]byte("one")))
+	p2 := tSuite.Point().Pick(tSuite.XOF([]byte("two")))
+	d1 := setupConfig()
+	d1.HashVersion = HashCurrent
+	d1.Device["one"] = &Device{Point: p1}
+	d1.Device["two"] = &Device{Point: p2}
+
+	// Build the same data with the maps filled in reverse order.
+	d2 := &Data{Storage: map[string]string{}, Device: map[string]*Device{},
+		HashVersion: HashCurrent}
+	var keys []string
+	for k := range d1.Storage {
+		keys = append(keys, k)
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		d2.Storage[keys[i]] = d1.Storage[keys[i]]
+	}
+	d2.Device["two"] = &Device{Point: p2}
+	d2.Device["one"] = &Device{Point: p1}
+	d2.Votes = map[string][]byte{"one": []byte("vote")}
+	assert.True(t, d1.Equal(d2))
+	assert.True(t, d2.Equal(d1))
+	for i := 0; i < 10; i++ {
+		h1, err := d1.Hash(tSuite)
+		assert.Nil(t, err)
+		h2, err := d2.Copy().Hash(tSuite)
+		assert.Nil(t, err)
+		assert.Equal(t, h1, h2)
+	}
+
+	changes := []func(d *Data){
+		func(d *Data) { d.Threshold++ },
+		func(d *Data) { d.Device["one"] = &Device{Point: p2} },
+		func(d *Data) { delete(d.Device, "two") },
+		func(d *Data) { d.Storage["web:one"] = "2" },
+		func(d *Data) { d.Storage["new"] = "" },
+		// Swapping values between keys must change the hash.
+		func(d *Data) { d.Storage["web:one"], d.Storage["web:two"] = "3", "1" },
+		// Moving characters between key and value must change the hash.
+		func(d *Data) { delete(d.Storage, "web:two"); d.Storage["web:tw"] = "o3" },
+		func(d *Data) { d.Readers = []kyber.Point{p1} },
+		func(d *Data) { d.Metadata = &Metadata{} },
+		func(d *Data) { d.Metadata = &Metadata{Name: "one"} },
+		func(d *Data) { d.HashVersion = HashLegacy },
+		func(d *Data) { d.Weights = map[string]int{"one": 1} },
+		func(d *Data) { d.ThresholdPercent = 50 },
+	}
+	h1, err := d1.Hash(tSuite)
+	assert.Nil(t, err)
+	for i, change := range changes {
+		d := d1.Copy()
+		change(d)
+		assert.False(t, d1.Equal(d), "change %d", i)
+		h, err := d.Hash(tSuite)
+		assert.Nil(t, err)
+		assert.NotEqual(t, h1, h, "change %d", i)
+	}
+	assert.False(t, d1.Equal(nil))
+	assert.True(t, (*Data)(nil).Equal(nil))
+
+	// Empty weights are the same as no weights.
+	d := d1.Copy()
+	d.Weights = map[string]int{}
+	assert.True(t, d1.Equal(d))
+	h, err := d.Hash(tSuite)
+	assert.Nil(t, err)
+	assert.Equal(t, h1, h)
+}
+
+func TestDataSigScheme(t *testing.T) {
+	p1 := tSuite.Point().Pick(tSuite.XOF([]byte("one")))
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	dev, err := NewECDSADevice(&priv.PublicKey)
+	require.Nil(t, err)
+	d := &Data{Threshold: 2, Device: map[string]*Device{"one": {Point: p1}, "two": dev},
+		HashVersion: HashCurrent}
+	assert.Nil(t, d.CheckDevices())
+	assert.Nil(t, d.checkNewBlock())
+
+	// The scheme and the key are part of the hash and go through the
+	// network-encoding.
+	h1, err := d.Hash(tSuite)
+	require.Nil(t, err)
+	buf, err := network.Marshal(d)
+	require.Nil(t, err)
+	_, msg, err := network.Unmarshal(buf, tSuite)
+	require.Nil(t, err)
+	assert.True(t, d.Equal(msg.(*Data)))
+	h2, err := msg.(*Data).Hash(tSuite)
+	require.Nil(t, err)
+	assert.Equal(t, h1, h2)
+
+	hash := sha256.Sum256([]byte("message"))
+	sig, err := priv.Sign(rand.Reader, hash[:], nil)
+	require.Nil(t, err)
+	sv := &SchnorrVerifier{Suite: tSuite}
+	assert.Nil(t, sv.VerifyMessage(dev, []byte("message"), sig))
+	assert.NotNil(t, sv.VerifyMessage(dev, []byte("other"), sig))
+
+	// Unknown schemes and invalid keys are refused.
+	for _, bad := range []*Device{
+		{Scheme: SchemeECDSA + 1, Key: dev.Key},
+		{Scheme: SchemeECDSA, Key: []byte("key")},
+		{Scheme: SchemeECDSA, Key: dev.Key, Point: p1},
+	} {
+		d.Device["two"] = bad
+		assert.NotNil(t, d.CheckDevices())
+		assert.NotNil(t, d.checkNewBlock())
+		assert.False(t, d.Equal(msg.(*Data)))
+	}
+}
+
+func TestDataNilPoints(t *testing.T) {
+	p1 := tSuite.Point().Pick(tSuite.XOF([]byte("one")))
+	newData := func() *Data {
+		d := NewData(nil, 1, p1, "one")
+		d.Readers = []kyber.Point{p1}
+		return d
+	}
+	d1 := newData()
+	changes := []func(d *Data){
+		func(d *Data) { d.Device["one"] = nil },
+		func(d *Data) { d.Device["one"] = &Device{} },
+		func(d *Data) { d.Readers = []kyber.Point{nil} },
+	}
+	for i, change := range changes {
+		d := newData()
+		change(d)
+		assert.False(t, d1.Equal(d), "change %d", i)
+		assert.False(t, d.Equal(d1), "change %d", i)
+		assert.True(t, d.Equal(d), "change %d", i)
+		_, err := d.Hash(tSuite)
+		assert.NotNil(t, err, "change %d", i)
+	}
+
+	// A roster without aggregate key is only equal to another one.
+	d2 := newData()
+	d2.Roster = &onet.Roster{}
+	assert.False(t, d1.Equal(d2))
+	assert.True(t, d2.Equal(d2))
+	_, err := d2.Hash(tSuite)
+	assert.Nil(t, err)
+	d3 := newData()
+	d3.Roster = &onet.Roster{Aggregate: p1}
+	assert.False(t, d2.Equal(d3))
+	assert.False(t, d3.Equal(d2))
+}
+
+func TestDataHashVersion(t *testing.T) {
+	p1 := tSuite.Point().Pick(tSuite.XOF([]byte("one")))
+	d := NewData(nil, 1, p1, "one")
+	assert.Equal(t, HashCurrent, d.HashVersion)
+	legacy := d.Copy()
+	legacy.HashVersion = HashLegacy
+	assert.Nil(t, d.checkHashVersion(legacy))
+	assert.Nil(t, d.checkHashVersion(d))
+	assert.NotNil(t, legacy.checkHashVersion(d))
+
+	d.HashVersion = HashCurrent + 1
+	_, err := d.Hash(tSuite)
+	assert.NotNil(t, err)
+}
+
+// TestDataHashVector checks the hash against fixed values, so that every
+// node and every client get the same hash for the same data, whatever the
+// order of the maps. The legacy hash must not change, else the existing
+// identities can't be updated anymore.
+func TestDataHashVector(t *testing.T) {
+	expected := map[int]string{
+		HashLegacy:   "cb53484f695bbc5ebadf2ea9353e12343937cf26c82a3ded688b04d9525e1096",
+		HashPrefixed: "d0db13635880b6fc1c664186cb4a91546a762acfc2fd860c08a41a999ac51819",
+		HashMerkle:   "d64d4ee345081f9ff35f02e101e7e8b4251de6097523bda7d5e2ab9c639a667a",
+	}
+	base := tSuite.Point().Base()
+	double := tSuite.Point().Mul(tSuite.Scalar().SetInt64(2), nil)
+	for i := 0; i < 10; i++ {
+		d := &Data{
+			Threshold:   2,
+			Device:      map[string]*Device{},
+			Storage:     map[string]string{},
+			HashVersion: i % len(expected),
+		}
+		if i%4 < 2 {
+			d.Device["phone"] = &Device{Point: double}
+			d.Device["laptop"] = &Device{Point: base}
+			d.Storage["web"] = "x"
+			d.Storage["ssh:key"] = "abc"
+		} else {
+			d.Device["laptop"] = &Device{Point: base}
+			d.Device["phone"] = &Device{Point: double}
+			d.Storage["ssh:key"] = "abc"
+			d.Storage["web"] = "x"
+		}
+		// Going through the network-encoding must not change the hash.
+		buf, err := network.Marshal(d)
+		require.Nil(t, err)
+		_, msg, err := network.Unmarshal(buf, tSuite)
+		require.Nil(t, err)
+		for _, data := range []*Data{d, msg.(*Data)} {
+			h, err := data.Hash(tSuite)
+			require.Nil(t, err)
+			require.Equal(t, expected[d.HashVersion], hex.EncodeToString(h))
+		}
+	}
+}
+
+func TestDataCanReadKey(t *testing.T) {
+	d := setupConfig()
+	dev := key.NewKeyPair(tSuite)
+	r1 := key.NewKeyPair(tSuite)
+	r2 := key.NewKeyPair(tSuite)
+	d.Device["dev"] = &Device{Point: dev.Public}
+	d.ReadRules = []*ReadRule{
+		{Prefix: "ssh:", Readers: []kyber.Point{r1.Public}},
+		{Prefix: "ssh:mbp:", Readers: []kyber.Point{r2.Public}},
+	}
+	// The longest prefix decides.
+	require.True(t, d.CanReadKey("ssh:mba:gh", r1.Public))
+	require.False(t, d.CanReadKey("ssh:mba:gh", r2.Public))
+	require.False(t, d.CanReadKey("ssh:mbp:gh", r1.Public))
+	require.True(t, d.CanReadKey("ssh:mbp:gh", r2.Public))
+	require.True(t, d.CanReadKey("ssh:mbp:gh", dev.Public))
+	require.True(t, d.CanReadKey("web:one", nil))
+	require.False(t, d.CanReadKey("ssh:mba:gh", nil))
+	require.Equal(t, 3, len(d.readableBy(nil, nil).Storage))
+	require.Equal(t, 6, len(d.Storage))
+	require.Equal(t, 5, len(d.readableBy(r2.Public, nil).Storage))
+}
+
+func TestDataValueProof(t *testing.T) {
+	d := setupConfig()
+	d.HashVersion = HashMerkle
+	d.Threshold = 1
+	d.Device["one"] = &Device{Point: tSuite.Point().Pick(tSuite.XOF([]byte("one")))}
+	hash, err := d.Hash(tSuite)
+	require.Nil(t, err)
+
+	// Present keys prove their value, missing keys their absence, before,
+	// between and after the other keys.
+	for _, k := range append(d.storageKeys(), "a", "ssh:mbp", "web:one:o", "zzz") {
+		p, err := d.ProveValue(tSuite, k)
+		require.Nil(t, err)
+		require.Equal(t, 0, len(p.Data.Storage))
+		value, ok, err := p.Verify(tSuite, hash)
+		require.Nil(t, err, k)
+		expected, present := d.Storage[k]
+		require.Equal(t, present, ok, k)
+		require.Equal(t, expected, value, k)
+	}
+
+	// A changed value or a dropped neighbour doesn't verify.
+	p, err := d.ProveValue(tSuite, "web:one")
+	require.Nil(t, err)
+	p.Entries[0].Value = "2"
+	_, _, err = p.Verify(tSuite, hash)
+	require.NotNil(t, err)
+	p, err = d.ProveValue(tSuite, "ssh:mbp")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(p.Entries))
+	p.Entries = p.Entries[1:]
+	_, _, err = p.Verify(tSuite, hash)
+	require.NotNil(t, err)
+	// Keys that are not next to each other don't prove an absence.
+	before, err := d.ProveValue(tSuite, "ssh:mba:gh")
+	require.Nil(t, err)
+	after, err := d.ProveValue(tSuite, "web:one")
+	require.Nil(t, err)
+	p.Entries = []*ProofEntry{before.Entries[0], after.Entries[0]}
+	_, _, err = p.Verify(tSuite, hash)
+	require.NotNil(t, err)
+
+	// The proof is bound to the rest of the data.
+	p, err = d.ProveValue(tSuite, "web:two")
+	require.Nil(t, err)
+	p.Data.Threshold = 2
+	_, _, err = p.Verify(tSuite, hash)
+	require.NotNil(t, err)
+
+	empty := &Data{Device: d.Device, Storage: map[string]string{}, HashVersion: HashMerkle}
+	hash, err = empty.Hash(tSuite)
+	require.Nil(t, err)
+	p, err = empty.ProveValue(tSuite, "web:one")
+	require.Nil(t, err)
+	_, ok, err := p.Verify(tSuite, hash)
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	d.HashVersion = HashPrefixed
+	_, err = d.ProveValue(tSuite, "web:one")
+	require.NotNil(t, err)
+}
+
 func setupConfig() *Data {
 	d := &Data{
 		Storage: map[string]string{
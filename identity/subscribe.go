@@ -0,0 +1,370 @@
+package identity
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/log"
+)
+
+// voteBufferSize is how many progress-messages are kept for a slow
+// subscriber before new ones are dropped.
+const voteBufferSize = 16
+
+// commitBufferSize is the same for the subscribers of new blocks.
+const commitBufferSize = 16
+
+// Default limits on the subscriptions, see SetSubscriptionLimits.
+const (
+	defaultMaxSubscriptions       = 1000
+	defaultMaxClientSubscriptions = 10
+	defaultSubscriptionIdle       = 10 * time.Minute
+)
+
+// ErrorTooManySubscriptions is returned if a new subscription would go over
+// the limit of the client or of the service.
+var ErrorTooManySubscriptions = errors.New("too many subscriptions")
+
+// VoteProgress is sent to the subscribers of a proposal every time a new
+// vote has been recorded.
+type VoteProgress struct {
+	ID ID
+	// Signer is the name of the device that voted.
+	Signer string
+	// Votes is the weight of the votes on the proposal, the number of
+	// votes if the devices have no weights.
+	Votes int
+	// Threshold is the weight of the votes needed to accept the proposal.
+	Threshold int
+}
+
+// NewBlock is sent to the subscribers of an identity every time a new block
+// has been stored.
+type NewBlock struct {
+	ID ID
+	// Index of the block, counting the blocks of compacted skipchains.
+	Index int
+	// Hash of the data of the block.
+	Hash []byte
+}
+
+// subscriber is one channel waiting for progress on a proposal, or for new
+// blocks of an identity if commits is set instead of ch.
+type subscriber struct {
+	ch      chan *VoteProgress
+	commits chan *NewBlock
+	client  string
+	// lastActive is the last time the client showed activity.
+	lastActive time.Time
+	closed     bool
+}
+
+// subscriptions holds all subscribers, mapped by the identity and then by
+// the hash of the proposal for votes. Every subscriber that is not closed is
+// counted in total and perClient.
+type subscriptions struct {
+	sync.Mutex
+	votes     map[string]map[string][]*subscriber
+	commits   map[string][]*subscriber
+	total     int
+	perClient map[string]int
+	// limits, a value of 0 means no limit
+	maxTotal  int
+	maxClient int
+	idle      time.Duration
+}
+
+// SetSubscriptionLimits sets how many subscriptions can be open in total and
+// per client, and after how long without activity a subscription is
+// closed. A value of 0 removes the corresponding limit.
+func (s *Service) SetSubscriptionLimits(total, perClient int, idle time.Duration) {
+	s.subscriptions.Lock()
+	defer s.subscriptions.Unlock()
+	s.subscriptions.maxTotal = total
+	s.subscriptions.maxClient = perClient
+	s.subscriptions.idle = idle
+}
+
+// SubscribeVotes returns a channel that receives a VoteProgress every time
+// a vote on the current proposal of the identity is recorded on this node.
+// The channel is closed once the proposal is committed, replaced or
+// removed, or if the client has been idle for too long. The returned
+// function cancels the subscription and must be called if the caller is
+// not interested anymore. If the caller doesn't read fast enough,
+// progress-messages are dropped.
+//
+// Subscriptions only exist in the memory of this node: they are neither
+// propagated to the other nodes nor saved, so after a restart the caller
+// has to subscribe again. As all votes are propagated, any node of the
+// identity can be used.
+func (s *Service) SubscribeVotes(id ID, client string) (<-chan *VoteProgress, func(), error) {
+	sid := s.getIdentityStorage(id)
+	if sid == nil {
+		return nil, nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	defer sid.Unlock()
+	if sid.Proposed == nil {
+		return nil, nil, errors.New("No proposed block")
+	}
+	hash, err := sid.Proposed.Hash(s.Suite().(kyber.HashFactory))
+	if err != nil {
+		return nil, nil, err
+	}
+	subs := &s.subscriptions
+	subs.Lock()
+	defer subs.Unlock()
+	if err := subs.add(client); err != nil {
+		return nil, nil, err
+	}
+	byHash := subs.votes[string(id)]
+	if byHash == nil {
+		byHash = make(map[string][]*subscriber)
+		subs.votes[string(id)] = byHash
+	}
+	sub := &subscriber{
+		ch:         make(chan *VoteProgress, voteBufferSize),
+		client:     client,
+		lastActive: s.now(),
+	}
+	byHash[string(hash)] = append(byHash[string(hash)], sub)
+	return sub.ch, func() { s.unsubscribeVotes(id, hash, sub) }, nil
+}
+
+// SubscribeCommits returns a channel that receives a NewBlock every time
+// this node stores a new block of the identity. Unlike SubscribeVotes, the
+// subscription stays open over all blocks, until it is cancelled with the
+// returned function or the client has been idle for too long. If the
+// caller doesn't read fast enough, blocks are dropped, so a gap in the
+// indexes means that the caller missed some changes.
+func (s *Service) SubscribeCommits(id ID, client string) (<-chan *NewBlock, func(), error) {
+	if s.getIdentityStorage(id) == nil {
+		return nil, nil, errors.New("Didn't find Identity")
+	}
+	subs := &s.subscriptions
+	subs.Lock()
+	defer subs.Unlock()
+	if err := subs.add(client); err != nil {
+		return nil, nil, err
+	}
+	sub := &subscriber{
+		commits:    make(chan *NewBlock, commitBufferSize),
+		client:     client,
+		lastActive: s.now(),
+	}
+	subs.commits[string(id)] = append(subs.commits[string(id)], sub)
+	return sub.commits, func() { s.unsubscribeCommits(id, sub) }, nil
+}
+
+// add counts a new subscription of the client, or returns an error if it
+// would go over a limit. It must be called with the lock held.
+func (subs *subscriptions) add(client string) error {
+	if subs.maxTotal > 0 && subs.total >= subs.maxTotal {
+		return ErrorTooManySubscriptions
+	}
+	if subs.maxClient > 0 && subs.perClient[client] >= subs.maxClient {
+		return ErrorTooManySubscriptions
+	}
+	if subs.perClient == nil {
+		subs.votes = make(map[string]map[string][]*subscriber)
+		subs.commits = make(map[string][]*subscriber)
+		subs.perClient = make(map[string]int)
+	}
+	subs.total++
+	subs.perClient[client]++
+	return nil
+}
+
+// KeepAlive marks all subscriptions of the client as active, so that they
+// are not closed as idle.
+func (s *Service) KeepAlive(client string) {
+	s.subscriptions.Lock()
+	defer s.subscriptions.Unlock()
+	now := s.now()
+	for _, byHash := range s.subscriptions.votes {
+		for _, subs := range byHash {
+			for _, sub := range subs {
+				if sub.client == client {
+					sub.lastActive = now
+				}
+			}
+		}
+	}
+	for _, subs := range s.subscriptions.commits {
+		for _, sub := range subs {
+			if sub.client == client {
+				sub.lastActive = now
+			}
+		}
+	}
+}
+
+// unsubscribeVotes removes the subscriber and closes its channel.
+func (s *Service) unsubscribeVotes(id ID, hash []byte, sub *subscriber) {
+	s.subscriptions.Lock()
+	defer s.subscriptions.Unlock()
+	byHash := s.subscriptions.votes[string(id)]
+	subs := byHash[string(hash)]
+	for i, other := range subs {
+		if other == sub {
+			byHash[string(hash)] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(byHash[string(hash)]) == 0 {
+		delete(byHash, string(hash))
+	}
+	if len(byHash) == 0 {
+		delete(s.subscriptions.votes, string(id))
+	}
+	s.subscriptions.close(sub)
+}
+
+// unsubscribeCommits removes the subscriber of new blocks and closes its
+// channel.
+func (s *Service) unsubscribeCommits(id ID, sub *subscriber) {
+	s.subscriptions.Lock()
+	defer s.subscriptions.Unlock()
+	subs := s.subscriptions.commits[string(id)]
+	for i, other := range subs {
+		if other == sub {
+			subs = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(s.subscriptions.commits, string(id))
+	} else {
+		s.subscriptions.commits[string(id)] = subs
+	}
+	s.subscriptions.close(sub)
+}
+
+// close closes the channel of the subscriber and removes it from the
+// counters. It must be called with the lock held.
+func (subs *subscriptions) close(sub *subscriber) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	if sub.commits != nil {
+		close(sub.commits)
+	} else {
+		close(sub.ch)
+	}
+	subs.total--
+	subs.perClient[sub.client]--
+	if subs.perClient[sub.client] <= 0 {
+		delete(subs.perClient, sub.client)
+	}
+}
+
+// notifyVote sends the progress to all subscribers of the proposal with
+// the given hash, without blocking.
+func (s *Service) notifyVote(hash []byte, vp *VoteProgress) {
+	s.subscriptions.Lock()
+	defer s.subscriptions.Unlock()
+	for _, sub := range s.subscriptions.votes[string(vp.ID)][string(hash)] {
+		select {
+		case sub.ch <- vp:
+		default:
+		}
+	}
+}
+
+// notifyCommit sends the new block to all subscribers of the identity,
+// without blocking. The data is only hashed if there are subscribers.
+func (s *Service) notifyCommit(id ID, index int, d *Data) {
+	s.subscriptions.Lock()
+	defer s.subscriptions.Unlock()
+	subs := s.subscriptions.commits[string(id)]
+	if len(subs) == 0 {
+		return
+	}
+	hash, err := d.Hash(s.Suite().(kyber.HashFactory))
+	if err != nil {
+		log.Error(s.ServerIdentity(), "couldn't hash new data:", err)
+		return
+	}
+	nb := &NewBlock{ID: id, Index: index, Hash: hash}
+	for _, sub := range subs {
+		select {
+		case sub.commits <- nb:
+		default:
+		}
+	}
+}
+
+// closeVoteSubscriptions closes all subscriptions of proposals of the
+// identity, because the proposal has been committed, replaced or removed.
+func (s *Service) closeVoteSubscriptions(id ID) {
+	s.subscriptions.Lock()
+	defer s.subscriptions.Unlock()
+	for _, subs := range s.subscriptions.votes[string(id)] {
+		for _, sub := range subs {
+			s.subscriptions.close(sub)
+		}
+	}
+	delete(s.subscriptions.votes, string(id))
+}
+
+// closeCommitSubscriptions closes all subscriptions of new blocks of the
+// identity, because it has been deleted.
+func (s *Service) closeCommitSubscriptions(id ID) {
+	s.subscriptions.Lock()
+	defer s.subscriptions.Unlock()
+	for _, sub := range s.subscriptions.commits[string(id)] {
+		s.subscriptions.close(sub)
+	}
+	delete(s.subscriptions.commits, string(id))
+}
+
+// reapSubscriptions closes all subscriptions whose client has been idle for
+// longer than the idle-timeout.
+func (s *Service) reapSubscriptions(now time.Time) {
+	subs := &s.subscriptions
+	subs.Lock()
+	defer subs.Unlock()
+	if subs.idle == 0 {
+		return
+	}
+	for id, byHash := range subs.votes {
+		for hash, list := range byHash {
+			var active []*subscriber
+			for _, sub := range list {
+				if now.Sub(sub.lastActive) > subs.idle {
+					log.Lvl2(s.ServerIdentity(), "closing idle subscription of", sub.client)
+					subs.close(sub)
+				} else {
+					active = append(active, sub)
+				}
+			}
+			if len(active) == 0 {
+				delete(byHash, hash)
+			} else {
+				byHash[hash] = active
+			}
+		}
+		if len(byHash) == 0 {
+			delete(subs.votes, id)
+		}
+	}
+	for id, list := range subs.commits {
+		var active []*subscriber
+		for _, sub := range list {
+			if now.Sub(sub.lastActive) > subs.idle {
+				log.Lvl2(s.ServerIdentity(), "closing idle subscription of", sub.client)
+				subs.close(sub)
+			} else {
+				active = append(active, sub)
+			}
+		}
+		if len(active) == 0 {
+			delete(subs.commits, id)
+		} else {
+			subs.commits[id] = active
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package identity
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dedis/onet/log"
+)
+
+// suspendWindow is how far the time of a suspend- or resume-request may be
+// away from the time of the node, in both directions.
+const suspendWindow = 10 * time.Minute
+
+// ErrorSuspended is returned for proposals and votes on a suspended
+// identity.
+var ErrorSuspended = errors.New("identity is suspended")
+
+// SuspendIdentity asks to reject all proposals and votes of the identity
+// until it is resumed. It needs the signatures of a threshold of devices.
+type SuspendIdentity struct {
+	ID ID
+	// Time in unix-nanoseconds, must be newer than the last suspend or
+	// resume and close to the time of the nodes.
+	Time int64
+	// Signatures of the devices on SuspendMessage, mapped by device.
+	Signatures map[string][]byte
+}
+
+// SuspendIdentityReply is empty.
+type SuspendIdentityReply struct{}
+
+// ResumeIdentity asks to accept proposals and votes of a suspended identity
+// again. Like SuspendIdentity it needs the signatures of a threshold of
+// devices.
+type ResumeIdentity struct {
+	ID         ID
+	Time       int64
+	Signatures map[string][]byte
+}
+
+// ResumeIdentityReply is empty.
+type ResumeIdentityReply struct{}
+
+// SuspendMessage returns the message the devices sign to suspend or resume
+// the identity at time t. It starts with a tag, so that it cannot be
+// mistaken for any other message signed by a device.
+func SuspendMessage(id ID, suspend bool, t int64) []byte {
+	tag := "identity-resume"
+	if suspend {
+		tag = "identity-suspend"
+	}
+	var ts [8]byte
+	binary.LittleEndian.PutUint64(ts[:], uint64(t))
+	msg := append([]byte(tag), id...)
+	return append(msg, ts[:]...)
+}
+
+// SuspendIdentity suspends the identity on all nodes.
+func (s *Service) SuspendIdentity(req *SuspendIdentity) (*SuspendIdentityReply, error) {
+	if err := s.changeSuspended(req.ID, req, true, req.Time, req.Signatures); err != nil {
+		return nil, err
+	}
+	return &SuspendIdentityReply{}, nil
+}
+
+// ResumeIdentity resumes the identity on all nodes.
+func (s *Service) ResumeIdentity(req *ResumeIdentity) (*ResumeIdentityReply, error) {
+	if err := s.changeSuspended(req.ID, req, false, req.Time, req.Signatures); err != nil {
+		return nil, err
+	}
+	return &ResumeIdentityReply{}, nil
+}
+
+// changeSuspended checks the request and propagates it to all nodes.
+func (s *Service) changeSuspended(id ID, req interface{}, suspend bool, t int64,
+	sigs map[string][]byte) error {
+	if s.isReadReplica() {
+		return ErrorReadReplica
+	}
+	sid := s.getIdentityStorage(id)
+	if sid == nil {
+		return errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	err := s.checkSuspend(id, sid, suspend, t, sigs)
+	roster := s.withReplicas(sid.votingRoster(sid.Latest))
+	sid.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = s.propagate(propagateKindData, roster, req, sid.propagateTimeout())
+	return err
+}
+
+// checkSuspend returns nil if enough devices signed to suspend or resume
+// the identity at time t. It must be called with the lock of sid held.
+func (s *Service) checkSuspend(id ID, sid *IDBlock, suspend bool, t int64,
+	sigs map[string][]byte) error {
+	if t <= sid.SuspendChanged {
+		return errors.New("request is older than the last change")
+	}
+	if d := s.now().Sub(time.Unix(0, t)); d > suspendWindow || d < -suspendWindow {
+		return errors.New("time of request is too far from the time of the node")
+	}
+	return s.checkThresholdSigned(sid, SuspendMessage(id, suspend, t), sigs)
+}
+
+// checkThresholdSigned returns nil if a threshold of the devices of the
+// identity signed msg. It must be called with the lock of sid held.
+func (s *Service) checkThresholdSigned(sid *IDBlock, msg []byte, sigs map[string][]byte) error {
+	return thresholdSigned(sid.Latest, msg, sigs, s.verifyDevice)
+}
+
+// thresholdSigned returns nil if verify accepts the signatures on msg of
+// devices of d whose weights add up to the threshold.
+func thresholdSigned(d *Data, msg []byte, sigs map[string][]byte,
+	verify func(*Device, []byte, []byte) error) error {
+	valid := 0
+	for name, sig := range sigs {
+		dev := d.Device[name]
+		if dev == nil {
+			continue
+		}
+		if verify(dev, msg, sig) == nil {
+			valid += d.weight(name)
+		}
+	}
+	if required := requiredVotes(d, nil, false); valid < required {
+		return fmt.Errorf("only %d out of %d signatures", valid, required)
+	}
+	return nil
+}
+
+// applySuspend sets the suspended flag if the request is valid. It must be
+// called with the lock of sid held.
+func (s *Service) applySuspend(id ID, sid *IDBlock, suspend bool, t int64,
+	sigs map[string][]byte) {
+	if err := s.checkSuspend(id, sid, suspend, t, sigs); err != nil {
+		log.Error(s.ServerIdentity(), "refusing to change suspension:", err)
+		return
+	}
+	log.Lvlf2("%s: identity %x suspended: %t", s.ServerIdentity(), []byte(id), suspend)
+	sid.Suspended = suspend
+	sid.SuspendChanged = t
+}
@@ -0,0 +1,147 @@
+package identity
+
+import (
+	"time"
+
+	"github.com/dedis/onet/log"
+)
+
+// defaultSweepInterval is how often the service looks for expired state.
+const defaultSweepInterval = time.Minute
+
+// sweeper removes expired state from one identity. It is called with the
+// lock of sid held and returns true if something changed.
+type sweeper func(id ID, sid *IDBlock, now time.Time) bool
+
+// SetSweepInterval sets how often the service looks for expired state in
+// all identities. A value of 0 stops the sweeping.
+func (s *Service) SetSweepInterval(d time.Duration) {
+	s.sweepMutex.Lock()
+	defer s.sweepMutex.Unlock()
+	s.sweepInterval = d
+	s.rescheduleSweep()
+}
+
+// Close stops the sweeping and the delayed commits, so that no timer is
+// left running when the service is shut down, and waits for the pending
+// saves.
+func (s *Service) Close() error {
+	s.SetSweepInterval(0)
+	s.stopCommitTimers()
+	s.timestamps.Wait()
+	s.flushSaves()
+	return nil
+}
+
+// rescheduleSweep stops the current timer and starts a new one if the
+// interval is not 0. Every timer gets a new generation, so that a sweep
+// that is already running doesn't re-arm an old timer. It must be called
+// with sweepMutex held.
+func (s *Service) rescheduleSweep() {
+	if s.sweepTimer != nil {
+		s.sweepTimer.Stop()
+		s.sweepTimer = nil
+	}
+	s.sweepGen++
+	if s.sweepInterval > 0 {
+		gen := s.sweepGen
+		s.sweepTimer = s.afterFunc(s.sweepInterval, func() {
+			s.sweepAndReschedule(gen)
+		})
+	}
+}
+
+// SetProposalMaxAge sets how long a proposal sent to this node stays open
+// before it is removed by the sweep. The expiry is stored with the proposal
+// on all nodes, so it doesn't depend on their settings. A value of 0 keeps
+// proposals forever.
+func (s *Service) SetProposalMaxAge(d time.Duration) {
+	s.sweepMutex.Lock()
+	defer s.sweepMutex.Unlock()
+	s.proposalMaxAge = d
+}
+
+// sweepAndReschedule is called by the timer of generation gen and re-arms
+// it, unless the timer has been replaced in the meantime.
+func (s *Service) sweepAndReschedule(gen int) {
+	s.sweepMutex.Lock()
+	current := gen == s.sweepGen
+	s.sweepMutex.Unlock()
+	if !current {
+		return
+	}
+	s.Sweep()
+	s.sweepMutex.Lock()
+	defer s.sweepMutex.Unlock()
+	if gen == s.sweepGen {
+		s.rescheduleSweep()
+	}
+}
+
+// Sweep goes through all identities and removes expired state. The
+// storage is only saved if something changed. It also closes idle
+// subscriptions and checks for proposals that are stuck below the
+// threshold.
+func (s *Service) Sweep() {
+	s.storageMutex.Lock()
+	ids := make(map[string]*IDBlock)
+	for id, sid := range s.Storage.Identities {
+		ids[id] = sid
+	}
+	s.storageMutex.Unlock()
+
+	now := s.now()
+	changed := false
+	for id, sid := range ids {
+		sid.Lock()
+		for _, sw := range s.sweepers {
+			if sw(ID(id), sid, now) {
+				changed = true
+			}
+		}
+		sid.Unlock()
+	}
+	if changed {
+		s.storageMutex.Lock()
+		s.save()
+		s.storageMutex.Unlock()
+	}
+	s.reapSubscriptions(now)
+	s.CheckQuorum()
+}
+
+// proposalExpiry returns when a proposal received at t with the given ttl
+// expires, or 0 if it doesn't expire. A ttl of 0 or above the maximum age
+// is replaced by the maximum age.
+func (s *Service) proposalExpiry(t int64, ttl time.Duration) int64 {
+	s.sweepMutex.Lock()
+	defer s.sweepMutex.Unlock()
+	if ttl == 0 || (s.proposalMaxAge > 0 && ttl > s.proposalMaxAge) {
+		ttl = s.proposalMaxAge
+	}
+	if ttl == 0 {
+		return 0
+	}
+	return t + int64(ttl)
+}
+
+// proposalExpired returns true if sid has a proposal that expired before
+// now. It must be called with the lock of sid held.
+func (sid *IDBlock) proposalExpired(now time.Time) bool {
+	return sid.Proposed != nil && sid.ProposalExpires > 0 &&
+		now.UnixNano() >= sid.ProposalExpires
+}
+
+// sweepProposal removes an expired proposal. As all nodes store the same
+// expiry and refuse votes after it, they agree on the proposal being gone
+// without propagating the removal.
+func (s *Service) sweepProposal(id ID, sid *IDBlock, now time.Time) bool {
+	if !sid.proposalExpired(now) {
+		return false
+	}
+	log.Lvlf2("%s: removing expired proposal of %x", s.ServerIdentity(), []byte(id))
+	sid.Proposed = nil
+	sid.ProposedBy = ""
+	s.closeVoteSubscriptions(id)
+	return true
+}
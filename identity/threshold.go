@@ -0,0 +1,156 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SetStrictThreshold sets whether a proposal changing the threshold needs
+// the votes of the higher of the old and the new threshold. Else the old
+// threshold is used for all proposals. The setting is stored, so it is
+// restored when the service is created again.
+func (s *Service) SetStrictThreshold(strict bool) {
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	s.Storage.StrictThreshold = strict
+	s.save()
+}
+
+// isStrictThreshold returns true if threshold changes need the higher of
+// both thresholds.
+func (s *Service) isStrictThreshold() bool {
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	return s.Storage.StrictThreshold
+}
+
+// approvals returns the weight of the votes approving the proposal, where
+// latest gives the weights of the devices. A rejection has no signature and
+// never counts towards the threshold.
+func approvals(latest *Data, votes map[string][]byte) int {
+	var names []string
+	for name, sig := range votes {
+		if len(sig) > 0 {
+			names = append(names, name)
+		}
+	}
+	return latest.weightOf(names)
+}
+
+// requiredVotes returns the weight of the votes of the devices in latest
+// needed to accept proposed. As only the devices in latest can vote, it is
+// never more than their total weight.
+func requiredVotes(latest, proposed *Data, strict bool) int {
+	required := latest.threshold()
+	if strict && proposed != nil {
+		if t := proposed.threshold(); t > required {
+			required = t
+		}
+	}
+	if total := latest.totalWeight(); required > total {
+		required = total
+	}
+	return required
+}
+
+// threshold returns the weight of the votes the devices of d need: the
+// ThresholdPercent of their total weight if it is set, but never less than
+// Threshold and at least 1.
+func (d *Data) threshold() int {
+	t := d.Threshold
+	if d.ThresholdPercent > 0 {
+		if p := (d.totalWeight()*d.ThresholdPercent + 99) / 100; p > t {
+			t = p
+		}
+	}
+	if t < 1 {
+		t = 1
+	}
+	return t
+}
+
+// checkThresholdPercent returns an error if ThresholdPercent is set and
+// not between 1 and 100.
+func (d *Data) checkThresholdPercent() error {
+	if d.ThresholdPercent != 0 && (d.ThresholdPercent < 1 || d.ThresholdPercent > 100) {
+		return fmt.Errorf("threshold-percent %d is not between 1 and 100",
+			d.ThresholdPercent)
+	}
+	return nil
+}
+
+// weight returns the weight of the vote of the device: 1 if the data has no
+// weights or none for the device.
+func (d *Data) weight(name string) int {
+	if w, ok := d.Weights[name]; ok {
+		return w
+	}
+	return 1
+}
+
+// weightOf returns the sum of the weights of the named devices. Names that
+// are not devices of the data don't count.
+func (d *Data) weightOf(names []string) int {
+	total := 0
+	for _, name := range names {
+		if d.Device[name] != nil {
+			total += d.weight(name)
+		}
+	}
+	return total
+}
+
+// totalWeight returns the sum of the weights of all devices.
+func (d *Data) totalWeight() int {
+	return d.weightOf(d.deviceNames())
+}
+
+// checkNewBlock returns an error if the data can't be stored in a new block,
+// because no device could vote anymore or because it could be replaced
+// without votes: it needs a device, every device needs a public key of a
+// known scheme, the threshold must be between 1 and the total weight of the
+// devices and a percentage between 1 and 100.
+func (d *Data) checkNewBlock() error {
+	if len(d.Device) == 0 {
+		return errors.New("no devices")
+	}
+	for name, dev := range d.Device {
+		if dev == nil {
+			return fmt.Errorf("device %s has no public key", name)
+		}
+		if err := dev.checkKey(); err != nil {
+			return fmt.Errorf("device %s: %s", name, err)
+		}
+	}
+	if d.Threshold < 1 {
+		return fmt.Errorf("threshold %d is lower than 1", d.Threshold)
+	}
+	if err := d.checkThresholdPercent(); err != nil {
+		return err
+	}
+	if err := d.checkWeights(); err != nil {
+		return err
+	}
+	if total := d.totalWeight(); d.Threshold > total {
+		return fmt.Errorf("threshold %d is more than the total weight %d",
+			d.Threshold, total)
+	}
+	return nil
+}
+
+// checkWeights returns an error if a weight is negative or given for an
+// unknown device.
+func (d *Data) checkWeights() error {
+	if len(d.Weights) == 0 {
+		return nil
+	}
+	for name, w := range d.Weights {
+		if d.Device[name] == nil {
+			return fmt.Errorf("weight for unknown device %s", name)
+		}
+		if w < 0 {
+			return fmt.Errorf("negative weight for device %s", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package identity
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/log"
+)
+
+// CancelProposal asks to drop a proposal that has been sent with a delay,
+// before it is committed. Every device of the identity can cancel it.
+type CancelProposal struct {
+	ID ID
+	// Hash of the cancelled proposal, so that a newer proposal is not
+	// cancelled by mistake.
+	Hash []byte
+	// Signer is the name of the device and Signature its signature on
+	// CancelMessage.
+	Signer    string
+	Signature []byte
+}
+
+// CancelProposalReply is empty.
+type CancelProposalReply struct{}
+
+// CancelMessage returns the message a device signs to cancel the proposal
+// with the given hash.
+func CancelMessage(id ID, hash []byte) []byte {
+	msg := append([]byte("identity-cancel"), id...)
+	return append(msg, hash...)
+}
+
+// CancelProposal checks the request and propagates it to all nodes.
+func (s *Service) CancelProposal(req *CancelProposal) (*CancelProposalReply, error) {
+	if s.isReadReplica() {
+		return nil, ErrorReadReplica
+	}
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	err := s.checkCancel(sid, req)
+	roster := s.withReplicas(sid.votingRoster(sid.Latest))
+	sid.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.propagate(propagateKindData, roster, req, sid.propagateTimeout()); err != nil {
+		return nil, err
+	}
+	return &CancelProposalReply{}, nil
+}
+
+// checkCancel returns nil if the request cancels the current proposal of
+// sid and is signed by one of its devices. It must be called with the lock
+// of sid held.
+func (s *Service) checkCancel(sid *IDBlock, req *CancelProposal) error {
+	if sid.Proposed == nil {
+		return errors.New("no proposal to cancel")
+	}
+	if sid.ProposalDelay == 0 {
+		return errors.New("only delayed proposals can be cancelled")
+	}
+	hash, err := sid.Proposed.Hash(s.Suite().(kyber.HashFactory))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, req.Hash) {
+		return errors.New("not the current proposal")
+	}
+	dev := sid.Latest.Device[req.Signer]
+	if dev == nil {
+		return errors.New("unknown device " + req.Signer)
+	}
+	return s.verifyDevice(dev, CancelMessage(req.ID, req.Hash), req.Signature)
+}
+
+// applyCancel removes the proposal if the request is valid. It must be
+// called with the lock of sid held.
+func (s *Service) applyCancel(id ID, sid *IDBlock, req *CancelProposal) {
+	if err := s.checkCancel(sid, req); err != nil {
+		log.Error(s.ServerIdentity(), "refusing to cancel proposal:", err)
+		return
+	}
+	log.Lvlf2("%s: proposal of %x cancelled by %s", s.ServerIdentity(), []byte(id),
+		req.Signer)
+	sid.Proposed = nil
+	sid.ProposedBy = ""
+	sid.ProposalDelay = 0
+	sid.CommitAt = 0
+	s.stopCommitTimer(id)
+	s.closeVoteSubscriptions(id)
+}
+
+// delayCommit returns true if the proposal of sid, which has enough votes,
+// must wait before being committed. The first time it is called for a
+// proposal, the commit is scheduled. It must be called with the lock of
+// sid held.
+func (s *Service) delayCommit(id ID, sid *IDBlock, now time.Time) bool {
+	if sid.ProposalDelay == 0 {
+		return false
+	}
+	if sid.CommitAt == 0 {
+		sid.CommitAt = now.UnixNano() + sid.ProposalDelay
+		log.Lvlf2("%s: committing proposal of %x at %s", s.ServerIdentity(),
+			[]byte(id), time.Unix(0, sid.CommitAt))
+		s.scheduleCommit(id, sid.CommitAt, now)
+	}
+	return now.UnixNano() < sid.CommitAt
+}
+
+// scheduleCommit starts a timer that commits the proposal of the identity
+// at the time at, replacing an existing timer.
+func (s *Service) scheduleCommit(id ID, at int64, now time.Time) {
+	s.commitTimersMutex.Lock()
+	defer s.commitTimersMutex.Unlock()
+	if s.commitTimers == nil {
+		s.commitTimers = make(map[string]Timer)
+	}
+	if t := s.commitTimers[string(id)]; t != nil {
+		t.Stop()
+	}
+	s.commitTimers[string(id)] = s.afterFunc(time.Unix(0, at).Sub(now), func() {
+		s.commitDelayed(id)
+	})
+}
+
+// hasCommitTimer returns true if a commit is scheduled for the identity.
+func (s *Service) hasCommitTimer(id ID) bool {
+	s.commitTimersMutex.Lock()
+	defer s.commitTimersMutex.Unlock()
+	return s.commitTimers[string(id)] != nil
+}
+
+// stopCommitTimer stops the scheduled commit of the identity, if any.
+func (s *Service) stopCommitTimer(id ID) {
+	s.commitTimersMutex.Lock()
+	defer s.commitTimersMutex.Unlock()
+	if t := s.commitTimers[string(id)]; t != nil {
+		t.Stop()
+		delete(s.commitTimers, string(id))
+	}
+}
+
+// stopCommitTimers stops all scheduled commits.
+func (s *Service) stopCommitTimers() {
+	s.commitTimersMutex.Lock()
+	defer s.commitTimersMutex.Unlock()
+	for id, t := range s.commitTimers {
+		t.Stop()
+		delete(s.commitTimers, id)
+	}
+}
+
+// commitDelayed is called by the timer of the identity. The proposal is
+// only committed if it has not been cancelled or replaced in the meantime.
+func (s *Service) commitDelayed(id ID) {
+	s.commitTimersMutex.Lock()
+	delete(s.commitTimers, string(id))
+	s.commitTimersMutex.Unlock()
+	sid := s.getIdentityStorage(id)
+	if sid == nil {
+		return
+	}
+	if _, err := s.commitProposal(id, sid); err != nil {
+		log.Error(s.ServerIdentity(), "couldn't commit delayed proposal:", err)
+	}
+}
+
+// sweepDelayed is a sweeper that schedules the delayed commits again, for
+// example after a restart of the node, as the timers are not saved.
+func (s *Service) sweepDelayed(id ID, sid *IDBlock, now time.Time) bool {
+	if sid.Proposed == nil || sid.CommitAt == 0 || s.hasCommitTimer(id) {
+		return false
+	}
+	s.scheduleCommit(id, sid.CommitAt, now)
+	return false
+}
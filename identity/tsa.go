@@ -0,0 +1,364 @@
+package identity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/log"
+)
+
+// The timestamps of RFC 3161 let a third party prove that a block existed
+// at a given time, without trusting the nodes. If a timestamp authority
+// (TSA) is configured, every node asks it for a token over the hash of each
+// block it stores and keeps the token with the identity. The tokens are
+// not part of the skipchain, so nodes without a TSA, or whose request
+// failed, simply have none.
+
+// tsaTimeout is how long a node waits for the timestamp authority.
+const tsaTimeout = 30 * time.Second
+
+var (
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+)
+
+// TimestampAuthority is the service the nodes ask for RFC 3161 tokens.
+type TimestampAuthority struct {
+	// URL accepts requests of the content-type application/timestamp-query.
+	URL string
+	// Cert is the DER-encoded certificate the tokens are signed with.
+	Cert []byte
+}
+
+// BlockTimestamp is the token of the timestamp authority for the block
+// with the given index and hash.
+type BlockTimestamp struct {
+	Index int
+	Hash  skipchain.SkipBlockID
+	Token []byte
+}
+
+// GetTimestamp asks for the token of the block with the given index.
+type GetTimestamp struct {
+	ID    ID
+	Index int
+	// Auth is needed if the identity has readers.
+	Auth *ReadAuth
+}
+
+// GetTimestampReply holds the hash of the block and the token over it.
+// Clients should check the token with VerifyTimestamp against a hash they
+// got from the skipchain.
+type GetTimestampReply struct {
+	Hash  skipchain.SkipBlockID
+	Token []byte
+}
+
+// ASN.1 structures of RFC 3161 and RFC 5652, limited to the fields that are
+// needed to ask for a token and to verify it.
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	CertReq        bool `asn1:"optional,default:false"`
+}
+
+type pkiStatusInfo struct {
+	Status int
+	// The optional text and failure information follow.
+}
+
+type timeStampResp struct {
+	Status pkiStatusInfo
+	Token  asn1.RawValue `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+	// The optional accuracy, ordering, nonce, tsa and extensions follow.
+}
+
+// timestampImprint returns the message imprint of the hash of a block.
+func timestampImprint(hash []byte) messageImprint {
+	h := sha256.Sum256(hash)
+	return messageImprint{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+		HashedMessage: h[:],
+	}
+}
+
+// requestTimestamp asks the timestamp authority at url for a token over
+// hash.
+func requestTimestamp(url string, hash []byte) ([]byte, error) {
+	req, err := asn1.Marshal(timeStampReq{
+		Version:        1,
+		MessageImprint: timestampImprint(hash),
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: tsaTimeout}
+	resp, err := client.Post(url, "application/timestamp-query", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("timestamp authority returned %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var tsr timeStampResp
+	if _, err := asn1.Unmarshal(body, &tsr); err != nil {
+		return nil, err
+	}
+	// 0 is granted and 1 granted with modifications.
+	if tsr.Status.Status > 1 {
+		return nil, fmt.Errorf("timestamp refused with status %d", tsr.Status.Status)
+	}
+	if len(tsr.Token.FullBytes) == 0 {
+		return nil, errors.New("no token in the response")
+	}
+	return tsr.Token.FullBytes, nil
+}
+
+// VerifyTimestamp checks that token is signed with cert and is over hash,
+// and returns the time of the token. Only tokens signed over their signed
+// attributes with SHA-256 are supported.
+func VerifyTimestamp(token, hash []byte, cert *x509.Certificate) (time.Time, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(token, &ci); err != nil {
+		return time.Time{}, err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return time.Time{}, errors.New("token is not signed data")
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return time.Time{}, err
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return time.Time{}, errors.New("token doesn't hold a timestamp")
+	}
+	if len(sd.SignerInfos) != 1 {
+		return time.Time{}, errors.New("token needs exactly one signer")
+	}
+	content := sd.EncapContentInfo.EContent
+	if err := verifySignerInfo(&sd.SignerInfos[0], content, cert); err != nil {
+		return time.Time{}, err
+	}
+	var info tstInfo
+	if _, err := asn1.Unmarshal(content, &info); err != nil {
+		return time.Time{}, err
+	}
+	imprint := timestampImprint(hash)
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) ||
+		!bytes.Equal(info.MessageImprint.HashedMessage, imprint.HashedMessage) {
+		return time.Time{}, errors.New("token is over another hash")
+	}
+	return info.GenTime, nil
+}
+
+// verifySignerInfo checks that the signed attributes of si hold the digest
+// of content and are signed with cert.
+func verifySignerInfo(si *signerInfo, content []byte, cert *x509.Certificate) error {
+	if !si.DigestAlgorithm.Algorithm.Equal(oidSHA256) {
+		return errors.New("unsupported digest algorithm")
+	}
+	if len(si.SignedAttrs.FullBytes) == 0 {
+		return errors.New("token has no signed attributes")
+	}
+	// The signature is over the attributes encoded as a SET, not with the
+	// implicit tag they have in the signer info.
+	signed := append([]byte{}, si.SignedAttrs.FullBytes...)
+	signed[0] = 0x31
+	var attrs []attribute
+	if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+		return err
+	}
+	var digest []byte
+	var contentType asn1.ObjectIdentifier
+	for _, a := range attrs {
+		if len(a.Values) != 1 {
+			continue
+		}
+		var err error
+		switch {
+		case a.Type.Equal(oidMessageDigest):
+			_, err = asn1.Unmarshal(a.Values[0].FullBytes, &digest)
+		case a.Type.Equal(oidContentType):
+			_, err = asn1.Unmarshal(a.Values[0].FullBytes, &contentType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !contentType.Equal(oidTSTInfo) {
+		return errors.New("signed content is not a timestamp")
+	}
+	h := sha256.Sum256(content)
+	if !bytes.Equal(digest, h[:]) {
+		return errors.New("wrong digest of the timestamp")
+	}
+	var algo x509.SignatureAlgorithm
+	switch cert.PublicKeyAlgorithm {
+	case x509.RSA:
+		algo = x509.SHA256WithRSA
+	case x509.ECDSA:
+		algo = x509.ECDSAWithSHA256
+	default:
+		return errors.New("unsupported key of the timestamp authority")
+	}
+	return cert.CheckSignature(algo, signed, si.Signature)
+}
+
+// SetTimestampAuthority makes the node ask the authority at url for a
+// token over every new block, signed with cert. An empty url stops it.
+func (s *Service) SetTimestampAuthority(url string, cert *x509.Certificate) error {
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	if url == "" {
+		s.Storage.TimestampAuthority = nil
+	} else {
+		if cert == nil {
+			return errors.New("the certificate of the authority is missing")
+		}
+		s.Storage.TimestampAuthority = &TimestampAuthority{URL: url, Cert: cert.Raw}
+	}
+	s.save()
+	return nil
+}
+
+// timestampAuthority returns the configured authority or nil.
+func (s *Service) timestampAuthority() *TimestampAuthority {
+	s.storageMutex.Lock()
+	defer s.storageMutex.Unlock()
+	return s.Storage.TimestampAuthority
+}
+
+// timestampLater asks for the token of the block in the background, if an
+// authority is configured.
+func (s *Service) timestampLater(id ID, sb *skipchain.SkipBlock) {
+	tsa := s.timestampAuthority()
+	if tsa == nil {
+		return
+	}
+	s.timestamps.Add(1)
+	go func() {
+		defer s.timestamps.Done()
+		if err := s.fetchTimestamp(tsa, id, sb); err != nil {
+			log.Error(s.ServerIdentity(), "couldn't timestamp block:", err)
+		}
+	}()
+}
+
+// fetchTimestamp asks tsa for the token of the block, verifies it and
+// stores it with the identity.
+func (s *Service) fetchTimestamp(tsa *TimestampAuthority, id ID, sb *skipchain.SkipBlock) error {
+	cert, err := x509.ParseCertificate(tsa.Cert)
+	if err != nil {
+		return err
+	}
+	token, err := requestTimestamp(tsa.URL, sb.Hash)
+	if err != nil {
+		return err
+	}
+	if _, err := VerifyTimestamp(token, sb.Hash, cert); err != nil {
+		return err
+	}
+	sid := s.getIdentityStorage(id)
+	if sid == nil {
+		return errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	sid.Timestamps = append(sid.Timestamps, &BlockTimestamp{
+		Index: sb.Index,
+		Hash:  sb.Hash,
+		Token: token,
+	})
+	sid.Unlock()
+	s.saveLater()
+	return nil
+}
+
+// GetTimestamp returns the token of a block, if the node has one.
+func (s *Service) GetTimestamp(req *GetTimestamp) (*GetTimestampReply, error) {
+	sid := s.getIdentityStorage(req.ID)
+	if sid == nil {
+		return nil, errors.New("Didn't find Identity")
+	}
+	sid.Lock()
+	err := s.checkRead(req.ID, sid.Latest, req.Auth)
+	var found *BlockTimestamp
+	for _, ts := range sid.Timestamps {
+		if ts.Index == req.Index {
+			found = ts
+		}
+	}
+	sid.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no timestamp for block %d", req.Index)
+	}
+	return &GetTimestampReply{Hash: found.Hash, Token: found.Token}, nil
+}
@@ -0,0 +1,195 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+// mockTSA is a timestamp authority answering every request with a token
+// signed by its self-signed certificate.
+type mockTSA struct {
+	*httptest.Server
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newMockTSA(t *testing.T) *mockTSA {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mock tsa"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	m := &mockTSA{key: priv, cert: cert}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.serve))
+	return m
+}
+
+func (m *mockTSA) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req timeStampReq
+	if _, err := asn1.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, err := m.sign(req.MessageImprint, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := asn1.Marshal(timeStampResp{Token: asn1.RawValue{FullBytes: token}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/timestamp-reply")
+	w.Write(resp)
+}
+
+// sign returns a token over the imprint at time now.
+func (m *mockTSA) sign(imprint messageImprint, now time.Time) ([]byte, error) {
+	content, err := asn1.Marshal(tstInfo{
+		Version:        1,
+		Policy:         asn1.ObjectIdentifier{1, 2, 3, 4},
+		MessageImprint: imprint,
+		SerialNumber:   big.NewInt(now.UnixNano()),
+		GenTime:        now.UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(content)
+	ct, err := asn1.Marshal(oidTSTInfo)
+	if err != nil {
+		return nil, err
+	}
+	md, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signed, err := asn1.MarshalWithParams([]attribute{
+		{Type: oidContentType, Values: []asn1.RawValue{{FullBytes: ct}}},
+		{Type: oidMessageDigest, Values: []asn1.RawValue{{FullBytes: md}}},
+	}, "set")
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(signed)
+	sig, err := m.key.Sign(rand.Reader, h[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	sid, err := asn1.Marshal(struct {
+		Issuer asn1.RawValue
+		Serial *big.Int
+	}{asn1.RawValue{FullBytes: m.cert.RawIssuer}, m.cert.SerialNumber})
+	if err != nil {
+		return nil, err
+	}
+	sha := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	sd, err := asn1.Marshal(signedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha},
+		EncapContentInfo: encapContentInfo{EContentType: oidTSTInfo, EContent: content},
+		SignerInfos: []signerInfo{{
+			Version:         1,
+			SID:             asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm: sha,
+			// The attributes are signed as a SET but sent with an
+			// implicit tag.
+			SignedAttrs:        asn1.RawValue{FullBytes: append([]byte{0xa0}, signed[1:]...)},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+			Signature:          sig,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0,
+			IsCompound: true, Bytes: sd},
+	})
+}
+
+func TestVerifyTimestamp(t *testing.T) {
+	tsa := newMockTSA(t)
+	defer tsa.Close()
+	hash := []byte("block hash")
+	now := time.Now()
+	token, err := requestTimestamp(tsa.URL, hash)
+	require.Nil(t, err)
+	ts, err := VerifyTimestamp(token, hash, tsa.cert)
+	require.Nil(t, err)
+	require.True(t, ts.After(now.Add(-time.Second)))
+	require.False(t, ts.After(time.Now()))
+
+	_, err = VerifyTimestamp(token, []byte("other hash"), tsa.cert)
+	require.NotNil(t, err)
+	other := newMockTSA(t)
+	defer other.Close()
+	_, err = VerifyTimestamp(token, hash, other.cert)
+	require.NotNil(t, err)
+	token[len(token)-1] ^= 1
+	_, err = VerifyTimestamp(token, hash, tsa.cert)
+	require.NotNil(t, err)
+}
+
+func TestService_Timestamp(t *testing.T) {
+	l, td := setupTestDevices(t, 3, 2, 2)
+	defer l.CloseAll()
+	tsa := newMockTSA(t)
+	defer tsa.Close()
+	for _, srvc := range td.services {
+		require.Nil(t, srvc.(*Service).SetTimestampAuthority(tsa.URL, tsa.cert))
+	}
+	data := td.Devices[0].Data.Copy()
+	data.Storage["key"] = "value"
+	require.Nil(t, td.propose(data))
+	sb, err := td.vote(1)
+	require.Nil(t, err)
+	require.NotNil(t, sb)
+
+	// The tokens are requested in the background.
+	var hash, token []byte
+	for i := 0; i < 50; i++ {
+		hash, token, err = td.Devices[0].GetTimestamp(sb.Index)
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Nil(t, err)
+	require.Equal(t, []byte(sb.Hash), hash)
+	_, err = VerifyTimestamp(token, sb.Hash, tsa.cert)
+	require.Nil(t, err)
+	_, _, err = td.Devices[0].GetTimestamp(sb.Index + 1)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,117 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/network"
+)
+
+// VoteVerifier checks the credential a device sends to vote on a proposal.
+// It can be used to accept other proofs than a schnorr-signature, e.g. from
+// hardware tokens.
+type VoteVerifier interface {
+	// VerifyVote returns nil if credential is a valid vote of the device
+	// on proposed.
+	VerifyVote(proposed *Data, device *Device, credential []byte) error
+}
+
+// MessageVerifier can be implemented by a VoteVerifier to also check the
+// other messages signed by the devices, like heartbeats or the suspension
+// of an identity. Verifiers that don't implement it are skipped for these
+// messages.
+type MessageVerifier interface {
+	// VerifyMessage returns nil if credential is valid for msg and the
+	// device.
+	VerifyMessage(device *Device, msg, credential []byte) error
+}
+
+// SchnorrVerifier is the default VoteVerifier. It accepts a
+// schnorr-signature of the device on the hash of the proposal, or a
+// collective signature for a device with a group. Devices using another
+// SigScheme are verified with that scheme.
+type SchnorrVerifier struct {
+	Suite network.Suite
+}
+
+// VerifyVote implements VoteVerifier.
+func (sv *SchnorrVerifier) VerifyVote(proposed *Data, device *Device, credential []byte) error {
+	hash, err := proposed.Hash(sv.Suite.(kyber.HashFactory))
+	if err != nil {
+		return err
+	}
+	return sv.VerifyMessage(device, hash, credential)
+}
+
+// VerifyMessage implements MessageVerifier.
+func (sv *SchnorrVerifier) VerifyMessage(device *Device, msg, credential []byte) error {
+	switch device.Scheme {
+	case SchemeSchnorr:
+	case SchemeECDSA:
+		return device.verifyECDSA(msg, credential)
+	default:
+		return fmt.Errorf("unknown signature scheme %d", device.Scheme)
+	}
+	if device.Group != nil {
+		return device.Group.verify(sv.Suite, device.Point, msg, credential)
+	}
+	return schnorr.Verify(sv.Suite, device.Point, msg, credential)
+}
+
+// SetVoteVerifiers replaces the verifiers used for the votes. A vote is only
+// accepted if all verifiers accept it. To keep the schnorr-signature check,
+// a SchnorrVerifier has to be part of the verifiers. Like the other
+// settings, it has to be done on all nodes of the identity.
+func (s *Service) SetVoteVerifiers(verifiers ...VoteVerifier) error {
+	if len(verifiers) == 0 {
+		return errors.New("need at least one verifier")
+	}
+	s.verifierMutex.Lock()
+	defer s.verifierMutex.Unlock()
+	s.verifiers = append([]VoteVerifier{}, verifiers...)
+	return nil
+}
+
+// verifyVote returns nil if all verifiers accept the vote. With a maximum
+// vote age, the vote must have a time and is checked like the other
+// messages of the devices.
+func (s *Service) verifyVote(proposed *Data, device *Device, credential []byte) error {
+	if maxAge := s.maxVoteAge(); maxAge > 0 {
+		return s.verifyTimedVote(proposed, device, credential, maxAge, s.now())
+	}
+	s.verifierMutex.Lock()
+	verifiers := s.verifiers
+	s.verifierMutex.Unlock()
+	for _, v := range verifiers {
+		if err := v.VerifyVote(proposed, device, credential); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyDevice returns nil if all verifiers implementing MessageVerifier
+// accept the credential of the device on msg. At least one of them has to
+// check it.
+func (s *Service) verifyDevice(device *Device, msg, credential []byte) error {
+	s.verifierMutex.Lock()
+	verifiers := s.verifiers
+	s.verifierMutex.Unlock()
+	checked := false
+	for _, v := range verifiers {
+		mv, ok := v.(MessageVerifier)
+		if !ok {
+			continue
+		}
+		if err := mv.VerifyMessage(device, msg, credential); err != nil {
+			return err
+		}
+		checked = true
+	}
+	if !checked {
+		return errors.New("no verifier for messages of the devices")
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package identity
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+)
+
+// voteClockSkew is how far in the future the time of a vote may be, to
+// allow for clocks of the devices that are ahead of the node.
+const voteClockSkew = time.Minute
+
+// voteTag prefixes the message signed for a vote with a time, so that the
+// signature can't be used for another message of the device.
+const voteTag = "identity-vote"
+
+// VoteMessage returns the message a device signs to vote at time t, in
+// unix-nanoseconds, on the proposal with the given hash.
+func VoteMessage(hash []byte, t int64) []byte {
+	var ts [8]byte
+	binary.LittleEndian.PutUint64(ts[:], uint64(t))
+	msg := append([]byte(voteTag), hash...)
+	return append(msg, ts[:]...)
+}
+
+// TimedCredential returns the credential of a vote at time t: the time
+// followed by the signature of the device on VoteMessage.
+func TimedCredential(t int64, sig []byte) []byte {
+	var ts [8]byte
+	binary.LittleEndian.PutUint64(ts[:], uint64(t))
+	return append(ts[:], sig...)
+}
+
+// splitTimedCredential returns the time and the signature of a credential
+// created by TimedCredential.
+func splitTimedCredential(credential []byte) (int64, []byte, error) {
+	if len(credential) <= 8 {
+		return 0, nil, errors.New("credential has no time")
+	}
+	return int64(binary.LittleEndian.Uint64(credential[:8])), credential[8:], nil
+}
+
+// PrepareTimedVote returns the vote of the device signer at time now on the
+// proposal with the given hash, for nodes that have a maximum vote age.
+func PrepareTimedVote(id ID, signer string, hash []byte, device kyber.Scalar,
+	now time.Time) (*ProposeVote, error) {
+	if device == nil {
+		return nil, errors.New("no private key is provided")
+	}
+	t := now.UnixNano()
+	sig, err := schnorr.Sign(cothority.Suite, device, VoteMessage(hash, t))
+	if err != nil {
+		return nil, err
+	}
+	return &ProposeVote{ID: id, Signer: signer, Signature: TimedCredential(t, sig)}, nil
+}
+
+// SetMaxVoteAge makes the node only accept votes with a time, see
+// PrepareTimedVote, that is at most maxAge old. Votes getting too old
+// before the proposal is committed are dropped, so the devices have to
+// vote again. A maxAge of 0 accepts votes without a time again. Like the
+// other settings, it has to be done on all nodes of the identity, and the
+// devices have to know whether to send votes with a time.
+func (s *Service) SetMaxVoteAge(maxAge time.Duration) error {
+	if maxAge < 0 {
+		return errors.New("negative vote age")
+	}
+	s.verifierMutex.Lock()
+	defer s.verifierMutex.Unlock()
+	s.voteMaxAge = maxAge
+	return nil
+}
+
+// maxVoteAge returns the maximum age of votes, 0 if votes don't need a
+// time.
+func (s *Service) maxVoteAge() time.Duration {
+	s.verifierMutex.Lock()
+	defer s.verifierMutex.Unlock()
+	return s.voteMaxAge
+}
+
+// verifyTimedVote returns nil if the credential has a time that is not
+// older than maxAge at now and a valid signature of the device on the
+// VoteMessage of proposed.
+func (s *Service) verifyTimedVote(proposed *Data, device *Device, credential []byte,
+	maxAge time.Duration, now time.Time) error {
+	t, sig, err := splitTimedCredential(credential)
+	if err != nil {
+		return err
+	}
+	age := now.Sub(time.Unix(0, t))
+	if age > maxAge {
+		return errors.New("vote is too old")
+	}
+	if age < -voteClockSkew {
+		return errors.New("vote is from the future")
+	}
+	hash, err := proposed.Hash(s.Suite().(kyber.HashFactory))
+	if err != nil {
+		return err
+	}
+	return s.verifyDevice(device, VoteMessage(hash, t), sig)
+}
+
+// validTimedVotes is validVotes for nodes with a maximum vote age, where
+// every vote is checked on its own.
+func (s *Service) validTimedVotes(proposed *Data, devices map[string]*Device,
+	votes map[string][]byte, maxAge time.Duration, now time.Time) (valid, invalid []string) {
+	for name, credential := range votes {
+		dev := devices[name]
+		if dev != nil && s.verifyTimedVote(proposed, dev, credential, maxAge, now) == nil {
+			valid = append(valid, name)
+		} else {
+			invalid = append(invalid, name)
+		}
+	}
+	sort.Strings(valid)
+	sort.Strings(invalid)
+	return
+}
@@ -73,12 +73,49 @@ type propagationContext interface {
 	CreateProtocol(name string, t *onet.Tree) (onet.ProtocolInstance, error)
 }
 
+// Topology returns the tree used to propagate a message to the nodes of
+// rooted, whose first node is the one starting the propagation.
+type Topology func(rooted *onet.Roster) *onet.Tree
+
+// TreeTopology sends the message along a tree where every node has at most
+// branches children. The deeper the tree, the longer the propagation takes,
+// but the less messages a node has to send.
+func TreeTopology(branches int) Topology {
+	return func(rooted *onet.Roster) *onet.Tree {
+		return rooted.GenerateNaryTree(branches)
+	}
+}
+
+// FlatTopology sends the message from the root to all other nodes directly.
+// It is the fastest topology for small rosters, but the root has to send a
+// message to every node.
+func FlatTopology(rooted *onet.Roster) *onet.Tree {
+	branches := len(rooted.List) - 1
+	if branches < 1 {
+		branches = 1
+	}
+	return rooted.GenerateNaryTree(branches)
+}
+
+// DefaultTopology is used if no topology is given to NewPropagationFunc.
+var DefaultTopology = TreeTopology(8)
+
 // NewPropagationFunc registers a new protocol name with the context c and will
 // set f as handler for every new instance of that protocol.
 // The protocol will fail if more than thresh nodes per subtree fail to respond.
 // If thresh == -1, the threshold defaults to len(n.Roster().List-1)/3. Thus, for a roster of
 // 5, t = int(4/3) = 1, e.g. 1 node out of the 5 can fail.
-func NewPropagationFunc(c propagationContext, name string, f PropagationStore, thresh int) (PropagationFunc, error) {
+// The message is sent along the tree returned by topology, or by
+// DefaultTopology if none is given.
+func NewPropagationFunc(c propagationContext, name string, f PropagationStore, thresh int,
+	topology ...Topology) (PropagationFunc, error) {
+	if len(topology) > 1 {
+		return nil, errors.New("only one topology can be given")
+	}
+	generate := DefaultTopology
+	if len(topology) == 1 && topology[0] != nil {
+		generate = topology[0]
+	}
 	pid, err := c.ProtocolRegister(name, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 		// Make a local copy in order to avoid a data race.
 		t := thresh
@@ -107,7 +144,7 @@ func NewPropagationFunc(c propagationContext, name string, f PropagationStore, t
 		if rooted == nil {
 			return 0, errors.New("we're not in the roster")
 		}
-		tree := rooted.GenerateNaryTree(8)
+		tree := generate(rooted)
 		if tree == nil {
 			return 0, errors.New("Didn't find root in tree")
 		}
@@ -76,6 +76,44 @@ func propagate(t *testing.T, nbrNodes []int, nbrFailures []int) {
 	}
 }
 
+func BenchmarkPropagationTree8(b *testing.B)   { benchmarkPropagation(b, 8, DefaultTopology) }
+func BenchmarkPropagationTree32(b *testing.B)  { benchmarkPropagation(b, 32, DefaultTopology) }
+func BenchmarkPropagationTree128(b *testing.B) { benchmarkPropagation(b, 128, DefaultTopology) }
+func BenchmarkPropagationFlat8(b *testing.B)   { benchmarkPropagation(b, 8, FlatTopology) }
+func BenchmarkPropagationFlat32(b *testing.B)  { benchmarkPropagation(b, 32, FlatTopology) }
+func BenchmarkPropagationFlat128(b *testing.B) { benchmarkPropagation(b, 128, FlatTopology) }
+
+// benchmarkPropagation measures how long it takes to propagate a message to
+// n nodes using topology.
+func benchmarkPropagation(b *testing.B, n int, topology Topology) {
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, el, _ := local.GenTree(n, true)
+	msg := &propagateMsg{[]byte("propagate")}
+	var propFunc PropagationFunc
+	for i, server := range servers {
+		pc := &PC{server, local.Overlays[server.ServerIdentity.ID]}
+		pf, err := NewPropagationFunc(pc, "Propagate", func(network.Message) {}, 0,
+			topology)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if i == 0 {
+			propFunc = pf
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		replies, err := propFunc(el, msg, 10*time.Second)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if replies != n {
+			b.Fatalf("only %d out of %d nodes replied", replies, n)
+		}
+	}
+}
+
 type PC struct {
 	C *onet.Server
 	O *onet.Overlay
@@ -91,3 +129,15 @@ func (pc *PC) ServerIdentity() *network.ServerIdentity {
 func (pc *PC) CreateProtocol(name string, t *onet.Tree) (onet.ProtocolInstance, error) {
 	return pc.O.CreateProtocol(name, t, onet.NilServiceID)
 }
+
+func TestFlatTopology(t *testing.T) {
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	_, el, _ := local.GenTree(10, false)
+	if n := len(FlatTopology(el).Root.Children); n != 9 {
+		t.Fatal("flat topology has", n, "children instead of 9")
+	}
+	if n := len(TreeTopology(3)(el).Root.Children); n != 3 {
+		t.Fatal("tree topology has", n, "children instead of 3")
+	}
+}
@@ -0,0 +1,118 @@
+package protocol
+
+/*
+A batch reencrypts several ciphertexts to the same Xc in one run of the
+protocol, instead of running it once per ciphertext. The root sends the
+further points in Reencrypt.Batch, and every node replies with a proven
+share for U and for every point of the batch. A reply only counts if all
+its shares verify, so the threshold of valid replies gives enough shares
+for every ciphertext. The shares of the batch are in OCS.BatchUis, in the
+order of OCS.Batch.
+*/
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
+)
+
+// reencryptBatch returns the proven shares of this node for all points,
+// computed in parallel.
+func (o *OCS) reencryptBatch(points []kyber.Point, xc kyber.Point, b kyber.Scalar) ([]*BatchShare, error) {
+	shares := make([]*BatchShare, len(points))
+	errs := make([]error, len(points))
+	var wg sync.WaitGroup
+	for j, p := range points {
+		wg.Add(1)
+		go func(j int, p kyber.Point) {
+			defer wg.Done()
+			if p == nil {
+				errs[j] = errors.New("missing point in batch")
+				return
+			}
+			U, Xc := blinded(p, xc, b)
+			ui, err := o.getUI(U, Xc)
+			if err != nil {
+				errs[j] = err
+				return
+			}
+			ei, fi := ProveShareHash(o.proofHash(), o.privateShare(), ui, U, Xc,
+				o.Suite().RandomStream())
+			shares[j] = &BatchShare{Ui: ui, Ei: ei, Fi: fi}
+		}(j, p)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return shares, nil
+}
+
+// verifyShare returns true if ui is a correctly proven share of the node
+// for the point p.
+func (o *OCS) verifyShare(p kyber.Point, ui *share.PubShare, ei, fi kyber.Scalar) bool {
+	U, Xc := blinded(p, o.Xc, o.blinding)
+	return VerifyShareHash(o.proofHash(), ui, ei, fi, U, Xc, o.Poly.Eval(ui.I).V)
+}
+
+// verifyBatch returns true if the reply has a correctly proven share of the
+// same node for every point of the batch.
+func (o *OCS) verifyBatch(r *ReencryptReply) bool {
+	if len(r.Batch) != len(o.Batch) {
+		return false
+	}
+	for j, s := range r.Batch {
+		if s == nil || s.Ui == nil || s.Ui.I != r.Ui.I ||
+			!o.verifyShare(o.Batch[j], s.Ui, s.Ei, s.Fi) {
+			return false
+		}
+	}
+	return true
+}
+
+// failedShare returns the first share of the reply whose proof doesn't
+// verify, with the point it is for. It returns nils if there is no such
+// share, e.g. if a share of the batch is missing.
+func (o *OCS) failedShare(r *ReencryptReply) (kyber.Point, *BatchShare) {
+	if !o.verifyShare(o.U, r.Ui, r.Ei, r.Fi) {
+		return o.U, &BatchShare{Ui: r.Ui, Ei: r.Ei, Fi: r.Fi}
+	}
+	for j, s := range r.Batch {
+		if j < len(o.Batch) && s != nil && s.Ui != nil &&
+			!o.verifyShare(o.Batch[j], s.Ui, s.Ei, s.Fi) {
+			return o.Batch[j], s
+		}
+	}
+	return nil, nil
+}
+
+// finishBatch creates the reencrypted shares of the batch from the share of
+// the root and the replies. It must be called with rootMutex held.
+func (o *OCS) finishBatch() error {
+	o.BatchUis = make([][]*share.PubShare, len(o.Batch))
+	for j, p := range o.Batch {
+		o.BatchUis[j] = make([]*share.PubShare, len(o.List()))
+		var err error
+		o.BatchUis[j][0], err = o.getUI(blinded(p, o.Xc, o.blinding))
+		if err != nil {
+			return err
+		}
+		for _, r := range o.replies {
+			o.BatchUis[j][r.Ui.I] = r.Batch[j].Ui
+		}
+	}
+	return nil
+}
+
+// BatchShares returns the valid reencrypted shares of the j-th point of
+// the batch, sorted by their index. It can be given to Recover.
+func (o *OCS) BatchShares(j int) []*share.PubShare {
+	if j < 0 || j >= len(o.BatchUis) {
+		return nil
+	}
+	return SortedShares(o.BatchUis[j], len(o.List()))
+}
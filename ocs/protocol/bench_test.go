@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber/share"
+	dkg "github.com/dedis/kyber/share/dkg/rabin"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+	"github.com/stretchr/testify/require"
+)
+
+// ocsBench holds the nodes and the distributed key of one configuration,
+// so that every optimization of the protocol is measured on the same
+// setup. Create it with newOCSBench and run rounds with round.
+type ocsBench struct {
+	local     *onet.LocalTest
+	services  []onet.Service
+	tree      *onet.Tree
+	nodes     int
+	threshold int
+	dks       *dkg.DistKeyShare
+	// phases sums the time spent in every phase of the rounds.
+	phases map[string]time.Duration
+	rounds int
+}
+
+// Phases of a round, in the order they are reported.
+var ocsBenchPhases = []string{"start", "collect", "verify", "recover"}
+
+// newOCSBench starts the nodes and runs the DKG, which is not part of the
+// measured rounds.
+func newOCSBench(b *testing.B, nodes, threshold int) *ocsBench {
+	ob := &ocsBench{
+		local:     onet.NewLocalTest(tSuite),
+		nodes:     nodes,
+		threshold: threshold,
+		phases:    make(map[string]time.Duration),
+	}
+	servers, _, tree := ob.local.GenBigTree(nodes, nodes, nodes, true)
+	ob.tree = tree
+	start := time.Now()
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nodes, threshold)
+	require.Nil(b, err)
+	ob.services = ob.local.GetServices(servers, testServiceID)
+	for i := range ob.services {
+		ob.services[i].(*testService).Shared, err = NewSharedSecret(dkgs[i])
+		require.Nil(b, err)
+	}
+	ob.dks, err = dkgs[0].DistKeyShare()
+	require.Nil(b, err)
+	b.Logf("%d nodes, threshold %d: dkg took %s", nodes, threshold, time.Since(start))
+	return ob
+}
+
+// round reencrypts a new key and adds the time of every phase.
+func (ob *ocsBench) round(b *testing.B) {
+	U, _ := EncodeKey(tSuite, ob.dks.Public(), []byte("benchmark"))
+	xc := key.NewKeyPair(cothority.Suite)
+	pi, err := ob.services[0].(*testService).createOCS(ob.tree, ob.threshold)
+	require.Nil(b, err)
+	protocol := pi.(*OCS)
+	protocol.U = U
+	protocol.Xc = xc.Public
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), ob.dks.Commits)
+	protocol.VerificationData = []byte("correct block")
+
+	t := time.Now()
+	require.Nil(b, protocol.Start())
+	ob.phases["start"] += time.Since(t)
+
+	t = time.Now()
+	select {
+	case ok := <-protocol.Reencrypted:
+		require.True(b, ok)
+	case <-time.After(time.Minute):
+		b.Fatal("Didn't finish in time")
+	}
+	ob.phases["collect"] += time.Since(t)
+
+	// The replies are verified while collecting, this measures the same
+	// work on its own.
+	t = time.Now()
+	protocol.rootMutex.Lock()
+	for _, r := range protocol.replies {
+		require.True(b, protocol.verifyReply(&r.ReencryptReply))
+	}
+	protocol.rootMutex.Unlock()
+	ob.phases["verify"] += time.Since(t)
+
+	t = time.Now()
+	xhat, err := Recover(protocol.Shares(), ob.threshold, ob.nodes)
+	require.Nil(b, err)
+	require.NotNil(b, xhat)
+	ob.phases["recover"] += time.Since(t)
+	ob.rounds++
+}
+
+// report logs the average time of every phase per round.
+func (ob *ocsBench) report(b *testing.B) {
+	if ob.rounds == 0 {
+		return
+	}
+	for _, p := range ocsBenchPhases {
+		b.Logf("%-8s %s", p, ob.phases[p]/time.Duration(ob.rounds))
+	}
+}
+
+func (ob *ocsBench) close() {
+	ob.local.CloseAll()
+}
+
+// benchmarkOCS measures full rounds with nodes and the threshold given as
+// a ratio of the nodes.
+func benchmarkOCS(b *testing.B, nodes int, ratio float64) {
+	threshold := int(float64(nodes)*ratio + 0.5)
+	if threshold < 2 {
+		threshold = 2
+	}
+	ob := newOCSBench(b, nodes, threshold)
+	defer ob.close()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ob.round(b)
+	}
+	b.StopTimer()
+	ob.report(b)
+}
+
+func BenchmarkOCSSmallHalf(b *testing.B)       { benchmarkOCS(b, 5, 0.5) }
+func BenchmarkOCSSmallTwoThirds(b *testing.B)  { benchmarkOCS(b, 5, 2.0/3) }
+func BenchmarkOCSMediumHalf(b *testing.B)      { benchmarkOCS(b, 16, 0.5) }
+func BenchmarkOCSMediumTwoThirds(b *testing.B) { benchmarkOCS(b, 16, 2.0/3) }
+func BenchmarkOCSLargeHalf(b *testing.B)       { benchmarkOCS(b, 32, 0.5) }
+func BenchmarkOCSLargeTwoThirds(b *testing.B)  { benchmarkOCS(b, 32, 2.0/3) }
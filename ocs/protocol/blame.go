@@ -0,0 +1,180 @@
+package protocol
+
+/*
+A blame proof shows that a node replied with a reencrypted share whose proof
+doesn't verify. It holds the inputs of the verification and both sides of
+the failing proof equation, and is signed by the root that received the
+share. Whoever trusts the key of the root can check it again with Verify,
+without running the protocol. As the node doesn't sign its reply, the proof
+doesn't convince anybody who doesn't trust the root.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"hash"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// blameTag prefixes the message signed for a blame proof, so that the
+// signature can't be used for another message of the root.
+const blameTag = "ocs-blame"
+
+// BlameProof is created by the root for a node that sent an invalid share.
+type BlameProof struct {
+	// ServerIdentity is the node that sent the share.
+	ServerIdentity *network.ServerIdentity
+	// U and Xc are the points of the request, multiplied by the blinding
+	// factor if the shares are re-randomized.
+	U  kyber.Point
+	Xc kyber.Point
+	// Gxi is the public share of the node, evaluated from the public
+	// polynomial of the DKG. Those who know the polynomial can compare
+	// it to Poly.Eval(Ui.I).V.
+	Gxi kyber.Point
+	// Ui, Ei and Fi are the share and its proof like sent by the node.
+	Ui *share.PubShare
+	Ei kyber.Scalar
+	Fi kyber.Scalar
+	// UiHat and HiHat are the commitments recomputed from the proof and
+	// Challenge is their hash, which differs from Ei. They are nil if the
+	// share or its proof is incomplete.
+	UiHat     kyber.Point
+	HiHat     kyber.Point
+	Challenge kyber.Scalar
+	// Signature of the root on the Message of the proof.
+	Signature []byte
+}
+
+// blame returns the signed blame proof for the invalid share s of the
+// node si for the point p, which is U or a point of the batch. It must be
+// called with rootMutex held.
+func (o *OCS) blame(si *network.ServerIdentity, p kyber.Point, s *BatchShare) (*BlameProof, error) {
+	U, Xc := blinded(p, o.Xc, o.blinding)
+	b := &BlameProof{
+		ServerIdentity: si,
+		U:              U,
+		Xc:             Xc,
+		Gxi:            o.Poly.Eval(s.Ui.I).V,
+		Ui:             s.Ui,
+		Ei:             s.Ei,
+		Fi:             s.Fi,
+	}
+	b.UiHat, b.HiHat, b.Challenge = b.equation(o.proofHash())
+	msg, err := b.Message()
+	if err != nil {
+		return nil, err
+	}
+	b.Signature, err = schnorr.Sign(cothority.Suite, o.Private(), msg)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// equation returns the commitments and the challenge of the proof, hashed
+// with newHash, or nils if the share or its proof is incomplete.
+func (b *BlameProof) equation(newHash func() hash.Hash) (uiHat, hiHat kyber.Point,
+	challenge kyber.Scalar) {
+	if b.Ui == nil || b.Ei == nil || b.Fi == nil || b.U == nil || b.Xc == nil ||
+		b.Gxi == nil || CheckPoint(b.Ui.V) != nil {
+		return nil, nil, nil
+	}
+	return shareEquation(newHash, b.Ui, b.Ei, b.Fi, b.U, b.Xc, b.Gxi)
+}
+
+// Message returns the bytes the root signs for the blame proof. Missing
+// values are written as empty, so that they can't be confused with
+// present ones.
+func (b *BlameProof) Message() ([]byte, error) {
+	if b.ServerIdentity == nil || b.Ui == nil {
+		return nil, errors.New("missing node or share")
+	}
+	msg := []byte(blameTag)
+	msg = append(msg, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(msg[len(blameTag):], uint64(b.Ui.I))
+	for _, m := range []encoding.BinaryMarshaler{b.ServerIdentity.Public,
+		b.U, b.Xc, b.Gxi, b.Ui.V, b.Ei, b.Fi, b.UiHat, b.HiHat, b.Challenge} {
+		var buf []byte
+		if m != nil {
+			var err error
+			buf, err = m.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+		}
+		length := make([]byte, 4)
+		binary.LittleEndian.PutUint32(length, uint32(len(buf)))
+		msg = append(append(msg, length...), buf...)
+	}
+	return msg, nil
+}
+
+// Verify returns nil if the blame proof has been signed by root and shows
+// an invalid share, for shares proven with SHA-256.
+func (b *BlameProof) Verify(root kyber.Point) error {
+	return b.VerifyHash(root, sha256.New)
+}
+
+// VerifyHash is like Verify for a protocol whose ProofHash is newHash.
+func (b *BlameProof) VerifyHash(root kyber.Point, newHash func() hash.Hash) error {
+	msg, err := b.Message()
+	if err != nil {
+		return err
+	}
+	if err := schnorr.Verify(cothority.Suite, root, msg, b.Signature); err != nil {
+		return err
+	}
+	if VerifyShareHash(newHash, b.Ui, b.Ei, b.Fi, b.U, b.Xc, b.Gxi) {
+		return errors.New("the share is valid")
+	}
+	uiHat, hiHat, challenge := b.equation(newHash)
+	if !pointsEqual(uiHat, b.UiHat) || !pointsEqual(hiHat, b.HiHat) ||
+		!scalarsEqual(challenge, b.Challenge) {
+		return errors.New("wrong proof equation")
+	}
+	return nil
+}
+
+// pointsEqual is like kyber.Point.Equal, but accepts nil points.
+func pointsEqual(a, b kyber.Point) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(b)
+}
+
+// scalarsEqual is like kyber.Scalar.Equal, but accepts nil scalars.
+func scalarsEqual(a, b kyber.Scalar) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(b)
+}
+
+// addBlame adds a blame proof for the first invalid share of the reply if
+// they are asked for.
+// It must be called with rootMutex held.
+func (o *OCS) addBlame(rr *structReencryptReply) {
+	if !o.Blame {
+		return
+	}
+	p, s := o.failedShare(&rr.ReencryptReply)
+	if s == nil {
+		return
+	}
+	b, err := o.blame(rr.ServerIdentity, p, s)
+	if err != nil {
+		log.Error("couldn't create blame proof:", err)
+		return
+	}
+	o.BlameProofs = append(o.BlameProofs, b)
+}
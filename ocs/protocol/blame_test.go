@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/dedis/kyber/share"
+	dkg "github.com/dedis/kyber/share/dkg/rabin"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/kyber/util/random"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlameProof(t *testing.T) {
+	nbrNodes, threshold := 4, 3
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, threshold)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = NewSharedSecret(dkgs[i])
+		require.Nil(t, err)
+	}
+	// Node 2 sends shares computed with a wrong secret.
+	services[2].(*testService).Shared.V = suite.Scalar().Pick(suite.RandomStream())
+	dks, err := dkgs[0].DistKeyShare()
+	require.Nil(t, err)
+
+	pi, err := services[0].(*testService).createOCS(tree, threshold)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	protocol.Blame = true
+	require.Nil(t, protocol.SetupSelfTest())
+	require.Nil(t, protocol.Start())
+	select {
+	case <-protocol.Reencrypted:
+	case <-time.After(time.Second):
+		t.Fatal("Didn't finish in time")
+	}
+
+	require.Equal(t, 1, len(protocol.BlameProofs))
+	b := protocol.BlameProofs[0]
+	require.True(t, b.ServerIdentity.Equal(servers[2].ServerIdentity))
+	require.Equal(t, services[2].(*testService).Shared.Index, b.Ui.I)
+	require.True(t, b.Gxi.Equal(protocol.Poly.Eval(b.Ui.I).V))
+	require.False(t, b.Challenge.Equal(b.Ei))
+	root := servers[0].ServerIdentity.Public
+	require.Nil(t, b.Verify(root))
+
+	// The proof is only valid for the key of the root and can't be
+	// changed.
+	require.NotNil(t, b.Verify(servers[1].ServerIdentity.Public))
+	other := *b
+	other.ServerIdentity = servers[1].ServerIdentity
+	require.NotNil(t, other.Verify(root))
+	other = *b
+	other.Challenge = b.Ei
+	require.NotNil(t, other.Verify(root))
+}
+
+func TestBlameProofValidShare(t *testing.T) {
+	n, threshold := 5, 3
+	priPoly := share.NewPriPoly(suite, threshold, nil, random.New())
+	pubPoly := priPoly.Commit(nil)
+	U := suite.Point().Mul(suite.Scalar().Pick(suite.RandomStream()), nil)
+	Xc := suite.Point().Mul(suite.Scalar().Pick(suite.RandomStream()), nil)
+	xi := priPoly.Shares(n)[1]
+	ui, err := ReencryptShare(xi, U, Xc)
+	require.Nil(t, err)
+	ei, fi := ProveShare(xi, ui, U, Xc, random.New())
+
+	// A root blaming a node for a valid share gets caught.
+	rootKey := key.NewKeyPair(suite)
+	node := key.NewKeyPair(suite)
+	b := &BlameProof{
+		ServerIdentity: network.NewServerIdentity(node.Public,
+			network.NewAddress(network.PlainTCP, "0:2000")),
+		U:   U,
+		Xc:  Xc,
+		Gxi: pubPoly.Eval(xi.I).V,
+		Ui:  ui,
+		Ei:  ei,
+		Fi:  fi,
+	}
+	b.UiHat, b.HiHat, b.Challenge = b.equation(sha256.New)
+	msg, err := b.Message()
+	require.Nil(t, err)
+	b.Signature, err = schnorr.Sign(suite, rootKey.Private, msg)
+	require.Nil(t, err)
+	require.NotNil(t, b.Verify(rootKey.Public))
+}
@@ -0,0 +1,51 @@
+package protocol
+
+/*
+The reader of an onchain-secret can be a group itself, for example another
+cothority that ran its own DKG. In this case Xc is the aggregate public key
+xc*G of the reader-group, and no single member knows xc.
+
+The OCS-protocol does not need to know about this: every node returns
+Ui = xi * (U + Xc), and the proof only shows that the same xi is used for
+Ui and for the public share of the node. Its soundness does not depend on
+who knows the discrete logarithm of Xc. The only assumption is that Xc is a
+valid point of the group, which is true for the aggregate key of a DKG.
+
+After recovery the reader-group holds XhatEnc = x*U + x*Xc = x*U + xc*X.
+To remove the second term, each member j of the reader-group computes
+xc_j * X with its private share xc_j, and a threshold of these shares is
+interpolated to xc*X. The security of xc is the one of the reader-group's
+DKG: fewer than its threshold of members cannot recover xc*X.
+*/
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
+)
+
+// GroupDecryptShare returns the share of a member of the reader-group
+// holding xcShare, needed to remove the reencryption from XhatEnc. X is
+// the aggregate public key of the DKG that encrypted the secret.
+func GroupDecryptShare(X kyber.Point, xcShare *share.PriShare) *share.PubShare {
+	return &share.PubShare{
+		I: xcShare.I,
+		V: cothority.Suite.Point().Mul(xcShare.V, X),
+	}
+}
+
+// GroupDecrypt takes the XhatEnc recovered from the OCS-protocol and at least
+// threshold shares from GroupDecryptShare of a reader-group of size n, and
+// returns Xhat, the point that has been used to encrypt the key-slices.
+func GroupDecrypt(XhatEnc kyber.Point, shares []*share.PubShare, threshold, n int) (kyber.Point, error) {
+	if XhatEnc == nil {
+		return nil, errors.New("no XhatEnc given")
+	}
+	xcX, err := share.RecoverCommit(cothority.Suite, shares, threshold, n)
+	if err != nil {
+		return nil, err
+	}
+	return cothority.Suite.Point().Sub(XhatEnc, xcX), nil
+}
@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/kyber/share"
+	dkg "github.com/dedis/kyber/share/dkg/rabin"
+	"github.com/dedis/kyber/util/random"
+	"github.com/dedis/onet"
+	"github.com/stretchr/testify/require"
+)
+
+// Reencrypts a key with the OCS-protocol to a reader-group that holds Xc
+// as a DKG and lets a threshold of the reader-group decrypt it.
+func TestGroupDecrypt(t *testing.T) {
+	nbrWriters, thrWriters := 5, 3
+	nbrReaders, thrReaders := 4, 3
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrWriters, nbrWriters, nbrWriters, true)
+	writers, err := CreateDKGs(tSuite.(dkg.Suite), nbrWriters, thrWriters)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = NewSharedSecret(writers[i])
+		require.Nil(t, err)
+	}
+	readers, err := CreateDKGs(tSuite.(dkg.Suite), nbrReaders, thrReaders)
+	require.Nil(t, err)
+
+	dksW, err := writers[0].DistKeyShare()
+	require.Nil(t, err)
+	X := dksW.Public()
+	dksR, err := readers[0].DistKeyShare()
+	require.Nil(t, err)
+	Xc := dksR.Public()
+
+	k := make([]byte, 16)
+	random.Bytes(k, random.New())
+	U, Cs := EncodeKey(suite, X, k)
+
+	pi, err := services[0].(*testService).createOCS(tree, thrWriters)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.U = U
+	protocol.Xc = Xc
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dksW.Commits)
+	protocol.VerificationData = []byte("correct block")
+	require.Nil(t, protocol.Start())
+	select {
+	case ok := <-protocol.Reencrypted:
+		require.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("Didn't finish in time")
+	}
+	XhatEnc, err := share.RecoverCommit(suite, protocol.Shares(), thrWriters, nbrWriters)
+	require.Nil(t, err)
+
+	// Every member of the reader-group computes its partial.
+	var shares []*share.PubShare
+	for i := 0; i < thrReaders; i++ {
+		dks, err := readers[i].DistKeyShare()
+		require.Nil(t, err)
+		shares = append(shares, GroupDecryptShare(X, dks.Share))
+	}
+	// Not enough readers cannot decrypt.
+	_, err = GroupDecrypt(XhatEnc, shares[:thrReaders-1], thrReaders, nbrReaders)
+	require.NotNil(t, err)
+
+	Xhat, err := GroupDecrypt(XhatEnc, shares, thrReaders, nbrReaders)
+	require.Nil(t, err)
+	var keyHat []byte
+	for _, C := range Cs {
+		part, err := suite.Point().Sub(C, Xhat).Data()
+		require.Nil(t, err)
+		keyHat = append(keyHat, part...)
+	}
+	require.Equal(t, k, keyHat)
+}
@@ -8,12 +8,20 @@ paper-draft about onchain-secrets (called BlockMage).
 import (
 	"crypto/sha256"
 	"errors"
+	"fmt"
+	"hash"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dedis/cothority"
 	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/share"
+	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
 )
 
 func init() {
@@ -24,11 +32,16 @@ func init() {
 // DKG and U must be initialized by the caller.
 type OCS struct {
 	*onet.TreeNodeInstance
-	Shared    *SharedSecret  // Shared represents the private key
-	Poly      *share.PubPoly // Represents all public keys
-	U         kyber.Point    // U is the encrypted secret
-	Xc        kyber.Point    // The client's public key
-	Threshold int            // How many replies are needed to re-create the secret
+	Shared *SharedSecret  // Shared represents the private key
+	Poly   *share.PubPoly // Represents all public keys
+	U      kyber.Point    // U is the encrypted secret
+	Xc     kyber.Point    // The client's public key, can be a group key
+	// Threshold is how many shares, including the one of the root, are
+	// needed to re-create the secret. It defaults to the threshold of the
+	// DKG, len(Roster) - (len(Roster)-1)/3, and is set with SetThreshold.
+	// As the root waits for Threshold shares, up to len(Roster) -
+	// Threshold nodes may fail, in the broadcast of Start or later.
+	Threshold int
 	// VerificationData is given to the VerifyRequest and has to hold everything
 	// needed to verify the request is valid.
 	VerificationData []byte
@@ -37,28 +50,160 @@ type OCS struct {
 	// do the reencryption
 	Verify VerifyRequest
 	// Reencrypted receives a 'true'-value when the protocol finished successfully,
-	// or 'false' if not enough shares have been collected.
+	// or 'false' if not enough shares have been collected. Results
+	// receives the same outcome with the reason of a failure. Both are
+	// created with a buffer by NewOCS, and nothing is sent on a channel
+	// set to nil.
 	Reencrypted chan bool
+	Results     chan *Result
 	Uis         []*share.PubShare // re-encrypted shares
+	// Batch holds further points reencrypted to Xc in the same round,
+	// and BatchUis their re-encrypted shares once the protocol finished.
+	// BatchUis[j] holds the shares of Batch[j] like Uis those of U.
+	Batch    []kyber.Point
+	BatchUis [][]*share.PubShare
+	// Invalid holds the indexes of the nodes that sent an invalid share,
+	// and InvalidNodes their server identities in the same order. An
+	// invalid share counts as a failure.
+	Invalid      []int
+	InvalidNodes []*network.ServerIdentity
+	// OnInvalidShare, if set, is called for every node that replied with
+	// a share that doesn't verify. It is called from the protocol before
+	// Reencrypted is written to, so it doesn't need to be thread-safe.
+	OnInvalidShare func(index int, serverID *network.ServerIdentity)
+	// OnShare, if set, reports the progress of the protocol: it is called
+	// every time a valid share is added, with the number of shares
+	// received so far and the number needed to recover the secret, both
+	// counting the share of the root. Collected returns the same count
+	// without the root. It runs on the protocol goroutine while the root
+	// holds its lock, so it must return quickly and must not call the
+	// methods of OCS.
+	OnShare func(received, needed int)
+	// Blame asks the root to create a signed BlameProof for every invalid
+	// share, which can be verified without running the protocol again.
+	Blame bool
+	// BlameProofs holds the blame proofs for the invalid shares.
+	BlameProofs []*BlameProof
+	// Rerandomize blinds the shares with a new factor for every run, so
+	// that the shares of two runs for the same U and Xc can't be linked.
+	// The point recovered from the shares must be given to Unblind with
+	// Blinding.
+	Rerandomize bool
+	// AskDenials asks the nodes to send a signed ReencryptDenied if they
+	// refuse the request. If so many nodes deny the request that the
+	// threshold can't be reached anymore, the protocol stops and
+	// AccessDenied returns true.
+	AskDenials bool
+	// DenialThreshold, if not 0, stops the protocol as soon as that many
+	// nodes denied the request, even if the other nodes could still reach
+	// the threshold. This gives a fast failure if all nodes are expected
+	// to verify the request the same way. It implies AskDenials.
+	DenialThreshold int
+	// Denials holds the verified denials received so far.
+	Denials []*Denial
+	// AckTimeout, if not 0, asks all nodes to acknowledge the request
+	// before they compute their share. Nodes that didn't acknowledge
+	// within AckTimeout are counted as failures and their replies are
+	// ignored.
+	AckTimeout time.Duration
+	// ProofHash returns the hash for the challenge of the proofs of the
+	// shares. It defaults to SHA-256. As it is not sent with the request,
+	// the root and all nodes must be set up with the same hash.
+	ProofHash func() hash.Hash
+	// Timeout is how long the root waits for the replies after Start. If
+	// not enough valid shares arrived by then, Reencrypted receives
+	// false, so that nodes that crashed don't block the protocol. The
+	// default of 0 waits forever.
+	Timeout time.Duration
 	// private fields
-	replies []ReencryptReply
+	blinding    kyber.Scalar
+	replies     []structReencryptReply
+	collected   int32
+	selfTest    *selfTest
+	nodes       map[network.ServerIdentityID]nodeState
+	unreachable []*network.ServerIdentity
+	ackTimer    *time.Timer
+	roundTimer  *time.Timer
+	finished    bool
+	denied      bool
+	refused     int
+	failure     FailureReason
+	// rootMutex protects the state of the root, as the ack-timeout runs
+	// in its own goroutine.
+	rootMutex sync.Mutex
 }
 
+// selfTest holds the seed and the discrete logarithms of U and Xc for a
+// self-test.
+type selfTest struct {
+	seed []byte
+	r    kyber.Scalar
+	xc   kyber.Scalar
+}
+
+// nodeState is what the root knows about a child, so that every child is
+// counted once, whatever the order of its messages.
+type nodeState int
+
+const (
+	// nodeWaiting is a node that neither acknowledged nor replied.
+	nodeWaiting nodeState = iota
+	// nodeAcked acknowledged the request but didn't reply yet.
+	nodeAcked
+	// nodeReplied sent a valid share.
+	nodeReplied
+	// nodeFailed refused the request, sent an invalid share or didn't
+	// acknowledge the request within AckTimeout.
+	nodeFailed
+)
+
 // NewOCS initialises the structure for use in one round
 func NewOCS(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 	o := &OCS{
 		TreeNodeInstance: n,
 		Reencrypted:      make(chan bool, 1),
+		Results:          make(chan *Result, 1),
 		Threshold:        len(n.Roster().List) - (len(n.Roster().List)-1)/3,
+		ProofHash:        sha256.New,
+		nodes:            make(map[network.ServerIdentityID]nodeState),
 	}
 
-	err := o.RegisterHandlers(o.reencrypt, o.reencryptReply)
+	err := o.RegisterHandlers(o.reencrypt, o.reencryptReply, o.reencryptAck,
+		o.reencryptDenied)
 	if err != nil {
 		return nil, err
 	}
 	return o, nil
 }
 
+// SetThreshold sets how many shares are needed to re-create the secret. It
+// must be called before Start, and returns an error if t is not between 1
+// and the number of nodes in the roster.
+func (o *OCS) SetThreshold(t int) error {
+	if n := len(o.Roster().List); t < 1 || t > n {
+		return fmt.Errorf("threshold %d is not between 1 and %d", t, n)
+	}
+	o.rootMutex.Lock()
+	defer o.rootMutex.Unlock()
+	o.Threshold = t
+	return nil
+}
+
+// proofHash returns ProofHash, or SHA-256 if it has been set to nil.
+func (o *OCS) proofHash() func() hash.Hash {
+	if o.ProofHash == nil {
+		return sha256.New
+	}
+	return o.ProofHash
+}
+
+// tolerated returns how many nodes may fail while the others can still
+// send enough shares to reach the threshold. It must be called with
+// rootMutex held.
+func (o *OCS) tolerated() int {
+	return len(o.List()) - o.Threshold
+}
+
 // Start asks all children to reply with a shared reencryption
 func (o *OCS) Start() error {
 	log.Lvl3("Starting Protocol")
@@ -68,23 +213,64 @@ func (o *OCS) Start() error {
 	if o.U == nil {
 		return errors.New("please initialize U first")
 	}
+	if o.Xc == nil {
+		return errors.New("please initialize Xc first")
+	}
+	if err := CheckPoint(o.U); err != nil {
+		return errors.New("U: " + err.Error())
+	}
+	if err := CheckPoint(o.Xc); err != nil {
+		return errors.New("Xc: " + err.Error())
+	}
+	for j, p := range o.Batch {
+		if err := CheckPoint(p); err != nil {
+			return fmt.Errorf("batch %d: %s", j, err)
+		}
+	}
 	rc := &Reencrypt{
-		U:  o.U,
-		Xc: o.Xc,
+		U:     o.U,
+		Xc:    o.Xc,
+		Batch: o.Batch,
 	}
 	if len(o.VerificationData) > 0 {
 		rc.VerificationData = &o.VerificationData
 	}
-	if o.Verify != nil {
+	if o.Rerandomize {
+		o.blinding = newBlinding()
+		buf, err := o.blinding.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		rc.Blinding = buf
+	}
+	if o.selfTest != nil {
+		rc.SelfTest = &o.selfTest.seed
+	} else if o.Verify != nil {
 		if !o.Verify(rc) {
-			o.Reencrypted <- false
-			o.Done()
+			o.rootMutex.Lock()
+			o.fail(FailureRootRefused)
+			o.rootMutex.Unlock()
 			return errors.New("refused to reencrypt")
 		}
 	}
+	rc.Denials = o.AskDenials || o.DenialThreshold > 0
+	o.rootMutex.Lock()
+	if o.AckTimeout > 0 {
+		rc.Ack = true
+		o.ackTimer = time.AfterFunc(o.AckTimeout, o.ackTimeout)
+	}
+	if o.Timeout > 0 {
+		o.roundTimer = time.AfterFunc(o.Timeout, o.roundTimeout)
+	}
+	tolerated := o.tolerated()
+	o.rootMutex.Unlock()
 	errs := o.Broadcast(rc)
-	if len(errs) > (len(o.Roster().List)-1)/3 {
+	if len(errs) > tolerated {
 		log.Errorf("Some nodes failed with error(s) %v", errs)
+		o.rootMutex.Lock()
+		o.finished = true
+		o.stopTimers()
+		o.rootMutex.Unlock()
 		return errors.New("too many nodes failed in broadcast")
 	}
 	return nil
@@ -95,91 +281,430 @@ func (o *OCS) Start() error {
 func (o *OCS) reencrypt(r structReencrypt) error {
 	defer o.Done()
 	log.Lvl3(o.Name() + ": starting reencrypt")
-	ui, err := o.getUI(r.U, r.Xc)
+	if r.Ack {
+		if err := o.SendToParent(&ReencryptAck{}); err != nil {
+			log.Lvl2(o.ServerIdentity(), "couldn't send ack:", err)
+		}
+	}
+	blinding, err := decodeBlinding(r.Blinding)
 	if err != nil {
-		return nil
+		log.Lvl2(o.ServerIdentity(), "refused to reencrypt:", err)
+		return o.SendToParent(&ReencryptReply{})
+	}
+	U, Xc := blinded(r.U, r.Xc, blinding)
+	ui, err := o.getUI(U, Xc)
+	if err != nil {
+		log.Lvl2(o.ServerIdentity(), "refused to reencrypt:", err)
+		return o.SendToParent(&ReencryptReply{})
 	}
 
-	if o.Verify != nil {
+	if o.Verify != nil && !verifySelfTest(&r.Reencrypt) {
 		if !o.Verify(&r.Reencrypt) {
 			log.Lvl2(o.ServerIdentity(), "refused to reencrypt")
+			if r.Denials {
+				return o.sendDenial(&r.Reencrypt, "refused by the verification")
+			}
 			return o.SendToParent(&ReencryptReply{})
 		}
 	}
 
-	// Calculating proofs
-	si := cothority.Suite.Scalar().Pick(o.Suite().RandomStream())
-	uiHat := cothority.Suite.Point().Mul(si, cothority.Suite.Point().Add(r.U, r.Xc))
-	hiHat := cothority.Suite.Point().Mul(si, nil)
-	hash := sha256.New()
-	ui.V.MarshalTo(hash)
-	uiHat.MarshalTo(hash)
-	hiHat.MarshalTo(hash)
-	ei := cothority.Suite.Scalar().SetBytes(hash.Sum(nil))
-
+	batch, err := o.reencryptBatch(r.Batch, r.Xc, blinding)
+	if err != nil {
+		log.Lvl2(o.ServerIdentity(), "refused to reencrypt batch:", err)
+		return o.SendToParent(&ReencryptReply{})
+	}
+	ei, fi := ProveShareHash(o.proofHash(), o.privateShare(), ui, U, Xc,
+		o.Suite().RandomStream())
 	return o.SendToParent(&ReencryptReply{
-		Ui: ui,
-		Ei: ei,
-		Fi: cothority.Suite.Scalar().Add(si, cothority.Suite.Scalar().Mul(ei, o.Shared.V)),
+		Ui:    ui,
+		Ei:    ei,
+		Fi:    fi,
+		Batch: batch,
 	})
 }
 
 // ReencryptReply is the root-node waiting for all replies and generating
 // the reencryption key.
 func (o *OCS) reencryptReply(rr structReencryptReply) error {
+	o.rootMutex.Lock()
+	defer o.rootMutex.Unlock()
+	if o.finished {
+		return nil
+	}
 	if rr.ReencryptReply.Ui == nil {
+		// Nodes asked for denials only send an empty reply if they
+		// couldn't compute their share.
+		if !o.settle(rr.ServerIdentity, nodeFailed) {
+			return nil
+		}
 		log.Lvl2("Node", rr.ServerIdentity, "refused to reply")
-		o.Failures++
-		if o.Failures >= len(o.Children())-o.Threshold {
-			log.Lvl2(rr.ServerIdentity, "couldn't get enough shares")
-			o.Reencrypted <- false
-			o.Done()
+		o.refused++
+		return o.checkFailures()
+	}
+	if !o.verifyReply(&rr.ReencryptReply) {
+		if !o.settle(rr.ServerIdentity, nodeFailed) {
+			return nil
+		}
+		log.Lvl1("Received invalid share from node", rr.Ui.I, rr.ServerIdentity)
+		o.Invalid = append(o.Invalid, rr.Ui.I)
+		o.InvalidNodes = append(o.InvalidNodes, rr.ServerIdentity)
+		o.addBlame(&rr)
+		if o.OnInvalidShare != nil {
+			o.OnInvalidShare(rr.Ui.I, rr.ServerIdentity)
 		}
+		return o.checkFailures()
+	}
+	if !o.settle(rr.ServerIdentity, nodeReplied) {
 		return nil
 	}
-	o.replies = append(o.replies, rr.ReencryptReply)
+	o.replies = append(o.replies, rr)
+	atomic.AddInt32(&o.collected, 1)
+	if o.OnShare != nil {
+		o.OnShare(len(o.replies)+1, o.needed()+1)
+	}
+
+	if len(o.replies) >= o.needed() {
+		return o.finish()
+	}
+	return nil
+}
+
+// sendDenial sends a signed ReencryptDenied for the request to the root.
+func (o *OCS) sendDenial(r *Reencrypt, reason string) error {
+	sig, err := schnorr.Sign(cothority.Suite, o.Private(), DeniedMessage(r.U, r.Xc, reason))
+	if err != nil {
+		return err
+	}
+	return o.SendToParent(&ReencryptDenied{Reason: reason, Signature: sig})
+}
 
+// reencryptDenied counts a denial like a refusal and stops the protocol if
+// enough nodes denied the request, as returned by deniedEnough.
+func (o *OCS) reencryptDenied(rd structReencryptDenied) error {
+	o.rootMutex.Lock()
+	defer o.rootMutex.Unlock()
+	if o.finished || !o.settle(rd.ServerIdentity, nodeFailed) {
+		return nil
+	}
+	si := rd.ServerIdentity
+	err := schnorr.Verify(cothority.Suite, si.Public, DeniedMessage(o.U, o.Xc, rd.Reason),
+		rd.Signature)
+	if err != nil {
+		log.Lvl2("Invalid denial from", si, err)
+		return o.checkFailures()
+	}
+	log.Lvl2("Node", si, "denied the request:", rd.Reason)
+	o.Denials = append(o.Denials, &Denial{
+		ServerIdentity: si,
+		Reason:         rd.Reason,
+		Signature:      rd.Signature,
+	})
+	o.refused++
+	if o.deniedEnough() {
+		o.denied = true
+		o.fail(FailureRefused)
+		return nil
+	}
+	return o.checkFailures()
+}
+
+// deniedEnough returns true if DenialThreshold denials have been received,
+// or if the nodes that didn't deny the request can't reach the threshold
+// anymore. It must be called with rootMutex held.
+func (o *OCS) deniedEnough() bool {
+	if o.DenialThreshold > 0 && len(o.Denials) >= o.DenialThreshold {
+		return true
+	}
+	return len(o.List())-len(o.Denials) < o.Threshold
+}
+
+// settle sets the final state of the node si and counts the failures from
+// the states of all nodes. It returns false if si already replied or
+// failed, for example because it didn't acknowledge the request in time,
+// so that its late messages are ignored. It must be called with rootMutex
+// held.
+func (o *OCS) settle(si *network.ServerIdentity, st nodeState) bool {
+	if cur := o.nodes[si.ID]; cur == nodeReplied || cur == nodeFailed {
+		log.Lvl2("Ignoring late reply from", si)
+		return false
+	}
+	o.nodes[si.ID] = st
+	o.Failures = 0
+	for _, st := range o.nodes {
+		if st == nodeFailed {
+			o.Failures++
+		}
+	}
+	return true
+}
+
+// AccessDenied returns true if the protocol stopped because the nodes
+// denied the request.
+func (o *OCS) AccessDenied() bool {
+	o.rootMutex.Lock()
+	defer o.rootMutex.Unlock()
+	return o.denied
+}
+
+// needed returns how many replies the root waits for. It must be called
+// with rootMutex held.
+func (o *OCS) needed() int {
+	if o.selfTest != nil {
+		// A self-test waits for all nodes.
+		return len(o.Children()) - o.Failures
+	}
 	// minus one to exclude the root
-	if len(o.replies) >= int(o.Threshold-1) {
-		o.Uis = make([]*share.PubShare, len(o.List()))
-		var err error
-		o.Uis[0], err = o.getUI(o.U, o.Xc)
-		if err != nil {
-			return err
+	return o.Threshold - 1
+}
+
+// reencryptAck records that the node received the request.
+func (o *OCS) reencryptAck(ra structReencryptAck) error {
+	o.rootMutex.Lock()
+	defer o.rootMutex.Unlock()
+	if o.nodes[ra.ServerIdentity.ID] == nodeWaiting {
+		o.nodes[ra.ServerIdentity.ID] = nodeAcked
+	}
+	return nil
+}
+
+// ackTimeout counts all nodes that neither acknowledged the request nor
+// replied as failures.
+func (o *OCS) ackTimeout() {
+	o.rootMutex.Lock()
+	defer o.rootMutex.Unlock()
+	if o.finished {
+		return
+	}
+	for _, c := range o.Children() {
+		if o.nodes[c.ServerIdentity.ID] == nodeWaiting {
+			log.Lvl2("Node", c.ServerIdentity, "didn't acknowledge the request")
+			o.unreachable = append(o.unreachable, c.ServerIdentity)
+			o.settle(c.ServerIdentity, nodeFailed)
+		}
+	}
+	if len(o.unreachable) > 0 {
+		if err := o.checkFailures(); err != nil {
+			log.Error(err)
 		}
+	}
+}
 
-		for _, r := range o.replies {
-			// Verify proofs
-			ufi := cothority.Suite.Point().Mul(r.Fi, cothority.Suite.Point().Add(o.U, o.Xc))
-			uiei := cothority.Suite.Point().Mul(cothority.Suite.Scalar().Neg(r.Ei), r.Ui.V)
-			uiHat := cothority.Suite.Point().Add(ufi, uiei)
-
-			gfi := cothority.Suite.Point().Mul(r.Fi, nil)
-			gxi := o.Poly.Eval(r.Ui.I).V
-			hiei := cothority.Suite.Point().Mul(cothority.Suite.Scalar().Neg(r.Ei), gxi)
-			hiHat := cothority.Suite.Point().Add(gfi, hiei)
-			hash := sha256.New()
-			r.Ui.V.MarshalTo(hash)
-			uiHat.MarshalTo(hash)
-			hiHat.MarshalTo(hash)
-			e := cothority.Suite.Scalar().SetBytes(hash.Sum(nil))
-			if e.Equal(r.Ei) {
-				o.Uis[r.Ui.I] = r.Ui
-			} else {
-				log.Lvl1("Received invalid share from node", r.Ui.I)
-			}
+// checkFailures finishes the protocol if too many nodes failed, or if a
+// self-test got an answer from every node. It must be called with
+// rootMutex held.
+func (o *OCS) checkFailures() error {
+	if o.selfTest != nil {
+		if len(o.replies) >= o.needed() {
+			return o.finish()
+		}
+		return nil
+	}
+	// The protocol can still succeed as long as the nodes that didn't
+	// fail can send the needed replies, using the same count as
+	// reencryptReply.
+	if len(o.Children())-o.Failures < o.needed() {
+		log.Lvl2(o.ServerIdentity(), "couldn't get enough shares")
+		if o.refused == o.Failures {
+			o.fail(FailureRefused)
+		} else {
+			o.fail(FailureNotEnoughShares)
 		}
-		o.Reencrypted <- true
-		o.Done()
 	}
 	return nil
 }
 
+// roundTimeout ends the protocol if it still waits for replies after
+// Timeout. The shares received so far are used if they reach the
+// threshold, which only happens for a self-test waiting for all nodes.
+func (o *OCS) roundTimeout() {
+	o.rootMutex.Lock()
+	defer o.rootMutex.Unlock()
+	if o.finished {
+		return
+	}
+	if len(o.replies) >= o.Threshold-1 {
+		if err := o.finish(); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+	log.Lvl2(o.ServerIdentity(), "timeout with", len(o.replies), "out of",
+		o.Threshold-1, "needed shares")
+	o.fail(FailureTimeout)
+}
+
+// fail ends the protocol without the reencrypted shares, for the reason f.
+// It must be called with rootMutex held.
+func (o *OCS) fail(f FailureReason) {
+	o.finished = true
+	o.failure = f
+	o.stopTimers()
+	o.report(f)
+	o.Done()
+}
+
+// Failure returns why the protocol failed, or FailureNone if it didn't
+// fail or is still running.
+func (o *OCS) Failure() FailureReason {
+	o.rootMutex.Lock()
+	defer o.rootMutex.Unlock()
+	return o.failure
+}
+
+// Unreachable returns the nodes that didn't acknowledge the request within
+// AckTimeout.
+func (o *OCS) Unreachable() []*network.ServerIdentity {
+	o.rootMutex.Lock()
+	defer o.rootMutex.Unlock()
+	return append([]*network.ServerIdentity{}, o.unreachable...)
+}
+
+// stopTimers stops the ack- and the round-timeout, so that they don't fire
+// after the protocol finished. It must be called with rootMutex held.
+func (o *OCS) stopTimers() {
+	if o.ackTimer != nil {
+		o.ackTimer.Stop()
+	}
+	if o.roundTimer != nil {
+		o.roundTimer.Stop()
+	}
+}
+
+// Collected returns how many valid shares have been received from the
+// other nodes so far. It can be called while the protocol is running.
+func (o *OCS) Collected() int {
+	return int(atomic.LoadInt32(&o.collected))
+}
+
+// verifyReply returns true if the proofs of the reencrypted shares of U
+// and of the batch are correct.
+func (o *OCS) verifyReply(r *ReencryptReply) bool {
+	return o.verifyShare(o.U, r.Ui, r.Ei, r.Fi) && o.verifyBatch(r)
+}
+
+// finish creates the reencrypted shares from the replies, which only hold
+// valid shares. It must be called with rootMutex held.
+func (o *OCS) finish() error {
+	o.finished = true
+	o.stopTimers()
+	o.Uis = make([]*share.PubShare, len(o.List()))
+	var err error
+	o.Uis[0], err = o.getUI(blinded(o.U, o.Xc, o.blinding))
+	if err != nil {
+		return err
+	}
+
+	for _, r := range o.replies {
+		o.Uis[r.Ui.I] = r.Ui
+	}
+	if err := o.finishBatch(); err != nil {
+		return err
+	}
+	o.report(FailureNone)
+	o.Done()
+	return nil
+}
+
+// getUI returns the share of this node reencrypted to Xc.
 func (o *OCS) getUI(U, Xc kyber.Point) (*share.PubShare, error) {
-	v := cothority.Suite.Point().Mul(o.Shared.V, U)
-	v.Add(v, cothority.Suite.Point().Mul(o.Shared.V, Xc))
-	return &share.PubShare{
-		I: o.Shared.Index,
-		V: v,
-	}, nil
+	return ReencryptShare(o.privateShare(), U, Xc)
+}
+
+// privateShare returns the share of the secret of this node.
+func (o *OCS) privateShare() *share.PriShare {
+	return &share.PriShare{I: o.Shared.Index, V: o.Shared.V}
+}
+
+// deniedTag prefixes the message signed for a denial, so that the
+// signature can't be used for another message of the node.
+const deniedTag = "ocs-denied"
+
+// ErrorAccessDenied is returned if the nodes denied the reencryption.
+var ErrorAccessDenied = errors.New("access denied by the nodes")
+
+// Denial is a verified ReencryptDenied of a node. It can be shown to
+// others to prove that the node refused the request.
+type Denial struct {
+	ServerIdentity *network.ServerIdentity
+	Reason         string
+	Signature      []byte
+}
+
+// DeniedMessage returns the bytes a node signs to deny the reencryption of
+// U to Xc.
+func DeniedMessage(U, Xc kyber.Point, reason string) []byte {
+	msg := []byte(deniedTag)
+	for _, p := range []kyber.Point{U, Xc} {
+		buf, err := p.MarshalBinary()
+		if err != nil {
+			log.Error(err)
+		}
+		msg = append(msg, buf...)
+	}
+	return append(msg, []byte(reason)...)
+}
+
+// Verify returns nil if the denial has been signed by the node for the
+// reencryption of U to Xc.
+func (d *Denial) Verify(U, Xc kyber.Point) error {
+	return schnorr.Verify(cothority.Suite, d.ServerIdentity.Public,
+		DeniedMessage(U, Xc, d.Reason), d.Signature)
+}
+
+// cofactor is the cofactor of the Ed25519 curve. For a suite of prime order
+// CheckPoint works the same.
+const cofactor = 8
+
+// CheckPoint returns an error if p is missing or not in the prime-order
+// subgroup. With a cofactor, a point with a small-order component would let
+// the shares and the proofs be computed on different subgroups. A point of
+// the subgroup doesn't change when multiplied by the cofactor and its
+// inverse, while the small-order component is removed.
+func CheckPoint(p kyber.Point) error {
+	if p == nil {
+		return errors.New("missing point")
+	}
+	c := cothority.Suite.Scalar().SetInt64(cofactor)
+	cp := cothority.Suite.Point().Mul(c, p)
+	if cp.Equal(cothority.Suite.Point().Null()) {
+		return errors.New("point of small order")
+	}
+	if !cothority.Suite.Point().Mul(cothority.Suite.Scalar().Inv(c), cp).Equal(p) {
+		return errors.New("point not in the prime-order subgroup")
+	}
+	return nil
+}
+
+// SortedShares returns the valid shares of uis, sorted by their index.
+// Missing shares can be nil, and shares with an index outside of [0, n) or
+// a duplicate index are left out.
+func SortedShares(uis []*share.PubShare, n int) []*share.PubShare {
+	seen := make(map[int]bool)
+	var valid []*share.PubShare
+	for _, ui := range uis {
+		if ui == nil || ui.V == nil || ui.I < 0 || ui.I >= n || seen[ui.I] {
+			continue
+		}
+		seen[ui.I] = true
+		valid = append(valid, ui)
+	}
+	sort.Slice(valid, func(i, j int) bool { return valid[i].I < valid[j].I })
+	return valid
+}
+
+// Shares returns the valid reencrypted shares, sorted by their index. It
+// can be given to Recover.
+func (o *OCS) Shares() []*share.PubShare {
+	return SortedShares(o.Uis, len(o.List()))
+}
+
+// Recover combines the reencrypted shares to the reencrypted secret. The
+// shares are filtered like in SortedShares. It returns an error if less
+// than threshold shares are left.
+func Recover(uis []*share.PubShare, threshold, n int) (kyber.Point, error) {
+	valid := SortedShares(uis, n)
+	if len(valid) < threshold {
+		return nil, fmt.Errorf("only %d out of %d needed shares", len(valid), threshold)
+	}
+	return share.RecoverCommit(cothority.Suite, valid, threshold, n)
 }
@@ -15,7 +15,8 @@ import (
 const NameOCS = "OCS"
 
 func init() {
-	network.RegisterMessages(&Reencrypt{}, &ReencryptReply{})
+	network.RegisterMessages(&Reencrypt{}, &ReencryptReply{}, &ReencryptAck{},
+		&ReencryptDenied{})
 }
 
 // VerifyRequest is a callback-function that can be set by a service.
@@ -33,6 +34,21 @@ type Reencrypt struct {
 	// VerificationData is optional and can be any slice of bytes, so that each
 	// node can verify if the reencryption request is valid or not.
 	VerificationData *[]byte
+	// SelfTest is only set for a self-test and holds the seed U and Xc
+	// are derived from.
+	SelfTest *[]byte
+	// Ack asks the nodes to acknowledge the request before computing
+	// their share.
+	Ack bool
+	// Denials asks the nodes that refuse the request to reply with a
+	// signed ReencryptDenied instead of an empty reply.
+	Denials bool
+	// Blinding, if set, is the marshalled factor U and Xc are multiplied
+	// with before they are reencrypted, see Rerandomize.
+	Blinding []byte
+	// Batch holds further points reencrypted to Xc together with U. A
+	// VerifyRequest must check all of them.
+	Batch []kyber.Point
 }
 
 type structReencrypt struct {
@@ -45,9 +61,42 @@ type ReencryptReply struct {
 	Ui *share.PubShare
 	Ei kyber.Scalar
 	Fi kyber.Scalar
+	// Batch holds the shares for the points of Reencrypt.Batch, in the
+	// same order.
+	Batch []*BatchShare
+}
+
+// BatchShare is the share of a node for one point of a batch, with its
+// proof.
+type BatchShare struct {
+	Ui *share.PubShare
+	Ei kyber.Scalar
+	Fi kyber.Scalar
 }
 
 type structReencryptReply struct {
 	*onet.TreeNode
 	ReencryptReply
 }
+
+// ReencryptAck is sent by a node as soon as it received the request.
+type ReencryptAck struct{}
+
+type structReencryptAck struct {
+	*onet.TreeNode
+	ReencryptAck
+}
+
+// ReencryptDenied is sent by a node that refused the request, so that the
+// reader knows it is not authorized instead of the node being down.
+type ReencryptDenied struct {
+	// Reason of the refusal.
+	Reason string
+	// Signature of the node on DeniedMessage.
+	Signature []byte
+}
+
+type structReencryptDenied struct {
+	*onet.TreeNode
+	ReencryptDenied
+}
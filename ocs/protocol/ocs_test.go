@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"encoding/hex"
 	"errors"
 	"testing"
 	"time"
@@ -14,6 +15,7 @@ import (
 	"github.com/dedis/kyber/util/random"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
 	"github.com/stretchr/testify/require"
 )
 
@@ -49,6 +51,465 @@ func TestRefuse(t *testing.T) {
 	ocs(t, 3, 2, 32, 0, true)
 }
 
+// Tests that the root stops waiting for a node that didn't acknowledge the
+// request.
+func TestAckTimeout(t *testing.T) {
+	ackTimeout(t, 3, 3, 0, false)
+}
+
+// Tests that the root continues after the ack-timeout if exactly enough
+// nodes acknowledged the request.
+func TestAckTimeoutThreshold(t *testing.T) {
+	ackTimeout(t, 4, 3, 500*time.Millisecond, true)
+}
+
+// Tests that a node whose reply arrives before its ack is counted once,
+// and not as an ack-timeout failure.
+func TestAckAfterReply(t *testing.T) {
+	nbrNodes, threshold := 6, 4
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, threshold)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = NewSharedSecret(dkgs[i])
+		require.Nil(t, err)
+	}
+	dks, err := dkgs[0].DistKeyShare()
+	require.Nil(t, err)
+	U, _ := EncodeKey(tSuite, dks.Public(), []byte("ack"))
+	Xc := key.NewKeyPair(cothority.Suite).Public
+
+	pi, err := services[0].(*testService).createOCS(tree, threshold)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.U = U
+	protocol.Xc = Xc
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	children := protocol.Children()
+
+	// The first child sends a valid share, the second one refuses, both
+	// before their ack is processed.
+	xi := services[1].(*testService).Shared
+	priv := &share.PriShare{I: xi.Index, V: xi.V}
+	ui, err := ReencryptShare(priv, U, Xc)
+	require.Nil(t, err)
+	ei, fi := ProveShareHash(protocol.proofHash(), priv, ui, U, Xc,
+		suite.RandomStream())
+	require.Nil(t, protocol.reencryptReply(structReencryptReply{children[0],
+		ReencryptReply{Ui: ui, Ei: ei, Fi: fi}}))
+	require.Nil(t, protocol.reencryptReply(structReencryptReply{children[1],
+		ReencryptReply{}}))
+	require.Equal(t, 1, protocol.Collected())
+	require.Equal(t, 1, protocol.Failures)
+	for _, c := range children[:4] {
+		require.Nil(t, protocol.reencryptAck(structReencryptAck{c, ReencryptAck{}}))
+	}
+
+	// Only the last child, which didn't do anything, is unreachable.
+	protocol.ackTimeout()
+	require.Equal(t, 2, protocol.Failures)
+	unreachable := protocol.Unreachable()
+	require.Equal(t, 1, len(unreachable))
+	require.True(t, unreachable[0].Equal(children[4].ServerIdentity))
+
+	// A second reply of a node is ignored.
+	require.Nil(t, protocol.reencryptReply(structReencryptReply{children[0],
+		ReencryptReply{}}))
+	require.Equal(t, 2, protocol.Failures)
+	require.Equal(t, 1, protocol.Collected())
+}
+
+// ackTimeout pauses the last node and lets the other children wait for
+// delay before they reply, so that the ack-timeout happens first.
+func ackTimeout(t *testing.T, nbrNodes, threshold int, delay time.Duration, success bool) {
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, threshold)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = NewSharedSecret(dkgs[i])
+		require.Nil(t, err)
+		services[i].(*testService).delay = delay
+	}
+	dks, err := dkgs[0].DistKeyShare()
+	require.Nil(t, err)
+	U, _ := EncodeKey(tSuite, dks.Public(), []byte("ack"))
+	xc := key.NewKeyPair(cothority.Suite)
+
+	paused := servers[nbrNodes-1]
+	paused.Pause()
+	pi, err := services[0].(*testService).createOCS(tree, threshold)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.U = U
+	protocol.Xc = xc.Public
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	protocol.VerificationData = []byte("correct block")
+	protocol.AckTimeout = 200 * time.Millisecond
+	require.Nil(t, protocol.Start())
+	select {
+	case ok := <-protocol.Reencrypted:
+		require.Equal(t, success, ok)
+	case <-time.After(time.Second + delay):
+		t.Fatal("Didn't stop after the ack-timeout")
+	}
+	unreachable := protocol.Unreachable()
+	require.Equal(t, 1, len(unreachable))
+	require.True(t, unreachable[0].ID.Equal(paused.ServerIdentity.ID))
+}
+
+// Tests that nodes refusing the request send a signed denial and that the
+// root stops once the threshold can't be reached anymore.
+func TestDenied(t *testing.T) {
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	nbrNodes := 3
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, 2)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = NewSharedSecret(dkgs[i])
+		require.Nil(t, err)
+	}
+	dks, err := dkgs[0].DistKeyShare()
+	require.Nil(t, err)
+	U, _ := EncodeKey(tSuite, dks.Public(), []byte("denied"))
+	xc := key.NewKeyPair(cothority.Suite)
+
+	pi, err := services[0].(*testService).createOCS(tree, 2)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.U = U
+	protocol.Xc = xc.Public
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	// Without verification data the nodes refuse.
+	protocol.AskDenials = true
+	require.Nil(t, protocol.Start())
+	select {
+	case ok := <-protocol.Reencrypted:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("Didn't stop after the denials")
+	}
+	require.True(t, protocol.AccessDenied())
+	require.Equal(t, FailureRefused, protocol.Failure())
+	require.Equal(t, nbrNodes-1, len(protocol.Denials))
+	for _, d := range protocol.Denials {
+		require.Nil(t, d.Verify(U, xc.Public))
+		require.NotNil(t, d.Verify(U, cothority.Suite.Point().Base()))
+	}
+}
+
+// Tests that the root stops at the first denial if DenialThreshold is 1,
+// even though the threshold could still be reached.
+func TestDeniedThreshold(t *testing.T) {
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	nbrNodes := 5
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, 3)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = NewSharedSecret(dkgs[i])
+		require.Nil(t, err)
+	}
+	dks, err := dkgs[0].DistKeyShare()
+	require.Nil(t, err)
+	U, _ := EncodeKey(tSuite, dks.Public(), []byte("denied"))
+	xc := key.NewKeyPair(cothority.Suite)
+
+	pi, err := services[0].(*testService).createOCS(tree, 3)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.U = U
+	protocol.Xc = xc.Public
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	protocol.DenialThreshold = 1
+	require.Nil(t, protocol.Start())
+	select {
+	case ok := <-protocol.Reencrypted:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("Didn't stop after the first denial")
+	}
+	require.True(t, protocol.AccessDenied())
+	protocol.rootMutex.Lock()
+	require.Equal(t, 1, len(protocol.Denials))
+	protocol.rootMutex.Unlock()
+}
+
+// Tests that points with a small-order component are rejected.
+// Tests that several keys are reencrypted in one run.
+func TestBatch(t *testing.T) {
+	nbrNodes, threshold := 4, 3
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, threshold)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = NewSharedSecret(dkgs[i])
+		require.Nil(t, err)
+	}
+	dks, err := dkgs[0].DistKeyShare()
+	require.Nil(t, err)
+	X := dks.Public()
+	var keys [][]byte
+	var Us []kyber.Point
+	var Css [][]kyber.Point
+	for i := 0; i < 3; i++ {
+		k := []byte{byte(i), 1, 2, 3}
+		U, Cs := EncodeKey(tSuite, X, k)
+		keys = append(keys, k)
+		Us = append(Us, U)
+		Css = append(Css, Cs)
+	}
+	xc := key.NewKeyPair(cothority.Suite)
+
+	pi, err := services[0].(*testService).createOCS(tree, threshold)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.U = Us[0]
+	protocol.Batch = Us[1:]
+	protocol.Xc = xc.Public
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	protocol.VerificationData = []byte("correct block")
+	require.Nil(t, protocol.Start())
+	select {
+	case ok := <-protocol.Reencrypted:
+		require.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("Didn't finish in time")
+	}
+	require.Equal(t, 0, len(protocol.Invalid))
+	require.Equal(t, 2, len(protocol.BatchUis))
+	require.Nil(t, protocol.BatchShares(2))
+	shares := [][]*share.PubShare{protocol.Shares(), protocol.BatchShares(0),
+		protocol.BatchShares(1)}
+	for i, uis := range shares {
+		XhatEnc, err := Recover(uis, threshold, nbrNodes)
+		require.Nil(t, err)
+		keyHat, err := DecodeKey(suite, X, Css[i], XhatEnc, xc.Private)
+		require.Nil(t, err)
+		require.Equal(t, keys[i], keyHat)
+	}
+}
+
+// Tests that the shares of nodes using another challenge hash than the root
+// don't verify.
+func TestProofHashMismatch(t *testing.T) {
+	nbrNodes, threshold := 3, 2
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, threshold)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = NewSharedSecret(dkgs[i])
+		require.Nil(t, err)
+	}
+	dks, err := dkgs[0].DistKeyShare()
+	require.Nil(t, err)
+	U, _ := EncodeKey(tSuite, dks.Public(), []byte("key"))
+
+	pi, err := services[0].(*testService).createOCS(tree, threshold)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.U = U
+	protocol.Xc = key.NewKeyPair(cothority.Suite).Public
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	protocol.VerificationData = []byte("correct block")
+	protocol.ProofHash = otherHash
+	require.Nil(t, protocol.Start())
+	select {
+	case ok := <-protocol.Reencrypted:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("Didn't finish in time")
+	}
+	require.Equal(t, nbrNodes-1, len(protocol.Invalid))
+}
+
+// Tests that the root stops waiting after the round-timeout if a node
+// doesn't reply, and that the timeout doesn't fire after a success.
+func TestRoundTimeout(t *testing.T) {
+	roundTimeout(t, 4, 4, false)
+	roundTimeout(t, 4, 3, true)
+}
+
+// roundTimeout pauses the last node and runs the protocol with a short
+// round-timeout.
+func roundTimeout(t *testing.T, nbrNodes, threshold int, success bool) {
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, threshold)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = NewSharedSecret(dkgs[i])
+		require.Nil(t, err)
+	}
+	dks, err := dkgs[0].DistKeyShare()
+	require.Nil(t, err)
+	U, _ := EncodeKey(tSuite, dks.Public(), []byte("key"))
+	servers[nbrNodes-1].Pause()
+
+	pi, err := services[0].(*testService).createOCS(tree, threshold)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.U = U
+	protocol.Xc = key.NewKeyPair(cothority.Suite).Public
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	protocol.VerificationData = []byte("correct block")
+	protocol.Timeout = 200 * time.Millisecond
+	require.Nil(t, protocol.Start())
+	expected := FailureTimeout
+	if success {
+		expected = FailureNone
+	}
+	select {
+	case res := <-protocol.Results:
+		require.Equal(t, expected, res.Failure)
+	case <-time.After(time.Second):
+		t.Fatal("Didn't finish in time")
+	}
+	require.Equal(t, success, <-protocol.Reencrypted)
+	select {
+	case <-protocol.Results:
+		t.Fatal("Finished twice")
+	case <-time.After(2 * protocol.Timeout):
+	}
+}
+
+// Tests that a refusal of the verification at the root is reported.
+func TestRootRefused(t *testing.T) {
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(3, 3, 3, true)
+	services := local.GetServices(servers, testServiceID)
+	pi, err := services[0].(*testService).createOCS(tree, 2)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.Shared = &SharedSecret{}
+	protocol.U = suite.Point().Pick(suite.RandomStream())
+	protocol.Xc = suite.Point().Pick(suite.RandomStream())
+	protocol.Verify = func(rc *Reencrypt) bool { return false }
+	require.NotNil(t, protocol.Start())
+	res := <-protocol.Results
+	require.Equal(t, FailureRootRefused, res.Failure)
+	require.False(t, <-protocol.Reencrypted)
+	require.Equal(t, FailureRootRefused, protocol.Failure())
+}
+
+// Tests that an invalid share counts as a failure, so that the root stops
+// as soon as the threshold can't be reached anymore.
+func TestInvalidShare(t *testing.T) {
+	nbrNodes := 4
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, nbrNodes)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = NewSharedSecret(dkgs[i])
+		require.Nil(t, err)
+	}
+	shared := services[1].(*testService).Shared
+	shared.V = suite.Scalar().Pick(suite.RandomStream())
+	dks, err := dkgs[0].DistKeyShare()
+	require.Nil(t, err)
+	U, _ := EncodeKey(tSuite, dks.Public(), []byte("key"))
+
+	pi, err := services[0].(*testService).createOCS(tree, nbrNodes)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.U = U
+	protocol.Xc = key.NewKeyPair(cothority.Suite).Public
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	protocol.VerificationData = []byte("correct block")
+	require.Nil(t, protocol.Start())
+	select {
+	case ok := <-protocol.Reencrypted:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("Didn't finish in time")
+	}
+	require.Equal(t, []int{shared.Index}, protocol.Invalid)
+	require.Equal(t, 1, len(protocol.InvalidNodes))
+	require.True(t, protocol.InvalidNodes[0].Equal(servers[1].ServerIdentity))
+	require.Equal(t, 1, protocol.Failures)
+	require.Equal(t, FailureNotEnoughShares, protocol.Failure())
+}
+
+func TestSetThreshold(t *testing.T) {
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(4, 4, 4, true)
+	services := local.GetServices(servers, testServiceID)
+	pi, err := services[0].(*testService).createOCS(tree, 3)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	defer protocol.Done()
+	require.Equal(t, 3, protocol.Threshold)
+	require.Equal(t, 1, protocol.tolerated())
+	require.NotNil(t, protocol.SetThreshold(0))
+	require.NotNil(t, protocol.SetThreshold(5))
+	require.Equal(t, 3, protocol.Threshold)
+	require.Nil(t, protocol.SetThreshold(2))
+	require.Equal(t, 2, protocol.tolerated())
+}
+
+func TestCheckPoint(t *testing.T) {
+	// (0, -1) has order 2.
+	torsion := cothority.Suite.Point()
+	buf, err := hex.DecodeString("ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f")
+	require.Nil(t, err)
+	require.Nil(t, torsion.UnmarshalBinary(buf))
+	base := cothority.Suite.Point().Base()
+	mixed := cothority.Suite.Point().Add(base, torsion)
+
+	require.Nil(t, CheckPoint(base))
+	require.Nil(t, CheckPoint(cothority.Suite.Point().Pick(random.New())))
+	require.NotNil(t, CheckPoint(nil))
+	require.NotNil(t, CheckPoint(cothority.Suite.Point().Null()))
+	require.NotNil(t, CheckPoint(torsion))
+	require.NotNil(t, CheckPoint(mixed))
+
+	// Neither the root nor a node may compute a share of such a point.
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(3, 3, 3, true)
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), 3, 2)
+	require.Nil(t, err)
+	service := local.GetServices(servers, testServiceID)[0].(*testService)
+	service.Shared, err = NewSharedSecret(dkgs[0])
+	require.Nil(t, err)
+	pi, err := service.createOCS(tree, 2)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.U = mixed
+	protocol.Xc = base
+	require.NotNil(t, protocol.Start())
+	protocol.U, protocol.Xc = base, mixed
+	require.NotNil(t, protocol.Start())
+	_, err = protocol.getUI(mixed, base)
+	require.NotNil(t, err)
+	_, err = protocol.getUI(base, base)
+	require.Nil(t, err)
+	protocol.Done()
+}
+
 func TestOCSKeyLengths(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Testing all keylengths takes some time...")
@@ -107,6 +568,11 @@ func ocs(t *testing.T, nbrNodes, threshold, keylen, fail int, refuse bool) {
 	if !refuse {
 		protocol.VerificationData = []byte("correct block")
 	}
+	var received []int
+	protocol.OnShare = func(r, needed int) {
+		require.Equal(t, threshold, needed)
+		received = append(received, r)
+	}
 	// timeout := network.WaitRetry * time.Duration(network.MaxRetryConnect*nbrNodes*2) * time.Millisecond
 	require.Nil(t, protocol.Start())
 	select {
@@ -122,11 +588,17 @@ func ocs(t *testing.T, nbrNodes, threshold, keylen, fail int, refuse bool) {
 	var XhatEnc kyber.Point
 	if refuse {
 		require.Nil(t, protocol.Uis, "Reencrypted request that should've been refused")
+		require.Equal(t, FailureRefused, protocol.Failure())
 		return
 	}
 
 	require.NotNil(t, protocol.Uis)
-	XhatEnc, err = share.RecoverCommit(suite, protocol.Uis, threshold, nbrNodes)
+	require.Equal(t, threshold-1, protocol.Collected())
+	require.Equal(t, threshold-1, len(received))
+	for i, r := range received {
+		require.Equal(t, i+2, r)
+	}
+	XhatEnc, err = Recover(protocol.Shares(), threshold, nbrNodes)
 	require.Nil(t, err, "Reencryption failed")
 
 	// 6 - reader - gets the resulting symmetric key, encrypted under Xc
@@ -136,6 +608,179 @@ func ocs(t *testing.T, nbrNodes, threshold, keylen, fail int, refuse bool) {
 	require.Equal(t, k, keyHat)
 }
 
+func TestRecover(t *testing.T) {
+	n, threshold := 7, 4
+	secret := suite.Scalar().SetInt64(42)
+	expected := suite.Point().Mul(secret, nil)
+	poly := share.NewPriPoly(suite, threshold, secret, random.New())
+	shares := poly.Commit(nil).Shares(n)
+
+	for _, test := range []struct {
+		indexes []int
+		ok      bool
+	}{
+		{[]int{0, 1, 2, 3}, true},
+		{[]int{6, 4, 2, 0}, true},
+		{[]int{1, 3, 5, 6, 0}, true},
+		{[]int{0, 6, 6, 6}, false},
+		{[]int{2, 5, 6}, false},
+		{[]int{}, false},
+	} {
+		uis := make([]*share.PubShare, n)
+		for _, i := range test.indexes {
+			if uis[i] == nil {
+				uis[i] = shares[i]
+			} else {
+				// A duplicate index must not count twice.
+				uis = append(uis, shares[i])
+			}
+		}
+		X, err := Recover(uis, threshold, n)
+		if !test.ok {
+			require.NotNil(t, err, "indexes %v", test.indexes)
+			continue
+		}
+		require.Nil(t, err, "indexes %v", test.indexes)
+		require.True(t, expected.Equal(X), "indexes %v", test.indexes)
+	}
+
+	// Shares with an index out of range are ignored.
+	wrong := &share.PubShare{I: n, V: shares[0].V}
+	_, err := Recover([]*share.PubShare{shares[0], shares[1], shares[2], wrong},
+		threshold, n)
+	require.NotNil(t, err)
+}
+
+func TestSortedShares(t *testing.T) {
+	n := 5
+	poly := share.NewPriPoly(suite, 3, nil, random.New())
+	shares := poly.Commit(nil).Shares(n)
+	uis := []*share.PubShare{nil, shares[3], shares[0], nil, shares[3],
+		{I: n, V: shares[0].V}, shares[1]}
+	sorted := SortedShares(uis, n)
+	require.Equal(t, 3, len(sorted))
+	for i, idx := range []int{0, 1, 3} {
+		require.Equal(t, idx, sorted[i].I)
+	}
+	require.Equal(t, 0, len(SortedShares(nil, n)))
+}
+
+func TestSelfTest(t *testing.T) {
+	selfTestOCS(t, false)
+	selfTestOCS(t, true)
+}
+
+func selfTestOCS(t *testing.T, corrupt bool) {
+	nbrNodes, threshold := 4, 3
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, threshold)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = NewSharedSecret(dkgs[i])
+		require.Nil(t, err)
+	}
+	if corrupt {
+		shared := services[1].(*testService).Shared
+		shared.V = suite.Scalar().Pick(suite.RandomStream())
+	}
+	dks, err := dkgs[0].DistKeyShare()
+	require.Nil(t, err)
+
+	pi, err := services[0].(*testService).createOCS(tree, threshold)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	var reported []*network.ServerIdentity
+	protocol.OnInvalidShare = func(index int, si *network.ServerIdentity) {
+		reported = append(reported, si)
+	}
+	require.Nil(t, protocol.SetupSelfTest())
+	require.Nil(t, protocol.Start())
+	select {
+	case <-protocol.Reencrypted:
+	case <-time.After(time.Second):
+		t.Fatal("Didn't finish in time")
+	}
+	if corrupt {
+		require.NotNil(t, protocol.VerifySelfTest())
+		require.Equal(t, []int{services[1].(*testService).Shared.Index}, protocol.Invalid)
+		require.Equal(t, 1, len(reported))
+		require.True(t, reported[0].Equal(servers[1].ServerIdentity))
+		require.Equal(t, reported, protocol.InvalidNodes)
+	} else {
+		require.Nil(t, protocol.VerifySelfTest())
+		require.Equal(t, 0, len(reported))
+	}
+}
+
+func TestVerifySelfTest(t *testing.T) {
+	seed := make([]byte, selfTestSeedLen)
+	st := newSelfTest(seed)
+	rc := &Reencrypt{
+		U:        suite.Point().Mul(st.r, nil),
+		Xc:       suite.Point().Mul(st.xc, nil),
+		SelfTest: &seed,
+	}
+	require.True(t, verifySelfTest(rc))
+
+	// The U of a real write cannot be passed off as a self-test, neither
+	// directly nor by shifting Xc so that U + Xc is the real U.
+	realU := suite.Point().Pick(suite.RandomStream())
+	forged := *rc
+	forged.U = realU
+	require.False(t, verifySelfTest(&forged))
+	forged = *rc
+	forged.Xc = suite.Point().Sub(realU, rc.U)
+	require.False(t, verifySelfTest(&forged))
+	forged = *rc
+	forged.Batch = []kyber.Point{realU}
+	require.False(t, verifySelfTest(&forged))
+	short := seed[1:]
+	forged = *rc
+	forged.SelfTest = &short
+	require.False(t, verifySelfTest(&forged))
+}
+
+func TestSelfTestForged(t *testing.T) {
+	nbrNodes, threshold := 4, 3
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, threshold)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = NewSharedSecret(dkgs[i])
+		require.Nil(t, err)
+	}
+	dks, err := dkgs[0].DistKeyShare()
+	require.Nil(t, err)
+
+	pi, err := services[0].(*testService).createOCS(tree, threshold)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	require.Nil(t, protocol.SetupSelfTest())
+	// Replace U by the U of a real write: the nodes must treat it as a
+	// normal request, which the verification of the test-service refuses.
+	protocol.U, _ = EncodeKey(suite, dks.Public(), []byte("secret"))
+	require.Nil(t, protocol.Start())
+	select {
+	case <-protocol.Reencrypted:
+	case <-time.After(time.Second):
+		t.Fatal("Didn't finish in time")
+	}
+	for _, ui := range protocol.Uis[1:] {
+		require.Nil(t, ui)
+	}
+	require.NotNil(t, protocol.VerifySelfTest())
+}
+
 // testService allows setting the dkg-field of the protocol.
 type testService struct {
 	// We need to embed the ServiceProcessor, so that incoming messages
@@ -145,15 +790,19 @@ type testService struct {
 	// Has to be initialised by the test
 	Shared *SharedSecret
 	Poly   *share.PubPoly
+	// delay is how long the nodes wait before verifying a request
+	delay time.Duration
 }
 
 // Creates a service-protocol and returns the ProtocolInstance.
 func (s *testService) createOCS(t *onet.Tree, threshold int) (onet.ProtocolInstance, error) {
 	pi, err := s.CreateProtocol(NameOCS, t)
+	if err != nil {
+		return nil, err
+	}
 	pi.(*OCS).Shared = s.Shared
 	pi.(*OCS).Poly = s.Poly
-	pi.(*OCS).Threshold = threshold
-	return pi, err
+	return pi, pi.(*OCS).SetThreshold(threshold)
 }
 
 // Store the dkg in the protocol
@@ -167,6 +816,7 @@ func (s *testService) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericC
 		ocs := pi.(*OCS)
 		ocs.Shared = s.Shared
 		ocs.Verify = func(rc *Reencrypt) bool {
+			time.Sleep(s.delay)
 			return rc.VerificationData != nil
 		}
 		return ocs, nil
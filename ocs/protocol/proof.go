@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"hash"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
+)
+
+// The reencryption of a node is a pure computation on its share of the
+// secret, so it can be tested without running the protocol.
+
+// ReencryptShare returns the share xi of the secret reencrypted to Xc:
+// ui = xi * (U + Xc). U and Xc must be in the prime-order subgroup.
+func ReencryptShare(xi *share.PriShare, U, Xc kyber.Point) (*share.PubShare, error) {
+	if err := CheckPoint(U); err != nil {
+		return nil, errors.New("U: " + err.Error())
+	}
+	if err := CheckPoint(Xc); err != nil {
+		return nil, errors.New("Xc: " + err.Error())
+	}
+	v := cothority.Suite.Point().Mul(xi.V, U)
+	v.Add(v, cothority.Suite.Point().Mul(xi.V, Xc))
+	return &share.PubShare{
+		I: xi.I,
+		V: v,
+	}, nil
+}
+
+// ProveShare returns a non-interactive proof (ei, fi) that ui has been
+// computed with the same xi as the public share xi * G, using the
+// randomness of stream. The challenge ei is hashed with SHA-256.
+func ProveShare(xi *share.PriShare, ui *share.PubShare, U, Xc kyber.Point,
+	stream cipher.Stream) (ei, fi kyber.Scalar) {
+	return ProveShareHash(sha256.New, xi, ui, U, Xc, stream)
+}
+
+// ProveShareHash is like ProveShare, but hashes the challenge with the
+// hash returned by newHash. The proof only verifies with the same hash.
+func ProveShareHash(newHash func() hash.Hash, xi *share.PriShare, ui *share.PubShare,
+	U, Xc kyber.Point, stream cipher.Stream) (ei, fi kyber.Scalar) {
+	si := cothority.Suite.Scalar().Pick(stream)
+	uiHat := cothority.Suite.Point().Mul(si, cothority.Suite.Point().Add(U, Xc))
+	hiHat := cothority.Suite.Point().Mul(si, nil)
+	ei = proofChallenge(newHash, ui.V, uiHat, hiHat)
+	fi = cothority.Suite.Scalar().Add(si, cothority.Suite.Scalar().Mul(ei, xi.V))
+	return ei, fi
+}
+
+// VerifyShare returns true if (ei, fi) proves that ui is the reencryption
+// of U to Xc with the share whose public value is gxi, for a proof made by
+// ProveShare.
+func VerifyShare(ui *share.PubShare, ei, fi kyber.Scalar, U, Xc, gxi kyber.Point) bool {
+	return VerifyShareHash(sha256.New, ui, ei, fi, U, Xc, gxi)
+}
+
+// VerifyShareHash is like VerifyShare for a proof made by ProveShareHash
+// with newHash.
+func VerifyShareHash(newHash func() hash.Hash, ui *share.PubShare, ei, fi kyber.Scalar,
+	U, Xc, gxi kyber.Point) bool {
+	if ui == nil || ei == nil || fi == nil || gxi == nil || CheckPoint(ui.V) != nil {
+		return false
+	}
+	_, _, challenge := shareEquation(newHash, ui, ei, fi, U, Xc, gxi)
+	return challenge.Equal(ei)
+}
+
+// shareEquation recomputes the commitments of the proof (ei, fi) from ui
+// and gxi, and returns them with the challenge they hash to with newHash.
+// The proof is valid if the challenge equals ei. All arguments must be
+// set.
+func shareEquation(newHash func() hash.Hash, ui *share.PubShare, ei, fi kyber.Scalar,
+	U, Xc, gxi kyber.Point) (uiHat, hiHat kyber.Point, challenge kyber.Scalar) {
+	ufi := cothority.Suite.Point().Mul(fi, cothority.Suite.Point().Add(U, Xc))
+	uiei := cothority.Suite.Point().Mul(cothority.Suite.Scalar().Neg(ei), ui.V)
+	uiHat = cothority.Suite.Point().Add(ufi, uiei)
+
+	gfi := cothority.Suite.Point().Mul(fi, nil)
+	hiei := cothority.Suite.Point().Mul(cothority.Suite.Scalar().Neg(ei), gxi)
+	hiHat = cothority.Suite.Point().Add(gfi, hiei)
+	return uiHat, hiHat, proofChallenge(newHash, ui.V, uiHat, hiHat)
+}
+
+// proofChallenge hashes the points of the proof to the challenge.
+func proofChallenge(newHash func() hash.Hash, ui, uiHat, hiHat kyber.Point) kyber.Scalar {
+	hash := newHash()
+	ui.MarshalTo(hash)
+	uiHat.MarshalTo(hash)
+	hiHat.MarshalTo(hash)
+	return cothority.Suite.Scalar().SetBytes(hash.Sum(nil))
+}
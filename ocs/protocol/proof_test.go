@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"hash"
+	"testing"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber/share"
+	"github.com/dedis/kyber/util/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReencryptShare(t *testing.T) {
+	n, threshold := 5, 3
+	x := cothority.Suite.Scalar().SetInt64(42)
+	priPoly := share.NewPriPoly(cothority.Suite, threshold, x, random.New())
+	pubPoly := priPoly.Commit(nil)
+	U := cothority.Suite.Point().Mul(cothority.Suite.Scalar().SetInt64(3), nil)
+	Xc := cothority.Suite.Point().Mul(cothority.Suite.Scalar().SetInt64(5), nil)
+
+	var uis []*share.PubShare
+	for _, xi := range priPoly.Shares(n) {
+		ui, err := ReencryptShare(xi, U, Xc)
+		require.Nil(t, err)
+		require.Equal(t, xi.I, ui.I)
+		ei, fi := ProveShare(xi, ui, U, Xc, random.New())
+		gxi := pubPoly.Eval(xi.I).V
+		require.True(t, VerifyShare(ui, ei, fi, U, Xc, gxi))
+
+		// The proof is bound to the share, the points and the
+		// public share.
+		other := cothority.Suite.Point().Add(ui.V, cothority.Suite.Point().Base())
+		require.False(t, VerifyShare(&share.PubShare{I: ui.I, V: other}, ei, fi, U, Xc, gxi))
+		require.False(t, VerifyShare(ui, ei, fi, Xc, U, pubPoly.Eval(xi.I+1).V))
+		require.False(t, VerifyShare(ui, fi, ei, U, Xc, gxi))
+		require.False(t, VerifyShare(ui, nil, fi, U, Xc, gxi))
+		uis = append(uis, ui)
+	}
+
+	// x * (U + Xc) = 42 * 8 * G
+	expected := cothority.Suite.Point().Mul(cothority.Suite.Scalar().SetInt64(42*8), nil)
+	xhat, err := Recover(uis, threshold, n)
+	require.Nil(t, err)
+	require.True(t, expected.Equal(xhat))
+
+	_, err = ReencryptShare(priPoly.Shares(n)[0], nil, Xc)
+	require.NotNil(t, err)
+}
+
+// otherHash is a challenge hash that differs from SHA-256.
+func otherHash() hash.Hash {
+	h := sha256.New()
+	h.Write([]byte("other"))
+	return h
+}
+
+func TestProveShareHash(t *testing.T) {
+	priPoly := share.NewPriPoly(cothority.Suite, 2, nil, random.New())
+	xi := priPoly.Shares(3)[1]
+	gxi := priPoly.Commit(nil).Eval(xi.I).V
+	U := cothority.Suite.Point().Mul(cothority.Suite.Scalar().SetInt64(3), nil)
+	Xc := cothority.Suite.Point().Mul(cothority.Suite.Scalar().SetInt64(5), nil)
+	ui, err := ReencryptShare(xi, U, Xc)
+	require.Nil(t, err)
+
+	ei, fi := ProveShareHash(otherHash, xi, ui, U, Xc, random.New())
+	require.True(t, VerifyShareHash(otherHash, ui, ei, fi, U, Xc, gxi))
+	require.False(t, VerifyShare(ui, ei, fi, U, Xc, gxi))
+	ei, fi = ProveShare(xi, ui, U, Xc, random.New())
+	require.True(t, VerifyShareHash(sha256.New, ui, ei, fi, U, Xc, gxi))
+	require.False(t, VerifyShareHash(otherHash, ui, ei, fi, U, Xc, gxi))
+}
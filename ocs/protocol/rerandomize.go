@@ -0,0 +1,68 @@
+package protocol
+
+/*
+Without re-randomization, the share of a node for U and Xc is always
+ui = xi*(U + Xc), so anybody seeing the shares of two runs, like the ones
+returned in a ReencryptReply, can tell that they are for the same
+ciphertext and reader.
+
+With Rerandomize, the root picks a new blinding factor b for every run and
+sends it to the nodes, which reencrypt b*U to b*Xc instead, and prove their
+share for these points. Without knowing b, the shares of two runs can't be
+linked, as long as the decisional Diffie-Hellman assumption holds. The
+shares recovered from them give b*x*(U + Xc), from which Unblind removes b.
+The recovered XhatEnc is the same for every run, so it must not be shown to
+those who shouldn't link the runs. As the root could ask for xi*(U + Xc)
+itself, the blinding doesn't give it anything it couldn't already get.
+*/
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+)
+
+// newBlinding returns a new random blinding factor.
+func newBlinding() kyber.Scalar {
+	return cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
+}
+
+// decodeBlinding returns the blinding factor of the request, nil if the
+// shares are not re-randomized.
+func decodeBlinding(buf []byte) (kyber.Scalar, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	b := cothority.Suite.Scalar()
+	if err := b.UnmarshalBinary(buf); err != nil {
+		return nil, err
+	}
+	if b.Equal(cothority.Suite.Scalar().Zero()) {
+		return nil, errors.New("zero blinding factor")
+	}
+	return b, nil
+}
+
+// blinded returns b*U and b*Xc, or U and Xc if b is nil.
+func blinded(U, Xc kyber.Point, b kyber.Scalar) (kyber.Point, kyber.Point) {
+	if b == nil {
+		return U, Xc
+	}
+	return cothority.Suite.Point().Mul(b, U), cothority.Suite.Point().Mul(b, Xc)
+}
+
+// Unblind returns the point recovered from shares re-randomized with the
+// blinding factor b, as it would have been recovered without it.
+func Unblind(p kyber.Point, b kyber.Scalar) kyber.Point {
+	if b == nil {
+		return p
+	}
+	return cothority.Suite.Point().Mul(cothority.Suite.Scalar().Inv(b), p)
+}
+
+// Blinding returns the blinding factor of the run, nil if the shares are
+// not re-randomized. It is set by Start.
+func (o *OCS) Blinding() kyber.Scalar {
+	return o.blinding
+}
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
+	dkg "github.com/dedis/kyber/share/dkg/rabin"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRerandomize(t *testing.T) {
+	nbrNodes, threshold := 4, 3
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, threshold)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = NewSharedSecret(dkgs[i])
+		require.Nil(t, err)
+	}
+	dks, err := dkgs[0].DistKeyShare()
+	require.Nil(t, err)
+	X := dks.Public()
+	U, Cs := EncodeKey(suite, X, []byte("secret"))
+	xc := key.NewKeyPair(cothority.Suite)
+
+	run := func(rerandomize bool) (*OCS, kyber.Point) {
+		pi, err := services[0].(*testService).createOCS(tree, threshold)
+		require.Nil(t, err)
+		protocol := pi.(*OCS)
+		protocol.U = U
+		protocol.Xc = xc.Public
+		protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+		protocol.VerificationData = []byte("correct block")
+		protocol.Rerandomize = rerandomize
+		// Wait for all nodes, so that the shares of both runs can be
+		// compared.
+		require.Nil(t, protocol.SetThreshold(nbrNodes))
+		require.Nil(t, protocol.Start())
+		select {
+		case <-protocol.Reencrypted:
+		case <-time.After(time.Second):
+			t.Fatal("Didn't finish in time")
+		}
+		require.Equal(t, 0, len(protocol.Invalid))
+		XhatEnc, err := Recover(protocol.Shares(), threshold, nbrNodes)
+		require.Nil(t, err)
+		return protocol, Unblind(XhatEnc, protocol.Blinding())
+	}
+
+	// Without re-randomization, the shares of two runs are the same.
+	plain1, XhatEnc := run(false)
+	require.Nil(t, plain1.Blinding())
+	plain2, XhatEnc2 := run(false)
+	for i, ui := range plain1.Uis {
+		require.True(t, ui.V.Equal(plain2.Uis[i].V))
+	}
+	require.True(t, XhatEnc.Equal(XhatEnc2))
+
+	// With re-randomization, no share of one run is in the other, but
+	// both give the same point.
+	blind1, XhatEnc1 := run(true)
+	blind2, XhatEnc2 := run(true)
+	require.NotNil(t, blind1.Blinding())
+	require.False(t, blind1.Blinding().Equal(blind2.Blinding()))
+	for _, u1 := range blind1.Uis {
+		for _, u2 := range append(blind2.Uis, plain1.Uis...) {
+			require.False(t, u1.V.Equal(u2.V))
+		}
+	}
+	require.True(t, XhatEnc.Equal(XhatEnc1))
+	require.True(t, XhatEnc.Equal(XhatEnc2))
+	k, err := DecodeKey(suite, X, Cs, XhatEnc1, xc.Private)
+	require.Nil(t, err)
+	require.Equal(t, []byte("secret"), k)
+}
@@ -0,0 +1,59 @@
+package protocol
+
+// FailureReason tells why the protocol didn't collect enough shares.
+type FailureReason int
+
+// FailureReason consts
+const (
+	// FailureNone is the reason of a successful run.
+	FailureNone FailureReason = iota
+	// FailureNotEnoughShares is returned if too many nodes didn't send
+	// a valid share, because they failed, didn't acknowledge the request
+	// or sent an invalid share.
+	FailureNotEnoughShares
+	// FailureRefused is returned if all nodes that failed refused or
+	// denied the request.
+	FailureRefused
+	// FailureRootRefused is returned if the verification of the root
+	// refused the request, so that it hasn't been sent to the nodes.
+	FailureRootRefused
+	// FailureTimeout is returned if not enough shares arrived within
+	// OCS.Timeout.
+	FailureTimeout
+)
+
+func (f FailureReason) String() string {
+	switch f {
+	case FailureNone:
+		return "success"
+	case FailureNotEnoughShares:
+		return "not enough valid shares"
+	case FailureRefused:
+		return "the nodes refused to reencrypt"
+	case FailureRootRefused:
+		return "the verification at the root refused to reencrypt"
+	case FailureTimeout:
+		return "timeout while waiting for the shares"
+	}
+	return "unknown failure"
+}
+
+// Result is sent on OCS.Results once the protocol finished.
+type Result struct {
+	// Failure is FailureNone if the shares have been collected.
+	Failure FailureReason
+	// Collected is the number of valid shares received from the other
+	// nodes.
+	Collected int
+}
+
+// report sends the result of the protocol on Results and, for the callers
+// that only know about it, on Reencrypted.
+func (o *OCS) report(f FailureReason) {
+	if o.Reencrypted != nil {
+		o.Reencrypted <- f == FailureNone
+	}
+	if o.Results != nil {
+		o.Results <- &Result{Failure: f, Collected: o.Collected()}
+	}
+}
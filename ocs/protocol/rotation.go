@@ -0,0 +1,169 @@
+package protocol
+
+/*
+Rotation re-grants access to a set of write-requests to a new reader key,
+for example when the old key of the reader has been compromised. The
+AccessList can be used as the ReaderPolicy of NewPolicyVerifier, so that the
+old key is revoked in the same operation.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+)
+
+// Ciphertext points to one write-request whose key has to be reencrypted.
+type Ciphertext struct {
+	// WriteID is the ID of the write-request.
+	WriteID []byte
+	// U is the encrypted secret of the write-request.
+	U kyber.Point
+}
+
+// Supersession records that the old key of a reader has been replaced by a
+// new key for one write-request.
+type Supersession struct {
+	WriteID []byte
+	Old     kyber.Point
+	New     kyber.Point
+	// Time in unix-seconds of the rotation.
+	Time int64
+}
+
+// Reencrypter runs one reencryption of U to Xc, for example by starting the
+// OCS-protocol with the given VerificationData, and returns XhatEnc.
+type Reencrypter func(U, Xc kyber.Point, verificationData []byte) (kyber.Point, error)
+
+// AccessList holds the readers allowed to access each write-request.
+type AccessList struct {
+	sync.Mutex
+	readers    map[string][]kyber.Point
+	superseded []*Supersession
+}
+
+// NewAccessList returns an empty AccessList.
+func NewAccessList() *AccessList {
+	return &AccessList{readers: make(map[string][]kyber.Point)}
+}
+
+// Grant allows the reader to access writeID.
+func (al *AccessList) Grant(writeID []byte, reader kyber.Point) {
+	al.Lock()
+	defer al.Unlock()
+	if al.index(writeID, reader) < 0 {
+		al.readers[string(writeID)] = append(al.readers[string(writeID)], reader)
+	}
+}
+
+// Revoke removes the reader from the readers of writeID.
+func (al *AccessList) Revoke(writeID []byte, reader kyber.Point) {
+	al.Lock()
+	defer al.Unlock()
+	al.revoke(writeID, reader)
+}
+
+// Allowed is a ReaderPolicy returning nil if the reader has access to
+// writeID.
+func (al *AccessList) Allowed(writeID []byte, reader kyber.Point) error {
+	al.Lock()
+	defer al.Unlock()
+	if al.index(writeID, reader) < 0 {
+		return errors.New("reader has no access to this write-request")
+	}
+	return nil
+}
+
+// Superseded returns all rotations done on this AccessList.
+func (al *AccessList) Superseded() []*Supersession {
+	al.Lock()
+	defer al.Unlock()
+	return append([]*Supersession{}, al.superseded...)
+}
+
+// RotateReader reencrypts all ciphertexts to the new key of the reader,
+// given by its private key newPriv. For every ciphertext, the new key is
+// granted access and a VerificationRequest signed by the new key is given to
+// reencrypt. Only if all reencryptions succeed, the old key is revoked from
+// all ciphertexts and the supersessions are recorded if record is true. If a
+// reencryption fails, the new key is removed again and the old key keeps
+// its access.
+// It returns the XhatEnc of every ciphertext, in the same order.
+func (al *AccessList) RotateReader(cts []Ciphertext, old kyber.Point, newPriv kyber.Scalar,
+	reencrypt Reencrypter, record bool) ([]kyber.Point, error) {
+	newPub := cothority.Suite.Point().Mul(newPriv, nil)
+	for _, ct := range cts {
+		if err := al.Allowed(ct.WriteID, old); err != nil {
+			return nil, fmt.Errorf("write-request %x: %s", ct.WriteID, err)
+		}
+	}
+
+	var granted [][]byte
+	rollback := func() {
+		for _, id := range granted {
+			al.Revoke(id, newPub)
+		}
+	}
+	var xhatEncs []kyber.Point
+	for _, ct := range cts {
+		if al.Allowed(ct.WriteID, newPub) != nil {
+			al.Grant(ct.WriteID, newPub)
+			granted = append(granted, ct.WriteID)
+		}
+		vr, err := NewVerificationRequest(ct.WriteID, newPub, newPriv)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		buf, err := vr.Marshal()
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		xhatEnc, err := reencrypt(ct.U, newPub, buf)
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("couldn't reencrypt %x: %s", ct.WriteID, err)
+		}
+		xhatEncs = append(xhatEncs, xhatEnc)
+	}
+
+	al.Lock()
+	defer al.Unlock()
+	now := time.Now().Unix()
+	for _, ct := range cts {
+		al.revoke(ct.WriteID, old)
+		if record {
+			al.superseded = append(al.superseded, &Supersession{
+				WriteID: ct.WriteID,
+				Old:     old,
+				New:     newPub,
+				Time:    now,
+			})
+		}
+	}
+	return xhatEncs, nil
+}
+
+// index returns the position of reader in the readers of writeID, or -1.
+// It must be called with the lock held.
+func (al *AccessList) index(writeID []byte, reader kyber.Point) int {
+	for i, r := range al.readers[string(writeID)] {
+		if r.Equal(reader) {
+			return i
+		}
+	}
+	return -1
+}
+
+// revoke must be called with the lock held.
+func (al *AccessList) revoke(writeID []byte, reader kyber.Point) {
+	if i := al.index(writeID, reader); i >= 0 {
+		readers := al.readers[string(writeID)]
+		al.readers[string(writeID)] = append(readers[:i], readers[i+1:]...)
+	}
+}
@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
+	dkg "github.com/dedis/kyber/share/dkg/rabin"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateReader(t *testing.T) {
+	nbrNodes, threshold := 4, 3
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, threshold)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = NewSharedSecret(dkgs[i])
+		require.Nil(t, err)
+	}
+	dks, err := dkgs[0].DistKeyShare()
+	require.Nil(t, err)
+	X := dks.Public()
+
+	al := NewAccessList()
+	old := key.NewKeyPair(tSuite)
+	var cts []Ciphertext
+	var keys [][]byte
+	var Css [][]kyber.Point
+	for _, id := range []string{"one", "two"} {
+		k := []byte("key of " + id)
+		U, Cs := EncodeKey(tSuite, X, k)
+		cts = append(cts, Ciphertext{WriteID: []byte(id), U: U})
+		keys = append(keys, k)
+		Css = append(Css, Cs)
+		al.Grant([]byte(id), old.Public)
+	}
+
+	resolve := func(id []byte) (kyber.Point, error) {
+		for _, ct := range cts {
+			if string(ct.WriteID) == string(id) {
+				return ct.U, nil
+			}
+		}
+		return nil, errors.New("unknown write-request")
+	}
+	reencrypt := func(U, Xc kyber.Point, vd []byte) (kyber.Point, error) {
+		pi, err := services[0].(*testService).createOCS(tree, threshold)
+		if err != nil {
+			return nil, err
+		}
+		o := pi.(*OCS)
+		o.U = U
+		o.Xc = Xc
+		o.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+		o.VerificationData = vd
+		o.Verify = NewPolicyVerifier(resolve, al.Allowed)
+		if err := o.Start(); err != nil {
+			return nil, err
+		}
+		select {
+		case ok := <-o.Reencrypted:
+			if !ok {
+				return nil, errors.New("reencryption refused")
+			}
+		case <-time.After(time.Second):
+			return nil, errors.New("timeout")
+		}
+		return share.RecoverCommit(suite, o.Uis, threshold, nbrNodes)
+	}
+
+	// A failing reencryption leaves the access-list untouched.
+	failing := key.NewKeyPair(tSuite)
+	_, err = al.RotateReader(cts, old.Public, failing.Private,
+		func(U, Xc kyber.Point, vd []byte) (kyber.Point, error) {
+			return nil, errors.New("offline")
+		}, true)
+	require.NotNil(t, err)
+	require.Nil(t, al.Allowed(cts[0].WriteID, old.Public))
+	require.NotNil(t, al.Allowed(cts[0].WriteID, failing.Public))
+
+	newKey := key.NewKeyPair(tSuite)
+	xhatEncs, err := al.RotateReader(cts, old.Public, newKey.Private, reencrypt, true)
+	require.Nil(t, err)
+	for i, ct := range cts {
+		k, err := DecodeKey(suite, X, Css[i], xhatEncs[i], newKey.Private)
+		require.Nil(t, err)
+		require.Equal(t, keys[i], k)
+		require.NotNil(t, al.Allowed(ct.WriteID, old.Public))
+		require.Nil(t, al.Allowed(ct.WriteID, newKey.Public))
+	}
+	superseded := al.Superseded()
+	require.Equal(t, 2, len(superseded))
+	require.True(t, superseded[0].Old.Equal(old.Public))
+	require.True(t, superseded[0].New.Equal(newKey.Public))
+
+	// The old key can't be rotated anymore.
+	_, err = al.RotateReader(cts, old.Public, newKey.Private, reencrypt, false)
+	require.NotNil(t, err)
+}
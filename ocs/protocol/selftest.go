@@ -0,0 +1,106 @@
+package protocol
+
+/*
+A self-test runs the OCS-protocol on a synthetic U and Xc to make sure that
+every node holds a share consistent with the public polynomial of the DKG.
+
+The root chooses a random seed and derives U = r*G and Xc = xc*G, where r
+and xc are hashes of the seed under a domain tag. The nodes derive both
+points again from the seed and refuse the self-test if they don't match.
+As r and xc are public, the reencrypted point x*(U + Xc) = (r + xc)*X can
+be computed by anybody, so the nodes can skip the verification of the
+request. Because U + Xc is the output of a hash, nobody can choose it to
+be the U of a stored write, which would be possible if the caller could
+pick U or Xc freely.
+*/
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
+	"github.com/dedis/kyber/util/random"
+)
+
+// selfTestTag is prepended to the seed of a self-test before hashing, so
+// that the derived scalars cannot collide with any other use of the seed.
+const selfTestTag = "ocs-selftest"
+
+// selfTestSeedLen is the length of the random seed of a self-test.
+const selfTestSeedLen = 32
+
+// SetupSelfTest prepares the protocol to run a self-test: U and Xc are
+// derived from a random seed, and the protocol waits for the replies of
+// all nodes. Once Reencrypted returned, VerifySelfTest returns the result.
+func (o *OCS) SetupSelfTest() error {
+	if o.Poly == nil {
+		return errors.New("please initialize Poly first")
+	}
+	seed := make([]byte, selfTestSeedLen)
+	random.Bytes(seed, cothority.Suite.RandomStream())
+	st := newSelfTest(seed)
+	o.U = cothority.Suite.Point().Mul(st.r, nil)
+	o.Xc = cothority.Suite.Point().Mul(st.xc, nil)
+	o.selfTest = st
+	return nil
+}
+
+// newSelfTest derives the discrete logarithms of U and Xc from the seed.
+func newSelfTest(seed []byte) *selfTest {
+	derive := func(name string) kyber.Scalar {
+		msg := append([]byte(selfTestTag+"-"+name), seed...)
+		return cothority.Suite.Scalar().Pick(cothority.Suite.XOF(msg))
+	}
+	return &selfTest{seed: seed, r: derive("u"), xc: derive("xc")}
+}
+
+// VerifySelfTest returns nil if all nodes returned a valid share and the
+// recovered point is correct. Else it returns an error naming the indexes
+// of the faulty nodes.
+func (o *OCS) VerifySelfTest() error {
+	if o.selfTest == nil {
+		return errors.New("not a self-test")
+	}
+	if o.Uis == nil {
+		return errors.New("not enough shares collected")
+	}
+	var faulty []int
+	pub := cothority.Suite.Point().Mul(o.Shared.V, nil)
+	if !pub.Equal(o.Poly.Eval(o.Shared.Index).V) {
+		faulty = append(faulty, o.Shared.Index)
+	}
+	for i, ui := range o.Uis {
+		if ui == nil {
+			faulty = append(faulty, i)
+		}
+	}
+	if len(faulty) > 0 {
+		return fmt.Errorf("nodes with invalid or missing shares: %v", faulty)
+	}
+	XhatEnc, err := share.RecoverCommit(cothority.Suite, o.Uis, o.Threshold, len(o.List()))
+	if err != nil {
+		return err
+	}
+	XhatEnc = Unblind(XhatEnc, o.blinding)
+	rxc := cothority.Suite.Scalar().Add(o.selfTest.r, o.selfTest.xc)
+	if !XhatEnc.Equal(cothority.Suite.Point().Mul(rxc, o.Poly.Commit())) {
+		return errors.New("recovered a wrong point")
+	}
+	return nil
+}
+
+// verifySelfTest returns true if rc is a self-test whose U and Xc are
+// derived from its seed. Any other U or Xc goes through the normal
+// verification, as well as a self-test with a batch, whose points would
+// be reencrypted without being verified.
+func verifySelfTest(rc *Reencrypt) bool {
+	if rc.SelfTest == nil || len(*rc.SelfTest) != selfTestSeedLen ||
+		len(rc.Batch) > 0 {
+		return false
+	}
+	st := newSelfTest(*rc.SelfTest)
+	return rc.U.Equal(cothority.Suite.Point().Mul(st.r, nil)) &&
+		rc.Xc.Equal(cothority.Suite.Point().Mul(st.xc, nil))
+}
@@ -0,0 +1,162 @@
+package protocol
+
+/*
+Verification holds an optional structured format for the VerificationData
+that is sent with every Reencrypt message. Services are free to keep using
+their own format, but VerificationRequest together with NewPolicyVerifier
+gives a tested default that checks the reader signed the request and that
+U is the one stored in the write-request.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// verificationTag separates the signatures on a VerificationRequest from
+// other signatures of the same key.
+const verificationTag = "ocs-verification-request"
+
+func init() {
+	network.RegisterMessage(&VerificationRequest{})
+}
+
+// VerificationRequest is a structured VerificationData. It holds the ID of
+// the write-request the reader wants to access and a proof that the reader
+// asked for the reencryption to Xc.
+type VerificationRequest struct {
+	// WriteID points to the write-request holding U.
+	WriteID []byte
+	// Reader is the public key of the reader asking for reencryption.
+	Reader kyber.Point
+	// Proof is a schnorr-signature of the reader on verificationTag,
+	// WriteID and Xc.
+	Proof []byte
+}
+
+// ReaderPolicy returns nil if the reader is allowed to access the data
+// stored in writeID.
+type ReaderPolicy func(writeID []byte, reader kyber.Point) error
+
+// WriteResolver returns the U stored in the write-request writeID.
+type WriteResolver func(writeID []byte) (kyber.Point, error)
+
+// NewVerificationRequest creates a signed VerificationRequest for the reader
+// with the private key priv, asking to reencrypt writeID to xc.
+func NewVerificationRequest(writeID []byte, xc kyber.Point, priv kyber.Scalar) (*VerificationRequest, error) {
+	vr := &VerificationRequest{
+		WriteID: writeID,
+		Reader:  cothority.Suite.Point().Mul(priv, nil),
+	}
+	msg, err := vr.message(xc)
+	if err != nil {
+		return nil, err
+	}
+	vr.Proof, err = schnorr.Sign(cothority.Suite, priv, msg)
+	if err != nil {
+		return nil, err
+	}
+	return vr, nil
+}
+
+// Marshal returns the VerificationRequest as a slice of bytes that can be
+// stored in OCS.VerificationData.
+func (vr *VerificationRequest) Marshal() ([]byte, error) {
+	return network.Marshal(vr)
+}
+
+// Verify checks that the proof is a valid signature of the reader on
+// WriteID and xc.
+func (vr *VerificationRequest) Verify(xc kyber.Point) error {
+	if vr.Reader == nil {
+		return errors.New("no reader given")
+	}
+	msg, err := vr.message(xc)
+	if err != nil {
+		return err
+	}
+	return schnorr.Verify(cothority.Suite, vr.Reader, msg, vr.Proof)
+}
+
+// message returns the bytes signed by the reader.
+func (vr *VerificationRequest) message(xc kyber.Point) ([]byte, error) {
+	if xc == nil {
+		return nil, errors.New("no Xc given")
+	}
+	buf, err := xc.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	// WriteID is prefixed by its length, so that it can't be shifted into
+	// Xc.
+	var l [4]byte
+	binary.LittleEndian.PutUint32(l[:], uint32(len(vr.WriteID)))
+	msg := append([]byte(verificationTag), l[:]...)
+	msg = append(msg, vr.WriteID...)
+	return append(msg, buf...), nil
+}
+
+// ParseVerificationRequest returns the VerificationRequest stored in the
+// VerificationData of rc, or an error if it is missing or of another type.
+func ParseVerificationRequest(rc *Reencrypt) (*VerificationRequest, error) {
+	if rc.VerificationData == nil {
+		return nil, errors.New("no verification data")
+	}
+	_, msg, err := network.Unmarshal(*rc.VerificationData, cothority.Suite)
+	if err != nil {
+		return nil, err
+	}
+	vr, ok := msg.(*VerificationRequest)
+	if !ok {
+		return nil, errors.New("verification data is not a VerificationRequest")
+	}
+	return vr, nil
+}
+
+// NewPolicyVerifier returns a VerifyRequest that parses the VerificationData
+// as a VerificationRequest, verifies the proof of the reader, checks with
+// resolve that U is the one of the write-request and asks the policy whether
+// the reader is allowed to access it. Without resolve or policy, or for a
+// batch, all requests are refused, as nothing ties them to the
+// write-request.
+func NewPolicyVerifier(resolve WriteResolver, policy ReaderPolicy) VerifyRequest {
+	return func(rc *Reencrypt) bool {
+		if resolve == nil || policy == nil {
+			log.Lvl2("policy verifier without resolver or policy")
+			return false
+		}
+		if len(rc.Batch) > 0 {
+			log.Lvl2("policy verifier refuses batches")
+			return false
+		}
+		vr, err := ParseVerificationRequest(rc)
+		if err != nil {
+			log.Lvl2("invalid verification data:", err)
+			return false
+		}
+		if err = vr.Verify(rc.Xc); err != nil {
+			log.Lvl2("invalid reader proof:", err)
+			return false
+		}
+		u, err := resolve(vr.WriteID)
+		if err != nil {
+			log.Lvl2("couldn't resolve write-request:", err)
+			return false
+		}
+		if u == nil || rc.U == nil || !u.Equal(rc.U) {
+			log.Lvl2("U is not the one of the write-request")
+			return false
+		}
+		if err = policy(vr.WriteID, vr.Reader); err != nil {
+			log.Lvl2("policy refused reader:", err)
+			return false
+		}
+		return true
+	}
+}
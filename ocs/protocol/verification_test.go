@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/key"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerificationRequest(t *testing.T) {
+	reader := key.NewKeyPair(tSuite)
+	xc := key.NewKeyPair(tSuite)
+	writeID := []byte("write-id")
+
+	vr, err := NewVerificationRequest(writeID, xc.Public, reader.Private)
+	require.Nil(t, err)
+	require.Nil(t, vr.Verify(xc.Public))
+	require.NotNil(t, vr.Verify(reader.Public))
+
+	buf, err := vr.Marshal()
+	require.Nil(t, err)
+	rc := &Reencrypt{Xc: xc.Public, VerificationData: &buf}
+	vr2, err := ParseVerificationRequest(rc)
+	require.Nil(t, err)
+	require.Equal(t, writeID, vr2.WriteID)
+	require.True(t, reader.Public.Equal(vr2.Reader))
+
+	u := tSuite.Point().Pick(tSuite.RandomStream())
+	resolve := func(id []byte) (kyber.Point, error) {
+		if string(id) != string(writeID) {
+			return nil, errors.New("unknown write-request")
+		}
+		return u, nil
+	}
+	allowAll := func(id []byte, r kyber.Point) error {
+		return nil
+	}
+	allow := NewPolicyVerifier(resolve, allowAll)
+	deny := NewPolicyVerifier(resolve, func(id []byte, r kyber.Point) error {
+		return errors.New("not allowed")
+	})
+	rc.U = u
+	require.True(t, allow(rc))
+	require.False(t, deny(rc))
+
+	// Wrong Xc or missing data must be refused.
+	require.False(t, allow(&Reencrypt{U: u, Xc: reader.Public, VerificationData: &buf}))
+	require.False(t, allow(&Reencrypt{U: u, Xc: xc.Public}))
+	garbage := []byte("garbage")
+	require.False(t, allow(&Reencrypt{U: u, Xc: xc.Public, VerificationData: &garbage}))
+
+	// The access to writeID doesn't give access to another U.
+	other := tSuite.Point().Pick(tSuite.RandomStream())
+	require.False(t, allow(&Reencrypt{U: other, Xc: xc.Public, VerificationData: &buf}))
+	require.False(t, allow(&Reencrypt{U: u, Xc: xc.Public, VerificationData: &buf,
+		Batch: []kyber.Point{other}}))
+
+	// Without a resolver or a policy nothing is allowed.
+	require.False(t, NewPolicyVerifier(nil, allowAll)(rc))
+	require.False(t, NewPolicyVerifier(resolve, nil)(rc))
+}
@@ -10,6 +10,7 @@ This part of the service runs on the client or the app.
 
 import (
 	"errors"
+	"time"
 
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/ocs/darc"
@@ -247,6 +248,79 @@ func (c *Client) DecryptKeyRequestEphemeral(ocs *SkipChainURL, readID skipchain.
 	return
 }
 
+// Reencrypt asks for the symmetric keys of all writes with a single
+// signature of the reader, which covers the writes, an ephemeral key and a
+// timestamp. The nodes store a read-request for every write and reencrypt
+// the keys to the ephemeral key.
+//
+// Input:
+//  - ocs [*SkipChainURL] - the url of the skipchain to use
+//  - writes [[]skipchain.SkipBlockID] - the IDs of the write-requests
+//  - readerDarc [*darc.Darc] - the darc allowing the reader to read
+//  - reader [*darc.Signer] - the reader
+//
+// Output:
+//  - syms [][]byte - the decrypted symmetric keys, in the order of writes
+//  - err - an error if something went wrong, or nil
+func (c *Client) Reencrypt(ocs *SkipChainURL, writes []skipchain.SkipBlockID,
+	readerDarc *darc.Darc, reader *darc.Signer) (syms [][]byte, err error) {
+	kp := key.NewKeyPair(cothority.Suite)
+	bulk := &BulkRead{
+		Writes:    writes,
+		Xc:        kp.Public,
+		Timestamp: time.Now().Unix(),
+	}
+	id := darc.NewIdentityEd25519(reader.Ed25519.Point)
+	path := darc.NewSignaturePath([]*darc.Darc{readerDarc}, *id, darc.User)
+	msg, err := bulk.Message()
+	if err != nil {
+		return
+	}
+	sig, err := darc.NewDarcSignature(msg, path, reader)
+	if err != nil {
+		return
+	}
+	request := &ReencryptRequest{
+		Bulk:      bulk,
+		Signature: sig,
+	}
+	reply := &ReencryptReply{}
+	err = c.SendProtobuf(ocs.Roster.List[0], request, reply)
+	if err != nil {
+		return
+	}
+	for _, r := range reply.Results {
+		sym, err := DecodeKey(cothority.Suite, r.X, r.Cs, r.XhatEnc, kp.Private)
+		if err != nil {
+			return nil, errors.New("could not decode sym: " + err.Error())
+		}
+		syms = append(syms, sym)
+	}
+	return
+}
+
+// Escrow sends an escrow signed by enough owners of the admin-darc. The
+// nodes store it on the skipchain and reencrypt the symmetric keys of its
+// write-requests to the escrow key, so that the escrow holder can decode
+// them with DecodeKey.
+//
+// Input:
+//  - ocs [*SkipChainURL] - the url of the skipchain to use
+//  - escrow [*Escrow] - the signed escrow
+//
+// Output:
+//  - reply [*EscrowReply] - the block holding the record and the
+//    reencrypted keys
+//  - err - an error if something went wrong, or nil
+func (c *Client) Escrow(ocs *SkipChainURL, escrow *Escrow) (reply *EscrowReply, err error) {
+	reply = &EscrowReply{}
+	err = c.SendProtobuf(ocs.Roster.List[0], &EscrowRequest{
+		OCS:    ocs.Genesis,
+		Escrow: escrow,
+	}, reply)
+	return
+}
+
 // GetData returns the encrypted data from a write-request given its id. It requests
 // the data from the skipchain. To decode the data, the caller has to have a
 // decrypted symmetric key, then he can decrypt the data with:
@@ -0,0 +1,272 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dedis/cothority/ocs/darc"
+	"github.com/dedis/cothority/ocs/protocol"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/protobuf"
+)
+
+// EscrowConfig allows the symmetric keys of an OCS-skipchain to be
+// reencrypted to the key of an escrow holder. It is set by the operators
+// of the nodes with SetEscrow.
+type EscrowConfig struct {
+	// Xc is the key of the escrow holder.
+	Xc kyber.Point
+	// Threshold is how many owners of the admin-darc must authorize an
+	// escrow.
+	Threshold int
+}
+
+// Escrow is the record of an escrow stored on the skipchain. It shows who
+// authorized the escrow of which write-requests, and when.
+type Escrow struct {
+	Writes []skipchain.SkipBlockID
+	// Xc is the key of the escrow holder.
+	Xc kyber.Point
+	// Timestamp in unix-seconds, must be close to the time of the nodes.
+	Timestamp int64
+	// Signatures on Message from different owners of the admin-darc of
+	// the skipchain.
+	Signatures []*darc.Signature
+}
+
+// EscrowRequest asks to reencrypt the symmetric keys of the write-requests
+// of Escrow to the escrow key. The record is stored on the skipchain
+// first.
+type EscrowRequest struct {
+	OCS    skipchain.SkipBlockID
+	Escrow *Escrow
+}
+
+// EscrowReply holds the block with the record and one result for every
+// write-request.
+type EscrowReply struct {
+	Record  *skipchain.SkipBlock
+	Results []*Reencrypted
+}
+
+// NewEscrow returns an unsigned escrow of the writes to xc, with the
+// current time.
+func NewEscrow(writes []skipchain.SkipBlockID, xc kyber.Point) *Escrow {
+	return &Escrow{
+		Writes:    writes,
+		Xc:        xc,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+// Message returns the bytes the owners sign to authorize the escrow.
+func (e *Escrow) Message() ([]byte, error) {
+	return writesMessage("ocs-escrow", e.Writes, e.Xc, e.Timestamp)
+}
+
+// Sign adds the signature of owner, who must be an owner of the admin-darc.
+func (e *Escrow) Sign(admin *darc.Darc, owner *darc.Signer) error {
+	msg, err := e.Message()
+	if err != nil {
+		return err
+	}
+	path := darc.NewSignaturePath([]*darc.Darc{admin}, *owner.Identity(), darc.Owner)
+	sig, err := darc.NewDarcSignature(msg, path, owner)
+	if err != nil {
+		return err
+	}
+	e.Signatures = append(e.Signatures, sig)
+	return nil
+}
+
+// SetEscrow allows to escrow the symmetric keys of the skipchain to xc,
+// if threshold owners of the admin-darc authorize it. A nil xc disables
+// the escrow. Like the other settings, it has to be done on all nodes.
+func (s *Service) SetEscrow(ocs skipchain.SkipBlockID, xc kyber.Point, threshold int) error {
+	s.saveMutex.Lock()
+	if xc == nil {
+		delete(s.Storage.Escrows, string(ocs))
+	} else {
+		if threshold < 1 {
+			s.saveMutex.Unlock()
+			return errors.New("the threshold must be at least 1")
+		}
+		if s.Storage.Escrows == nil {
+			s.Storage.Escrows = map[string]*EscrowConfig{}
+		}
+		s.Storage.Escrows[string(ocs)] = &EscrowConfig{Xc: xc, Threshold: threshold}
+	}
+	s.saveMutex.Unlock()
+	s.save()
+	return nil
+}
+
+// escrowConfig returns the escrow-configuration of the skipchain, or nil.
+func (s *Service) escrowConfig(ocs skipchain.SkipBlockID) *EscrowConfig {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+	return s.Storage.Escrows[string(ocs)]
+}
+
+// Escrow stores the record of the escrow on the skipchain and reencrypts
+// the symmetric keys of all its write-requests to the escrow key.
+func (s *Service) Escrow(req *EscrowRequest) (*EscrowReply, error) {
+	e := req.Escrow
+	if e == nil || e.Xc == nil {
+		return nil, errors.New("need an escrow")
+	}
+	if err := s.verifyEscrow(req.OCS, e); err != nil {
+		return nil, errors.New("verification of escrow failed: " + err.Error())
+	}
+	if err := s.rateLimit.take(e.Xc, len(e.Writes), time.Now()); err != nil {
+		for _, id := range e.Writes {
+			s.audit(e.Xc, id, err)
+		}
+		return nil, err
+	}
+	msg, err := e.Message()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.markOnce(e.Timestamp, string(msg)); err != nil {
+		return nil, err
+	}
+	record, err := s.storeEscrow(req.OCS, e)
+	if err != nil {
+		return nil, err
+	}
+	log.Lvlf2("%s: escrow of %d writes stored in %x", s.ServerIdentity(),
+		len(e.Writes), record.Hash)
+
+	reply := &EscrowReply{Record: record}
+	for _, id := range e.Writes {
+		fileSB := s.db().GetByID(id)
+		file := NewOCS(fileSB.Data)
+		ocsProto, threshold, err := s.reencrypt(fileSB, file.Write, e.Xc,
+			&vData{SB: record.Hash})
+		s.audit(e.Xc, id, err)
+		if err != nil {
+			return nil, err
+		}
+		result := &Reencrypted{
+			Write: id,
+			Read:  record.Hash,
+			X:     ocsProto.Shared.X.Clone(),
+			Cs:    file.Write.Cs,
+		}
+		result.Uis = ocsProto.Shares()
+		result.XhatEnc, err = protocol.Recover(result.Uis, threshold, len(ocsProto.List()))
+		if err != nil {
+			return nil, err
+		}
+		reply.Results = append(reply.Results, result)
+	}
+	return reply, nil
+}
+
+// storeEscrow adds the record of the escrow to the skipchain.
+func (s *Service) storeEscrow(ocs skipchain.SkipBlockID, e *Escrow) (*skipchain.SkipBlock, error) {
+	s.process.Lock()
+	defer s.process.Unlock()
+	data, err := protobuf.Encode(&Transaction{
+		Escrow:    e,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	latestSB, err := s.db().GetLatest(s.db().GetByID(ocs))
+	if err != nil {
+		return nil, errors.New("didn't find latest block: " + err.Error())
+	}
+	sb, err := s.storeSkipBlock(latestSB, data)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := s.propagateOCS(sb.Roster, sb, propagationTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if replies != len(sb.Roster.List) {
+		log.Warn("Got only", replies, "replies for escrow-propagation")
+	}
+	return sb, nil
+}
+
+// verifyEscrow checks that the escrow is enabled on this node for the
+// skipchain, that all writes are on the skipchain and that enough owners of
+// the admin-darc signed the escrow.
+func (s *Service) verifyEscrow(ocs skipchain.SkipBlockID, e *Escrow) error {
+	conf := s.escrowConfig(ocs)
+	if conf == nil {
+		return errors.New("escrow is not enabled for this skipchain")
+	}
+	if e.Xc == nil || !e.Xc.Equal(conf.Xc) {
+		return errors.New("not the escrow key of this skipchain")
+	}
+	if d := time.Now().Unix() - e.Timestamp; d > timestampRange || d < -timestampRange {
+		return errors.New("timestamp of escrow out of range")
+	}
+	if len(e.Writes) == 0 {
+		return errors.New("no write-requests to escrow")
+	}
+	for _, id := range e.Writes {
+		sb := s.db().GetByID(id)
+		if sb == nil || !bytes.Equal(sb.SkipChainID(), ocs) {
+			return fmt.Errorf("didn't find write-request %x", []byte(id))
+		}
+		if w := NewOCS(sb.Data); w == nil || w.Write == nil {
+			return fmt.Errorf("%x is not a write-request", []byte(id))
+		}
+	}
+	s.saveMutex.Lock()
+	admin := s.Storage.Admins[string(ocs)]
+	s.saveMutex.Unlock()
+	if admin == nil {
+		return errors.New("couldn't find admin for this chain")
+	}
+	msg, err := e.Message()
+	if err != nil {
+		return err
+	}
+	owners := map[string]bool{}
+	for _, sig := range e.Signatures {
+		if sig == nil {
+			continue
+		}
+		if err := s.verifySignature(msg, *sig, *admin, darc.Owner); err != nil {
+			log.Lvl2("Invalid authorization of escrow:", err)
+			continue
+		}
+		owners[sig.SignaturePath.Signer.String()] = true
+	}
+	if len(owners) < conf.Threshold {
+		return fmt.Errorf("only %d out of %d authorizations", len(owners),
+			conf.Threshold)
+	}
+	return nil
+}
+
+// verifyEscrowReencryption checks that rc reencrypts one of the writes of
+// the escrow stored in sb to the escrow key.
+func (s *Service) verifyEscrowReencryption(sb *skipchain.SkipBlock, e *Escrow,
+	rc *protocol.Reencrypt) error {
+	conf := s.escrowConfig(sb.SkipChainID())
+	if conf == nil || !conf.Xc.Equal(rc.Xc) || !e.Xc.Equal(rc.Xc) {
+		return errors.New("Xc is not the escrow key")
+	}
+	for _, id := range e.Writes {
+		wb := s.db().GetByID(id)
+		if wb == nil {
+			continue
+		}
+		if w := NewOCS(wb.Data); w != nil && w.Write != nil && w.Write.U.Equal(rc.U) {
+			return nil
+		}
+	}
+	return errors.New("U is not from a write-request of the escrow")
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet/log"
+)
+
+// ErrorBusy is returned if a reader sent more reencryption requests than
+// allowed. The request can be sent again once the interval passed.
+var ErrorBusy = errors.New("too many reencryption requests, retry later")
+
+// ReencryptAudit records one reencryption done by this node.
+type ReencryptAudit struct {
+	// Reader is the key the symmetric key has been reencrypted to.
+	Reader kyber.Point
+	// Write is the id of the write-request.
+	Write skipchain.SkipBlockID
+	// Time in unix-nanoseconds.
+	Time int64
+	// Error is empty if the key has been reencrypted.
+	Error string
+}
+
+// rateLimit remembers the reencryptions of every reader during the last
+// interval.
+type rateLimit struct {
+	sync.Mutex
+	limit    int
+	interval time.Duration
+	requests map[string][]time.Time
+}
+
+// SetReencryptLimit allows every reader at most limit reencryptions during
+// interval. Further requests fail with ErrorBusy. A limit of 0 removes the
+// limit, which is the default.
+func (s *Service) SetReencryptLimit(limit int, interval time.Duration) {
+	s.rateLimit.Lock()
+	defer s.rateLimit.Unlock()
+	s.rateLimit.limit = limit
+	s.rateLimit.interval = interval
+	s.rateLimit.requests = nil
+}
+
+// SetAuditHook calls hook for every reencryption, successful or not. If no
+// hook is set, the reencryptions are logged.
+func (s *Service) SetAuditHook(hook func(*ReencryptAudit)) {
+	s.auditMutex.Lock()
+	defer s.auditMutex.Unlock()
+	s.auditHook = hook
+}
+
+// take counts n reencryptions for the reader, or returns ErrorBusy if this
+// would go over the limit.
+func (rl *rateLimit) take(reader kyber.Point, n int, now time.Time) error {
+	rl.Lock()
+	defer rl.Unlock()
+	if rl.limit <= 0 {
+		return nil
+	}
+	if rl.requests == nil {
+		rl.requests = map[string][]time.Time{}
+	}
+	for k, times := range rl.requests {
+		rl.requests[k] = sinceTimes(times, now.Add(-rl.interval))
+		if len(rl.requests[k]) == 0 {
+			delete(rl.requests, k)
+		}
+	}
+	key := reader.String()
+	if len(rl.requests[key])+n > rl.limit {
+		return ErrorBusy
+	}
+	for i := 0; i < n; i++ {
+		rl.requests[key] = append(rl.requests[key], now)
+	}
+	return nil
+}
+
+// sinceTimes returns the times that are after start. The times must be
+// sorted.
+func sinceTimes(times []time.Time, start time.Time) []time.Time {
+	for i, t := range times {
+		if t.After(start) {
+			return times[i:]
+		}
+	}
+	return nil
+}
+
+// audit passes the outcome of a reencryption to the audit hook.
+func (s *Service) audit(reader kyber.Point, write skipchain.SkipBlockID, err error) {
+	a := &ReencryptAudit{
+		Reader: reader,
+		Write:  write,
+		Time:   time.Now().UnixNano(),
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	s.auditMutex.Lock()
+	hook := s.auditHook
+	s.auditMutex.Unlock()
+	if hook == nil {
+		log.Lvlf2("Reencryption of %x to %s: %s", []byte(write), reader, a.Error)
+		return
+	}
+	hook(a)
+}
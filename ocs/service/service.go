@@ -12,6 +12,7 @@ runs on the node.
 */
 
 import (
+	"bytes"
 	"errors"
 	"sync"
 	"time"
@@ -58,6 +59,15 @@ type Service struct {
 	Storage   *Storage
 	// big bad global lock
 	process sync.Mutex
+	// bulkReads holds the signatures of the bulk reencryptions and the
+	// messages of the escrows already done, together with their
+	// timestamps.
+	bulkReads map[string]int64
+	bulkMutex sync.Mutex
+	// rateLimit limits the reencryptions per reader.
+	rateLimit  rateLimit
+	auditHook  func(*ReencryptAudit)
+	auditMutex sync.Mutex
 }
 
 // pubPoly is a serializaable version of share.PubPoly
@@ -72,6 +82,8 @@ type Storage struct {
 	Shared   map[string]*protocol.SharedSecret
 	Polys    map[string]*pubPoly
 	Admins   map[string]*darc.Darc
+	// Escrows holds the escrow-configuration of the skipchains
+	Escrows map[string]*EscrowConfig
 }
 
 // Darcs holds a series of darcs in increasing, succeeding version numbers.
@@ -422,20 +434,10 @@ func (s *Service) DecryptKeyRequest(req *DecryptKeyRequest) (reply *DecryptKeyRe
 		return nil, errors.New("Data-block is broken")
 	}
 
-	// Start OCS-protocol to re-encrypt the file's symmetric key under the
-	// reader's public key.
-	nodes := len(fileSB.Roster.List)
-	threshold := nodes - (nodes-1)/3
-	tree := fileSB.Roster.GenerateNaryTreeWithRoot(nodes, s.ServerIdentity())
-	pi, err := s.CreateProtocol(protocol.NameOCS, tree)
-	if err != nil {
-		return nil, err
-	}
-	ocsProto := pi.(*protocol.OCS)
-	ocsProto.U = file.Write.U
 	verificationData := &vData{
 		SB: readSB.Hash,
 	}
+	var xc kyber.Point
 	if req.Ephemeral != nil {
 		var pub []byte
 		pub, err = req.Ephemeral.MarshalBinary()
@@ -445,18 +447,144 @@ func (s *Service) DecryptKeyRequest(req *DecryptKeyRequest) (reply *DecryptKeyRe
 		if err = req.Signature.Verify(pub, &file.Write.Reader); err != nil {
 			return nil, errors.New("wrong signature")
 		}
-		ocsProto.Xc = req.Ephemeral
+		xc = req.Ephemeral
 		verificationData.Ephemeral = req.Ephemeral
 		verificationData.Signature = req.Signature
 	} else if read.Read.Signature.SignaturePath.Signer.Ed25519 == nil {
 		return nil, errors.New("please use ephemeral keys for non-ed25519 private keys")
 	} else {
-		ocsProto.Xc = read.Read.Signature.SignaturePath.Signer.Ed25519.Point
+		xc = read.Read.Signature.SignaturePath.Signer.Ed25519.Point
+	}
+	if err = s.rateLimit.take(xc, 1, time.Now()); err != nil {
+		s.audit(xc, fileSB.Hash, err)
+		return nil, err
+	}
+	ocsProto, threshold, err := s.reencrypt(fileSB, file.Write, xc, verificationData)
+	s.audit(xc, fileSB.Hash, err)
+	if err != nil {
+		return nil, err
+	}
+	reply.X = ocsProto.Shared.X.Clone()
+	reply.XhatEnc, err = protocol.Recover(ocsProto.Uis, threshold, len(ocsProto.List()))
+	if err != nil {
+		return nil, err
+	}
+	reply.Cs = file.Write.Cs
+	return
+}
+
+// Reencrypt reencrypts the symmetric keys of all given write-requests to
+// Bulk.Xc. The signature on Bulk.Message must come from a reader of every
+// write-request, and a read-request is stored for each of them, so that
+// every access stays visible on the skipchain. For every write, the valid
+// reencrypted shares are returned together with the recovered key.
+func (s *Service) Reencrypt(req *ReencryptRequest) (*ReencryptReply, error) {
+	if req.Bulk == nil || req.Bulk.Xc == nil || req.Signature == nil {
+		return nil, errors.New("need Xc and a signature")
+	}
+	// The limit is checked before the signature is marked as used, so
+	// that the request can be sent again.
+	if err := s.rateLimit.take(req.Bulk.Xc, len(req.Bulk.Writes), time.Now()); err != nil {
+		for _, id := range req.Bulk.Writes {
+			s.audit(req.Bulk.Xc, id, err)
+		}
+		return nil, err
+	}
+	if err := s.markBulkRead(req.Bulk, req.Signature); err != nil {
+		return nil, err
+	}
+	reply := &ReencryptReply{}
+	for _, id := range req.Bulk.Writes {
+		fileSB := s.db().GetByID(id)
+		if fileSB == nil {
+			return nil, errors.New("didn't find that block")
+		}
+		file := NewOCS(fileSB.Data)
+		if file == nil || file.Write == nil {
+			return nil, errors.New("not a write-block")
+		}
+		read, err := s.ReadRequest(&ReadRequest{Read: Read{
+			DataID:    id,
+			Signature: *req.Signature,
+			Bulk:      req.Bulk,
+		}})
+		if err != nil {
+			return nil, err
+		}
+		ocsProto, threshold, err := s.reencrypt(fileSB, file.Write, req.Bulk.Xc,
+			&vData{SB: read.SB.Hash})
+		s.audit(req.Bulk.Xc, id, err)
+		if err != nil {
+			return nil, err
+		}
+		result := &Reencrypted{
+			Write: id,
+			Read:  read.SB.Hash,
+			X:     ocsProto.Shared.X.Clone(),
+			Cs:    file.Write.Cs,
+		}
+		result.Uis = ocsProto.Shares()
+		result.XhatEnc, err = protocol.Recover(result.Uis, threshold, len(ocsProto.List()))
+		if err != nil {
+			return nil, err
+		}
+		reply.Results = append(reply.Results, result)
+	}
+	return reply, nil
+}
+
+// markBulkRead refuses a bulk-read outside of timestampRange or one whose
+// signature has already been used, and remembers the signature otherwise.
+func (s *Service) markBulkRead(bulk *BulkRead, sig *darc.Signature) error {
+	now := time.Now().Unix()
+	if d := now - bulk.Timestamp; d > timestampRange || d < -timestampRange {
+		return errors.New("timestamp of bulk-read out of range")
+	}
+	return s.markOnce(bulk.Timestamp, string(sig.Signature))
+}
+
+// markOnce refuses a key that has already been used and remembers it
+// otherwise. The keys are forgotten once their timestamp is out of range.
+func (s *Service) markOnce(timestamp int64, key string) error {
+	now := time.Now().Unix()
+	s.bulkMutex.Lock()
+	defer s.bulkMutex.Unlock()
+	if s.bulkReads == nil {
+		s.bulkReads = map[string]int64{}
+	}
+	for k, t := range s.bulkReads {
+		if now-t > 2*timestampRange {
+			delete(s.bulkReads, k)
+		}
+	}
+	if _, ok := s.bulkReads[key]; ok {
+		return errors.New("request already used")
+	}
+	s.bulkReads[key] = timestamp
+	return nil
+}
+
+// reencrypt runs the OCS-protocol on the roster of fileSB to reencrypt the
+// symmetric key of the write-request to xc. It returns the finished
+// protocol and the threshold needed to recover the key.
+func (s *Service) reencrypt(fileSB *skipchain.SkipBlock, write *Write, xc kyber.Point,
+	verificationData *vData) (*protocol.OCS, int, error) {
+	// Start OCS-protocol to re-encrypt the file's symmetric key under the
+	// reader's public key.
+	nodes := len(fileSB.Roster.List)
+	threshold := nodes - (nodes-1)/3
+	tree := fileSB.Roster.GenerateNaryTreeWithRoot(nodes, s.ServerIdentity())
+	pi, err := s.CreateProtocol(protocol.NameOCS, tree)
+	if err != nil {
+		return nil, 0, err
 	}
+	ocsProto := pi.(*protocol.OCS)
+	ocsProto.U = write.U
+	ocsProto.Xc = xc
 	log.Lvlf2("Public key is: %s", ocsProto.Xc)
 	ocsProto.VerificationData, err = network.Marshal(verificationData)
 	if err != nil {
-		return nil, errors.New("couldn't marshal verificationdata: " + err.Error())
+		return nil, 0, errors.New("couldn't marshal verificationdata: " + err.Error())
 	}
 
 	// Make sure everything used from the s.Storage structure is copied, so
@@ -464,7 +592,6 @@ func (s *Service) DecryptKeyRequest(req *DecryptKeyRequest) (reply *DecryptKeyRe
 	s.saveMutex.Lock()
 	ocsProto.Shared = s.Storage.Shared[string(fileSB.SkipChainID())]
 	pp := s.Storage.Polys[string(fileSB.SkipChainID())]
-	reply.X = s.Storage.Shared[string(fileSB.SkipChainID())].X.Clone()
 	var commits []kyber.Point
 	for _, c := range pp.Commits {
 		commits = append(commits, c.Clone())
@@ -473,21 +600,19 @@ func (s *Service) DecryptKeyRequest(req *DecryptKeyRequest) (reply *DecryptKeyRe
 	s.saveMutex.Unlock()
 
 	ocsProto.SetConfig(&onet.GenericConfig{Data: fileSB.SkipChainID()})
+	ocsProto.AskDenials = true
 	err = ocsProto.Start()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	log.Lvl3("Waiting for end of ocs-protocol")
-	if !<-ocsProto.Reencrypted {
-		return nil, errors.New("reencryption got refused")
-	}
-	reply.XhatEnc, err = share.RecoverCommit(cothority.Suite, ocsProto.Uis,
-		threshold, nodes)
-	if err != nil {
-		return nil, err
+	if res := <-ocsProto.Results; res.Failure != protocol.FailureNone {
+		if ocsProto.AccessDenied() {
+			return nil, 0, protocol.ErrorAccessDenied
+		}
+		return nil, 0, errors.New("reencryption failed: " + res.Failure.String())
 	}
-	reply.Cs = file.Write.Cs
-	return
+	return ocsProto, threshold, nil
 }
 
 // storeSkipBlock calls directly the method of the service.
@@ -553,6 +678,10 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 
 func (s *Service) verifyReencryption(rc *protocol.Reencrypt) bool {
 	err := func() error {
+		if len(rc.Batch) > 0 {
+			// Only U is checked against the write-request.
+			return errors.New("batches are not supported")
+		}
 		_, vdInt, err := network.Unmarshal(*rc.VerificationData, cothority.Suite)
 		if err != nil {
 			return err
@@ -569,10 +698,25 @@ func (s *Service) verifyReencryption(rc *protocol.Reencrypt) bool {
 		if o == nil {
 			return errors.New("not an OCS-data block")
 		}
+		if o.Escrow != nil {
+			return s.verifyEscrowReencryption(sb, o.Escrow, rc)
+		}
 		if o.Read == nil {
 			return errors.New("not an OCS-read block")
 		}
-		if verificationData.Ephemeral != nil {
+		wb := s.db().GetByID(o.Read.DataID)
+		if wb == nil {
+			return errors.New("didn't find write-block of read-request")
+		}
+		w := NewOCS(wb.Data)
+		if w == nil || w.Write == nil || !w.Write.U.Equal(rc.U) {
+			return errors.New("U is not from the write-request that has been read")
+		}
+		if o.Read.Bulk != nil {
+			if !o.Read.Bulk.Xc.Equal(rc.Xc) {
+				return errors.New("Xc is not the one of the bulk-read")
+			}
+		} else if verificationData.Ephemeral != nil {
 			buf, err := verificationData.Ephemeral.MarshalBinary()
 			if err != nil {
 				return errors.New("couldn't marshal ephemeral key: " + err.Error())
@@ -640,6 +784,12 @@ func (s *Service) verifyOCS(newID []byte, sb *skipchain.SkipBlock) bool {
 			return false
 		}
 	}
+	if dataOCS.Escrow != nil {
+		if err := s.verifyEscrow(sb.SkipChainID(), dataOCS.Escrow); err != nil {
+			log.Error("verification of escrow failed: " + err.Error())
+			return false
+		}
+	}
 	log.Lvl3("OCS verification succeeded")
 	return true
 }
@@ -664,9 +814,41 @@ func (s *Service) verifyRead(read *Read) error {
 	if s.getDarc(readers.GetID()) == nil {
 		return errors.New("couldn't find reader-darc in database")
 	}
+	if read.Bulk != nil {
+		return s.verifyBulkRead(read, readers)
+	}
 	return s.verifySignature(read.DataID, read.Signature, readers, darc.User)
 }
 
+// verifyBulkRead checks a read-request created by a bulk reencryption. As
+// the signature covers all writes, the signer must be a reader in the latest
+// version of the readers-darc, even if the signature carries an older path.
+func (s *Service) verifyBulkRead(read *Read, readers darc.Darc) error {
+	found := false
+	for _, w := range read.Bulk.Writes {
+		if bytes.Equal(w, read.DataID) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.New("write-request is not part of the bulk-read")
+	}
+	d := time.Now().Unix() - read.Bulk.Timestamp
+	if d > timestampRange || d < -timestampRange {
+		return errors.New("timestamp of bulk-read out of range")
+	}
+	if s.searchPath([]darc.Darc{readers}, read.Signature.SignaturePath.Signer,
+		darc.User) == nil {
+		return errors.New("signer is not in the latest readers-darc")
+	}
+	msg, err := read.Bulk.Message()
+	if err != nil {
+		return err
+	}
+	return s.verifySignature(msg, read.Signature, readers, darc.User)
+}
+
 // verifySignature handles both offline and online signatures. For offline
 // signatures, all darcs in the path must be stored in the SignaturePath.
 // For online signatures, the system will check itself if it finds a valid
@@ -926,7 +1108,7 @@ func newService(c *onet.Context) (onet.Service, error) {
 	}
 	if err := s.RegisterHandlers(s.CreateSkipchains,
 		s.WriteRequest, s.ReadRequest, s.GetReadRequests,
-		s.DecryptKeyRequest, s.SharedPublic,
+		s.DecryptKeyRequest, s.Reencrypt, s.Escrow, s.SharedPublic,
 		s.UpdateDarc, s.GetDarcPath,
 		s.GetLatestDarc); err != nil {
 		log.Error("Couldn't register messages", err)
@@ -3,12 +3,14 @@ package service
 import (
 	"sync"
 	"testing"
+	"time"
 
 	bolt "github.com/coreos/bbolt"
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/ocs/darc"
 	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber/suites"
+	"github.com/dedis/kyber/util/key"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 	"github.com/dedis/onet/network"
@@ -94,6 +96,193 @@ func TestService_proof(t *testing.T) {
 	require.Equal(t, 1, len(requests.Documents))
 }
 
+func TestService_Reencrypt(t *testing.T) {
+	o := createOCS(t)
+	defer o.local.CloseAll()
+
+	sigPath := darc.NewSignaturePath([]*darc.Darc{o.readers}, *o.writerI, darc.User)
+	var writes []skipchain.SkipBlockID
+	var keys [][]byte
+	for i := byte(0); i < 2; i++ {
+		encKey := []byte{1, 2, 3, i}
+		write := NewWrite(cothority.Suite, o.sc.OCS.Hash, o.sc.X, o.readers, encKey)
+		write.Data = []byte{}
+		sig, err := darc.NewDarcSignature(write.Reader.GetID(), sigPath, o.writer)
+		require.Nil(t, err)
+		wr, err := o.service.WriteRequest(&WriteRequest{
+			OCS:       o.sc.OCS.Hash,
+			Write:     *write,
+			Signature: *sig,
+			Readers:   o.readers,
+		})
+		require.Nil(t, err)
+		writes = append(writes, wr.SB.Hash)
+		keys = append(keys, encKey)
+	}
+
+	kp := key.NewKeyPair(cothority.Suite)
+	bulk := &BulkRead{Writes: writes, Xc: kp.Public, Timestamp: time.Now().Unix()}
+	sign := func(b *BulkRead) *darc.Signature {
+		msg, err := b.Message()
+		require.Nil(t, err)
+		sig, err := darc.NewDarcSignature(msg, sigPath, o.writer)
+		require.Nil(t, err)
+		return sig
+	}
+	sig := sign(bulk)
+	reply, err := o.service.Reencrypt(&ReencryptRequest{Bulk: bulk, Signature: sig})
+	require.Nil(t, err)
+	require.Equal(t, len(writes), len(reply.Results))
+	for i, r := range reply.Results {
+		require.Equal(t, writes[i], r.Write)
+		require.True(t, len(r.Uis) >= 4)
+		sym, err := DecodeKey(cothority.Suite, r.X, r.Cs, r.XhatEnc, kp.Private)
+		require.Nil(t, err)
+		require.Equal(t, keys[i], sym)
+		read := NewOCS(o.service.db().GetByID(r.Read).Data)
+		require.NotNil(t, read.Read)
+		require.Equal(t, writes[i], read.Read.DataID)
+	}
+
+	// The same request cannot be sent twice.
+	_, err = o.service.Reencrypt(&ReencryptRequest{Bulk: bulk, Signature: sig})
+	require.NotNil(t, err)
+
+	// A signature on another key is refused.
+	other := key.NewKeyPair(cothority.Suite)
+	changed := &BulkRead{Writes: writes, Xc: other.Public, Timestamp: bulk.Timestamp}
+	_, err = o.service.Reencrypt(&ReencryptRequest{Bulk: changed, Signature: sign(bulk)})
+	require.NotNil(t, err)
+
+	// Once the reader is removed from the darc, even a signature with the
+	// old path is refused.
+	newReader := o.readers.Copy()
+	_, err = newReader.RemoveUser(o.writerI)
+	require.Nil(t, err)
+	require.Nil(t, newReader.SetEvolution(o.readers, nil, o.writer))
+	_, err = o.service.UpdateDarc(&UpdateDarc{
+		OCS:  o.sc.OCS.SkipChainID(),
+		Darc: *newReader,
+	})
+	require.Nil(t, err)
+	_, err = o.service.Reencrypt(&ReencryptRequest{Bulk: bulk, Signature: sign(bulk)})
+	require.NotNil(t, err)
+}
+
+func TestService_ReencryptLimit(t *testing.T) {
+	o := createOCS(t)
+	defer o.local.CloseAll()
+	var audits []*ReencryptAudit
+	var auditMutex sync.Mutex
+	o.service.SetAuditHook(func(a *ReencryptAudit) {
+		auditMutex.Lock()
+		audits = append(audits, a)
+		auditMutex.Unlock()
+	})
+	o.service.SetReencryptLimit(1, time.Hour)
+
+	write := NewWrite(cothority.Suite, o.sc.OCS.Hash, o.sc.X, o.readers, []byte{1, 2, 3})
+	write.Data = []byte{}
+	sigPath := darc.NewSignaturePath([]*darc.Darc{o.readers}, *o.writerI, darc.User)
+	sig, err := darc.NewDarcSignature(write.Reader.GetID(), sigPath, o.writer)
+	require.Nil(t, err)
+	wr, err := o.service.WriteRequest(&WriteRequest{
+		OCS:       o.sc.OCS.Hash,
+		Write:     *write,
+		Signature: *sig,
+		Readers:   o.readers,
+	})
+	require.Nil(t, err)
+	sigRead, err := darc.NewDarcSignature(wr.SB.Hash, sigPath, o.writer)
+	require.Nil(t, err)
+	rr, err := o.service.ReadRequest(&ReadRequest{
+		OCS:  o.sc.OCS.Hash,
+		Read: Read{DataID: wr.SB.Hash, Signature: *sigRead},
+	})
+	require.Nil(t, err)
+
+	_, err = o.service.DecryptKeyRequest(&DecryptKeyRequest{Read: rr.SB.Hash})
+	require.Nil(t, err)
+	_, err = o.service.DecryptKeyRequest(&DecryptKeyRequest{Read: rr.SB.Hash})
+	require.Equal(t, ErrorBusy, err)
+
+	auditMutex.Lock()
+	require.Equal(t, 2, len(audits))
+	for _, a := range audits {
+		require.Equal(t, wr.SB.Hash, a.Write)
+		require.True(t, a.Reader.Equal(o.writer.Ed25519.Point))
+	}
+	require.Equal(t, "", audits[0].Error)
+	require.Equal(t, ErrorBusy.Error(), audits[1].Error)
+	auditMutex.Unlock()
+
+	// Once the interval passed, the reader can ask again.
+	rl := &rateLimit{limit: 1, interval: time.Minute}
+	now := time.Now()
+	require.Nil(t, rl.take(o.writer.Ed25519.Point, 1, now))
+	require.Equal(t, ErrorBusy, rl.take(o.writer.Ed25519.Point, 1, now))
+	require.Nil(t, rl.take(o.writer.Ed25519.Point, 1, now.Add(time.Minute+1)))
+}
+
+func TestService_Escrow(t *testing.T) {
+	o := createOCS(t)
+	defer o.local.CloseAll()
+	escrow := key.NewKeyPair(cothority.Suite)
+
+	write := NewWrite(cothority.Suite, o.sc.OCS.Hash, o.sc.X, o.readers, []byte{1, 2, 3})
+	write.Data = []byte{}
+	sigPath := darc.NewSignaturePath([]*darc.Darc{o.readers}, *o.writerI, darc.User)
+	sig, err := darc.NewDarcSignature(write.Reader.GetID(), sigPath, o.writer)
+	require.Nil(t, err)
+	wr, err := o.service.WriteRequest(&WriteRequest{
+		OCS:       o.sc.OCS.Hash,
+		Write:     *write,
+		Signature: *sig,
+		Readers:   o.readers,
+	})
+	require.Nil(t, err)
+
+	e := NewEscrow([]skipchain.SkipBlockID{wr.SB.Hash}, escrow.Public)
+	require.Nil(t, e.Sign(o.readers, o.writer))
+	req := &EscrowRequest{OCS: o.sc.OCS.Hash, Escrow: e}
+	_, err = o.service.Escrow(req)
+	require.NotNil(t, err, "escrow is not enabled")
+
+	for _, s := range o.services {
+		require.Nil(t, s.(*Service).SetEscrow(o.sc.OCS.Hash, escrow.Public, 2))
+	}
+	// The same owner signing twice counts only once.
+	require.Nil(t, e.Sign(o.readers, o.writer))
+	_, err = o.service.Escrow(req)
+	require.NotNil(t, err)
+
+	for _, s := range o.services {
+		require.Nil(t, s.(*Service).SetEscrow(o.sc.OCS.Hash, escrow.Public, 1))
+	}
+	reply, err := o.service.Escrow(req)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(reply.Results))
+	r := reply.Results[0]
+	sym, err := DecodeKey(cothority.Suite, r.X, r.Cs, r.XhatEnc, escrow.Private)
+	require.Nil(t, err)
+	require.Equal(t, []byte{1, 2, 3}, sym)
+	// An escrow can't be replayed.
+	_, err = o.service.Escrow(req)
+	require.NotNil(t, err)
+
+	// The record is on the skipchain and can be verified by other nodes.
+	record := NewOCS(o.services[1].(*Service).db().GetByID(reply.Record.Hash).Data)
+	require.NotNil(t, record.Escrow)
+	require.Equal(t, wr.SB.Hash, record.Escrow.Writes[0])
+	require.Nil(t, o.services[1].(*Service).verifyEscrow(o.sc.OCS.Hash, record.Escrow))
+
+	// Another key is refused.
+	other := NewEscrow([]skipchain.SkipBlockID{wr.SB.Hash}, o.sc.X)
+	require.Nil(t, other.Sign(o.readers, o.writer))
+	_, err = o.service.Escrow(&EscrowRequest{OCS: o.sc.OCS.Hash, Escrow: other})
+	require.NotNil(t, err)
+}
+
 func TestService_GetDarcPath(t *testing.T) {
 	o := createOCS(t)
 	defer o.local.CloseAll()
@@ -5,7 +5,9 @@ This holds the messages used to communicate with the service over the network.
 */
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 
@@ -13,6 +15,7 @@ import (
 	"github.com/dedis/cothority/ocs/darc"
 	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
 	"github.com/dedis/kyber/suites"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
@@ -35,6 +38,8 @@ func init() {
 		ReadRequest{}, ReadReply{},
 		SharedPublicRequest{}, SharedPublicReply{},
 		DecryptKeyRequest{}, DecryptKeyReply{},
+		ReencryptRequest{}, ReencryptReply{},
+		Escrow{}, EscrowRequest{}, EscrowReply{},
 		GetReadRequests{}, GetReadRequestsReply{})
 }
 
@@ -97,6 +102,10 @@ func (dw *Transaction) String() string {
 	if dw.Read != nil {
 		str += fmt.Sprintf("Read: %+v read data %x\n", dw.Read.Signature.SignaturePath.Signer, dw.Read.DataID)
 	}
+	if dw.Escrow != nil {
+		str += fmt.Sprintf("Escrow: %d writes with %d authorizations\n",
+			len(dw.Escrow.Writes), len(dw.Escrow.Signatures))
+	}
 	return str
 }
 
@@ -260,6 +269,8 @@ type Transaction struct {
 	Darc *darc.Darc
 	// Meta is any free-form data in that skipblock
 	Meta *[]byte
+	// Escrow holds an eventual record of an escrow
+	Escrow *Escrow
 	// Unix timestamp to record the transaction creation time
 	Timestamp int64
 }
@@ -302,6 +313,47 @@ type Read struct {
 	// Signature is a Schnorr-signature using the private key of the
 	// reader on the message 'DataID'
 	Signature darc.Signature
+	// Bulk is set if the read-request has been created by a
+	// ReencryptRequest. Then Signature is on Bulk.Message and DataID
+	// must be one of Bulk.Writes.
+	Bulk *BulkRead
+}
+
+// BulkRead is signed by a reader to get the symmetric keys of several
+// write-requests at once.
+type BulkRead struct {
+	Writes []skipchain.SkipBlockID
+	// Xc is the key the symmetric keys are reencrypted to.
+	Xc kyber.Point
+	// Timestamp in unix-seconds, must be close to the time of the nodes.
+	Timestamp int64
+}
+
+// Message returns the bytes the reader signs. It starts with a tag, so
+// that it cannot be mistaken for another message signed by the reader.
+func (br *BulkRead) Message() ([]byte, error) {
+	return writesMessage("ocs-bulk-read", br.Writes, br.Xc, br.Timestamp)
+}
+
+// writesMessage returns the message signed to reencrypt writes to xc.
+func writesMessage(tag string, writes []skipchain.SkipBlockID, xc kyber.Point,
+	timestamp int64) ([]byte, error) {
+	if xc == nil {
+		return nil, errors.New("no Xc given")
+	}
+	buf := bytes.NewBufferString(tag)
+	binary.Write(buf, binary.LittleEndian, int32(len(writes)))
+	for _, w := range writes {
+		binary.Write(buf, binary.LittleEndian, int32(len(w)))
+		buf.Write(w)
+	}
+	xcBuf, err := xc.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(xcBuf)
+	binary.Write(buf, binary.LittleEndian, timestamp)
+	return buf.Bytes(), nil
 }
 
 // ReadDoc represents one read-request by a reader.
@@ -413,6 +465,34 @@ type DecryptKeyReply struct {
 	X       kyber.Point
 }
 
+// ReencryptRequest asks to reencrypt the symmetric keys of one or more
+// write-requests to Bulk.Xc. A read-request is stored on the skipchain for
+// every write-request.
+type ReencryptRequest struct {
+	Bulk *BulkRead
+	// Signature on Bulk.Message from a reader allowed to read all writes
+	// with the latest version of their darcs. It can only be used once.
+	Signature *darc.Signature
+}
+
+// ReencryptReply holds one result for every write of the request.
+type ReencryptReply struct {
+	Results []*Reencrypted
+}
+
+// Reencrypted holds the symmetric key of a write-request, reencrypted to
+// Xc.
+type Reencrypted struct {
+	Write skipchain.SkipBlockID
+	// Read is the read-request stored for this write.
+	Read skipchain.SkipBlockID
+	// Uis are the valid reencrypted shares of the nodes, sorted by index.
+	Uis     []*share.PubShare
+	XhatEnc kyber.Point
+	X       kyber.Point
+	Cs      []kyber.Point
+}
+
 // GetReadRequests asks for a list of requests
 type GetReadRequests struct {
 	Start skipchain.SkipBlockID
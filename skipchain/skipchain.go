@@ -1113,6 +1113,13 @@ func (s *Service) registerVerification(v VerifierID, f SkipBlockVerifier) error
 	return nil
 }
 
+// HasVerification returns true if a verification function is registered
+// for v.
+func (s *Service) HasVerification(v VerifierID) bool {
+	_, ok := s.verifiers[v]
+	return ok
+}
+
 // verifyBlock makes sure the basic parameters of a block are correct and returns
 // an error if something fails.
 func (s *Service) verifyBlock(sb *SkipBlock) error {